@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"healthcare/shared/doctors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultDuration = 30 // minutes
+	// defaultMaxDuration caps an appointment's length in minutes unless
+	// MAX_APPOINTMENT_MINUTES says otherwise.
+	defaultMaxDuration = 8 * 60
+	// suggestedSlots is how many free slots a 409 lists.
+	suggestedSlots = 3
+	// slotSearchHorizon bounds how far ahead free slots are looked for.
+	slotSearchHorizon = 14 * 24 * time.Hour
+)
+
+// overlapConstraint keeps a doctor's active appointments from overlapping.
+// Postgres checks it on every insert and update, so two concurrent
+// bookings for the same time cannot both succeed.
+const overlapConstraint = "appointments_no_doctor_overlap"
+
+// exclusionViolation is the SQLSTATE Postgres reports when an exclusion
+// constraint rejects a row.
+const exclusionViolation = "23P01"
+
+// maxDuration is the longest an appointment may last, in minutes. Without
+// a cap one booking could hold a doctor's calendar, through the overlap
+// constraint, for years.
+var maxDuration = defaultMaxDuration
+
+// errDurationTooLong is returned when an appointment is longer than
+// maxDuration.
+var errDurationTooLong = errors.New("appointment is longer than the maximum duration")
+
+// checkDuration answers 400 when minutes is longer than maxDuration.
+func checkDuration(c *gin.Context, minutes int) bool {
+	if minutes > maxDuration {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Duration cannot exceed %d minutes", maxDuration)})
+		return false
+	}
+	return true
+}
+
+// BeforeSave derives EndTime, which the overlap constraint ranges over.
+// It is stored rather than computed in the constraint because adding an
+// interval to a timestamptz is not immutable in Postgres.
+// Lengths over maxDuration are refused here too, whichever path they came
+// in through.
+func (a *Appointment) BeforeSave(tx *gorm.DB) error {
+	if a.Duration > maxDuration {
+		return errDurationTooLong
+	}
+	a.setEndTime()
+	return nil
+}
+
+func (a *Appointment) setEndTime() {
+	if a.Duration <= 0 {
+		a.Duration = defaultDuration
+	}
+	a.EndTime = a.DateTime.Add(time.Duration(a.Duration) * time.Minute)
+}
+
+// overlapPredicate limits the overlap constraint to appointments that
+// still hold the doctor's time; see inactiveStatuses. Appointments flagged
+// by migrateConflicts are left out too.
+const overlapPredicate = "deleted_at IS NULL AND status NOT IN ('cancelled', 'rescheduled') AND NOT legacy_overlap"
+
+// flagLegacyOverlaps marks every active appointment that overlaps an
+// earlier active one of the same doctor. What is left unmarked does not
+// overlap, so the constraint can be added without touching bookings.
+const flagLegacyOverlaps = `UPDATE appointments a SET legacy_overlap = true
+	WHERE a.deleted_at IS NULL AND a.status NOT IN ('cancelled', 'rescheduled') AND NOT a.legacy_overlap
+	AND EXISTS (SELECT 1 FROM appointments b
+		WHERE b.doctor_id = a.doctor_id AND b.id < a.id
+		AND b.deleted_at IS NULL AND b.status NOT IN ('cancelled', 'rescheduled')
+		AND tstzrange(b.date_time, b.end_time, '[)') && tstzrange(a.date_time, a.end_time, '[)'))
+	RETURNING a.id`
+
+// migrateConflicts backfills EndTime and adds the overlap constraint, or
+// rebuilds it when it was created with an older predicate. Appointments
+// that already overlap are flagged and logged rather than stopping
+// startup; staff resolve them by rescheduling or cancelling. The btree_gist
+// extension the constraint needs is created by db/init.sql, as creating it
+// takes more rights than the service should have.
+func migrateConflicts(db *gorm.DB) error {
+	var installed bool
+	if err := db.Raw("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'btree_gist')").
+		Scan(&installed).Error; err != nil {
+		return err
+	}
+	if !installed {
+		return errors.New("extension btree_gist is missing; run CREATE EXTENSION btree_gist as a superuser (see db/init.sql)")
+	}
+	if err := db.Exec(`UPDATE appointments
+		SET duration = COALESCE(NULLIF(duration, 0), ?),
+			end_time = date_time + make_interval(mins => COALESCE(NULLIF(duration, 0), ?))
+		WHERE end_time IS NULL`, defaultDuration, defaultDuration).Error; err != nil {
+		return err
+	}
+
+	var defs []string
+	if err := db.Raw("SELECT pg_get_constraintdef(oid) FROM pg_constraint WHERE conname = ?", overlapConstraint).
+		Scan(&defs).Error; err != nil {
+		return err
+	}
+	if len(defs) == 0 || !strings.Contains(defs[0], "legacy_overlap") {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var flagged []uint
+			if err := tx.Raw(flagLegacyOverlaps).Scan(&flagged).Error; err != nil {
+				return err
+			}
+			if len(flagged) > 0 {
+				log.Printf("Flagged %d appointments that overlap earlier bookings: %v", len(flagged), flagged)
+			}
+			if err := tx.Exec("ALTER TABLE appointments DROP CONSTRAINT IF EXISTS " + overlapConstraint).Error; err != nil {
+				return err
+			}
+			return tx.Exec(`ALTER TABLE appointments ADD CONSTRAINT ` + overlapConstraint + `
+				EXCLUDE USING gist (doctor_id WITH =, tstzrange(date_time, end_time, '[)') WITH &&)
+				WHERE (` + overlapPredicate + `)`).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var open []uint
+	if err := db.Model(&Appointment{}).Where("legacy_overlap AND status NOT IN ?", inactiveStatuses).
+		Pluck("id", &open).Error; err != nil {
+		return err
+	}
+	if len(open) > 0 {
+		log.Printf("Appointments %v overlap other bookings and still need to be rescheduled or cancelled", open)
+	}
+	return nil
+}
+
+// isOverlap reports whether err is the overlap constraint rejecting a row.
+func isOverlap(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == exclusionViolation && pgErr.ConstraintName == overlapConstraint
+}
+
+// Slot is a free window in a doctor's calendar.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// slotFinder suggests free slots when a booking clashes. It asks
+// doctor-service's slot engine, so suggestions fall in the doctor's working
+// hours and skip holidays, exceptions, bookings and waitlist holds.
+type slotFinder struct {
+	db      *gorm.DB
+	doctors *doctors.Client
+}
+
+func newSlotFinder(db *gorm.DB, doctors *doctors.Client) *slotFinder {
+	return &slotFinder{db: db, doctors: doctors}
+}
+
+// next finds up to suggestedSlots windows of the same length as a,
+// starting at or after a's start. Should doctor-service be down, it falls
+// back to the gaps between the doctor's appointments and holds.
+func (f *slotFinder) next(a *Appointment) ([]Slot, error) {
+	from := a.DateTime
+	if now := time.Now(); from.Before(now) {
+		from = now
+	}
+	free, err := f.doctors.Slots(a.DoctorID, from, from.Add(slotSearchHorizon), a.Duration)
+	if err != nil {
+		log.Printf("Failed to fetch slots of doctor %d, suggesting gaps between appointments: %v", a.DoctorID, err)
+		return f.gaps(a, from)
+	}
+
+	slots := make([]Slot, 0, suggestedSlots)
+	for _, s := range free {
+		if len(slots) == suggestedSlots {
+			break
+		}
+		slots = append(slots, Slot{Start: s.Start, End: s.End})
+	}
+	return slots, nil
+}
+
+// gaps finds up to suggestedSlots windows of a's length from from on that
+// no active appointment or pending waitlist hold of the doctor covers.
+func (f *slotFinder) gaps(a *Appointment, from time.Time) ([]Slot, error) {
+	length := a.EndTime.Sub(a.DateTime)
+	to := from.Add(slotSearchHorizon)
+
+	var booked []Appointment
+	err := f.db.Select("id", "date_time", "end_time").
+		Where("doctor_id = ? AND id <> ? AND status NOT IN ? AND end_time > ? AND date_time < ?",
+			a.DoctorID, a.ID, inactiveStatuses, from, to).
+		Find(&booked).Error
+	if err != nil {
+		return nil, err
+	}
+	var held []WaitlistOffer
+	err = f.db.Select("starts_at", "ends_at").
+		Where("doctor_id = ? AND status = ? AND expires_at > ? AND ends_at > ? AND starts_at < ?",
+			a.DoctorID, OfferPending, time.Now(), from, to).
+		Find(&held).Error
+	if err != nil {
+		return nil, err
+	}
+
+	busy := make([]Slot, 0, len(booked)+len(held))
+	for _, b := range booked {
+		busy = append(busy, Slot{Start: b.DateTime, End: b.EndTime})
+	}
+	for _, h := range held {
+		busy = append(busy, Slot{Start: h.StartsAt, End: h.EndsAt})
+	}
+	sort.Slice(busy, func(i, j int) bool { return busy[i].Start.Before(busy[j].Start) })
+
+	slots := make([]Slot, 0, suggestedSlots)
+	candidate := from
+	for _, b := range busy {
+		for len(slots) < suggestedSlots && !candidate.Add(length).After(b.Start) {
+			slots = append(slots, Slot{Start: candidate, End: candidate.Add(length)})
+			candidate = candidate.Add(length)
+		}
+		if len(slots) == suggestedSlots {
+			return slots, nil
+		}
+		if b.End.After(candidate) {
+			candidate = b.End
+		}
+	}
+	for len(slots) < suggestedSlots {
+		slots = append(slots, Slot{Start: candidate, End: candidate.Add(length)})
+		candidate = candidate.Add(length)
+	}
+	return slots, nil
+}
+
+// respondConflict answers a booking the overlap constraint rejected.
+func respondConflict(c *gin.Context, finder *slotFinder, a *Appointment) {
+	response := gin.H{"error": "The doctor already has an appointment at that time"}
+	if slots, err := finder.next(a); err == nil {
+		response["nextFreeSlots"] = slots
+	}
+	c.JSON(409, response)
+}
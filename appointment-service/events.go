@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"healthcare/shared/notify"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// eventBatch is how many events one dispatch pass delivers.
+	eventBatch = 100
+	// maxEventAttempts is how often delivery of an event is tried before
+	// it is left in the outbox for inspection.
+	maxEventAttempts = 10
+	// eventClaim is how long a dispatcher owns the events it claimed. An
+	// instance that dies mid-batch leaves them to another after this.
+	eventClaim = 5 * time.Minute
+)
+
+// DomainEvent is published for every appointment status change. Type is
+// "appointment." followed by the new status, e.g. "appointment.confirmed".
+type DomainEvent struct {
+	Type          string    `json:"type"`
+	AppointmentID uint      `json:"appointmentId"`
+	PatientID     uint      `json:"patientId"`
+	DoctorID      uint      `json:"doctorId"`
+	DateTime      time.Time `json:"dateTime"`
+	From          string    `json:"from,omitempty"`
+	To            string    `json:"to"`
+	ActorID       uint      `json:"actorId,omitempty"`
+	ActorRole     string    `json:"actorRole,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+func eventType(status string) string {
+	return "appointment." + status
+}
+
+// AppointmentEvent is the outbox row of a DomainEvent. It is written in
+// the transaction that changes the status, so an event exists exactly
+// when the change was committed.
+type AppointmentEvent struct {
+	ID            uint   `gorm:"primarykey"`
+	AppointmentID uint   `gorm:"not null;index"`
+	Type          string `gorm:"size:40;not null"`
+	Payload       string `gorm:"type:jsonb;not null"`
+	CreatedAt     time.Time
+	PublishedAt   *time.Time `gorm:"index"`
+	ClaimedUntil  *time.Time
+	Attempts      int
+	LastError     string
+}
+
+// AppointmentEventDelivery records that one handler has handled an event,
+// so a retry after another handler failed does not run it again.
+type AppointmentEventDelivery struct {
+	EventID     uint   `gorm:"primaryKey;autoIncrement:false"`
+	Handler     string `gorm:"primaryKey;size:40"`
+	DeliveredAt time.Time
+}
+
+// publish adds the event for a history entry to the outbox.
+func publish(tx *gorm.DB, a *Appointment, entry *AppointmentTransition) error {
+	event := DomainEvent{
+		Type:          eventType(entry.ToStatus),
+		AppointmentID: a.ID,
+		PatientID:     a.PatientID,
+		DoctorID:      a.DoctorID,
+		DateTime:      a.DateTime,
+		From:          entry.FromStatus,
+		To:            entry.ToStatus,
+		ActorID:       entry.ActorID,
+		ActorRole:     entry.ActorRole,
+		Reason:        entry.Reason,
+		At:            entry.CreatedAt,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&AppointmentEvent{
+		AppointmentID: a.ID,
+		Type:          event.Type,
+		Payload:       string(payload),
+		CreatedAt:     entry.CreatedAt,
+	}).Error
+}
+
+type eventHandler func(DomainEvent) error
+
+type subscriber struct {
+	name string
+	h    eventHandler
+}
+
+// outbox delivers committed events to in-process subscribers. Delivery is
+// at least once per subscriber: an event whose handler fails is retried on
+// a later pass, but only with the handlers that have not yet succeeded.
+type outbox struct {
+	db       *gorm.DB
+	handlers map[string][]subscriber
+}
+
+func newOutbox(db *gorm.DB) *outbox {
+	return &outbox{db: db, handlers: map[string][]subscriber{}}
+}
+
+// subscribe registers h under name for the given event types. The name
+// keys its deliveries, so it must stay the same across releases.
+func (o *outbox) subscribe(name string, h eventHandler, types ...string) {
+	for _, t := range types {
+		o.handlers[t] = append(o.handlers[t], subscriber{name, h})
+	}
+}
+
+// run dispatches pending events every interval. Several instances may run
+// it at once; each event is claimed by the one delivering it.
+func (o *outbox) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := o.dispatch(); err != nil {
+			log.Printf("Failed to dispatch appointment events: %v", err)
+		}
+	}
+}
+
+func (o *outbox) dispatch() error {
+	pending, err := o.claim()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	ids := make([]uint, len(pending))
+	for i, e := range pending {
+		ids[i] = e.ID
+	}
+	var done []AppointmentEventDelivery
+	if err := o.db.Where("event_id IN ?", ids).Find(&done).Error; err != nil {
+		return err
+	}
+	delivered := map[uint]map[string]bool{}
+	for _, d := range done {
+		if delivered[d.EventID] == nil {
+			delivered[d.EventID] = map[string]bool{}
+		}
+		delivered[d.EventID][d.Handler] = true
+	}
+
+	for i := range pending {
+		e := &pending[i]
+		updates := map[string]interface{}{"claimed_until": nil}
+		if err := o.deliver(e, delivered[e.ID]); err != nil {
+			updates["attempts"] = e.Attempts + 1
+			updates["last_error"] = err.Error()
+			log.Printf("Failed to deliver appointment event %d (%s): %v", e.ID, e.Type, err)
+		} else {
+			updates["published_at"] = time.Now()
+			updates["last_error"] = ""
+		}
+		if err := o.db.Model(e).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim takes a batch of pending events for this instance and commits the
+// claim, so no lock is held while the handlers call other services.
+func (o *outbox) claim() ([]AppointmentEvent, error) {
+	var pending []AppointmentEvent
+	err := o.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL AND attempts < ?", maxEventAttempts).
+			Where("claimed_until IS NULL OR claimed_until < ?", now).
+			Order("id").Limit(eventBatch).Find(&pending).Error; err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(pending))
+		for i, e := range pending {
+			ids[i] = e.ID
+		}
+		return tx.Model(&AppointmentEvent{}).Where("id IN ?", ids).
+			Update("claimed_until", now.Add(eventClaim)).Error
+	})
+	return pending, err
+}
+
+// deliver runs the handlers of e that are not in done, recording each one
+// that succeeds.
+func (o *outbox) deliver(e *AppointmentEvent, done map[string]bool) error {
+	var event DomainEvent
+	if err := json.Unmarshal([]byte(e.Payload), &event); err != nil {
+		return err
+	}
+	for _, s := range o.handlers[e.Type] {
+		if done[s.name] {
+			continue
+		}
+		if err := s.h(event); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		err := o.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&AppointmentEventDelivery{
+			EventID:     e.ID,
+			Handler:     s.name,
+			DeliveredAt: time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyPatient tells the patient when staff confirm, cancel or move their
+// appointment, or mark it missed. Bookings and changes the patient made
+// themselves are not echoed.
+func notifyPatient(n *notify.Client, loc *time.Location) eventHandler {
+	return func(e DomainEvent) error {
+		if e.From == "" || e.ActorID == e.PatientID {
+			return nil
+		}
+		when := e.DateTime.In(loc).Format("Mon 2 Jan 2006 15:04")
+		msg := notify.Notification{
+			UserID:   e.PatientID,
+			Type:     "appointment",
+			Data:     fmt.Sprintf(`{"appointmentId":%d}`, e.AppointmentID),
+			Priority: notify.PriorityNormal,
+		}
+		switch e.To {
+		case StatusConfirmed:
+			msg.Title = "Appointment confirmed"
+			msg.Message = fmt.Sprintf("Your appointment on %s is confirmed.", when)
+		case StatusCancelled:
+			msg.Title = "Appointment cancelled"
+			msg.Message = fmt.Sprintf("Your appointment on %s was cancelled.", when)
+			msg.Priority = notify.PriorityHigh
+		case StatusRescheduled:
+			msg.Title = "Appointment rescheduled"
+			msg.Message = fmt.Sprintf("Your appointment on %s was moved to a new time.", when)
+			msg.Priority = notify.PriorityHigh
+		case StatusNoShow:
+			msg.Title = "Missed appointment"
+			msg.Message = fmt.Sprintf("You were marked as not attending your appointment on %s.", when)
+		default:
+			return nil
+		}
+		return n.Send(msg)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/identity"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// feedHistory is how far back a feed lists past appointments.
+	feedHistory = 90 * 24 * time.Hour
+	// maxFeedEvents caps the appointments in one feed.
+	maxFeedEvents = 1000
+	icalTime      = "20060102T150405Z"
+	icalProdID    = "-//Healthcare//Appointments//EN"
+	// icalUIDDomain makes event UIDs globally unique.
+	icalUIDDomain = "appointments.healthcare"
+)
+
+// CalendarFeed is a subscription URL for one patient's or one doctor's
+// appointments. Calendar apps cannot send a bearer token, so the URL
+// carries a random token; only its hash is stored. Each fetch is checked
+// against the access rules as the user who created the feed.
+type CalendarFeed struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	PatientID  *uint  // set for a patient's feed
+	DoctorID   *uint  // set for a doctor's feed
+	TokenHash  string `gorm:"uniqueIndex;size:64;not null" json:"-"`
+	LastUsedAt *time.Time
+}
+
+type calendar struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	users    *identity.Client
+	baseURL  string
+}
+
+// newCalendar reads CALENDAR_BASE_URL, the public address feed URLs are
+// built on.
+func newCalendar(db *gorm.DB, policies *policy.Policy, users *identity.Client) *calendar {
+	baseURL := os.Getenv("CALENDAR_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8082"
+	}
+	return &calendar{db: db, policies: policies, users: users, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// FeedInput is the body of POST /api/calendar/feeds. Exactly one of the
+// IDs is set.
+type FeedInput struct {
+	PatientID *uint
+	DoctorID  *uint
+}
+
+// createFeed answers POST /api/calendar/feeds. The URL is only shown once.
+func (cal *calendar) createFeed(c *gin.Context) {
+	var input FeedInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	switch {
+	case (input.PatientID == nil) == (input.DoctorID == nil):
+		c.JSON(400, gin.H{"error": "Give either PatientID or DoctorID"})
+		return
+	case input.PatientID != nil:
+		if !cal.policies.Authorize(c, policy.ResourceAppointments, policy.ActionRead, *input.PatientID) {
+			return
+		}
+	default:
+		if !cal.policies.AuthorizeDoctor(c, policy.ResourceAppointments, policy.ActionRead, *input.DoctorID) {
+			return
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create feed"})
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	feed := CalendarFeed{
+		UserID:    auth.UserID(c),
+		PatientID: input.PatientID,
+		DoctorID:  input.DoctorID,
+		TokenHash: hashFeedToken(token),
+	}
+	if err := cal.db.Create(&feed).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to create feed"})
+		return
+	}
+
+	c.JSON(201, gin.H{"feed": feed, "url": cal.baseURL + "/calendar/feed.ics?token=" + token})
+}
+
+// listFeeds answers GET /api/calendar/feeds with the caller's feeds.
+func (cal *calendar) listFeeds(c *gin.Context) {
+	var feeds []CalendarFeed
+	if err := cal.db.Where("user_id = ?", auth.UserID(c)).Order("created_at").Find(&feeds).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch feeds"})
+		return
+	}
+	c.JSON(200, feeds)
+}
+
+// revokeFeed answers DELETE /api/calendar/feeds/:id. The URL stops working
+// at once.
+func (cal *calendar) revokeFeed(c *gin.Context) {
+	res := cal.db.Where("id = ? AND user_id = ?", c.Param("id"), auth.UserID(c)).Delete(&CalendarFeed{})
+	if res.Error != nil {
+		c.JSON(400, gin.H{"error": "Failed to revoke feed"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Feed not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Feed revoked"})
+}
+
+// feed answers GET /calendar/feed.ics?token=.
+func (cal *calendar) feed(c *gin.Context) {
+	token := c.Query("token")
+	var f CalendarFeed
+	if token == "" || cal.db.Where("token_hash = ?", hashFeedToken(token)).First(&f).Error != nil {
+		c.JSON(404, gin.H{"error": "Feed not found"})
+		return
+	}
+	audit.SetResourceID(c, strconv.FormatUint(uint64(f.ID), 10))
+
+	// Act as the feed's owner with their current role, so the feed loses
+	// access whenever its owner does
+	owner, err := cal.users.User(f.UserID)
+	if errors.Is(err, identity.ErrNotFound) || (err == nil && !owner.IsActive) {
+		c.JSON(404, gin.H{"error": "Feed not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up owner of calendar feed %d: %v", f.ID, err)
+		c.JSON(502, gin.H{"error": "Failed to load feed"})
+		return
+	}
+	c.Set(auth.ContextUserID, owner.ID)
+	c.Set(auth.ContextRole, owner.Role)
+
+	query := cal.db.Where("date_time >= ?", time.Now().Add(-feedHistory))
+	if f.PatientID != nil {
+		if !cal.policies.Authorize(c, policy.ResourceAppointments, policy.ActionRead, *f.PatientID) {
+			return
+		}
+		query = query.Where("patient_id = ?", *f.PatientID)
+	} else {
+		if !cal.policies.AuthorizeDoctor(c, policy.ResourceAppointments, policy.ActionRead, *f.DoctorID) {
+			return
+		}
+		query = query.Where("doctor_id = ?", *f.DoctorID)
+	}
+
+	var appointments []Appointment
+	if err := query.Order("date_time").Limit(maxFeedEvents).Find(&appointments).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load feed"})
+		return
+	}
+	for _, a := range appointments {
+		audit.SetPatients(c, a.PatientID)
+	}
+	if err := cal.db.Model(&f).UpdateColumn("last_used_at", time.Now()).Error; err != nil {
+		log.Printf("Failed to record use of calendar feed %d: %v", f.ID, err)
+	}
+
+	writeCalendar(c, "", appointments, f.DoctorID != nil)
+}
+
+// download answers GET /api/appointments/:id/ics with a single event.
+func (cal *calendar) download(c *gin.Context) {
+	a, ok := loadAppointment(c, cal.db, cal.policies, policy.ActionRead)
+	if !ok {
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="appointment-%d.ics"`, a.ID))
+	writeCalendar(c, "PUBLISH", []Appointment{*a}, auth.Role(c) != auth.RolePatient)
+}
+
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeCalendar renders appointments as an RFC 5545 VCALENDAR. Times are
+// written in UTC, so no VTIMEZONE is needed. Staff calendars name the
+// patient by ID; notes are never included.
+func writeCalendar(c *gin.Context, method string, appointments []Appointment, forStaff bool) {
+	var w icalWriter
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", icalProdID)
+	w.line("CALSCALE", "GREGORIAN")
+	if method != "" {
+		w.line("METHOD", method)
+	}
+	w.line("X-WR-CALNAME", "Appointments")
+	for i := range appointments {
+		writeEvent(&w, &appointments[i], forStaff)
+	}
+	w.line("END", "VCALENDAR")
+
+	c.Data(200, "text/calendar; charset=utf-8", []byte(w.String()))
+}
+
+func writeEvent(w *icalWriter, a *Appointment, forStaff bool) {
+	summary := "Appointment"
+	if a.Type != "" {
+		summary = strings.ToUpper(a.Type[:1]) + a.Type[1:] + " appointment"
+	}
+	if forStaff {
+		summary += fmt.Sprintf(" with patient #%d", a.PatientID)
+	}
+
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", fmt.Sprintf("appointment-%d@%s", a.ID, icalUIDDomain))
+	w.line("DTSTAMP", a.UpdatedAt.UTC().Format(icalTime))
+	w.line("CREATED", a.CreatedAt.UTC().Format(icalTime))
+	w.line("LAST-MODIFIED", a.UpdatedAt.UTC().Format(icalTime))
+	w.line("SEQUENCE", strconv.Itoa(a.Sequence))
+	w.line("DTSTART", a.DateTime.UTC().Format(icalTime))
+	w.line("DURATION", fmt.Sprintf("PT%dM", a.Duration))
+	w.line("SUMMARY", escapeText(summary))
+	w.line("STATUS", icalStatus(a.Status))
+	w.line("DESCRIPTION", escapeText("Status: "+strings.ReplaceAll(a.Status, "_", " ")))
+	switch {
+	case a.Location != "":
+		w.line("LOCATION", escapeText(a.Location))
+	case a.MeetingLink != "":
+		w.line("LOCATION", escapeText(a.MeetingLink))
+	}
+	if a.MeetingLink != "" {
+		w.line("URL", a.MeetingLink)
+	}
+	w.line("END", "VEVENT")
+}
+
+// icalStatus maps an appointment state to a VEVENT STATUS.
+func icalStatus(status string) string {
+	switch status {
+	case StatusRequested:
+		return "TENTATIVE"
+	case StatusCancelled, StatusRescheduled:
+		return "CANCELLED"
+	default:
+		return "CONFIRMED"
+	}
+}
+
+// escapeText escapes an iCalendar TEXT value.
+func escapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icalWriter builds content lines, folded at 75 octets and ended by CRLF.
+type icalWriter struct {
+	strings.Builder
+}
+
+func (w *icalWriter) line(name, value string) {
+	s := name + ":" + value
+	limit := 75
+	for len(s) > limit {
+		// Never split a UTF-8 sequence
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		limit = 74 // the leading space counts
+	}
+	w.WriteString(s + "\r\n")
+}
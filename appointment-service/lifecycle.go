@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"healthcare/shared/auth"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Appointment states.
+const (
+	StatusRequested   = "requested"
+	StatusConfirmed   = "confirmed"
+	StatusCheckedIn   = "checked_in"
+	StatusInProgress  = "in_progress"
+	StatusCompleted   = "completed"
+	StatusNoShow      = "no_show"
+	StatusCancelled   = "cancelled"
+	StatusRescheduled = "rescheduled"
+)
+
+// inactiveStatuses no longer hold the doctor's time. The overlap
+// constraint and every busy-time query skip them.
+var inactiveStatuses = []string{StatusCancelled, StatusRescheduled}
+
+// upcomingStatuses are the states in which an appointment can still be
+// edited, moved or cancelled as part of a series.
+var upcomingStatuses = []string{StatusRequested, StatusConfirmed}
+
+// roleSystem is the actor role of changes appointment-service makes on its
+// own, such as marking no-shows.
+const roleSystem = "system"
+
+var systemActor = actor{Role: roleSystem}
+
+var (
+	patientStaff  = []string{auth.RolePatient, auth.RoleDoctor, auth.RoleAdmin}
+	staff         = []string{auth.RoleDoctor, auth.RoleAdmin}
+	staffOrSystem = []string{auth.RoleDoctor, auth.RoleAdmin, roleSystem}
+	doctorOnly    = []string{auth.RoleDoctor}
+)
+
+// transitions lists, for each state, the states it may move to and the
+// roles allowed to move it there. completed, no_show, cancelled and
+// rescheduled are final. Only virtual appointments, which have no
+// check-in, go from confirmed straight to in_progress.
+var transitions = map[string]map[string][]string{
+	StatusRequested: {
+		StatusConfirmed:   staff,
+		StatusCancelled:   patientStaff,
+		StatusRescheduled: patientStaff,
+	},
+	StatusConfirmed: {
+		StatusCheckedIn:   staff,
+		StatusInProgress:  doctorOnly,
+		StatusNoShow:      staffOrSystem,
+		StatusCancelled:   patientStaff,
+		StatusRescheduled: patientStaff,
+	},
+	StatusCheckedIn: {
+		StatusInProgress: doctorOnly,
+		StatusCancelled:  staff,
+	},
+	StatusInProgress: {
+		StatusCompleted: doctorOnly,
+	},
+}
+
+var (
+	errInvalidTransition   = errors.New("transition not allowed")
+	errTransitionForbidden = errors.New("role may not make this transition")
+	errNotStarted          = errors.New("appointment has not started yet")
+	errStaleStatus         = errors.New("appointment status changed concurrently")
+)
+
+// actor is who made a transition.
+type actor struct {
+	ID   uint
+	Role string
+}
+
+func actorFrom(c *gin.Context) actor {
+	return actor{ID: auth.UserID(c), Role: auth.Role(c)}
+}
+
+// initialStatus is the state a new booking starts in: patients request,
+// staff book confirmed appointments directly.
+func initialStatus(role string) string {
+	if role == auth.RolePatient {
+		return StatusRequested
+	}
+	return StatusConfirmed
+}
+
+// checkTransition reports whether role may move an appointment from one
+// state to another.
+func checkTransition(from, to, role string) error {
+	roles, ok := transitions[from][to]
+	if !ok {
+		return fmt.Errorf("%w: %s to %s", errInvalidTransition, from, to)
+	}
+	for _, r := range roles {
+		if r == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s to %s", errTransitionForbidden, from, to)
+}
+
+// stamp sets the timestamp field for status and returns its column, or ""
+// for a state without one.
+func (a *Appointment) stamp(status string, t time.Time) string {
+	var field **time.Time
+	var column string
+	switch status {
+	case StatusConfirmed:
+		field, column = &a.ConfirmedAt, "confirmed_at"
+	case StatusCheckedIn:
+		field, column = &a.CheckedInAt, "checked_in_at"
+	case StatusInProgress:
+		field, column = &a.StartedAt, "started_at"
+	case StatusCompleted:
+		field, column = &a.CompletedAt, "completed_at"
+	case StatusNoShow:
+		field, column = &a.NoShowAt, "no_show_at"
+	case StatusCancelled:
+		field, column = &a.CancelledAt, "cancelled_at"
+	case StatusRescheduled:
+		field, column = &a.RescheduledAt, "rescheduled_at"
+	default:
+		return ""
+	}
+	*field = &t
+	return column
+}
+
+// AppointmentTransition is one entry in an appointment's status history.
+// The entry written on booking has an empty FromStatus.
+type AppointmentTransition struct {
+	ID            uint   `gorm:"primarykey"`
+	AppointmentID uint   `gorm:"not null;index"`
+	FromStatus    string `gorm:"size:20"`
+	ToStatus      string `gorm:"size:20;not null"`
+	ActorID       uint
+	ActorRole     string `gorm:"size:20"`
+	Reason        string
+	CreatedAt     time.Time
+}
+
+// transition moves a to status to inside tx, stamps the time, and writes
+// the history entry and domain event in the same transaction. The update
+// only applies if the row still has the status a was loaded with.
+func transition(tx *gorm.DB, a *Appointment, to string, by actor, reason string) error {
+	from := a.Status
+	if err := checkTransition(from, to, by.Role); err != nil {
+		return err
+	}
+	if from == StatusConfirmed && to == StatusInProgress && !a.Virtual {
+		return fmt.Errorf("%w: in-person appointments are checked in first", errInvalidTransition)
+	}
+	now := time.Now()
+	if to == StatusNoShow && now.Before(a.DateTime) {
+		return errNotStarted
+	}
+
+	a.Status = to
+	a.Sequence++
+	updates := map[string]interface{}{"status": to, "sequence": gorm.Expr("sequence + 1")}
+	if column := a.stamp(to, now); column != "" {
+		updates[column] = now
+	}
+	res := tx.Model(&Appointment{}).Where("id = ? AND status = ?", a.ID, from).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errStaleStatus
+	}
+	return record(tx, a, from, by, reason, now)
+}
+
+// recordBooked writes the first history entry and event of a new
+// appointment.
+func recordBooked(tx *gorm.DB, a *Appointment, by actor) error {
+	return record(tx, a, "", by, "", a.CreatedAt)
+}
+
+func record(tx *gorm.DB, a *Appointment, from string, by actor, reason string, at time.Time) error {
+	entry := AppointmentTransition{
+		AppointmentID: a.ID,
+		FromStatus:    from,
+		ToStatus:      a.Status,
+		ActorID:       by.ID,
+		ActorRole:     by.Role,
+		Reason:        reason,
+		CreatedAt:     at,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return err
+	}
+	return publish(tx, a, &entry)
+}
+
+// respondTransitionError maps a failed transition to a response.
+func respondTransitionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errTransitionForbidden):
+		c.JSON(403, gin.H{"error": err.Error()})
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errNotStarted), errors.Is(err, errStaleStatus):
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		c.JSON(400, gin.H{"error": "Failed to update appointment status"})
+	}
+}
+
+// lifecycle serves the status endpoints.
+type lifecycle struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	booking  *noShows
+	finder   *slotFinder
+}
+
+func newLifecycle(db *gorm.DB, policies *policy.Policy, booking *noShows, finder *slotFinder) *lifecycle {
+	return &lifecycle{db: db, policies: policies, booking: booking, finder: finder}
+}
+
+// load fetches the appointment named by :id and authorizes act on it.
+func (l *lifecycle) load(c *gin.Context, act policy.Action) (*Appointment, bool) {
+	return loadAppointment(c, l.db, l.policies, act)
+}
+
+// loadAppointment fetches the appointment named by :id and authorizes act
+// on it, answering the request if either fails.
+func loadAppointment(c *gin.Context, db *gorm.DB, policies *policy.Policy, act policy.Action) (*Appointment, bool) {
+	var a Appointment
+	if err := db.First(&a, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Appointment not found"})
+		return nil, false
+	}
+	if !authorizeAppointment(c, policies, act, &a) {
+		return nil, false
+	}
+	return &a, true
+}
+
+// authorizeAppointment checks act on a against its patient and, when a
+// doctor changes it, against its doctor too: a relationship with the
+// patient lets a doctor see another doctor's appointments, not change them.
+func authorizeAppointment(c *gin.Context, policies *policy.Policy, act policy.Action, a *Appointment) bool {
+	if !policies.Authorize(c, policy.ResourceAppointments, act, a.PatientID) {
+		return false
+	}
+	if act == policy.ActionWrite && auth.Role(c) == auth.RoleDoctor {
+		return policies.AuthorizeDoctor(c, policy.ResourceAppointments, act, a.DoctorID)
+	}
+	return true
+}
+
+// TransitionInput is the body of POST /api/appointments/:id/transitions.
+type TransitionInput struct {
+	Status string `binding:"required"`
+	Reason string
+}
+
+// move answers POST /api/appointments/:id/transitions.
+func (l *lifecycle) move(c *gin.Context) {
+	a, ok := l.load(c, policy.ActionWrite)
+	if !ok {
+		return
+	}
+	var input TransitionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Status == StatusRescheduled {
+		c.JSON(400, gin.H{"error": "Use /reschedule to move an appointment"})
+		return
+	}
+	l.apply(c, a, input.Status, input.Reason)
+}
+
+// cancel answers PUT /api/appointments/:id/cancel. The body, with an
+// optional Reason, may be left out.
+func (l *lifecycle) cancel(c *gin.Context) {
+	a, ok := l.load(c, policy.ActionWrite)
+	if !ok {
+		return
+	}
+	var input struct{ Reason string }
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	l.apply(c, a, StatusCancelled, input.Reason)
+}
+
+func (l *lifecycle) apply(c *gin.Context, a *Appointment, to, reason string) {
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		return transition(tx, a, to, actorFrom(c), reason)
+	})
+	if err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+	c.JSON(200, a)
+}
+
+// RescheduleInput is the body of POST /api/appointments/:id/reschedule.
+type RescheduleInput struct {
+	DateTime time.Time `binding:"required"`
+	Duration int
+	Reason   string
+}
+
+// reschedule answers POST /api/appointments/:id/reschedule. The old
+// appointment becomes rescheduled and a new one is booked in its place,
+// pointing back at it through RescheduledFromID.
+func (l *lifecycle) reschedule(c *gin.Context) {
+	old, ok := l.load(c, policy.ActionWrite)
+	if !ok {
+		return
+	}
+	var input RescheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkDuration(c, input.Duration) {
+		return
+	}
+
+	by := actorFrom(c)
+	status, err := l.booking.initialStatus(by, old.PatientID)
+	if err != nil {
+		respondBookingError(c, err)
+		return
+	}
+	next := replacement(old, input.DateTime, status)
+	if input.Duration > 0 {
+		next.Duration = input.Duration
+	}
+
+	err = l.db.Transaction(func(tx *gorm.DB) error {
+		return rebook(tx, old, &next, by, input.Reason)
+	})
+	if isSlotTaken(err) {
+		respondTaken(c, l.finder, &next, err)
+		return
+	}
+	if err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+
+	c.JSON(201, next)
+}
+
+// replacement is the appointment booked in old's place at start, in
+// status.
+func replacement(old *Appointment, start time.Time, status string) Appointment {
+	next := Appointment{
+		PatientID:         old.PatientID,
+		DoctorID:          old.DoctorID,
+		DateTime:          start,
+		Status:            status,
+		Type:              old.Type,
+		Notes:             old.Notes,
+		Duration:          old.Duration,
+		Virtual:           old.Virtual,
+		Location:          old.Location,
+		SeriesID:          old.SeriesID,
+		RecurrenceID:      old.RecurrenceID,
+		RescheduledFromID: &old.ID,
+	}
+	if next.Status == StatusConfirmed {
+		next.stamp(StatusConfirmed, time.Now())
+	}
+	return next
+}
+
+// rebook moves old to next inside tx: old becomes rescheduled and next is
+// booked. The old appointment leaves the overlap constraint before the new
+// one is inserted, so it may overlap its own old time.
+func rebook(tx *gorm.DB, old, next *Appointment, by actor, reason string) error {
+	if err := transition(tx, old, StatusRescheduled, by, reason); err != nil {
+		return err
+	}
+	if err := tx.Create(next).Error; err != nil {
+		return err
+	}
+	return recordBooked(tx, next, by)
+}
+
+// updateDetails writes a's editable columns inside tx, and only if no
+// transition happened since it was read. The time is never changed here;
+// that goes through rebook. Updates skip BeforeCreate, so a longer
+// Duration is checked against waitlist holds here.
+func updateDetails(tx *gorm.DB, a *Appointment) error {
+	a.setEndTime()
+	if err := a.checkHold(tx); err != nil {
+		return err
+	}
+	a.Sequence++
+	res := tx.Model(a).Where("status = ?", a.Status).
+		Select("type", "notes", "duration", "location", "end_time", "sequence").
+		Updates(a)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errStaleStatus
+	}
+	return nil
+}
+
+// history answers GET /api/appointments/:id/history, oldest first.
+func (l *lifecycle) history(c *gin.Context) {
+	a, ok := l.load(c, policy.ActionRead)
+	if !ok {
+		return
+	}
+	var entries []AppointmentTransition
+	if err := l.db.Where("appointment_id = ?", a.ID).Order("id").Find(&entries).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch appointment history"})
+		return
+	}
+	c.JSON(200, entries)
+}
+
+// migrateLifecycle moves rows written before the state machine onto it:
+// the old default "scheduled" (or no status) becomes confirmed, and each
+// appointment without history gets a first entry for its current status.
+func migrateLifecycle(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`UPDATE appointments SET status = ?, confirmed_at = COALESCE(confirmed_at, created_at)
+			WHERE status IS NULL OR status IN ('', 'scheduled')`, StatusConfirmed).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`INSERT INTO appointment_transitions (appointment_id, from_status, to_status, reason, created_at)
+			SELECT a.id, '', a.status, 'migrated', a.created_at FROM appointments a
+			WHERE NOT EXISTS (SELECT 1 FROM appointment_transitions t WHERE t.appointment_id = a.id)`).Error
+	})
+}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
+	"sort"
 	"time"
 
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/billing"
+	"healthcare/shared/clinic"
+	"healthcare/shared/doctors"
+	"healthcare/shared/identity"
+	"healthcare/shared/notify"
+	"healthcare/shared/policy"
+	"healthcare/shared/video"
+
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -16,12 +28,64 @@ type Appointment struct {
 	PatientID   uint      `gorm:"not null"`
 	DoctorID    uint      `gorm:"not null"`
 	DateTime    time.Time `gorm:"not null"`
-	Status      string    `gorm:"default:'scheduled'"` // scheduled, completed, cancelled
+	Status      string    `gorm:"default:'requested'"` // see lifecycle.go
 	Type        string    // consultation, follow-up, emergency
 	Notes       string
-	Duration    int    `gorm:"default:30"` // duration in minutes
-	MeetingLink string // for virtual appointments
+	Duration    int    `gorm:"default:30"`             // duration in minutes
+	Virtual     bool   `gorm:"not null;default:false"` // held over video; see telehealth.go
+	MeetingLink string // the telehealth session's room, for virtual appointments
 	Location    string // for in-person appointments
+	// EndTime is DateTime plus Duration, set on save
+	EndTime time.Time `gorm:"index"`
+	// LegacyOverlap marks an appointment that already overlapped an
+	// earlier one of the doctor's when the overlap constraint was added; it
+	// is left out of the constraint until rescheduled or cancelled
+	LegacyOverlap bool `gorm:"not null;default:false"`
+	// SeriesID and RecurrenceID (the start the rule generated) are set on
+	// occurrences of a recurring series
+	SeriesID     *uint `gorm:"index"`
+	RecurrenceID *time.Time
+	// RescheduledFromID is the appointment this one replaced
+	RescheduledFromID *uint `gorm:"index"`
+	// Sequence counts changes to the time, details or status; it is the
+	// iCalendar SEQUENCE of the appointment's event
+	Sequence int `gorm:"not null;default:0"`
+	// When the appointment entered each state; see lifecycle.go
+	ConfirmedAt   *time.Time
+	CheckedInAt   *time.Time
+	StartedAt     *time.Time
+	CompletedAt   *time.Time
+	NoShowAt      *time.Time
+	CancelledAt   *time.Time
+	RescheduledAt *time.Time
+	// NoShowExcused keeps a no-show out of the patient's count; see noshow.go
+	NoShowExcused bool `gorm:"not null;default:false"`
+}
+
+// AppointmentInput is the body of POST /api/appointments. The status and
+// its timestamps are not set by the client, nor is the meeting link of a
+// virtual appointment.
+type AppointmentInput struct {
+	PatientID uint      `binding:"required"`
+	DoctorID  uint      `binding:"required"`
+	DateTime  time.Time `binding:"required"`
+	Type      string
+	Notes     string
+	Duration  int
+	Virtual   bool
+	Location  string
+	// RRule books a recurring series; see series.go
+	RRule string
+}
+
+// AppointmentUpdate is the body of PUT /api/appointments/:id. Fields left
+// out keep their value. The time is changed with /reschedule and the
+// status with /transitions.
+type AppointmentUpdate struct {
+	Type     *string
+	Notes    *string
+	Duration *int
+	Location *string
 }
 
 func main() {
@@ -42,7 +106,73 @@ func main() {
 	}
 
 	// Auto migrate the schema
-	db.AutoMigrate(&Appointment{})
+	db.AutoMigrate(&Appointment{}, &AppointmentSeries{}, &AppointmentTransition{},
+		&AppointmentEvent{}, &AppointmentEventDelivery{}, &WaitlistEntry{}, &WaitlistWindow{},
+		&WaitlistOffer{}, &CalendarFeed{}, &AppointmentReminder{}, &TelehealthSession{},
+		&TelehealthParticipant{})
+	if err := migrateLifecycle(db); err != nil {
+		log.Fatal("Failed to migrate appointment statuses:", err)
+	}
+	if err := migrateTelehealth(db); err != nil {
+		log.Fatal("Failed to migrate meeting links:", err)
+	}
+	if err := migrateConflicts(db); err != nil {
+		log.Fatal("Failed to add appointment overlap constraint:", err)
+	}
+	if err := audit.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate audit log:", err)
+	}
+
+	verifier, err := auth.NewServiceVerifier(identity.NewClientFromEnv())
+	if err != nil {
+		log.Fatal("Failed to load auth configuration:", err)
+	}
+	policies := policy.New(db)
+	auditLog := audit.NewLogger(db, "appointment-service")
+
+	clinicTZ, err := clinic.Location()
+	if err != nil {
+		log.Fatal("Invalid CLINIC_TIMEZONE:", err)
+	}
+	// Suggestions for clashing bookings come from doctor-service's slots
+	maxDuration = envInt("MAX_APPOINTMENT_MINUTES", defaultMaxDuration)
+	if maxDuration == 0 {
+		log.Fatal("Invalid MAX_APPOINTMENT_MINUTES: 0")
+	}
+	finder := newSlotFinder(db, doctors.NewClientFromEnv())
+	missed := newNoShows(db, policies, billing.NewClientFromEnv())
+	go missed.run()
+	recurring := newSeries(db, policies, clinicTZ, finder, missed)
+	states := newLifecycle(db, policies, missed, finder)
+
+	notifier := notify.NewClientFromEnv()
+	waiting := newWaitlist(db, policies, notifier, clinicTZ, missed)
+	go waiting.run()
+	calendars := newCalendar(db, policies, identity.NewClientFromEnv())
+	reminding := newReminders(db, policies, notifier, clinicTZ)
+	go reminding.run()
+	clinicQueue := newQueue(db, policies, clinicTZ)
+	go clinicQueue.listen(dsn)
+	videoProvider, err := video.NewProviderFromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure video provider:", err)
+	}
+	visits := newTelehealth(db, policies, videoProvider)
+
+	// Domain events are delivered from the outbox table
+	events := newOutbox(db)
+	events.subscribe("notify-patient", notifyPatient(notifier, clinicTZ),
+		eventType(StatusConfirmed), eventType(StatusCancelled), eventType(StatusRescheduled), eventType(StatusNoShow))
+	events.subscribe("waitlist", waiting.slotFreed, eventType(StatusCancelled), eventType(StatusRescheduled))
+	for _, status := range queueEvents {
+		events.subscribe("queue", clinicQueue.changed, eventType(status))
+	}
+	events.subscribe("telehealth-booked", visits.booked, eventType(StatusRequested), eventType(StatusConfirmed))
+	for _, status := range sessionEndEvents {
+		events.subscribe("telehealth-over", visits.over, eventType(status))
+	}
+	events.subscribe("no-show-fee", missed.bill, eventType(StatusNoShow))
+	go events.run(time.Second)
 
 	// Initialize Gin router
 	r := gin.Default()
@@ -61,16 +191,69 @@ func main() {
 
 	// Appointment routes
 	appointmentRoutes := r.Group("/api/appointments")
+	appointmentRoutes.Use(audit.Middleware(auditLog, "appointment"), auth.AuthMiddleware(verifier))
 	{
-		// Create appointment
+		// Create appointment, or a recurring series when RRule is set
 		appointmentRoutes.POST("/", func(c *gin.Context) {
-			var appointment Appointment
-			if err := c.ShouldBindJSON(&appointment); err != nil {
+			var input AppointmentInput
+			if err := c.ShouldBindJSON(&input); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
 
-			if err := db.Create(&appointment).Error; err != nil {
+			if !policies.Authorize(c, policy.ResourceAppointments, policy.ActionWrite, input.PatientID) {
+				return
+			}
+			if !checkDuration(c, input.Duration) {
+				return
+			}
+			// A doctor books under their own profile only
+			if auth.Role(c) == auth.RoleDoctor {
+				doctorID, err := policies.DoctorIDFor(auth.UserID(c))
+				if err != nil || doctorID == 0 {
+					c.JSON(403, gin.H{"error": "Doctor profile not found"})
+					return
+				}
+				input.DoctorID = doctorID
+			}
+
+			by := actorFrom(c)
+			status, err := missed.initialStatus(by, input.PatientID)
+			if err != nil {
+				respondBookingError(c, err)
+				return
+			}
+			appointment := Appointment{
+				PatientID: input.PatientID,
+				DoctorID:  input.DoctorID,
+				DateTime:  input.DateTime,
+				Status:    status,
+				Type:      input.Type,
+				Notes:     input.Notes,
+				Duration:  input.Duration,
+				Virtual:   input.Virtual,
+				Location:  input.Location,
+			}
+			if appointment.Status == StatusConfirmed {
+				appointment.stamp(StatusConfirmed, time.Now())
+			}
+
+			if input.RRule != "" {
+				recurring.create(c, &appointment, input.RRule)
+				return
+			}
+
+			err = db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Create(&appointment).Error; err != nil {
+					return err
+				}
+				return recordBooked(tx, &appointment, by)
+			})
+			if err != nil {
+				if isSlotTaken(err) {
+					respondTaken(c, finder, &appointment, err)
+					return
+				}
 				c.JSON(400, gin.H{"error": "Failed to create appointment"})
 				return
 			}
@@ -79,7 +262,7 @@ func main() {
 		})
 
 		// Get appointments for a patient
-		appointmentRoutes.GET("/patient/:patientId", func(c *gin.Context) {
+		appointmentRoutes.GET("/patient/:patientId", policies.PatientParam(policy.ResourceAppointments, policy.ActionRead, "patientId"), func(c *gin.Context) {
 			var appointments []Appointment
 			if err := db.Where("patient_id = ?", c.Param("patientId")).Find(&appointments).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to fetch appointments"})
@@ -89,13 +272,19 @@ func main() {
 			c.JSON(200, appointments)
 		})
 
+		// A patient's recent no-shows and the booking standing they give
+		appointmentRoutes.GET("/patient/:patientId/no-shows", policies.PatientParam(policy.ResourceAppointments, policy.ActionRead, "patientId"), missed.forPatient)
+
 		// Get appointments for a doctor
-		appointmentRoutes.GET("/doctor/:doctorId", func(c *gin.Context) {
+		appointmentRoutes.GET("/doctor/:doctorId", policies.DoctorParam(policy.ResourceAppointments, policy.ActionRead, "doctorId"), func(c *gin.Context) {
 			var appointments []Appointment
 			if err := db.Where("doctor_id = ?", c.Param("doctorId")).Find(&appointments).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to fetch appointments"})
 				return
 			}
+			for _, a := range appointments {
+				audit.SetPatients(c, a.PatientID)
+			}
 
 			c.JSON(200, appointments)
 		})
@@ -108,37 +297,155 @@ func main() {
 				return
 			}
 
-			if err := c.ShouldBindJSON(&appointment); err != nil {
+			if !authorizeAppointment(c, policies, policy.ActionWrite, &appointment) {
+				return
+			}
+
+			if _, open := transitions[appointment.Status]; !open {
+				c.JSON(409, gin.H{"error": "Appointment is " + appointment.Status + " and can no longer be changed"})
+				return
+			}
+
+			var input AppointmentUpdate
+			if err := c.ShouldBindJSON(&input); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
 
-			if err := db.Save(&appointment).Error; err != nil {
-				c.JSON(400, gin.H{"error": "Failed to update appointment"})
+			if input.Duration != nil {
+				if !checkDuration(c, *input.Duration) {
+					return
+				}
+				appointment.Duration = *input.Duration
+			}
+			for _, f := range []struct{ dst, src *string }{
+				{&appointment.Type, input.Type},
+				{&appointment.Notes, input.Notes},
+				{&appointment.Location, input.Location},
+			} {
+				if f.src != nil {
+					*f.dst = *f.src
+				}
+			}
+
+			if err := updateDetails(db, &appointment); err != nil {
+				switch {
+				case isSlotTaken(err):
+					respondTaken(c, finder, &appointment, err)
+				case errors.Is(err, errStaleStatus):
+					respondTransitionError(c, err)
+				default:
+					c.JSON(400, gin.H{"error": "Failed to update appointment"})
+				}
 				return
 			}
 
 			c.JSON(200, appointment)
 		})
 
-		// Cancel appointment
-		appointmentRoutes.PUT("/:id/cancel", func(c *gin.Context) {
-			var appointment Appointment
-			if err := db.First(&appointment, c.Param("id")).Error; err != nil {
-				c.JSON(404, gin.H{"error": "Appointment not found"})
+		// Recurring series
+		appointmentRoutes.GET("/series/:id", recurring.get)
+		appointmentRoutes.PUT("/:id/following", recurring.editFollowing)
+		appointmentRoutes.PUT("/:id/cancel-following", recurring.cancelFollowing)
+
+		// Status changes
+		appointmentRoutes.POST("/:id/transitions", states.move)
+		appointmentRoutes.POST("/:id/reschedule", states.reschedule)
+		appointmentRoutes.PUT("/:id/cancel", states.cancel)
+		appointmentRoutes.GET("/:id/history", states.history)
+		appointmentRoutes.PUT("/:id/no-show/excuse", auth.RoleMiddleware(auth.RoleAdmin), missed.excuse)
+		appointmentRoutes.GET("/:id/ics", calendars.download)
+		appointmentRoutes.GET("/:id/reminders", reminding.list)
+		appointmentRoutes.POST("/:id/check-in", auth.RoleMiddleware(auth.RoleAdmin, auth.RoleDoctor), clinicQueue.checkIn)
+
+		// Telehealth sessions of virtual appointments
+		appointmentRoutes.GET("/:id/telehealth", visits.get)
+		appointmentRoutes.POST("/:id/telehealth/join", visits.join)
+		appointmentRoutes.POST("/:id/telehealth/events", visits.report)
+		appointmentRoutes.POST("/:id/telehealth/end", visits.end)
+	}
+
+	// Clinic queue
+	queueRoutes := r.Group("/api/queue")
+	queueRoutes.Use(audit.Middleware(auditLog, "queue"), auth.AuthMiddleware(verifier), auth.RoleMiddleware(auth.RoleAdmin, auth.RoleDoctor))
+	{
+		queueRoutes.GET("/", clinicQueue.view)
+		queueRoutes.GET("/stream", clinicQueue.stream)
+		queueRoutes.POST("/doctor/:doctorId/next", clinicQueue.callNext)
+	}
+
+	// Calendar subscriptions
+	feedRoutes := r.Group("/api/calendar/feeds")
+	feedRoutes.Use(audit.Middleware(auditLog, "calendar_feed"), auth.AuthMiddleware(verifier))
+	{
+		feedRoutes.POST("/", calendars.createFeed)
+		feedRoutes.GET("/", calendars.listFeeds)
+		feedRoutes.DELETE("/:id", calendars.revokeFeed)
+	}
+	// The feed itself is authenticated by the token in its URL. It is a
+	// query parameter so the audit log, which records the path, never
+	// holds it.
+	r.GET("/calendar/feed.ics", audit.Middleware(auditLog, "calendar_feed"), calendars.feed)
+
+	// Waitlist for earlier slots
+	waitlistRoutes := r.Group("/api/waitlist")
+	waitlistRoutes.Use(audit.Middleware(auditLog, "waitlist"), auth.AuthMiddleware(verifier))
+	{
+		waitlistRoutes.POST("/", waiting.join)
+		waitlistRoutes.GET("/patient/:patientId", policies.PatientParam(policy.ResourceAppointments, policy.ActionRead, "patientId"), waiting.forPatient)
+		waitlistRoutes.GET("/doctor/:doctorId", policies.DoctorParam(policy.ResourceAppointments, policy.ActionRead, "doctorId"), waiting.forDoctor)
+		waitlistRoutes.PUT("/:id/priority", auth.RoleMiddleware(auth.RoleAdmin, auth.RoleDoctor), waiting.setPriority)
+		waitlistRoutes.DELETE("/:id", waiting.withdraw)
+		waitlistRoutes.POST("/offers/:id/accept", waiting.accept)
+		waitlistRoutes.POST("/offers/:id/decline", waiting.decline)
+	}
+
+	// Internal API for doctor-service's slot engine
+	internal := r.Group("/internal/appointments")
+	internal.Use(auth.InternalMiddleware(auth.InternalToken()))
+	{
+		// Busy windows of a doctor between from and to (RFC 3339)
+		internal.GET("/busy", func(c *gin.Context) {
+			from, errFrom := time.Parse(time.RFC3339, c.Query("from"))
+			to, errTo := time.Parse(time.RFC3339, c.Query("to"))
+			if c.Query("doctorId") == "" || errFrom != nil || errTo != nil {
+				c.JSON(400, gin.H{"error": "doctorId, from and to are required"})
 				return
 			}
 
-			appointment.Status = "cancelled"
-			if err := db.Save(&appointment).Error; err != nil {
-				c.JSON(400, gin.H{"error": "Failed to cancel appointment"})
+			var appointments []Appointment
+			if err := db.Select("date_time", "end_time").
+				Where("doctor_id = ? AND status NOT IN ? AND end_time > ? AND date_time < ?", c.Query("doctorId"), inactiveStatuses, from, to).
+				Order("date_time").
+				Find(&appointments).Error; err != nil {
+				c.JSON(500, gin.H{"error": "Failed to fetch appointments"})
 				return
 			}
 
-			c.JSON(200, appointment)
+			// Slots held for waitlist offers are not free either
+			var held []WaitlistOffer
+			if err := db.Select("starts_at", "ends_at").
+				Where("doctor_id = ? AND status = ? AND expires_at > ? AND ends_at > ? AND starts_at < ?", c.Query("doctorId"), OfferPending, time.Now(), from, to).
+				Find(&held).Error; err != nil {
+				c.JSON(500, gin.H{"error": "Failed to fetch appointments"})
+				return
+			}
+
+			busy := make([]Slot, 0, len(appointments)+len(held))
+			for _, a := range appointments {
+				busy = append(busy, Slot{Start: a.DateTime, End: a.EndTime})
+			}
+			for _, o := range held {
+				busy = append(busy, Slot{Start: o.StartsAt, End: o.EndsAt})
+			}
+			sort.Slice(busy, func(i, j int) bool { return busy[i].Start.Before(busy[j].Start) })
+			c.JSON(200, busy)
 		})
 	}
 
+	// Join and leave callbacks from the video provider
+	r.POST("/internal/telehealth/events", auth.InternalMiddleware(auth.InternalToken()), visits.providerEvent)
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
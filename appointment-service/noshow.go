@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"healthcare/shared/auth"
+	"healthcare/shared/billing"
+	"healthcare/shared/policy"
+	"healthcare/shared/video"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Booking standings of a patient, by their recent no-shows.
+const (
+	StandingGood    = "good"
+	StandingConfirm = "confirm" // own bookings need staff confirmation
+	StandingBlocked = "blocked" // no own bookings at all
+)
+
+const (
+	defaultNoShowGrace      = 15 * time.Minute
+	defaultNoShowWindowDays = 365
+	defaultNoShowConfirm    = 2
+	noShowInterval          = time.Minute
+	noShowBatch             = 200
+	// noShowLookback keeps the sweep to recent appointments, so turning it
+	// on does not mark every old unattended appointment at once.
+	noShowLookback = 24 * time.Hour
+)
+
+var errBookingBlocked = errors.New("online booking is blocked after repeated no-shows")
+
+// noShows marks missed appointments, counts them per patient and applies
+// the booking policy that follows from the count.
+type noShows struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	bills    *billing.Client
+	// grace is how long after the start an appointment that was neither
+	// checked in nor started becomes a no-show; 0 turns the sweep off
+	grace  time.Duration
+	window time.Duration
+	// autoConfirm books patients in good standing straight into confirmed
+	autoConfirm  bool
+	confirmAfter int // 0 means never
+	blockAfter   int // 0 means never
+}
+
+// newNoShows reads NO_SHOW_GRACE (default 15m, "none" to only mark
+// no-shows by hand), NO_SHOW_WINDOW_DAYS (default 365),
+// PATIENT_AUTO_CONFIRM, NO_SHOW_CONFIRM_AFTER (default 2) and
+// NO_SHOW_BLOCK_AFTER (default 0, off).
+func newNoShows(db *gorm.DB, policies *policy.Policy, bills *billing.Client) *noShows {
+	n := &noShows{db: db, policies: policies, bills: bills, grace: defaultNoShowGrace}
+	switch v := os.Getenv("NO_SHOW_GRACE"); v {
+	case "":
+	case "none":
+		n.grace = 0
+	default:
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid NO_SHOW_GRACE:", v)
+		}
+		n.grace = d
+	}
+	n.window = time.Duration(envInt("NO_SHOW_WINDOW_DAYS", defaultNoShowWindowDays)) * 24 * time.Hour
+	n.confirmAfter = envInt("NO_SHOW_CONFIRM_AFTER", defaultNoShowConfirm)
+	n.blockAfter = envInt("NO_SHOW_BLOCK_AFTER", 0)
+	if v := os.Getenv("PATIENT_AUTO_CONFIRM"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatal("Invalid PATIENT_AUTO_CONFIRM:", v)
+		}
+		n.autoConfirm = b
+	}
+	return n
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		log.Fatalf("Invalid %s: %s", key, v)
+	}
+	return i
+}
+
+// run marks missed appointments every noShowInterval.
+func (n *noShows) run() {
+	if n.grace == 0 {
+		return
+	}
+	for range time.Tick(noShowInterval) {
+		if err := n.sweep(); err != nil {
+			log.Printf("Failed to mark no-shows: %v", err)
+		}
+	}
+}
+
+// sweep marks confirmed appointments whose grace period has passed as
+// no_show. Checked-in and started ones have left confirmed already; a
+// virtual appointment whose patient joined the room is waiting for the
+// doctor, not missed.
+func (n *noShows) sweep() error {
+	now := time.Now()
+	var due []Appointment
+	if err := n.db.Where("status = ? AND date_time < ? AND date_time > ?",
+		StatusConfirmed, now.Add(-n.grace), now.Add(-noShowLookback)).
+		Where(`NOT EXISTS (SELECT 1 FROM telehealth_sessions s JOIN telehealth_participants p ON p.session_id = s.id
+			WHERE s.appointment_id = appointments.id AND p.role = ?)`, video.RoleParticipant).
+		Order("date_time").Limit(noShowBatch).Find(&due).Error; err != nil {
+		return err
+	}
+	reason := fmt.Sprintf("not checked in within %s of the start", n.grace)
+	for i := range due {
+		err := n.db.Transaction(func(tx *gorm.DB) error {
+			return transition(tx, &due[i], StatusNoShow, systemActor, reason)
+		})
+		if err != nil && !errors.Is(err, errStaleStatus) {
+			log.Printf("Failed to mark appointment %d as no-show: %v", due[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// count returns the patient's unexcused no-shows within the window.
+func (n *noShows) count(patientID uint) (int64, error) {
+	var count int64
+	err := n.db.Model(&Appointment{}).
+		Where("patient_id = ? AND status = ? AND NOT no_show_excused AND no_show_at > ?", patientID, StatusNoShow, time.Now().Add(-n.window)).
+		Count(&count).Error
+	return count, err
+}
+
+// standing maps a no-show count to a booking standing.
+func (n *noShows) standing(count int64) string {
+	switch {
+	case n.blockAfter > 0 && count >= int64(n.blockAfter):
+		return StandingBlocked
+	case n.confirmAfter > 0 && count >= int64(n.confirmAfter):
+		return StandingConfirm
+	default:
+		return StandingGood
+	}
+}
+
+// initialStatus is the state a booking by by for patientID starts in. Staff
+// bookings are confirmed. A patient's own booking is requested, or
+// confirmed in good standing when PATIENT_AUTO_CONFIRM is on, and refused
+// with errBookingBlocked once they are blocked.
+func (n *noShows) initialStatus(by actor, patientID uint) (string, error) {
+	if by.Role != auth.RolePatient {
+		return initialStatus(by.Role), nil
+	}
+	count, err := n.count(patientID)
+	if err != nil {
+		return "", err
+	}
+	switch n.standing(count) {
+	case StandingBlocked:
+		return "", errBookingBlocked
+	case StandingGood:
+		if n.autoConfirm {
+			return StatusConfirmed, nil
+		}
+	}
+	return StatusRequested, nil
+}
+
+// respondBookingError answers a booking refused by initialStatus.
+func respondBookingError(c *gin.Context, err error) {
+	if errors.Is(err, errBookingBlocked) {
+		c.JSON(403, gin.H{"error": "Online booking is unavailable after repeated missed appointments. Please contact the clinic."})
+		return
+	}
+	c.JSON(500, gin.H{"error": "Failed to check booking policy"})
+}
+
+// forPatient answers GET /api/appointments/patient/:patientId/no-shows.
+func (n *noShows) forPatient(c *gin.Context) {
+	patientID, err := strconv.ParseUint(c.Param("patientId"), 10, 32)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid patient ID"})
+		return
+	}
+	count, err := n.count(uint(patientID))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch no-shows"})
+		return
+	}
+	var appointments []Appointment
+	if err := n.db.Where("patient_id = ? AND status = ? AND no_show_at > ?", patientID, StatusNoShow, time.Now().Add(-n.window)).
+		Order("date_time DESC").Find(&appointments).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch no-shows"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"count":        count,
+		"windowDays":   int(n.window / (24 * time.Hour)),
+		"standing":     n.standing(count),
+		"appointments": appointments,
+	})
+}
+
+// excuse answers PUT /api/appointments/:id/no-show/excuse. An excused
+// no-show stays in the history but no longer counts against the patient.
+// A fee already billed is not withdrawn.
+func (n *noShows) excuse(c *gin.Context) {
+	a, ok := loadAppointment(c, n.db, n.policies, policy.ActionWrite)
+	if !ok {
+		return
+	}
+	if a.Status != StatusNoShow {
+		c.JSON(409, gin.H{"error": "Appointment is not a no-show"})
+		return
+	}
+	if err := n.db.Model(a).Update("no_show_excused", true).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to excuse no-show"})
+		return
+	}
+	c.JSON(200, a)
+}
+
+// bill asks billing-service for a no-show fee. billing-service decides
+// whether one is charged, and bills each appointment at most once.
+func (n *noShows) bill(e DomainEvent) error {
+	return n.bills.NoShowFee(billing.NoShow{
+		AppointmentID: e.AppointmentID,
+		PatientID:     e.PatientID,
+		DoctorID:      e.DoctorID,
+		DateTime:      e.DateTime,
+	})
+}
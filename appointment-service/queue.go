@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// queueChannel is the Postgres NOTIFY channel queue changes go out
+	// on, so every replica's streams hear about them.
+	queueChannel = "appointment_queue"
+	// queueHistory bounds the visits average consult times are taken from.
+	queueHistory = 30 * 24 * time.Hour
+	queueSamples = 50
+	// queueRefresh resends the queue on open streams even without
+	// changes, so wait estimates keep moving.
+	queueRefresh = 30 * time.Second
+)
+
+// queueEvents are the changes that move patients into, through or out of a
+// queue.
+var queueEvents = []string{StatusCheckedIn, StatusInProgress, StatusCompleted, StatusNoShow, StatusCancelled}
+
+// QueueEntry is one checked-in or in-progress appointment in a queue.
+type QueueEntry struct {
+	AppointmentID uint       `json:"appointmentId"`
+	PatientID     uint       `json:"patientId"`
+	DoctorID      uint       `json:"doctorId"`
+	Location      string     `json:"location,omitempty"`
+	Status        string     `json:"status"`
+	DateTime      time.Time  `json:"dateTime"`
+	CheckedInAt   *time.Time `json:"checkedInAt"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	// Position is 0 for the patient being seen, then 1, 2, ... for those
+	// waiting
+	Position             int       `json:"position"`
+	EstimatedStart       time.Time `json:"estimatedStart"`
+	EstimatedWaitMinutes int       `json:"estimatedWaitMinutes"`
+}
+
+// queueFilter selects a doctor's queue or a location's.
+type queueFilter struct {
+	doctorID uint
+	location string
+}
+
+type queue struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	loc      *time.Location
+
+	mu   sync.Mutex
+	subs map[chan struct{}]bool
+}
+
+func newQueue(db *gorm.DB, policies *policy.Policy, loc *time.Location) *queue {
+	return &queue{db: db, policies: policies, loc: loc, subs: map[chan struct{}]bool{}}
+}
+
+// checkIn answers POST /api/appointments/:id/check-in. Only in-person
+// appointments on the current clinic day can be checked in.
+func (q *queue) checkIn(c *gin.Context) {
+	a, ok := loadAppointment(c, q.db, q.policies, policy.ActionWrite)
+	if !ok {
+		return
+	}
+	if a.Virtual {
+		c.JSON(409, gin.H{"error": "Virtual appointments are not checked in"})
+		return
+	}
+	start, end := q.today()
+	if a.DateTime.Before(start) || !a.DateTime.Before(end) {
+		c.JSON(409, gin.H{"error": "Only today's appointments can be checked in"})
+		return
+	}
+
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		return transition(tx, a, StatusCheckedIn, actorFrom(c), "")
+	})
+	if err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+	c.JSON(200, a)
+}
+
+// callNext answers POST /api/queue/doctor/:doctorId/next: the doctor
+// starts the appointment at the front of their queue.
+func (q *queue) callNext(c *gin.Context) {
+	doctorID, err := strconv.ParseUint(c.Param("doctorId"), 10, 32)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid doctor ID"})
+		return
+	}
+	if !q.policies.AuthorizeDoctor(c, policy.ResourceAppointments, policy.ActionWrite, uint(doctorID)) {
+		return
+	}
+
+	entries, err := q.entries(queueFilter{doctorID: uint(doctorID)})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load queue"})
+		return
+	}
+	if len(entries) > 0 && entries[0].Status == StatusInProgress {
+		c.JSON(409, gin.H{"error": "Finish the current appointment first"})
+		return
+	}
+	if len(entries) == 0 {
+		c.JSON(404, gin.H{"error": "Nobody is waiting"})
+		return
+	}
+
+	var a Appointment
+	if err := q.db.First(&a, entries[0].AppointmentID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Appointment not found"})
+		return
+	}
+	err = q.db.Transaction(func(tx *gorm.DB) error {
+		return transition(tx, &a, StatusInProgress, actorFrom(c), "")
+	})
+	if err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+	c.JSON(200, a)
+}
+
+// filter reads ?doctorId= or ?location= and authorizes it. A doctor may
+// see their own queue; a location's queue spans doctors, so only admins
+// see it.
+func (q *queue) filter(c *gin.Context) (queueFilter, bool) {
+	if v := c.Query("doctorId"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid doctor ID"})
+			return queueFilter{}, false
+		}
+		if !q.policies.AuthorizeDoctor(c, policy.ResourceAppointments, policy.ActionRead, uint(id)) {
+			return queueFilter{}, false
+		}
+		return queueFilter{doctorID: uint(id)}, true
+	}
+	if v := c.Query("location"); v != "" {
+		if auth.Role(c) != auth.RoleAdmin {
+			c.JSON(403, gin.H{"error": "Insufficient permissions"})
+			return queueFilter{}, false
+		}
+		return queueFilter{location: v}, true
+	}
+	c.JSON(400, gin.H{"error": "doctorId or location is required"})
+	return queueFilter{}, false
+}
+
+// view answers GET /api/queue?doctorId= or ?location=.
+func (q *queue) view(c *gin.Context) {
+	f, ok := q.filter(c)
+	if !ok {
+		return
+	}
+	entries, err := q.entries(f)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load queue"})
+		return
+	}
+	auditQueue(c, entries)
+	c.JSON(200, entries)
+}
+
+// stream answers GET /api/queue/stream with server-sent events: a "queue"
+// event with the whole queue on connect, after every change and every
+// queueRefresh.
+func (q *queue) stream(c *gin.Context) {
+	f, ok := q.filter(c)
+	if !ok {
+		return
+	}
+	changed := q.subscribe()
+	defer q.unsubscribe(changed)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	send := func() bool {
+		entries, err := q.entries(f)
+		if err != nil {
+			log.Printf("Failed to load queue for stream: %v", err)
+			return false
+		}
+		auditQueue(c, entries)
+		c.SSEvent("queue", entries)
+		c.Writer.Flush()
+		return true
+	}
+	if !send() {
+		return
+	}
+
+	refresh := time.NewTicker(queueRefresh)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-changed:
+		case <-refresh.C:
+		}
+		if !send() {
+			return
+		}
+	}
+}
+
+// entries builds the queue: today's checked-in and in-progress
+// appointments, per doctor in the order patients became ready (the later
+// of their start time and arrival), with waits estimated from the
+// doctor's recent actual consult times.
+func (q *queue) entries(f queueFilter) ([]QueueEntry, error) {
+	start, end := q.today()
+	query := q.db.Where("status IN ? AND date_time >= ? AND date_time < ?",
+		[]string{StatusCheckedIn, StatusInProgress}, start, end)
+	if f.doctorID != 0 {
+		query = query.Where("doctor_id = ?", f.doctorID)
+	} else {
+		query = query.Where("location = ?", f.location)
+	}
+	var appointments []Appointment
+	if err := query.Find(&appointments).Error; err != nil {
+		return nil, err
+	}
+
+	byDoctor := map[uint][]Appointment{}
+	for _, a := range appointments {
+		byDoctor[a.DoctorID] = append(byDoctor[a.DoctorID], a)
+	}
+
+	now := time.Now()
+	entries := []QueueEntry{}
+	for doctorID, list := range byDoctor {
+		avg, err := q.averageConsult(doctorID)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if (list[i].Status == StatusInProgress) != (list[j].Status == StatusInProgress) {
+				return list[i].Status == StatusInProgress
+			}
+			return readyAt(&list[i]).Before(readyAt(&list[j]))
+		})
+
+		// next is when the doctor is expected to be free
+		next := now
+		position := 1
+		for i := range list {
+			a := &list[i]
+			length := avg
+			if length == 0 {
+				length = time.Duration(a.Duration) * time.Minute
+			}
+			e := QueueEntry{
+				AppointmentID: a.ID,
+				PatientID:     a.PatientID,
+				DoctorID:      a.DoctorID,
+				Location:      a.Location,
+				Status:        a.Status,
+				DateTime:      a.DateTime,
+				CheckedInAt:   a.CheckedInAt,
+				StartedAt:     a.StartedAt,
+			}
+			if a.Status == StatusInProgress && a.StartedAt != nil {
+				e.EstimatedStart = *a.StartedAt
+				if done := a.StartedAt.Add(length); done.After(next) {
+					next = done
+				}
+			} else {
+				e.Position = position
+				position++
+				e.EstimatedStart = next
+				e.EstimatedWaitMinutes = int(next.Sub(now).Round(time.Minute) / time.Minute)
+				next = next.Add(length)
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].DoctorID != entries[j].DoctorID {
+			return entries[i].DoctorID < entries[j].DoctorID
+		}
+		return entries[i].Position < entries[j].Position
+	})
+	return entries, nil
+}
+
+// auditQueue records the patients a queue showed.
+func auditQueue(c *gin.Context, entries []QueueEntry) {
+	for _, e := range entries {
+		audit.SetPatients(c, e.PatientID)
+	}
+}
+
+// readyAt is when a checked-in patient can be seen: not before their
+// start time, and not before they arrived.
+func readyAt(a *Appointment) time.Time {
+	if a.CheckedInAt != nil && a.CheckedInAt.After(a.DateTime) {
+		return *a.CheckedInAt
+	}
+	return a.DateTime
+}
+
+// averageConsult is the doctor's mean actual consult time over their last
+// queueSamples completed appointments, or 0 without any.
+func (q *queue) averageConsult(doctorID uint) (time.Duration, error) {
+	var seconds *float64
+	err := q.db.Raw(`SELECT AVG(EXTRACT(EPOCH FROM completed_at - started_at)) FROM (
+			SELECT started_at, completed_at FROM appointments
+			WHERE doctor_id = ? AND status = ? AND started_at IS NOT NULL AND completed_at > ? AND deleted_at IS NULL
+			ORDER BY completed_at DESC LIMIT ?) recent`,
+		doctorID, StatusCompleted, time.Now().Add(-queueHistory), queueSamples).Scan(&seconds).Error
+	if err != nil || seconds == nil {
+		return 0, err
+	}
+	return time.Duration(*seconds * float64(time.Second)), nil
+}
+
+// today is the current clinic day.
+func (q *queue) today() (time.Time, time.Time) {
+	now := time.Now().In(q.loc)
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, q.loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// changed is the outbox handler for queueEvents. It tells every replica
+// through Postgres NOTIFY.
+func (q *queue) changed(e DomainEvent) error {
+	return q.db.Exec("SELECT pg_notify(?, ?)", queueChannel, strconv.FormatUint(uint64(e.DoctorID), 10)).Error
+}
+
+// listen wakes this replica's streams on every queue change, reconnecting
+// when the connection drops.
+func (q *queue) listen(dsn string) {
+	for {
+		if err := q.listenOnce(dsn); err != nil {
+			log.Printf("Queue listener stopped: %v", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (q *queue) listenOnce(dsn string) error {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "LISTEN "+queueChannel); err != nil {
+		return err
+	}
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		q.broadcast()
+	}
+}
+
+func (q *queue) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	q.mu.Lock()
+	q.subs[ch] = true
+	q.mu.Unlock()
+	return ch
+}
+
+func (q *queue) unsubscribe(ch chan struct{}) {
+	q.mu.Lock()
+	delete(q.subs, ch)
+	q.mu.Unlock()
+}
+
+// broadcast wakes every stream. A stream that is still busy with the last
+// change already has one pending and will pick this one up with it.
+func (q *queue) broadcast() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for ch := range q.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"healthcare/shared/notify"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reminder delivery states.
+const (
+	ReminderSending = "sending"
+	ReminderSent    = "sent"
+	ReminderFailed  = "failed"
+	// ReminderSkipped is a retry dropped because the appointment was
+	// cancelled or moved in the meantime.
+	ReminderSkipped = "skipped"
+)
+
+const (
+	defaultReminderOffsets = "24h,1h"
+	reminderInterval       = time.Minute
+	reminderBatch          = 200
+	maxReminderAttempts    = 5
+	// reminderStale is how long a claimed reminder may stay in sending
+	// before another pass takes it over, e.g. after a crash.
+	reminderStale = 5 * time.Minute
+)
+
+// AppointmentReminder is one reminder for one start time of an
+// appointment. The unique index makes claiming it idempotent: whichever
+// replica inserts the row sends it, and a moved appointment gets new rows
+// for its new start.
+type AppointmentReminder struct {
+	ID            uint      `gorm:"primarykey"`
+	AppointmentID uint      `gorm:"not null;uniqueIndex:idx_reminder_once"`
+	OffsetMinutes int       `gorm:"not null;uniqueIndex:idx_reminder_once"`
+	ScheduledFor  time.Time `gorm:"not null;uniqueIndex:idx_reminder_once"` // the start being reminded of
+	Status        string    `gorm:"size:20;not null;index"`
+	Attempts      int
+	LastError     string
+	SentAt        *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+type reminders struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	notifier *notify.Client
+	loc      *time.Location
+	offsets  []time.Duration // ascending
+}
+
+// newReminders reads REMINDER_OFFSETS, a comma-separated list of
+// durations before the start (default "24h,1h").
+func newReminders(db *gorm.DB, policies *policy.Policy, notifier *notify.Client, loc *time.Location) *reminders {
+	v := os.Getenv("REMINDER_OFFSETS")
+	if v == "" {
+		v = defaultReminderOffsets
+	}
+	var offsets []time.Duration
+	if v != "none" {
+		for _, part := range strings.Split(v, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(part))
+			if err != nil || d < time.Minute {
+				log.Fatal("Invalid REMINDER_OFFSETS:", v)
+			}
+			offsets = append(offsets, d)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return &reminders{db: db, policies: policies, notifier: notifier, loc: loc, offsets: offsets}
+}
+
+// run sends due reminders every reminderInterval.
+func (r *reminders) run() {
+	if len(r.offsets) == 0 {
+		return
+	}
+	for range time.Tick(reminderInterval) {
+		if err := r.sendDue(); err != nil {
+			log.Printf("Failed to send appointment reminders: %v", err)
+		}
+		if err := r.retry(); err != nil {
+			log.Printf("Failed to retry appointment reminders: %v", err)
+		}
+	}
+}
+
+// sendDue claims and sends the reminders that have come due. Offsets are
+// handled smallest first, and an appointment gets at most one reminder per
+// pass: one that is 30 minutes away gets the 1h reminder, not a late 24h
+// one as well. Appointments booked after an offset's time skip it.
+func (r *reminders) sendDue() error {
+	now := time.Now()
+	for _, offset := range r.offsets {
+		minutes := int(offset / time.Minute)
+		var due []Appointment
+		err := r.db.
+			Where("status IN ? AND date_time > ? AND date_time <= ?", upcomingStatuses, now, now.Add(offset)).
+			Where("created_at < date_time - make_interval(mins => ?)", minutes).
+			Where(`NOT EXISTS (SELECT 1 FROM appointment_reminders r
+				WHERE r.appointment_id = appointments.id AND r.scheduled_for = appointments.date_time AND r.offset_minutes <= ?)`, minutes).
+			Order("date_time").Limit(reminderBatch).Find(&due).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range due {
+			a := &due[i]
+			rem := AppointmentReminder{
+				AppointmentID: a.ID,
+				OffsetMinutes: minutes,
+				ScheduledFor:  a.DateTime,
+				Status:        ReminderSending,
+				Attempts:      1,
+			}
+			res := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&rem)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				continue // another replica has it
+			}
+			r.deliver(&rem, a)
+		}
+	}
+	return nil
+}
+
+// retry sends failed reminders again, and takes over ones a crashed
+// replica left in sending.
+func (r *reminders) retry() error {
+	now := time.Now()
+	var claimed []AppointmentReminder
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("scheduled_for > ? AND attempts < ?", now, maxReminderAttempts).
+			Where("status = ? OR (status = ? AND updated_at < ?)", ReminderFailed, ReminderSending, now.Add(-reminderStale)).
+			Limit(reminderBatch).Find(&claimed).Error; err != nil {
+			return err
+		}
+		for i := range claimed {
+			claimed[i].Status = ReminderSending
+			claimed[i].Attempts++
+			if err := tx.Save(&claimed[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range claimed {
+		rem := &claimed[i]
+		var a Appointment
+		if err := r.db.First(&a, rem.AppointmentID).Error; err != nil {
+			r.finish(rem, ReminderSkipped, "appointment not found")
+			continue
+		}
+		if !a.DateTime.Equal(rem.ScheduledFor) || !isUpcoming(a.Status) {
+			r.finish(rem, ReminderSkipped, "appointment was moved or cancelled")
+			continue
+		}
+		r.deliver(rem, &a)
+	}
+	return nil
+}
+
+// deliver sends a claimed reminder and records the outcome.
+func (r *reminders) deliver(rem *AppointmentReminder, a *Appointment) {
+	err := r.notifier.Send(notify.Notification{
+		UserID: a.PatientID,
+		Type:   "appointment",
+		Title:  "Appointment reminder",
+		Message: fmt.Sprintf("Reminder: you have an appointment on %s.",
+			a.DateTime.In(r.loc).Format("Mon 2 Jan 2006 15:04")),
+		Data:     fmt.Sprintf(`{"appointmentId":%d,"reminderMinutes":%d}`, a.ID, rem.OffsetMinutes),
+		Priority: notify.PriorityNormal,
+	})
+	if err != nil {
+		log.Printf("Failed to send reminder %d for appointment %d: %v", rem.ID, a.ID, err)
+		r.finish(rem, ReminderFailed, err.Error())
+		return
+	}
+	r.finish(rem, ReminderSent, "")
+}
+
+func (r *reminders) finish(rem *AppointmentReminder, status, reason string) {
+	updates := map[string]interface{}{"status": status, "last_error": reason}
+	if status == ReminderSent {
+		updates["sent_at"] = time.Now()
+	}
+	if err := r.db.Model(rem).Updates(updates).Error; err != nil {
+		log.Printf("Failed to record reminder %d as %s: %v", rem.ID, status, err)
+	}
+}
+
+func isUpcoming(status string) bool {
+	for _, s := range upcomingStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// list answers GET /api/appointments/:id/reminders.
+func (r *reminders) list(c *gin.Context) {
+	a, ok := loadAppointment(c, r.db, r.policies, policy.ActionRead)
+	if !ok {
+		return
+	}
+	var list []AppointmentReminder
+	if err := r.db.Where("appointment_id = ?", a.ID).Order("created_at").Find(&list).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch reminders"})
+		return
+	}
+	c.JSON(200, list)
+}
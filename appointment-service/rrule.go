@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxOccurrences caps how many appointments one series may create.
+	maxOccurrences = 104
+	// maxSeriesSpan caps how far after its first occurrence a series runs.
+	maxSeriesSpan = 366 * 24 * time.Hour
+)
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// byDay is one BYDAY entry: a weekday, with an ordinal such as 2 (second)
+// or -1 (last) in monthly rules.
+type byDay struct {
+	n       int
+	weekday time.Weekday
+}
+
+// rrule is the subset of an iCalendar (RFC 5545) RRULE that appointment
+// series use: FREQ=DAILY, WEEKLY or MONTHLY with INTERVAL, COUNT, UNTIL,
+// BYDAY and BYMONTHDAY. COUNT or UNTIL is required.
+type rrule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []byDay
+	byMonthDay []int
+}
+
+// parseRRule reads a rule such as "FREQ=WEEKLY;BYDAY=TU;COUNT=8". A
+// leading "RRULE:" is allowed.
+func parseRRule(s string) (*rrule, error) {
+	r := &rrule{interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rrule: malformed part %q", part)
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.freq = strings.ToUpper(value)
+			if r.freq != "DAILY" && r.freq != "WEEKLY" && r.freq != "MONTHLY" {
+				return nil, fmt.Errorf("rrule: unsupported FREQ %q", value)
+			}
+		case "INTERVAL":
+			if r.interval, err = strconv.Atoi(value); err != nil || r.interval < 1 {
+				return nil, fmt.Errorf("rrule: invalid INTERVAL %q", value)
+			}
+		case "COUNT":
+			if r.count, err = strconv.Atoi(value); err != nil || r.count < 1 {
+				return nil, fmt.Errorf("rrule: invalid COUNT %q", value)
+			}
+		case "UNTIL":
+			if r.until, err = parseUntil(value); err != nil {
+				return nil, err
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(strings.ToUpper(value), ",") {
+				bd, err := parseByDay(d)
+				if err != nil {
+					return nil, err
+				}
+				r.byDay = append(r.byDay, bd)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("rrule: invalid BYMONTHDAY %q", d)
+				}
+				r.byMonthDay = append(r.byMonthDay, n)
+			}
+		case "WKST":
+			// Weeks start on Monday; other values would only matter for
+			// INTERVAL>1 with several BYDAY entries.
+		default:
+			return nil, fmt.Errorf("rrule: unsupported part %q", key)
+		}
+	}
+
+	switch {
+	case r.freq == "":
+		return nil, errors.New("rrule: FREQ is required")
+	case r.count == 0 && r.until.IsZero():
+		return nil, errors.New("rrule: COUNT or UNTIL is required")
+	case r.count > 0 && !r.until.IsZero():
+		return nil, errors.New("rrule: COUNT and UNTIL are mutually exclusive")
+	case r.count > maxOccurrences:
+		return nil, fmt.Errorf("rrule: COUNT may not exceed %d", maxOccurrences)
+	case len(r.byMonthDay) > 0 && r.freq != "MONTHLY":
+		return nil, errors.New("rrule: BYMONTHDAY is only supported with FREQ=MONTHLY")
+	case len(r.byMonthDay) > 0 && len(r.byDay) > 0:
+		return nil, errors.New("rrule: BYDAY and BYMONTHDAY together are not supported")
+	}
+	for _, bd := range r.byDay {
+		if bd.n != 0 && r.freq != "MONTHLY" {
+			return nil, errors.New("rrule: BYDAY ordinals are only supported with FREQ=MONTHLY")
+		}
+	}
+	return r, nil
+}
+
+func parseUntil(v string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			if layout == "20060102" {
+				// A date includes the whole day
+				t = t.Add(24*time.Hour - time.Second)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("rrule: invalid UNTIL %q", v)
+}
+
+func parseByDay(v string) (byDay, error) {
+	if len(v) < 2 {
+		return byDay{}, fmt.Errorf("rrule: invalid BYDAY %q", v)
+	}
+	wd, ok := weekdays[v[len(v)-2:]]
+	if !ok {
+		return byDay{}, fmt.Errorf("rrule: invalid BYDAY %q", v)
+	}
+	bd := byDay{weekday: wd}
+	if prefix := v[:len(v)-2]; prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return byDay{}, fmt.Errorf("rrule: invalid BYDAY %q", v)
+		}
+		bd.n = n
+	}
+	return bd, nil
+}
+
+// expand lists the occurrences of r starting at start, laid out at start's
+// wall-clock time in loc so a series keeps its local time across DST
+// changes. start itself is included only if it matches the rule.
+func (r *rrule) expand(start time.Time, loc *time.Location) ([]time.Time, error) {
+	start = start.In(loc)
+	limit := start.Add(maxSeriesSpan)
+	if !r.until.IsZero() {
+		if r.until.After(limit) {
+			return nil, errors.New("rrule: series may not run longer than a year")
+		}
+		limit = r.until
+	}
+
+	var out []time.Time
+	// add reports whether expansion should go on
+	add := func(day time.Time) bool {
+		t := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, loc)
+		if t.Before(start) {
+			return true
+		}
+		if t.After(limit) {
+			return false
+		}
+		out = append(out, t)
+		return r.count == 0 || len(out) < r.count
+	}
+
+	first := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	switch r.freq {
+	case "DAILY":
+		for day := first; !day.After(limit); day = day.AddDate(0, 0, r.interval) {
+			if len(r.byDay) > 0 && !r.matchesWeekday(day.Weekday()) {
+				continue
+			}
+			if !add(day) {
+				break
+			}
+		}
+
+	case "WEEKLY":
+		days := r.byDay
+		if len(days) == 0 {
+			days = []byDay{{weekday: start.Weekday()}}
+		}
+		offsets := make([]int, 0, len(days))
+		for _, d := range days {
+			offsets = append(offsets, (int(d.weekday)+6)%7) // days after Monday
+		}
+		sort.Ints(offsets)
+		monday := first.AddDate(0, 0, -((int(first.Weekday()) + 6) % 7))
+	weeks:
+		for week := monday; !week.After(limit); week = week.AddDate(0, 0, 7*r.interval) {
+			for _, off := range offsets {
+				if !add(week.AddDate(0, 0, off)) {
+					break weeks
+				}
+			}
+		}
+
+	case "MONTHLY":
+		monthStart := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, loc)
+	months:
+		for month := monthStart; !month.After(limit); month = month.AddDate(0, r.interval, 0) {
+			for _, day := range r.monthDays(month, start.Day()) {
+				if !add(day) {
+					break months
+				}
+			}
+		}
+	}
+
+	switch {
+	case r.count > 0 && len(out) < r.count:
+		// COUNT was not reached within maxSeriesSpan
+		return nil, errors.New("rrule: series may not run longer than a year")
+	case len(out) > maxOccurrences:
+		return nil, fmt.Errorf("rrule: series may not have more than %d occurrences", maxOccurrences)
+	case len(out) == 0:
+		return nil, errors.New("rrule: rule has no occurrences")
+	}
+	return out, nil
+}
+
+func (r *rrule) matchesWeekday(wd time.Weekday) bool {
+	for _, d := range r.byDay {
+		if d.weekday == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// monthDays lists the days of month the rule selects, in order. Without
+// BYMONTHDAY or BYDAY it is the day of month of the first occurrence,
+// skipping months too short to have it.
+func (r *rrule) monthDays(month time.Time, startDay int) []time.Time {
+	last := month.AddDate(0, 1, -1).Day()
+	seen := map[int]bool{}
+
+	for _, n := range r.byMonthDay {
+		if n < 0 {
+			n = last + n + 1
+		}
+		if n >= 1 && n <= last {
+			seen[n] = true
+		}
+	}
+	for _, bd := range r.byDay {
+		for d := 1; d <= last; d++ {
+			if month.AddDate(0, 0, d-1).Weekday() != bd.weekday {
+				continue
+			}
+			nth := (d-1)/7 + 1           // 1 for the first such weekday
+			fromEnd := -((last-d)/7 + 1) // -1 for the last
+			if bd.n == 0 || bd.n == nth || bd.n == fromEnd {
+				seen[d] = true
+			}
+		}
+	}
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 && startDay <= last {
+		seen[startDay] = true
+	}
+
+	days := make([]int, 0, len(seen))
+	for d := range seen {
+		days = append(days, d)
+	}
+	sort.Ints(days)
+	out := make([]time.Time, 0, len(days))
+	for _, d := range days {
+		out = append(out, month.AddDate(0, 0, d-1))
+	}
+	return out
+}
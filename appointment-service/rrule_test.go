@@ -0,0 +1,233 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func newYork(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestExpand(t *testing.T) {
+	loc := newYork(t)
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name  string
+		rule  string
+		start string
+		want  []string
+	}{
+		{
+			name:  "weekly on the start's weekday",
+			rule:  "FREQ=WEEKLY;COUNT=3",
+			start: "2024-01-02 10:00",
+			want:  []string{"2024-01-02 10:00", "2024-01-09 10:00", "2024-01-16 10:00"},
+		},
+		{
+			name:  "RRULE prefix",
+			rule:  "RRULE:FREQ=WEEKLY;BYDAY=TU;COUNT=2",
+			start: "2024-01-02 10:00",
+			want:  []string{"2024-01-02 10:00", "2024-01-09 10:00"},
+		},
+		{
+			name:  "weekly on several days skips those before the start",
+			rule:  "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=4",
+			start: "2024-01-03 09:30",
+			want:  []string{"2024-01-03 09:30", "2024-01-08 09:30", "2024-01-10 09:30", "2024-01-15 09:30"},
+		},
+		{
+			name:  "start not matching the rule is left out",
+			rule:  "FREQ=WEEKLY;BYDAY=TH;COUNT=2",
+			start: "2024-01-02 08:00",
+			want:  []string{"2024-01-04 08:00", "2024-01-11 08:00"},
+		},
+		{
+			name:  "every other week",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=FR;COUNT=3",
+			start: "2024-01-05 16:00",
+			want:  []string{"2024-01-05 16:00", "2024-01-19 16:00", "2024-02-02 16:00"},
+		},
+		{
+			name:  "weekly keeps local time across the spring DST change",
+			rule:  "FREQ=WEEKLY;COUNT=3",
+			start: "2024-03-04 09:00",
+			want:  []string{"2024-03-04 09:00", "2024-03-11 09:00", "2024-03-18 09:00"},
+		},
+		{
+			name:  "daily keeps local time across the autumn DST change",
+			rule:  "FREQ=DAILY;COUNT=3",
+			start: "2024-11-02 09:00",
+			want:  []string{"2024-11-02 09:00", "2024-11-03 09:00", "2024-11-04 09:00"},
+		},
+		{
+			name:  "daily on weekdays",
+			rule:  "FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;COUNT=5",
+			start: "2024-01-05 11:00",
+			want:  []string{"2024-01-05 11:00", "2024-01-08 11:00", "2024-01-09 11:00", "2024-01-10 11:00", "2024-01-11 11:00"},
+		},
+		{
+			name:  "UNTIL date includes that day",
+			rule:  "FREQ=DAILY;INTERVAL=2;UNTIL=20240107",
+			start: "2024-01-01 18:00",
+			want:  []string{"2024-01-01 18:00", "2024-01-03 18:00", "2024-01-05 18:00", "2024-01-07 18:00"},
+		},
+		{
+			name:  "UNTIL time is exclusive of later occurrences",
+			rule:  "FREQ=WEEKLY;UNTIL=20240115T000000Z",
+			start: "2024-01-01 09:00",
+			want:  []string{"2024-01-01 09:00", "2024-01-08 09:00"},
+		},
+		{
+			name:  "monthly on the second Tuesday",
+			rule:  "FREQ=MONTHLY;BYDAY=2TU;COUNT=3",
+			start: "2024-01-09 14:00",
+			want:  []string{"2024-01-09 14:00", "2024-02-13 14:00", "2024-03-12 14:00"},
+		},
+		{
+			name:  "monthly on the last Friday",
+			rule:  "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			start: "2024-01-26 14:00",
+			want:  []string{"2024-01-26 14:00", "2024-02-23 14:00", "2024-03-29 14:00"},
+		},
+		{
+			name:  "monthly on the last day",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=4",
+			start: "2024-01-31 10:00",
+			want:  []string{"2024-01-31 10:00", "2024-02-29 10:00", "2024-03-31 10:00", "2024-04-30 10:00"},
+		},
+		{
+			name:  "monthly on several days",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=15,1;COUNT=3",
+			start: "2024-01-10 10:00",
+			want:  []string{"2024-01-15 10:00", "2024-02-01 10:00", "2024-02-15 10:00"},
+		},
+		{
+			name:  "monthly on the 31st skips short months",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			start: "2024-01-31 10:00",
+			want:  []string{"2024-01-31 10:00", "2024-03-31 10:00", "2024-05-31 10:00"},
+		},
+		{
+			name:  "BYMONTHDAY=31 skips short months",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=31;COUNT=2",
+			start: "2024-03-01 10:00",
+			want:  []string{"2024-03-31 10:00", "2024-05-31 10:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRRule(tt.rule)
+			if err != nil {
+				t.Fatalf("parseRRule(%q): %v", tt.rule, err)
+			}
+			got, err := r.expand(at(tt.start), loc)
+			if err != nil {
+				t.Fatalf("expand: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d occurrences %v, want %d", len(got), got, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !got[i].Equal(at(w)) {
+					t.Errorf("occurrence %d = %v, want %s", i, got[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandDSTOffset(t *testing.T) {
+	loc := newYork(t)
+	r, err := parseRRule("FREQ=WEEKLY;COUNT=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.expand(time.Date(2024, 3, 4, 9, 0, 0, 0, loc), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 09:00 EST is 14:00 UTC; a week later 09:00 EDT is 13:00 UTC
+	if h := got[0].UTC().Hour(); h != 14 {
+		t.Errorf("first occurrence at %d:00 UTC, want 14:00", h)
+	}
+	if h := got[1].UTC().Hour(); h != 13 {
+		t.Errorf("second occurrence at %d:00 UTC, want 13:00", h)
+	}
+}
+
+func TestExpandLimits(t *testing.T) {
+	loc := newYork(t)
+	start := time.Date(2024, 1, 10, 9, 0, 0, 0, loc)
+
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{"UNTIL more than a year out", "FREQ=WEEKLY;UNTIL=20260101", "longer than a year"},
+		{"COUNT not reached within a year", "FREQ=WEEKLY;INTERVAL=4;COUNT=20", "longer than a year"},
+		{"too many occurrences before UNTIL", "FREQ=DAILY;UNTIL=20240601", "more than 104"},
+		{"UNTIL before the start", "FREQ=DAILY;UNTIL=20240105", "no occurrences"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRRule(tt.rule)
+			if err != nil {
+				t.Fatalf("parseRRule(%q): %v", tt.rule, err)
+			}
+			_, err = r.expand(start, loc)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expand: got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRRuleErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"COUNT=3", "FREQ is required"},
+		{"FREQ=WEEKLY", "COUNT or UNTIL is required"},
+		{"FREQ=WEEKLY;COUNT=3;UNTIL=20240101", "mutually exclusive"},
+		{"FREQ=WEEKLY;COUNT=105", "may not exceed"},
+		{"FREQ=YEARLY;COUNT=3", "unsupported FREQ"},
+		{"FREQ=WEEKLY;INTERVAL=0;COUNT=3", "invalid INTERVAL"},
+		{"FREQ=WEEKLY;COUNT=0", "invalid COUNT"},
+		{"FREQ=WEEKLY;UNTIL=tomorrow", "invalid UNTIL"},
+		{"FREQ=WEEKLY;BYDAY=XX;COUNT=3", "invalid BYDAY"},
+		{"FREQ=MONTHLY;BYDAY=6MO;COUNT=3", "invalid BYDAY"},
+		{"FREQ=WEEKLY;BYDAY=2MO;COUNT=3", "ordinals are only supported"},
+		{"FREQ=MONTHLY;BYMONTHDAY=0;COUNT=3", "invalid BYMONTHDAY"},
+		{"FREQ=MONTHLY;BYMONTHDAY=32;COUNT=3", "invalid BYMONTHDAY"},
+		{"FREQ=WEEKLY;BYMONTHDAY=1;COUNT=3", "only supported with FREQ=MONTHLY"},
+		{"FREQ=MONTHLY;BYMONTHDAY=1;BYDAY=MO;COUNT=3", "together are not supported"},
+		{"FREQ=WEEKLY;BYHOUR=9;COUNT=3", "unsupported part"},
+		{"FREQ=WEEKLY;COUNT", "malformed part"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			_, err := parseRRule(tt.rule)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseRRule(%q): got error %v, want one containing %q", tt.rule, err, tt.want)
+			}
+		})
+	}
+}
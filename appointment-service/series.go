@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AppointmentSeries is a recurring booking. Its occurrences are stored as
+// ordinary appointments pointing back at it, so each one can be moved or
+// cancelled on its own.
+type AppointmentSeries struct {
+	gorm.Model
+	PatientID uint      `gorm:"not null;index"`
+	DoctorID  uint      `gorm:"not null"`
+	RRule     string    `gorm:"not null"`
+	DTStart   time.Time `gorm:"not null"`
+	Timezone  string    // the zone the rule was expanded in
+}
+
+// errSeriesConflict rolls back a series change when an occurrence overlaps
+// another booking.
+var errSeriesConflict = errors.New("series occurrence conflicts with another appointment")
+
+// occurrenceConflict is an occurrence the overlap constraint rejected.
+type occurrenceConflict struct {
+	Start         time.Time `json:"start"`
+	NextFreeSlots []Slot    `json:"nextFreeSlots,omitempty"`
+}
+
+type series struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	loc      *time.Location
+	finder   *slotFinder
+	booking  *noShows
+}
+
+func newSeries(db *gorm.DB, policies *policy.Policy, loc *time.Location, finder *slotFinder, booking *noShows) *series {
+	return &series{db: db, policies: policies, loc: loc, finder: finder, booking: booking}
+}
+
+// create books every occurrence of rule, starting at a.DateTime. Either all
+// occurrences are booked or none; the 409 lists every one that clashed.
+func (s *series) create(c *gin.Context, a *Appointment, rule string) {
+	r, err := parseRRule(rule)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	starts, err := r.expand(a.DateTime, s.loc)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	rec := AppointmentSeries{
+		PatientID: a.PatientID,
+		DoctorID:  a.DoctorID,
+		RRule:     rule,
+		DTStart:   a.DateTime,
+		Timezone:  s.loc.String(),
+	}
+	by := actorFrom(c)
+	occurrences := make([]Appointment, len(starts))
+	var conflicts []*Appointment
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&rec).Error; err != nil {
+			return err
+		}
+		for i, start := range starts {
+			start := start
+			occ := *a
+			occ.Model = gorm.Model{}
+			occ.DateTime = start
+			occ.SeriesID = &rec.ID
+			occ.RecurrenceID = &start
+			occurrences[i] = occ
+			err := s.save(tx, &occurrences[i], &conflicts, func(sp *gorm.DB) error {
+				return sp.Create(&occurrences[i]).Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(conflicts) > 0 {
+			return errSeriesConflict
+		}
+		for i := range occurrences {
+			if err := recordBooked(tx, &occurrences[i], by); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errSeriesConflict) {
+		s.respondConflicts(c, conflicts)
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to create appointment series"})
+		return
+	}
+
+	c.JSON(201, gin.H{"series": rec, "appointments": occurrences})
+}
+
+// SeriesEdit changes this and the following occurrences. A new DateTime
+// moves them by the same number of days and to its local time of day; each
+// moved occurrence is rescheduled as /reschedule would, with Reason.
+type SeriesEdit struct {
+	DateTime *time.Time
+	Duration *int
+	Type     *string
+	Notes    *string
+	Location *string
+	Reason   string
+}
+
+// editFollowing answers PUT /api/appointments/:id/following.
+func (s *series) editFollowing(c *gin.Context) {
+	first, following, ok := s.following(c)
+	if !ok {
+		return
+	}
+
+	var input SeriesEdit
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Duration != nil && !checkDuration(c, *input.Duration) {
+		return
+	}
+
+	by := actorFrom(c)
+	var status string
+	var dayShift int
+	var clock time.Time
+	// Moving later is applied from the last occurrence back, so no
+	// occurrence lands on a sibling that has not moved yet
+	later := false
+	if input.DateTime != nil {
+		var err error
+		if status, err = s.booking.initialStatus(by, first.PatientID); err != nil {
+			respondBookingError(c, err)
+			return
+		}
+		clock = input.DateTime.In(s.loc)
+		dayShift = civilDays(first.DateTime.In(s.loc), clock)
+		later = input.DateTime.After(first.DateTime)
+	}
+
+	// updated holds each occurrence as it is after the edit: the
+	// replacement of a moved one, or the same one with new details
+	updated := make([]Appointment, len(following))
+	var conflicts []*Appointment
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for n := range following {
+			i := n
+			if later {
+				i = len(following) - 1 - n
+			}
+			occ, next := &following[i], &updated[i]
+			*next = *occ
+			if input.DateTime != nil {
+				t := occ.DateTime.In(s.loc)
+				*next = replacement(occ, time.Date(t.Year(), t.Month(), t.Day()+dayShift, clock.Hour(), clock.Minute(), clock.Second(), 0, s.loc), status)
+			}
+			if input.Duration != nil {
+				next.Duration = *input.Duration
+			}
+			for _, f := range []struct{ dst, src *string }{
+				{&next.Type, input.Type},
+				{&next.Notes, input.Notes},
+				{&next.Location, input.Location},
+			} {
+				if f.src != nil {
+					*f.dst = *f.src
+				}
+			}
+
+			err := s.save(tx, next, &conflicts, func(sp *gorm.DB) error {
+				if input.DateTime != nil {
+					return rebook(sp, occ, next, by, input.Reason)
+				}
+				return updateDetails(sp, next)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(conflicts) > 0 {
+			return errSeriesConflict
+		}
+		return nil
+	})
+	if errors.Is(err, errSeriesConflict) {
+		s.respondConflicts(c, conflicts)
+		return
+	}
+	if err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+
+	c.JSON(200, updated)
+}
+
+// cancelFollowing cancels this and the following occurrences. The body,
+// with an optional Reason, may be left out.
+func (s *series) cancelFollowing(c *gin.Context) {
+	_, following, ok := s.following(c)
+	if !ok {
+		return
+	}
+	var input struct{ Reason string }
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	by := actorFrom(c)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for i := range following {
+			if err := transition(tx, &following[i], StatusCancelled, by, input.Reason); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+
+	c.JSON(200, following)
+}
+
+// get answers GET /api/appointments/series/:id with the series and all its
+// occurrences.
+func (s *series) get(c *gin.Context) {
+	var rec AppointmentSeries
+	if err := s.db.First(&rec, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Series not found"})
+		return
+	}
+	if !s.policies.Authorize(c, policy.ResourceAppointments, policy.ActionRead, rec.PatientID) {
+		return
+	}
+
+	var occurrences []Appointment
+	if err := s.db.Where("series_id = ?", rec.ID).Order("date_time").Find(&occurrences).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch appointments"})
+		return
+	}
+
+	c.JSON(200, gin.H{"series": rec, "appointments": occurrences})
+}
+
+// following loads the occurrence named by :id and the ones after it in its
+// series that are still upcoming (requested or confirmed).
+func (s *series) following(c *gin.Context) (*Appointment, []Appointment, bool) {
+	var first Appointment
+	if err := s.db.First(&first, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Appointment not found"})
+		return nil, nil, false
+	}
+	if !authorizeAppointment(c, s.policies, policy.ActionWrite, &first) {
+		return nil, nil, false
+	}
+	if first.SeriesID == nil {
+		c.JSON(400, gin.H{"error": "Appointment is not part of a series"})
+		return nil, nil, false
+	}
+
+	var following []Appointment
+	if err := s.db.Where("series_id = ? AND date_time >= ? AND status IN ?", *first.SeriesID, first.DateTime, upcomingStatuses).
+		Order("date_time").Find(&following).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch appointments"})
+		return nil, nil, false
+	}
+	return &first, following, true
+}
+
+// save runs write for one occurrence inside a savepoint, so an overlap or
+// a held slot is noted in conflicts and the rest can still be checked.
+func (s *series) save(tx *gorm.DB, occ *Appointment, conflicts *[]*Appointment, write func(sp *gorm.DB) error) error {
+	err := tx.Transaction(write)
+	if isSlotTaken(err) {
+		*conflicts = append(*conflicts, occ)
+		return nil
+	}
+	return err
+}
+
+func (s *series) respondConflicts(c *gin.Context, conflicts []*Appointment) {
+	list := make([]occurrenceConflict, 0, len(conflicts))
+	for _, occ := range conflicts {
+		oc := occurrenceConflict{Start: occ.DateTime}
+		if slots, err := s.finder.next(occ); err == nil {
+			oc.NextFreeSlots = slots
+		}
+		list = append(list, oc)
+	}
+	c.JSON(409, gin.H{
+		"error":     "Some occurrences clash with the doctor's other appointments",
+		"conflicts": list,
+	})
+}
+
+// civilDays is the number of calendar days from a's date to b's.
+func civilDays(a, b time.Time) int {
+	da := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	db := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(db.Sub(da).Hours() / 24)
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"healthcare/shared/auth"
+	"healthcare/shared/policy"
+	"healthcare/shared/video"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Join tokens are issued, and valid, from telehealthEarlyJoin before
+	// the appointment until telehealthLateJoin after its end.
+	telehealthEarlyJoin = 15 * time.Minute
+	telehealthLateJoin  = 30 * time.Minute
+)
+
+// Participant events, reported by the client or the video provider.
+const (
+	ParticipantJoined = "joined"
+	ParticipantLeft   = "left"
+)
+
+// joinableStatuses are the states in which a virtual appointment's room
+// can be joined.
+var joinableStatuses = []string{StatusConfirmed, StatusInProgress}
+
+// sessionEndEvents close the room of an appointment that is over.
+var sessionEndEvents = []string{StatusCompleted, StatusNoShow, StatusCancelled, StatusRescheduled}
+
+var (
+	errNoSession    = errors.New("appointment has no telehealth session")
+	errSessionEnded = errors.New("telehealth session has ended")
+	errNotInSession = errors.New("user is neither the doctor nor the patient")
+)
+
+// TelehealthSession is the video room of a virtual appointment. It is
+// opened when the appointment is booked, or on the first join if that
+// failed, and summarized when it ends.
+type TelehealthSession struct {
+	gorm.Model
+	AppointmentID uint   `gorm:"not null;uniqueIndex"`
+	RoomID        string `gorm:"size:64;not null;uniqueIndex"`
+	Provider      string `gorm:"size:20;not null"`
+	URL           string
+	StartedAt     *time.Time // first join
+	EndedAt       *time.Time
+	// The summary, filled in when the session ends
+	Summary         string                  // the host's closing note
+	DurationMinutes int                     // from the first join to the end
+	PatientMinutes  int                     // time the patient was connected
+	Participants    []TelehealthParticipant `gorm:"foreignKey:SessionID"`
+}
+
+// TelehealthParticipant is one connection to a session, from join to
+// leave.
+type TelehealthParticipant struct {
+	ID        uint      `gorm:"primarykey"`
+	SessionID uint      `gorm:"not null;index"`
+	UserID    uint      `gorm:"not null"`
+	Role      string    `gorm:"size:20;not null"` // video.RoleHost or video.RoleParticipant
+	JoinedAt  time.Time `gorm:"not null"`
+	LeftAt    *time.Time
+}
+
+type telehealth struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	provider video.Provider
+}
+
+func newTelehealth(db *gorm.DB, policies *policy.Policy, provider video.Provider) *telehealth {
+	return &telehealth{db: db, policies: policies, provider: provider}
+}
+
+// joinWindow is when the room of a may be joined.
+func joinWindow(a *Appointment) (opens, closes time.Time) {
+	return a.DateTime.Add(-telehealthEarlyJoin), a.EndTime.Add(telehealthLateJoin)
+}
+
+// roleOf returns the room role of userID: host for the appointment's
+// doctor, participant for its patient.
+func (t *telehealth) roleOf(a *Appointment, userID uint) (string, error) {
+	if userID == a.PatientID {
+		return video.RoleParticipant, nil
+	}
+	doctorID, err := t.policies.DoctorIDFor(userID)
+	if err != nil {
+		return "", err
+	}
+	if doctorID != 0 && doctorID == a.DoctorID {
+		return video.RoleHost, nil
+	}
+	return "", errNotInSession
+}
+
+// session returns the session of a, opening a room for it if it has none.
+func (t *telehealth) session(a *Appointment) (*TelehealthSession, error) {
+	var s TelehealthSession
+	err := t.db.Where("appointment_id = ?", a.ID).First(&s).Error
+	if err == nil || !errors.Is(err, gorm.ErrRecordNotFound) {
+		return &s, err
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	roomID := hex.EncodeToString(raw)
+	url, err := t.provider.CreateRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	s = TelehealthSession{AppointmentID: a.ID, RoomID: roomID, Provider: t.provider.Name(), URL: url}
+	created := false
+	err = t.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&s)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		created = true
+		// The link changes the appointment's calendar event
+		return tx.Model(&Appointment{}).Where("id = ?", a.ID).
+			Updates(map[string]interface{}{"meeting_link": url, "sequence": gorm.Expr("sequence + 1")}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		// Another request opened one first
+		if err := t.provider.CloseRoom(roomID); err != nil {
+			log.Printf("Failed to close unused room %s: %v", roomID, err)
+		}
+		s = TelehealthSession{}
+		err = t.db.Where("appointment_id = ?", a.ID).First(&s).Error
+		return &s, err
+	}
+	a.MeetingLink = url
+	a.Sequence++
+	return &s, nil
+}
+
+// get answers GET /api/appointments/:id/telehealth with the session, its
+// connections and, once it has ended, its summary.
+func (t *telehealth) get(c *gin.Context) {
+	a, ok := loadAppointment(c, t.db, t.policies, policy.ActionRead)
+	if !ok {
+		return
+	}
+	var s TelehealthSession
+	err := t.db.Preload("Participants", func(db *gorm.DB) *gorm.DB { return db.Order("joined_at") }).
+		Where("appointment_id = ?", a.ID).First(&s).Error
+	if err != nil {
+		c.JSON(404, gin.H{"error": errNoSession.Error()})
+		return
+	}
+	c.JSON(200, s)
+}
+
+// join answers POST /api/appointments/:id/telehealth/join with a token for
+// the room. Only the appointment's doctor, as host, and its patient can
+// join, and only around the appointment time.
+func (t *telehealth) join(c *gin.Context) {
+	a, ok := loadAppointment(c, t.db, t.policies, policy.ActionRead)
+	if !ok {
+		return
+	}
+	if !a.Virtual {
+		c.JSON(409, gin.H{"error": "Appointment is not virtual"})
+		return
+	}
+	role, err := t.roleOf(a, auth.UserID(c))
+	if err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	if !isJoinable(a.Status) {
+		c.JSON(409, gin.H{"error": "Appointment is " + a.Status})
+		return
+	}
+	opens, closes := joinWindow(a)
+	now := time.Now()
+	if now.Before(opens) {
+		c.JSON(409, gin.H{"error": "The session has not opened yet", "opensAt": opens})
+		return
+	}
+	if !now.Before(closes) {
+		c.JSON(409, gin.H{"error": "The session has closed"})
+		return
+	}
+
+	s, err := t.session(a)
+	if err != nil {
+		log.Printf("Failed to open telehealth session for appointment %d: %v", a.ID, err)
+		c.JSON(502, gin.H{"error": "Failed to open session"})
+		return
+	}
+	if s.EndedAt != nil {
+		respondSessionError(c, errSessionEnded)
+		return
+	}
+	token, err := t.provider.JoinToken(video.Grant{
+		RoomID:    s.RoomID,
+		Identity:  strconv.FormatUint(uint64(auth.UserID(c)), 10),
+		Role:      role,
+		NotBefore: opens,
+		Expires:   closes,
+	})
+	if err != nil {
+		log.Printf("Failed to sign join token for room %s: %v", s.RoomID, err)
+		c.JSON(502, gin.H{"error": "Failed to open session"})
+		return
+	}
+	c.JSON(200, gin.H{"session": s, "role": role, "token": token, "expiresAt": closes})
+}
+
+// ParticipantInput is the body of POST /api/appointments/:id/telehealth/events.
+type ParticipantInput struct {
+	Event string `binding:"required,oneof=joined left"`
+}
+
+// report answers POST /api/appointments/:id/telehealth/events: the client
+// reports that its user joined or left.
+func (t *telehealth) report(c *gin.Context) {
+	a, ok := loadAppointment(c, t.db, t.policies, policy.ActionRead)
+	if !ok {
+		return
+	}
+	var input ParticipantInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var s TelehealthSession
+	if err := t.db.Where("appointment_id = ?", a.ID).First(&s).Error; err != nil {
+		respondSessionError(c, errNoSession)
+		return
+	}
+	if err := t.record(&s, a, auth.UserID(c), input.Event, time.Now()); err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Recorded"})
+}
+
+// ProviderEvent is the body of POST /internal/telehealth/events, sent by
+// the video provider.
+type ProviderEvent struct {
+	RoomID string `binding:"required"`
+	UserID uint   `binding:"required"`
+	Event  string `binding:"required,oneof=joined left"`
+	At     time.Time
+}
+
+// providerEvent answers POST /internal/telehealth/events.
+func (t *telehealth) providerEvent(c *gin.Context) {
+	var input ProviderEvent
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if input.At.IsZero() {
+		input.At = time.Now()
+	}
+	var s TelehealthSession
+	if err := t.db.Where("room_id = ?", input.RoomID).First(&s).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Room not found"})
+		return
+	}
+	var a Appointment
+	if err := t.db.First(&a, s.AppointmentID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Appointment not found"})
+		return
+	}
+	if err := t.record(&s, &a, input.UserID, input.Event, input.At); err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Recorded"})
+}
+
+// record logs a join or leave. Leaving closes all of the user's open
+// connections.
+func (t *telehealth) record(s *TelehealthSession, a *Appointment, userID uint, event string, at time.Time) error {
+	if s.EndedAt != nil {
+		return errSessionEnded
+	}
+	role, err := t.roleOf(a, userID)
+	if err != nil {
+		return err
+	}
+	if event == ParticipantLeft {
+		return t.db.Model(&TelehealthParticipant{}).
+			Where("session_id = ? AND user_id = ? AND left_at IS NULL", s.ID, userID).
+			Update("left_at", at).Error
+	}
+	return t.db.Transaction(func(tx *gorm.DB) error {
+		p := TelehealthParticipant{SessionID: s.ID, UserID: userID, Role: role, JoinedAt: at}
+		if err := tx.Create(&p).Error; err != nil {
+			return err
+		}
+		return tx.Model(&TelehealthSession{}).Where("id = ? AND started_at IS NULL", s.ID).
+			Update("started_at", at).Error
+	})
+}
+
+// EndInput is the body of POST /api/appointments/:id/telehealth/end.
+type EndInput struct {
+	Summary string
+}
+
+// end answers POST /api/appointments/:id/telehealth/end: the host, or an
+// admin, closes the room and attaches a summary.
+func (t *telehealth) end(c *gin.Context) {
+	a, ok := loadAppointment(c, t.db, t.policies, policy.ActionWrite)
+	if !ok {
+		return
+	}
+	if auth.Role(c) != auth.RoleAdmin {
+		if role, err := t.roleOf(a, auth.UserID(c)); err != nil || role != video.RoleHost {
+			c.JSON(403, gin.H{"error": "Only the host can end the session"})
+			return
+		}
+	}
+	var input EndInput
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	var s TelehealthSession
+	if err := t.db.Where("appointment_id = ?", a.ID).First(&s).Error; err != nil {
+		respondSessionError(c, errNoSession)
+		return
+	}
+	if err := t.close(&s, input.Summary); err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	t.get(c)
+}
+
+// close closes the room, ends the open connections and writes the
+// summary.
+func (t *telehealth) close(s *TelehealthSession, summary string) error {
+	if s.EndedAt != nil {
+		return errSessionEnded
+	}
+	if err := t.provider.CloseRoom(s.RoomID); err != nil {
+		return err
+	}
+	now := time.Now()
+	return t.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&TelehealthParticipant{}).Where("session_id = ? AND left_at IS NULL", s.ID).
+			Update("left_at", now).Error; err != nil {
+			return err
+		}
+		var connections []TelehealthParticipant
+		if err := tx.Where("session_id = ? AND role = ?", s.ID, video.RoleParticipant).
+			Order("joined_at").Find(&connections).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{
+			"ended_at":        now,
+			"summary":         summary,
+			"patient_minutes": int(connected(connections) / time.Minute),
+		}
+		if s.StartedAt != nil {
+			updates["duration_minutes"] = int(now.Sub(*s.StartedAt) / time.Minute)
+		}
+		res := tx.Model(&TelehealthSession{}).Where("id = ? AND ended_at IS NULL", s.ID).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errSessionEnded
+		}
+		return nil
+	})
+}
+
+// connected is the time covered by closed connections, counting overlaps
+// (e.g. two devices) once. connections are ordered by JoinedAt.
+func connected(connections []TelehealthParticipant) time.Duration {
+	var total time.Duration
+	var start, end time.Time
+	for _, p := range connections {
+		if p.LeftAt == nil {
+			continue
+		}
+		if p.JoinedAt.After(end) {
+			total += end.Sub(start)
+			start, end = p.JoinedAt, *p.LeftAt
+		} else if p.LeftAt.After(end) {
+			end = *p.LeftAt
+		}
+	}
+	return total + end.Sub(start)
+}
+
+// booked opens the room of a newly booked virtual appointment, so its
+// link is in the patient's calendar ahead of time.
+func (t *telehealth) booked(e DomainEvent) error {
+	if e.From != "" {
+		return nil
+	}
+	var a Appointment
+	if err := t.db.First(&a, e.AppointmentID).Error; err != nil {
+		return err
+	}
+	if !a.Virtual {
+		return nil
+	}
+	_, err := t.session(&a)
+	return err
+}
+
+// over closes the room when its appointment is completed, missed,
+// cancelled or moved. A host's summary written before then is kept.
+func (t *telehealth) over(e DomainEvent) error {
+	var s TelehealthSession
+	err := t.db.Where("appointment_id = ? AND ended_at IS NULL", e.AppointmentID).First(&s).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.close(&s, ""); err != nil && !errors.Is(err, errSessionEnded) {
+		return err
+	}
+	return nil
+}
+
+// respondSessionError maps a failed session operation to a response.
+func respondSessionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNotInSession):
+		c.JSON(403, gin.H{"error": "Only the appointment's doctor and patient can join"})
+	case errors.Is(err, errNoSession):
+		c.JSON(404, gin.H{"error": err.Error()})
+	case errors.Is(err, errSessionEnded):
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Telehealth session error: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to update session"})
+	}
+}
+
+// migrateTelehealth marks appointments booked with a hand-written meeting
+// link as virtual.
+func migrateTelehealth(db *gorm.DB) error {
+	return db.Exec(`UPDATE appointments SET virtual = true
+		WHERE NOT virtual AND meeting_link <> '' AND COALESCE(location, '') = ''`).Error
+}
+
+func isJoinable(status string) bool {
+	for _, s := range joinableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/notify"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Waitlist entry states.
+const (
+	WaitlistWaiting   = "waiting"
+	WaitlistOffered   = "offered"
+	WaitlistBooked    = "booked"
+	WaitlistWithdrawn = "withdrawn"
+)
+
+// Offer states.
+const (
+	OfferPending  = "pending"
+	OfferAccepted = "accepted"
+	OfferDeclined = "declined"
+	OfferExpired  = "expired"
+)
+
+const (
+	defaultWaitlistHold   = 15 * time.Minute
+	waitlistSweepInterval = time.Minute
+	maxWaitlistWindows    = 10
+)
+
+// errSlotHeld rejects a booking in a slot held for a waitlisted patient.
+var errSlotHeld = errors.New("slot is held for a waitlisted patient")
+
+// WaitlistEntry is a patient waiting for an earlier slot with one doctor,
+// or with any doctor of a specialization when DoctorID is nil.
+type WaitlistEntry struct {
+	gorm.Model
+	PatientID      uint  `gorm:"not null;index"`
+	DoctorID       *uint `gorm:"index"`
+	Specialization string
+	Type           string
+	Notes          string
+	// Priority orders offers, highest first, then by when the entry was
+	// made. Only staff set it.
+	Priority int
+	Status   string           `gorm:"default:'waiting';index"`
+	Windows  []WaitlistWindow `gorm:"foreignKey:EntryID"`
+	Offers   []WaitlistOffer  `gorm:"foreignKey:EntryID"`
+}
+
+// WaitlistWindow is a time the patient could come in. An entry without
+// windows takes any slot.
+type WaitlistWindow struct {
+	ID       uint      `gorm:"primarykey"`
+	EntryID  uint      `gorm:"not null;index"`
+	StartsAt time.Time `gorm:"not null"`
+	EndsAt   time.Time `gorm:"not null"`
+}
+
+// WaitlistOffer holds a freed slot for one waitlisted patient until
+// ExpiresAt. While it is pending nobody else can book the slot.
+type WaitlistOffer struct {
+	gorm.Model
+	EntryID   uint      `gorm:"not null;index"`
+	PatientID uint      `gorm:"not null;index"`
+	DoctorID  uint      `gorm:"not null"`
+	StartsAt  time.Time `gorm:"not null"`
+	EndsAt    time.Time `gorm:"not null"`
+	// FreedByID is the cancelled or rescheduled appointment that opened
+	// the slot
+	FreedByID     uint   `gorm:"not null;index"`
+	Status        string `gorm:"default:'pending';index"`
+	ExpiresAt     time.Time
+	AppointmentID *uint
+}
+
+// BeforeCreate refuses a booking that overlaps a slot held for another
+// patient.
+func (a *Appointment) BeforeCreate(tx *gorm.DB) error {
+	return a.checkHold(tx)
+}
+
+// checkHold refuses a's time if it overlaps a slot held for another
+// patient. Updates that change the time or length call it themselves;
+// see updateDetails. Unlike the overlap constraint this is not enforced by
+// Postgres, so it narrows but does not close the race with a concurrent
+// offer.
+func (a *Appointment) checkHold(tx *gorm.DB) error {
+	var held int64
+	err := tx.Session(&gorm.Session{NewDB: true}).Model(&WaitlistOffer{}).
+		Where("doctor_id = ? AND patient_id <> ? AND status = ? AND expires_at > ? AND starts_at < ? AND ends_at > ?",
+			a.DoctorID, a.PatientID, OfferPending, time.Now(), a.EndTime, a.DateTime).
+		Count(&held).Error
+	if err != nil {
+		return err
+	}
+	if held > 0 {
+		return errSlotHeld
+	}
+	return nil
+}
+
+// isSlotTaken reports whether a booking failed because its time is booked
+// or held.
+func isSlotTaken(err error) bool {
+	return isOverlap(err) || errors.Is(err, errSlotHeld)
+}
+
+// respondTaken answers a booking that failed because its time is booked or
+// held.
+func respondTaken(c *gin.Context, finder *slotFinder, a *Appointment, err error) {
+	if !errors.Is(err, errSlotHeld) {
+		respondConflict(c, finder, a)
+		return
+	}
+	response := gin.H{"error": "That time is held for a waitlisted patient"}
+	if slots, err := finder.next(a); err == nil {
+		response["nextFreeSlots"] = slots
+	}
+	c.JSON(409, response)
+}
+
+type waitlist struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	notifier *notify.Client
+	loc      *time.Location
+	hold     time.Duration
+	booking  *noShows
+}
+
+func newWaitlist(db *gorm.DB, policies *policy.Policy, notifier *notify.Client, loc *time.Location, booking *noShows) *waitlist {
+	hold := defaultWaitlistHold
+	if v := os.Getenv("WAITLIST_HOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid WAITLIST_HOLD:", v)
+		}
+		hold = d
+	}
+	return &waitlist{db: db, policies: policies, notifier: notifier, loc: loc, hold: hold, booking: booking}
+}
+
+// WaitlistInput is the body of POST /api/waitlist.
+type WaitlistInput struct {
+	PatientID      uint `binding:"required"`
+	DoctorID       *uint
+	Specialization string
+	Type           string
+	Notes          string
+	Priority       int
+	Windows        []struct {
+		StartsAt time.Time `binding:"required"`
+		EndsAt   time.Time `binding:"required"`
+	} `binding:"dive"`
+}
+
+// join answers POST /api/waitlist.
+func (w *waitlist) join(c *gin.Context) {
+	var input WaitlistInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !w.policies.Authorize(c, policy.ResourceAppointments, policy.ActionWrite, input.PatientID) {
+		return
+	}
+	if (input.DoctorID == nil) == (input.Specialization == "") {
+		c.JSON(400, gin.H{"error": "Give either DoctorID or Specialization"})
+		return
+	}
+	if len(input.Windows) > maxWaitlistWindows {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("At most %d windows are allowed", maxWaitlistWindows)})
+		return
+	}
+	if _, err := w.booking.initialStatus(actorFrom(c), input.PatientID); err != nil {
+		respondBookingError(c, err)
+		return
+	}
+	if input.DoctorID != nil {
+		var count int64
+		if err := w.db.Table("doctors").Where("id = ? AND deleted_at IS NULL", *input.DoctorID).Count(&count).Error; err != nil || count == 0 {
+			c.JSON(400, gin.H{"error": "Doctor not found"})
+			return
+		}
+	}
+
+	entry := WaitlistEntry{
+		PatientID:      input.PatientID,
+		DoctorID:       input.DoctorID,
+		Specialization: input.Specialization,
+		Type:           input.Type,
+		Notes:          input.Notes,
+		Status:         WaitlistWaiting,
+	}
+	if auth.Role(c) != auth.RolePatient {
+		entry.Priority = input.Priority
+	}
+	for _, win := range input.Windows {
+		if !win.EndsAt.After(win.StartsAt) {
+			c.JSON(400, gin.H{"error": "Each window must end after it starts"})
+			return
+		}
+		entry.Windows = append(entry.Windows, WaitlistWindow{StartsAt: win.StartsAt, EndsAt: win.EndsAt})
+	}
+
+	if err := w.db.Create(&entry).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to join waitlist"})
+		return
+	}
+	c.JSON(201, entry)
+}
+
+// forPatient answers GET /api/waitlist/patient/:patientId.
+func (w *waitlist) forPatient(c *gin.Context) {
+	var entries []WaitlistEntry
+	if err := w.db.Preload("Windows").Preload("Offers").
+		Where("patient_id = ?", c.Param("patientId")).Order("created_at").Find(&entries).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch waitlist"})
+		return
+	}
+	c.JSON(200, entries)
+}
+
+// forDoctor answers GET /api/waitlist/doctor/:doctorId with the open
+// entries for the doctor or their specialization, in offer order.
+func (w *waitlist) forDoctor(c *gin.Context) {
+	specialization, err := w.specialization(c.Param("doctorId"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch waitlist"})
+		return
+	}
+	var entries []WaitlistEntry
+	if err := w.db.Preload("Windows").
+		Where("status IN ? AND (doctor_id = ? OR (doctor_id IS NULL AND specialization = ? AND specialization <> ''))",
+			[]string{WaitlistWaiting, WaitlistOffered}, c.Param("doctorId"), specialization).
+		Order("priority DESC, created_at").Find(&entries).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch waitlist"})
+		return
+	}
+	for _, e := range entries {
+		audit.SetPatients(c, e.PatientID)
+	}
+	c.JSON(200, entries)
+}
+
+// load fetches the entry named by :id and authorizes a write on it.
+func (w *waitlist) load(c *gin.Context) (*WaitlistEntry, bool) {
+	var entry WaitlistEntry
+	if err := w.db.First(&entry, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Waitlist entry not found"})
+		return nil, false
+	}
+	if !w.policies.Authorize(c, policy.ResourceAppointments, policy.ActionWrite, entry.PatientID) {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// setPriority answers PUT /api/waitlist/:id/priority (staff only).
+func (w *waitlist) setPriority(c *gin.Context) {
+	entry, ok := w.load(c)
+	if !ok {
+		return
+	}
+	var input struct{ Priority int }
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := w.db.Model(entry).Update("priority", input.Priority).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to update waitlist entry"})
+		return
+	}
+	c.JSON(200, entry)
+}
+
+// withdraw answers DELETE /api/waitlist/:id. A pending offer is declined
+// and passed on.
+func (w *waitlist) withdraw(c *gin.Context) {
+	entry, ok := w.load(c)
+	if !ok {
+		return
+	}
+	if entry.Status == WaitlistBooked || entry.Status == WaitlistWithdrawn {
+		c.JSON(409, gin.H{"error": "Waitlist entry is already " + entry.Status})
+		return
+	}
+
+	var offers []WaitlistOffer
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("entry_id = ? AND status = ?", entry.ID, OfferPending).Find(&offers).Error; err != nil {
+			return err
+		}
+		for i := range offers {
+			if err := tx.Model(&offers[i]).Update("status", OfferDeclined).Error; err != nil {
+				return err
+			}
+		}
+		entry.Status = WaitlistWithdrawn
+		return tx.Model(entry).Update("status", WaitlistWithdrawn).Error
+	})
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to leave waitlist"})
+		return
+	}
+	for i := range offers {
+		w.passOn(&offers[i])
+	}
+	c.JSON(200, entry)
+}
+
+// loadOffer fetches the offer named by :id and authorizes a write on it.
+func (w *waitlist) loadOffer(c *gin.Context) (*WaitlistOffer, bool) {
+	var offer WaitlistOffer
+	if err := w.db.First(&offer, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Offer not found"})
+		return nil, false
+	}
+	if !w.policies.Authorize(c, policy.ResourceAppointments, policy.ActionWrite, offer.PatientID) {
+		return nil, false
+	}
+	return &offer, true
+}
+
+// errOfferClosed means the offer is no longer pending.
+var errOfferClosed = errors.New("offer is no longer available")
+
+// accept answers POST /api/waitlist/offers/:id/accept by booking the held
+// slot.
+func (w *waitlist) accept(c *gin.Context) {
+	offer, ok := w.loadOffer(c)
+	if !ok {
+		return
+	}
+
+	by := actorFrom(c)
+	status, err := w.booking.initialStatus(by, offer.PatientID)
+	if err != nil {
+		respondBookingError(c, err)
+		return
+	}
+	var appointment Appointment
+	taken := false
+	err = w.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(offer, offer.ID).Error; err != nil {
+			return err
+		}
+		if offer.Status != OfferPending || !time.Now().Before(offer.ExpiresAt) {
+			return errOfferClosed
+		}
+		var entry WaitlistEntry
+		if err := tx.First(&entry, offer.EntryID).Error; err != nil {
+			return err
+		}
+
+		appointment = Appointment{
+			PatientID: offer.PatientID,
+			DoctorID:  offer.DoctorID,
+			DateTime:  offer.StartsAt,
+			Status:    status,
+			Type:      entry.Type,
+			Notes:     entry.Notes,
+			Duration:  int(offer.EndsAt.Sub(offer.StartsAt) / time.Minute),
+		}
+		if status == StatusConfirmed {
+			appointment.stamp(StatusConfirmed, time.Now())
+		}
+		// In a savepoint, so the offer can still be closed if the slot
+		// was booked some other way
+		err := tx.Transaction(func(sp *gorm.DB) error {
+			if err := sp.Create(&appointment).Error; err != nil {
+				return err
+			}
+			return recordBooked(sp, &appointment, by)
+		})
+		if isSlotTaken(err) {
+			taken = true
+			return tx.Model(offer).Update("status", OfferExpired).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		offer.Status = OfferAccepted
+		offer.AppointmentID = &appointment.ID
+		if err := tx.Model(offer).Updates(map[string]interface{}{"status": OfferAccepted, "appointment_id": appointment.ID}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&entry).Update("status", WaitlistBooked).Error
+	})
+	switch {
+	case errors.Is(err, errOfferClosed):
+		c.JSON(409, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(400, gin.H{"error": "Failed to accept offer"})
+	case taken:
+		w.reopen(offer)
+		c.JSON(409, gin.H{"error": "The slot has been booked in the meantime"})
+	default:
+		c.JSON(201, appointment)
+	}
+}
+
+// decline answers POST /api/waitlist/offers/:id/decline. The entry stays
+// on the waitlist and the slot goes to the next patient.
+func (w *waitlist) decline(c *gin.Context) {
+	offer, ok := w.loadOffer(c)
+	if !ok {
+		return
+	}
+	res := w.db.Model(offer).Where("status = ?", OfferPending).Update("status", OfferDeclined)
+	if res.Error != nil {
+		c.JSON(400, gin.H{"error": "Failed to decline offer"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(409, gin.H{"error": errOfferClosed.Error()})
+		return
+	}
+	w.reopen(offer)
+	w.passOn(offer)
+	c.JSON(200, offer)
+}
+
+// reopen puts the entry of a closed offer back in the queue.
+func (w *waitlist) reopen(offer *WaitlistOffer) {
+	if err := w.db.Model(&WaitlistEntry{}).Where("id = ? AND status = ?", offer.EntryID, WaitlistOffered).
+		Update("status", WaitlistWaiting).Error; err != nil {
+		log.Printf("Failed to reopen waitlist entry %d: %v", offer.EntryID, err)
+	}
+}
+
+// passOn offers the slot of a closed offer to the next patient.
+func (w *waitlist) passOn(offer *WaitlistOffer) {
+	if err := w.offer(offer.FreedByID, offer.DoctorID, offer.StartsAt, offer.EndsAt); err != nil {
+		log.Printf("Failed to pass on waitlist slot of offer %d: %v", offer.ID, err)
+	}
+}
+
+// slotFreed handles appointment.cancelled and appointment.rescheduled
+// events by offering the freed time to the waitlist.
+func (w *waitlist) slotFreed(e DomainEvent) error {
+	var freed Appointment
+	if err := w.db.Unscoped().First(&freed, e.AppointmentID).Error; err != nil {
+		return err
+	}
+	if !freed.DateTime.After(time.Now()) {
+		return nil
+	}
+	// Events are delivered at least once
+	var count int64
+	if err := w.db.Model(&WaitlistOffer{}).Where("freed_by_id = ?", freed.ID).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	return w.offer(freed.ID, freed.DoctorID, freed.DateTime, freed.EndTime)
+}
+
+// offer holds [start, end) for the highest-priority waiting entry that
+// fits it and has not been offered this slot yet, and notifies the
+// patient. It does nothing if the time has been booked or is held, or if
+// nobody fits.
+func (w *waitlist) offer(freedByID, doctorID uint, start, end time.Time) error {
+	now := time.Now()
+	if !start.After(now) {
+		return nil
+	}
+	specialization, err := w.specialization(doctorID)
+	if err != nil {
+		return err
+	}
+
+	var offer *WaitlistOffer
+	err = w.db.Transaction(func(tx *gorm.DB) error {
+		var busy int64
+		if err := tx.Model(&Appointment{}).
+			Where("doctor_id = ? AND status NOT IN ? AND date_time < ? AND end_time > ?", doctorID, inactiveStatuses, end, start).
+			Count(&busy).Error; err != nil || busy > 0 {
+			return err
+		}
+		if err := tx.Model(&WaitlistOffer{}).
+			Where("doctor_id = ? AND status = ? AND expires_at > ? AND starts_at < ? AND ends_at > ?", doctorID, OfferPending, now, end, start).
+			Count(&busy).Error; err != nil || busy > 0 {
+			return err
+		}
+
+		var entry WaitlistEntry
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ?", WaitlistWaiting).
+			Where("doctor_id = ? OR (doctor_id IS NULL AND specialization = ? AND specialization <> '')", doctorID, specialization).
+			Where("NOT EXISTS (SELECT 1 FROM waitlist_offers o WHERE o.entry_id = waitlist_entries.id AND o.freed_by_id = ?)", freedByID).
+			Where(`NOT EXISTS (SELECT 1 FROM waitlist_windows ww WHERE ww.entry_id = waitlist_entries.id)
+				OR EXISTS (SELECT 1 FROM waitlist_windows ww WHERE ww.entry_id = waitlist_entries.id AND ww.starts_at <= ? AND ww.ends_at >= ?)`, start, end).
+			Order("priority DESC, created_at").
+			Take(&entry).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		expires := now.Add(w.hold)
+		if expires.After(start) {
+			expires = start
+		}
+		offer = &WaitlistOffer{
+			EntryID:   entry.ID,
+			PatientID: entry.PatientID,
+			DoctorID:  doctorID,
+			StartsAt:  start,
+			EndsAt:    end,
+			FreedByID: freedByID,
+			Status:    OfferPending,
+			ExpiresAt: expires,
+		}
+		if err := tx.Create(offer).Error; err != nil {
+			return err
+		}
+		return tx.Model(&entry).Update("status", WaitlistOffered).Error
+	})
+	if err != nil || offer == nil {
+		return err
+	}
+
+	// The hold stands even if notification-service is down; the patient
+	// also sees the offer in their waitlist
+	if err := w.notifyOffer(offer); err != nil {
+		log.Printf("Failed to notify patient %d of waitlist offer %d: %v", offer.PatientID, offer.ID, err)
+	}
+	return nil
+}
+
+func (w *waitlist) notifyOffer(offer *WaitlistOffer) error {
+	return w.notifier.Send(notify.Notification{
+		UserID: offer.PatientID,
+		Type:   "appointment",
+		Title:  "An earlier appointment is available",
+		Message: fmt.Sprintf("A slot on %s has opened up. It is held for you until %s.",
+			offer.StartsAt.In(w.loc).Format("Mon 2 Jan 2006 15:04"), offer.ExpiresAt.In(w.loc).Format("15:04")),
+		Data:     fmt.Sprintf(`{"offerId":%d}`, offer.ID),
+		Priority: notify.PriorityHigh,
+	})
+}
+
+// specialization reads a doctor's specialization from doctor-service's
+// table in the shared database.
+func (w *waitlist) specialization(doctorID interface{}) (string, error) {
+	var specs []string
+	if err := w.db.Table("doctors").Where("id = ? AND deleted_at IS NULL", doctorID).
+		Limit(1).Pluck("specialization", &specs).Error; err != nil || len(specs) == 0 {
+		return "", err
+	}
+	return specs[0], nil
+}
+
+// expire closes pending offers whose hold has run out and passes each slot
+// on. Several instances may run it at once.
+func (w *waitlist) expire() error {
+	var expired []WaitlistOffer
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND expires_at <= ?", OfferPending, time.Now()).
+			Find(&expired).Error; err != nil {
+			return err
+		}
+		for i := range expired {
+			if err := tx.Model(&expired[i]).Update("status", OfferExpired).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range expired {
+		w.reopen(&expired[i])
+		w.passOn(&expired[i])
+	}
+	return nil
+}
+
+// run expires offers every waitlistSweepInterval.
+func (w *waitlist) run() {
+	for range time.Tick(waitlistSweepInterval) {
+		if err := w.expire(); err != nil {
+			log.Printf("Failed to expire waitlist offers: %v", err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"healthcare/auth-service/models"
+	"healthcare/auth-service/sessions"
+	"healthcare/shared/auth"
+	"healthcare/shared/mail"
+)
+
+type EmailInput struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordInput struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+type TokenInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ForgotPassword mails a password reset link. The response is the same
+// whether or not the address is registered.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var input EmailInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := h.db.Where("email = ? AND is_active = ?", input.Email, true).First(&user).Error; err == nil {
+		token, err := h.signer.SignPurpose(auth.PurposePasswordReset, user.ID, user.Email)
+		if err == nil {
+			err = h.mailer.Send(mail.PasswordReset(user.Email, user.FirstName, token, h.cfg.PasswordResetTTL))
+		}
+		if err != nil {
+			log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address is registered, a reset link has been sent"})
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword and
+// signs the user out everywhere.
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var input ResetPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, claims, ok := h.purposeUser(c, auth.PurposePasswordReset, input.Token)
+	if !ok {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := auth.ConsumeToken(tx, claims); err != nil {
+			return err
+		}
+		return tx.Model(user).Update("password", string(hashedPassword)).Error
+	})
+	if errors.Is(err, auth.ErrTokenUsed) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reset link has already been used"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error resetting password"})
+		return
+	}
+
+	if _, err := h.sessions.RevokeAll(user.ID, sessions.ReasonPasswordReset); err != nil {
+		log.Printf("Failed to revoke sessions of user %d after password reset: %v", user.ID, err)
+	}
+	createActivity(h.db, user.ID, string(models.ActivityPasswordReset), "Password reset by email link")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset; please log in again"})
+}
+
+// VerifyEmail marks the user's address verified with a token from the
+// verification email.
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var input TokenInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, claims, ok := h.purposeUser(c, auth.PurposeEmailVerification, input.Token)
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := auth.ConsumeToken(tx, claims); err != nil {
+			return err
+		}
+		return tx.Model(user).Update("email_verified_at", time.Now()).Error
+	})
+	if errors.Is(err, auth.ErrTokenUsed) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verification link has already been used"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error verifying email"})
+		return
+	}
+
+	createActivity(h.db, user.ID, string(models.ActivityEmailVerified), "Verified "+user.Email)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address verified"})
+}
+
+// ResendVerification mails a new verification link to an unverified
+// address. Like ForgotPassword it never reveals whether the address exists.
+func (h *AuthHandler) ResendVerification(c *gin.Context) {
+	var input EmailInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := h.db.Where("email = ? AND email_verified_at IS NULL", input.Email).First(&user).Error; err == nil {
+		h.sendVerification(&user)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address needs verifying, a new link has been sent"})
+}
+
+func (h *AuthHandler) sendVerification(user *models.User) {
+	token, err := h.signer.SignPurpose(auth.PurposeEmailVerification, user.ID, user.Email)
+	if err == nil {
+		err = h.mailer.Send(mail.EmailVerification(user.Email, user.FirstName, token, h.cfg.VerificationTTL))
+	}
+	if err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+	}
+}
+
+// purposeUser verifies a one-time token and loads its user. The token is
+// refused if the user's email has changed since it was issued.
+func (h *AuthHandler) purposeUser(c *gin.Context, purpose, token string) (*models.User, *auth.PurposeClaims, bool) {
+	claims, err := h.verifier.VerifyPurpose(purpose, token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired link"})
+		return nil, nil, false
+	}
+
+	var user models.User
+	if err := h.db.First(&user, claims.UserID).Error; err != nil || user.Email != claims.Email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired link"})
+		return nil, nil, false
+	}
+	return &user, claims, true
+}
@@ -2,19 +2,25 @@ package handlers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 
+	"healthcare/auth-service/mfa"
 	"healthcare/auth-service/models"
+	"healthcare/auth-service/sessions"
+	"healthcare/shared/auth"
+	"healthcare/shared/envelope"
+	"healthcare/shared/lockout"
+	"healthcare/shared/mail"
 )
 
-var jwtKey = []byte("your-secret-key") // In production, use environment variable
-
 type RegisterInput struct {
 	Email     string `json:"email" binding:"required,email"`
 	Password  string `json:"password" binding:"required,min=6"`
@@ -31,6 +37,14 @@ type UpdateProfileInput struct {
 	FirstName string `json:"firstName" binding:"required"`
 	LastName  string `json:"lastName" binding:"required"`
 	Email     string `json:"email" binding:"required,email"`
+	// Phone and Address are left unchanged when omitted
+	Phone   *string `json:"phone"`
+	Address *string `json:"address"`
+}
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required,min=6"`
 }
 
 type EmergencyContactInput struct {
@@ -57,23 +71,33 @@ type BioInformationInput struct {
 }
 
 type AuthHandler struct {
-	db *gorm.DB
+	db       *gorm.DB
+	cfg      auth.Config
+	sessions *sessions.Manager
+	signer   *auth.Signer
+	verifier *auth.Verifier
+	mfa      *mfa.Service
+	mailer   mail.Sender
+	guard    *lockout.Guard
+	keys     *envelope.Keyring
 }
 
-func NewAuthHandler(db *gorm.DB) *AuthHandler {
-	return &AuthHandler{db: db}
+func NewAuthHandler(db *gorm.DB, cfg auth.Config, sessions *sessions.Manager, signer *auth.Signer, verifier *auth.Verifier, mfa *mfa.Service, mailer mail.Sender, guard *lockout.Guard, keys *envelope.Keyring) *AuthHandler {
+	return &AuthHandler{db: db, cfg: cfg, sessions: sessions, signer: signer, verifier: verifier, mfa: mfa, mailer: mailer, guard: guard, keys: keys}
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
-	Register(c, h.db)
+	if user := Register(c, h.db, h.sessions, h.cfg.RequireEmailVerification); user != nil {
+		h.sendVerification(user)
+	}
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
-	Login(c, h.db)
+	Login(c, h.db, h.sessions, h.mfa, h.guard, h.cfg.RequireEmailVerification)
 }
 
 func (h *AuthHandler) VerifyToken(c *gin.Context) {
-	VerifyToken(c)
+	VerifyToken(c, h.verifier, h.sessions)
 }
 
 func (h *AuthHandler) UpdateProfile(c *gin.Context) {
@@ -86,8 +110,8 @@ func (h *AuthHandler) GetUserActivities(c *gin.Context) {
 
 func (h *AuthHandler) UpdateBioInformation(c *gin.Context) {
 	// Get user ID from token
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID := auth.UserID(c)
+	if userID == 0 {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
@@ -98,6 +122,13 @@ func (h *AuthHandler) UpdateBioInformation(c *gin.Context) {
 		return
 	}
 
+	// Policy numbers are sealed; they are searched by their blind index
+	policyNumberIndex, err := models.PolicyNumberIndex(h.keys, input.PolicyNumber)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update bio information"})
+		return
+	}
+
 	// Check if bio information already exists for this user
 	var existingBio models.BioInformation
 	result := h.db.Where("user_id = ?", userID).First(&existingBio)
@@ -118,6 +149,7 @@ func (h *AuthHandler) UpdateBioInformation(c *gin.Context) {
 		existingBio.ChronicConditions = input.ChronicConditions
 		existingBio.InsuranceProvider = input.InsuranceProvider
 		existingBio.PolicyNumber = input.PolicyNumber
+		existingBio.PolicyNumberIndex = policyNumberIndex
 		existingBio.ProfilePhoto = input.ProfilePhoto
 		existingBio.InsuranceCard = input.InsuranceCard
 
@@ -154,7 +186,7 @@ func (h *AuthHandler) UpdateBioInformation(c *gin.Context) {
 	} else {
 		// Create new bio information
 		newBio := models.BioInformation{
-			UserID:            userID.(uint),
+			UserID:            userID,
 			FullName:          input.FullName,
 			DateOfBirth:       input.DateOfBirth,
 			Gender:            input.Gender,
@@ -166,6 +198,7 @@ func (h *AuthHandler) UpdateBioInformation(c *gin.Context) {
 			ChronicConditions: input.ChronicConditions,
 			InsuranceProvider: input.InsuranceProvider,
 			PolicyNumber:      input.PolicyNumber,
+			PolicyNumberIndex: policyNumberIndex,
 			ProfilePhoto:      input.ProfilePhoto,
 			InsuranceCard:     input.InsuranceCard,
 		}
@@ -200,7 +233,7 @@ func (h *AuthHandler) UpdateBioInformation(c *gin.Context) {
 		"action": "bio_information_update",
 		"email":  input.Email,
 	})
-	if err := createActivity(tx, userID.(uint), "profile_update", string(details)); err != nil {
+	if err := createActivity(tx, userID, "profile_update", string(details)); err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create activity record"})
 		return
@@ -214,8 +247,8 @@ func (h *AuthHandler) UpdateBioInformation(c *gin.Context) {
 
 func (h *AuthHandler) GetProfile(c *gin.Context) {
 	// Get user ID from token
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID := auth.UserID(c)
+	if userID == 0 {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
@@ -226,19 +259,20 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	c.JSON(http.StatusOK, userResponse(&user))
+}
+
+// userResponse is the user object returned alongside tokens.
+func userResponse(user *models.User) gin.H {
+	return gin.H{
 		"id":        user.ID,
 		"email":     user.Email,
 		"firstName": user.FirstName,
 		"lastName":  user.LastName,
 		"role":      user.Role,
-	})
-}
-
-func (h *AuthHandler) Logout(c *gin.Context) {
-	// In a real application, you might want to invalidate the token
-	// For now, we'll just return a success message
-	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+		"phone":     user.Phone,
+		"address":   user.Address,
+	}
 }
 
 func createActivity(db *gorm.DB, userID uint, activityType string, details string) error {
@@ -251,25 +285,28 @@ func createActivity(db *gorm.DB, userID uint, activityType string, details strin
 	return db.Create(&activity).Error
 }
 
-func Register(c *gin.Context, db *gorm.DB) {
+// Register creates the user and returns it, or writes an error response and
+// returns nil. When requireVerified is set the user gets no tokens until
+// they have verified their email address.
+func Register(c *gin.Context, db *gorm.DB, sm *sessions.Manager, requireVerified bool) *models.User {
 	var input RegisterInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		return nil
 	}
 
 	// Check if user already exists
 	var existingUser models.User
 	if result := db.Where("email = ?", input.Email).First(&existingUser); result.Error == nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
-		return
+		return nil
 	}
 
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
-		return
+		return nil
 	}
 
 	// Create user
@@ -278,26 +315,28 @@ func Register(c *gin.Context, db *gorm.DB) {
 		Password:  string(hashedPassword),
 		FirstName: input.FirstName,
 		LastName:  input.LastName,
-		Role:      "user", // Set default role
+		Role:      auth.RolePatient, // Set default role
 	}
 
 	if result := db.Create(&user); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
-		return
+		return nil
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"email":   user.Email,
-		"role":    user.Role,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
+	if requireVerified {
+		c.JSON(http.StatusCreated, gin.H{
+			"message":              "Registration successful; check your email to verify your address",
+			"verificationRequired": true,
+			"user":                 userResponse(&user),
+		})
+		return &user
+	}
 
-	tokenString, err := token.SignedString(jwtKey)
+	// Start a session and issue its first token pair
+	tokens, err := sm.Start(&user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
-		return
+		return nil
 	}
 
 	// Create activity record
@@ -310,113 +349,178 @@ func Register(c *gin.Context, db *gorm.DB) {
 
 	// Return response in the format expected by the frontend
 	c.JSON(http.StatusCreated, gin.H{
-		"token": tokenString,
-		"user": gin.H{
-			"id":        user.ID,
-			"email":     user.Email,
-			"firstName": user.FirstName,
-			"lastName":  user.LastName,
-			"role":      user.Role,
-		},
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+		"user":         userResponse(&user),
 	})
+	return &user
 }
 
-func Login(c *gin.Context, db *gorm.DB) {
+// Login checks the password, subject to the brute-force guard, and either
+// starts a session or issues an MFA challenge.
+func Login(c *gin.Context, db *gorm.DB, sm *sessions.Manager, mf *mfa.Service, guard *lockout.Guard, requireVerified bool) {
 	var input LoginInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	decision, err := guard.Check(input.Email, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking login attempts"})
+		return
+	}
+	if !decision.Allowed {
+		rejectLogin(c, decision)
+		return
+	}
+
 	var user models.User
 	if result := db.Where("email = ?", input.Email).First(&user); result.Error != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		loginFailed(c, db, guard, nil, input.Email)
 		return
 	}
 
 	// Check password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		loginFailed(c, db, guard, &user, input.Email)
+		return
+	}
+
+	// Checked after the password so the answer says nothing about accounts
+	// to someone guessing
+	if !user.IsActive {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is deactivated"})
+		return
+	}
+
+	if requireVerified && user.EmailVerifiedAt == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address has not been verified", "verificationRequired": true})
+		return
+	}
+
+	// Users with MFA, or whose role requires it, get a challenge instead of
+	// tokens and finish at /login/mfa
+	enabled, err := mf.Enabled(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking MFA"})
+		return
+	}
+	if enabled || mf.Required(user.Role) {
+		mfaToken, err := mf.NewChallenge(user.ID, c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting MFA challenge"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"mfaRequired":        true,
+			"mfaToken":           mfaToken,
+			"expiresIn":          int(mf.ChallengeTTL().Seconds()),
+			"enrollmentRequired": !enabled,
+		})
 		return
 	}
 
+	completeLogin(c, db, sm, guard, &user, nil)
+}
+
+// rejectLogin answers an attempt the guard has refused.
+func rejectLogin(c *gin.Context, decision lockout.Decision) {
+	c.Header("Retry-After", strconv.Itoa(decision.RetryAfterSeconds()))
+	message := "Too many login attempts; try again later"
+	if decision.Locked {
+		message = "Account temporarily locked after too many failed logins; try again later"
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message, "retryAfter": decision.RetryAfterSeconds()})
+}
+
+// loginFailed counts a failed password check and answers it.
+func loginFailed(c *gin.Context, db *gorm.DB, guard *lockout.Guard, user *models.User, email string) {
+	countFailure(c, db, guard, user, email)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+}
+
+// countFailure counts a failed password or MFA code and records a lockout
+// against user, when the address belongs to one.
+func countFailure(c *gin.Context, db *gorm.DB, guard *lockout.Guard, user *models.User, email string) {
+	locked, err := guard.Failure(email, c.ClientIP())
+	if err != nil {
+		log.Printf("Failed to count failed login: %v", err)
+	}
+	if locked && user != nil {
+		createActivity(db, user.ID, string(models.ActivityAccountLocked), "Account locked after repeated failed logins from "+c.ClientIP())
+	}
+}
+
+// completeLogin starts a session for user once every factor has been
+// checked, and only then clears the account's failed logins. recoveryCodes
+// is set when login also finished MFA enrollment.
+func completeLogin(c *gin.Context, db *gorm.DB, sm *sessions.Manager, guard *lockout.Guard, user *models.User, recoveryCodes []string) {
 	// Update last login
 	user.LastLogin = time.Now()
-	db.Save(&user)
-
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"email":   user.Email,
-		"role":    user.Role,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
+	db.Save(user)
 
-	tokenString, err := token.SignedString(jwtKey)
+	// Start a session and issue its first token pair
+	tokens, err := sm.Start(user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
 		return
 	}
 
+	if err := guard.Success(user.Email); err != nil {
+		log.Printf("Failed to reset login attempts of user %d: %v", user.ID, err)
+	}
+
 	// Create activity record
 	createActivity(db, user.ID, string(models.ActivityLogin), "User logged in")
 
-	c.JSON(http.StatusOK, gin.H{
-		"token": tokenString,
-		"user": gin.H{
-			"id":        user.ID,
-			"email":     user.Email,
-			"firstName": user.FirstName,
-			"lastName":  user.LastName,
-			"role":      user.Role,
-		},
-	})
+	response := gin.H{
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+		"user":         userResponse(user),
+	}
+	if recoveryCodes != nil {
+		response["recoveryCodes"] = recoveryCodes
+	}
+	c.JSON(http.StatusOK, response)
 }
 
-func VerifyToken(c *gin.Context) {
-	tokenString := c.GetHeader("Authorization")
+// VerifyToken reports who a token belongs to, refusing tokens whose session
+// has been revoked or has ended, like every protected route.
+func VerifyToken(c *gin.Context, verifier *auth.Verifier, sm *sessions.Manager) {
+	tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
 	if tokenString == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token provided"})
 		return
 	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-
-	if err != nil || !token.Valid {
+	claims, err := verifier.Verify(tokenString)
+	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 		return
 	}
+	if claims.SessionID == "" || !sm.IsActive(claims.SessionID, claims.UserID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+		return
+	}
 
-	claims := token.Claims.(jwt.MapClaims)
 	c.JSON(http.StatusOK, gin.H{
-		"user_id": claims["user_id"],
-		"email":   claims["email"],
-		"role":    claims["role"],
+		"user_id": claims.UserID,
+		"email":   claims.Email,
+		"role":    claims.Role,
 	})
 }
 
 func UpdateProfile(c *gin.Context, db *gorm.DB) {
 	// Get user ID from token
-	tokenString := c.GetHeader("Authorization")
-	if tokenString == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token provided"})
-		return
-	}
-
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-
-	if err != nil || !token.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+	userID := auth.UserID(c)
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
-
 	// Parse input
 	var input UpdateProfileInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -443,11 +547,23 @@ func UpdateProfile(c *gin.Context, db *gorm.DB) {
 		"firstName": user.FirstName,
 		"lastName":  user.LastName,
 		"email":     user.Email,
+		"phone":     user.Phone,
+		"address":   user.Address,
 	}
 
+	// A new address has to be verified again
+	if user.Email != input.Email {
+		user.EmailVerifiedAt = nil
+	}
 	user.FirstName = input.FirstName
 	user.LastName = input.LastName
 	user.Email = input.Email
+	if input.Phone != nil {
+		user.Phone = *input.Phone
+	}
+	if input.Address != nil {
+		user.Address = *input.Address
+	}
 
 	if result := db.Save(&user); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating profile"})
@@ -461,39 +577,23 @@ func UpdateProfile(c *gin.Context, db *gorm.DB) {
 			"firstName": input.FirstName,
 			"lastName":  input.LastName,
 			"email":     input.Email,
+			"phone":     user.Phone,
+			"address":   user.Address,
 		},
 	})
 	createActivity(db, user.ID, string(models.ActivityProfileUpdate), string(details))
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":        user.ID,
-		"email":     user.Email,
-		"firstName": user.FirstName,
-		"lastName":  user.LastName,
-		"role":      user.Role,
-	})
+	c.JSON(http.StatusOK, userResponse(&user))
 }
 
 func GetUserActivities(c *gin.Context, db *gorm.DB) {
 	// Get user ID from token
-	tokenString := c.GetHeader("Authorization")
-	if tokenString == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token provided"})
-		return
-	}
-
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-
-	if err != nil || !token.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+	userID := auth.UserID(c)
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
-
 	// Get activities
 	var activities []models.Activity
 	if result := db.Where("user_id = ?", userID).Order("created_at desc").Limit(10).Find(&activities); result.Error != nil {
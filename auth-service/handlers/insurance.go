@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"healthcare/auth-service/models"
+	"healthcare/shared/audit"
+)
+
+// InsuredPatient is a patient found by their insurance policy.
+type InsuredPatient struct {
+	UserID            uint   `json:"userId"`
+	FullName          string `json:"fullName"`
+	InsuranceProvider string `json:"insuranceProvider"`
+	PolicyNumber      string `json:"policyNumber"`
+}
+
+// FindByPolicyNumber answers GET /api/insurance/patients?policyNumber=...
+// Policy numbers are sealed, so they are matched exactly, by blind index,
+// ignoring case, spaces and dashes. The number is a query parameter so it
+// stays out of the audit log's path.
+func (h *AuthHandler) FindByPolicyNumber(c *gin.Context) {
+	policyNumber := strings.TrimSpace(c.Query("policyNumber"))
+	if policyNumber == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "policyNumber is required"})
+		return
+	}
+	index, err := models.PolicyNumberIndex(h.keys, policyNumber)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error searching policies"})
+		return
+	}
+
+	var bios []models.BioInformation
+	if err := h.db.Where("policy_number_index = ?", index).Order("user_id").Find(&bios).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error searching policies"})
+		return
+	}
+	patients := make([]InsuredPatient, len(bios))
+	for i, bio := range bios {
+		patients[i] = InsuredPatient{
+			UserID:            bio.UserID,
+			FullName:          bio.FullName,
+			InsuranceProvider: bio.InsuranceProvider,
+			PolicyNumber:      bio.PolicyNumber,
+		}
+	}
+	if len(bios) == 1 {
+		audit.SetPatient(c, bios[0].UserID)
+	}
+	c.JSON(http.StatusOK, patients)
+}
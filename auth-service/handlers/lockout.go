@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"healthcare/auth-service/models"
+	"healthcare/shared/auth"
+)
+
+// GetLockouts lists the accounts and client IPs that are locked out.
+func (h *AuthHandler) GetLockouts(c *gin.Context) {
+	locked, err := h.guard.Locked()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching lockouts"})
+		return
+	}
+
+	lockouts := make([]gin.H, 0, len(locked))
+	for _, rec := range locked {
+		lockouts = append(lockouts, gin.H{
+			"key":           rec.Key,
+			"failures":      rec.Failures,
+			"lastFailureAt": rec.LastFailureAt,
+			"lockedUntil":   rec.LockedUntil,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": lockouts})
+}
+
+// UnlockUser lifts a lockout on a user's account and clears its failed
+// login count.
+func (h *AuthHandler) UnlockUser(c *gin.Context) {
+	user, ok := h.userParam(c)
+	if !ok {
+		return
+	}
+
+	if err := h.guard.Unlock(user.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unlocking account"})
+		return
+	}
+	createActivity(h.db, user.ID, string(models.ActivityAccountUnlock), fmt.Sprintf("Account unlocked by admin %d", auth.UserID(c)))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked"})
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"healthcare/auth-service/mfa"
+	"healthcare/auth-service/models"
+	"healthcare/shared/auth"
+)
+
+type MFALoginInput struct {
+	MFAToken     string `json:"mfaToken" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type MFAChallengeInput struct {
+	MFAToken string `json:"mfaToken" binding:"required"`
+}
+
+type MFACodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// LoginMFA is the second login step: it exchanges the challenge from Login
+// and a TOTP or recovery code for a token pair. For users whose role
+// requires MFA but who have not enrolled yet, a valid code from the
+// authenticator set up via LoginMFAEnroll also confirms enrollment.
+func (h *AuthHandler) LoginMFA(c *gin.Context) {
+	var input MFALoginInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Code == "" && input.RecoveryCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code or recoveryCode is required"})
+		return
+	}
+
+	challenge, err := h.mfa.Challenge(input.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, challenge.UserID).Error; err != nil || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	// Wrong codes count against the account like wrong passwords, so a
+	// fresh challenge per login cannot be used to keep guessing
+	decision, err := h.guard.Check(user.Email, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking login attempts"})
+		return
+	}
+	if !decision.Allowed {
+		rejectLogin(c, decision)
+		return
+	}
+
+	enabled, err := h.mfa.Enabled(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking MFA"})
+		return
+	}
+
+	var recoveryCodes []string
+	switch {
+	case !enabled && input.Code != "":
+		recoveryCodes, err = h.mfa.Confirm(user.ID, input.Code)
+	case input.Code != "":
+		err = h.mfa.Verify(user.ID, input.Code)
+	case enabled:
+		err = h.mfa.UseRecoveryCode(user.ID, input.RecoveryCode)
+	default:
+		err = mfa.ErrNotEnrolled
+	}
+
+	if errors.Is(err, mfa.ErrInvalidCode) || errors.Is(err, mfa.ErrNotEnrolled) {
+		h.mfa.Fail(challenge)
+		details, _ := json.Marshal(map[string]string{"ipAddress": c.ClientIP()})
+		createActivity(h.db, user.ID, string(models.ActivityMFAFailed), string(details))
+		countFailure(c, h.db, h.guard, &user, user.Email)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking MFA code"})
+		return
+	}
+
+	if err := h.mfa.Complete(challenge); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	if recoveryCodes != nil {
+		createActivity(h.db, user.ID, string(models.ActivityMFAEnabled), "Enrolled authenticator at login")
+	} else if input.Code == "" {
+		details, _ := json.Marshal(map[string]string{"ipAddress": c.ClientIP()})
+		createActivity(h.db, user.ID, string(models.ActivityRecoveryCode), string(details))
+	}
+
+	completeLogin(c, h.db, h.sessions, h.guard, &user, recoveryCodes)
+}
+
+// LoginMFAEnroll lets a user whose role requires MFA set up an authenticator
+// in the middle of logging in, using the challenge from Login.
+func (h *AuthHandler) LoginMFAEnroll(c *gin.Context) {
+	var input MFAChallengeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge, err := h.mfa.Challenge(input.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, challenge.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	h.enroll(c, &user)
+}
+
+// GetMFA reports the current user's MFA status.
+func (h *AuthHandler) GetMFA(c *gin.Context) {
+	userID := auth.UserID(c)
+
+	enabled, err := h.mfa.Enabled(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking MFA"})
+		return
+	}
+	remaining, err := h.mfa.RemainingRecoveryCodes(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking MFA"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                enabled,
+		"required":               h.mfa.Required(auth.Role(c)),
+		"recoveryCodesRemaining": remaining,
+	})
+}
+
+// EnrollMFA starts authenticator setup for the current user.
+func (h *AuthHandler) EnrollMFA(c *gin.Context) {
+	var user models.User
+	if err := h.db.First(&user, auth.UserID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	h.enroll(c, &user)
+}
+
+// ConfirmMFA activates the authenticator from EnrollMFA and returns the
+// recovery codes. They are shown only this once.
+func (h *AuthHandler) ConfirmMFA(c *gin.Context) {
+	var input MFACodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := auth.UserID(c)
+
+	codes, err := h.mfa.Confirm(userID, input.Code)
+	if errors.Is(err, mfa.ErrNotEnrolled) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No pending MFA enrollment"})
+		return
+	}
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error confirming MFA"})
+		return
+	}
+
+	createActivity(h.db, userID, string(models.ActivityMFAEnabled), "Enrolled authenticator")
+
+	c.JSON(http.StatusOK, gin.H{"message": "MFA enabled", "recoveryCodes": codes})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes. It
+// needs a current TOTP code.
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var input MFACodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := auth.UserID(c)
+
+	if !h.checkCode(c, userID, input.Code) {
+		return
+	}
+
+	codes, err := h.mfa.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// DisableMFA removes the current user's authenticator. It needs a current
+// TOTP code and is refused for roles that require MFA.
+func (h *AuthHandler) DisableMFA(c *gin.Context) {
+	var input MFACodeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := auth.UserID(c)
+
+	if h.mfa.Required(auth.Role(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "MFA is required for your role"})
+		return
+	}
+	if !h.checkCode(c, userID, input.Code) {
+		return
+	}
+
+	if err := h.mfa.Disable(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error disabling MFA"})
+		return
+	}
+
+	createActivity(h.db, userID, string(models.ActivityMFADisabled), "Removed authenticator")
+
+	c.JSON(http.StatusOK, gin.H{"message": "MFA disabled"})
+}
+
+func (h *AuthHandler) enroll(c *gin.Context, user *models.User) {
+	secret, uri, err := h.mfa.Enroll(user)
+	if errors.Is(err, mfa.ErrAlreadyEnrolled) {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA is already enabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting MFA enrollment"})
+		return
+	}
+
+	// The client renders otpauthUri as a QR code
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauthUri": uri})
+}
+
+// checkCode verifies a TOTP code for userID and writes the error response
+// if it is wrong.
+func (h *AuthHandler) checkCode(c *gin.Context, userID uint, code string) bool {
+	err := h.mfa.Verify(userID, code)
+	if errors.Is(err, mfa.ErrNotEnrolled) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MFA is not enabled"})
+		return false
+	}
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		createActivity(h.db, userID, string(models.ActivityMFAFailed), "Invalid code for MFA settings change")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking MFA code"})
+		return false
+	}
+	return true
+}
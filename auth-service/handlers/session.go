@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"healthcare/auth-service/models"
+	"healthcare/auth-service/sessions"
+	"healthcare/shared/auth"
+)
+
+type RefreshInput struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// Refresh exchanges a refresh token for a new access/refresh token pair.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var input RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, user, err := h.sessions.Rotate(input.RefreshToken)
+	if errors.Is(err, sessions.ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used; session revoked"})
+		return
+	}
+	if errors.Is(err, sessions.ErrInvalidRefreshToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error refreshing token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+		"user":         userResponse(user),
+	})
+}
+
+// Logout revokes the session the current access token belongs to.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	claims, _ := auth.ClaimsFrom(c)
+
+	if err := h.sessions.Revoke(claims.SessionID, claims.UserID, sessions.ReasonLogout); err != nil && !errors.Is(err, sessions.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	details, _ := json.Marshal(map[string]string{"sessionId": claims.SessionID})
+	createActivity(h.db, claims.UserID, string(models.ActivityLogout), string(details))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// LogoutAll revokes every session of the current user.
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userID := auth.UserID(c)
+
+	count, err := h.sessions.RevokeAll(userID, sessions.ReasonLogoutAll)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{"action": "logout_all", "sessions": count})
+	createActivity(h.db, userID, string(models.ActivityLogout), string(details))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions", "revoked": count})
+}
+
+// GetSessions lists the current user's active sessions.
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	claims, _ := auth.ClaimsFrom(c)
+
+	active, err := h.sessions.Active(claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching sessions"})
+		return
+	}
+
+	result := make([]gin.H, 0, len(active))
+	for _, s := range active {
+		result = append(result, gin.H{
+			"id":         s.ID,
+			"userAgent":  s.UserAgent,
+			"ipAddress":  s.IPAddress,
+			"createdAt":  s.CreatedAt,
+			"lastUsedAt": s.LastUsedAt,
+			"current":    s.ID == claims.SessionID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": result})
+}
+
+// RevokeSession ends one of the current user's sessions, e.g. a lost device.
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID := auth.UserID(c)
+
+	err := h.sessions.Revoke(c.Param("id"), userID, sessions.ReasonRevoked)
+	if errors.Is(err, sessions.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	details, _ := json.Marshal(map[string]string{"action": "session_revoked", "sessionId": c.Param("id")})
+	createActivity(h.db, userID, string(models.ActivityLogout), string(details))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// InternalSessionStatus tells another service whether the session an access
+// token names is still live, so logout and revocation reach every service.
+func (h *AuthHandler) InternalSessionStatus(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Query("userId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"active": h.sessions.IsActive(c.Param("id"), uint(userID))})
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"healthcare/auth-service/models"
+	"healthcare/auth-service/sessions"
+	"healthcare/shared/auth"
+)
+
+type RoleInput struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// ProfilePatchInput is a partial profile update from another service.
+// Omitted fields are left unchanged.
+type ProfilePatchInput struct {
+	FirstName *string `json:"firstName"`
+	LastName  *string `json:"lastName"`
+	Phone     *string `json:"phone"`
+	Address   *string `json:"address"`
+}
+
+// ChangePassword sets a new password after checking the current one, and
+// signs out every other session.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	claims, _ := auth.ClaimsFrom(c)
+
+	var input ChangePasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, claims.UserID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.CurrentPassword)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
+		return
+	}
+	if err := h.db.Model(&user).Update("password", string(hashedPassword)).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing password"})
+		return
+	}
+
+	if _, err := h.sessions.RevokeOthers(user.ID, claims.SessionID, sessions.ReasonPasswordChange); err != nil {
+		log.Printf("Failed to revoke other sessions of user %d after password change: %v", user.ID, err)
+	}
+	createActivity(h.db, user.ID, string(models.ActivityPasswordChange), "Password changed")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
+
+// ListUsers lists every user for admins.
+func (h *AuthHandler) ListUsers(c *gin.Context) {
+	var users []models.User
+	if err := h.db.Order("id").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching users"})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// SetUserRole changes a user's role. The user's sessions are revoked so no
+// token carrying the old role can be refreshed.
+func (h *AuthHandler) SetUserRole(c *gin.Context) {
+	user, ok := h.userParam(c)
+	if !ok {
+		return
+	}
+
+	var input RoleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.ValidRole(input.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+
+	oldRole := user.Role
+	if err := h.db.Model(user).Update("role", input.Role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating role"})
+		return
+	}
+
+	if _, err := h.sessions.RevokeAll(user.ID, sessions.ReasonRoleChange); err != nil {
+		log.Printf("Failed to revoke sessions of user %d after role change: %v", user.ID, err)
+	}
+	details, _ := json.Marshal(map[string]interface{}{"old": oldRole, "new": input.Role, "by": auth.UserID(c)})
+	createActivity(h.db, user.ID, string(models.ActivityRoleChange), string(details))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully"})
+}
+
+// InternalGetUser returns a user's profile to another service.
+func (h *AuthHandler) InternalGetUser(c *gin.Context) {
+	user, ok := h.userParam(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, internalUserResponse(user))
+}
+
+// InternalListUsers returns the active users with the role given by the
+// role query parameter, for services that notify everyone in a role.
+func (h *AuthHandler) InternalListUsers(c *gin.Context) {
+	role := c.Query("role")
+	if !auth.ValidRole(role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	var users []models.User
+	if err := h.db.Where("role = ? AND is_active", role).Order("id").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching users"})
+		return
+	}
+
+	response := make([]gin.H, len(users))
+	for i := range users {
+		response[i] = internalUserResponse(&users[i])
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// InternalUpdateProfile applies a partial profile update on behalf of
+// another service. Email changes are not accepted here, since they need
+// verifying; users change their address through PUT /api/users/profile.
+func (h *AuthHandler) InternalUpdateProfile(c *gin.Context) {
+	user, ok := h.userParam(c)
+	if !ok {
+		return
+	}
+
+	var input ProfilePatchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	for column, value := range map[string]*string{
+		"first_name": input.FirstName,
+		"last_name":  input.LastName,
+		"phone":      input.Phone,
+		"address":    input.Address,
+	} {
+		if value != nil {
+			updates[column] = *value
+		}
+	}
+	if len(updates) > 0 {
+		if err := h.db.Model(user).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating profile"})
+			return
+		}
+		details, _ := json.Marshal(map[string]interface{}{"new": updates})
+		createActivity(h.db, user.ID, string(models.ActivityProfileUpdate), string(details))
+	}
+
+	c.JSON(http.StatusOK, internalUserResponse(user))
+}
+
+// userParam loads the user named by the :id path parameter.
+func (h *AuthHandler) userParam(c *gin.Context) (*models.User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	var user models.User
+	if err := h.db.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("User %d not found", id)})
+		return nil, false
+	}
+	return &user, true
+}
+
+// internalUserResponse is userResponse plus the account state other
+// services may need.
+func internalUserResponse(user *models.User) gin.H {
+	response := userResponse(user)
+	response["isActive"] = user.IsActive
+	response["emailVerifiedAt"] = user.EmailVerifiedAt
+	return response
+}
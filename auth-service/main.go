@@ -4,10 +4,18 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"healthcare/auth-service/handlers"
+	"healthcare/auth-service/mfa"
 	"healthcare/auth-service/middleware"
 	"healthcare/auth-service/models"
+	"healthcare/auth-service/sessions"
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/envelope"
+	"healthcare/shared/lockout"
+	"healthcare/shared/mail"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -49,15 +57,77 @@ func main() {
 	}
 	log.Println("Successfully connected to database")
 
+	// Sensitive bio fields are sealed with the tenant's data key; the
+	// serializer has to be in place before gorm parses the models
+	keys, err := envelope.NewKeyringFromEnv(db)
+	if err != nil {
+		log.Fatalf("Failed to set up encryption keys: %v", err)
+	}
+	envelope.Register(keys)
+
 	// Auto-migrate the schema
 	log.Println("Running database migrations...")
-	if err := db.AutoMigrate(&models.User{}, &models.Activity{}, &models.BioInformation{}, &models.EmergencyContact{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.Activity{}, &models.BioInformation{}, &models.EmergencyContact{}, &models.Session{}, &models.RefreshToken{}, &models.MFAFactor{}, &models.RecoveryCode{}, &models.MFAChallenge{}, &auth.UsedToken{}); err != nil {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
+	if err := models.MigrateUsers(db); err != nil {
+		log.Fatalf("Failed to migrate users: %v", err)
+	}
+	if err := audit.Migrate(db); err != nil {
+		log.Fatalf("Failed to migrate audit log: %v", err)
+	}
+	if err := envelope.Migrate(db); err != nil {
+		log.Fatalf("Failed to migrate data keys: %v", err)
+	}
 	log.Println("Database migrations completed")
+	go envelope.NewReencryptor(db, keys,
+		envelope.Column{Table: "bio_informations", Name: "allergies"},
+		envelope.Column{Table: "bio_informations", Name: "medications"},
+		models.PolicyNumberColumn,
+		envelope.Column{Table: "bio_informations", Name: "insurance_card"},
+	).Run(envelope.DefaultSweepInterval)
+
+	// Load token configuration and signing keys
+	authConfig, err := auth.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load auth configuration: %v", err)
+	}
+	keySet, err := auth.LoadKeySet(authConfig)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	go rotateKeys(keySet)
+
+	signer := auth.NewSigner(authConfig, keySet)
+	verifier := auth.NewVerifier(authConfig, keySet)
+	sessionManager := sessions.NewManager(db, signer, authConfig.RefreshTTL, authConfig.SessionAge)
+
+	mfaConfig, err := mfa.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load MFA configuration: %v", err)
+	}
+	mfaService := mfa.NewService(db, mfaConfig)
+
+	mailer, err := mail.NewSenderFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure mail: %v", err)
+	}
+
+	lockoutConfig, err := lockout.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load lockout configuration: %v", err)
+	}
+	lockoutStore, err := lockout.NewStoreFromEnv(db)
+	if err != nil {
+		log.Fatalf("Failed to set up lockout store: %v", err)
+	}
+	loginGuard := lockout.NewGuard(lockoutStore, lockoutConfig)
+	go loginGuard.PruneEvery(time.Hour)
 
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db)
+	authHandler := handlers.NewAuthHandler(db, authConfig, sessionManager, signer, verifier, mfaService, mailer, loginGuard, keys)
+	auditHandler := audit.NewHandler(db)
+	auditLog := audit.NewLogger(db, "auth-service")
 
 	// Initialize router
 	r := gin.Default()
@@ -78,6 +148,12 @@ func main() {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Public signing keys for the other services to verify tokens with
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(200, keySet.JWKS())
+	})
+
 	// API routes group
 	api := r.Group("/api")
 	{
@@ -86,20 +162,79 @@ func main() {
 		api.POST("/users/register", authHandler.Register)
 		api.POST("/users/login", authHandler.Login)
 		api.POST("/users/verify", authHandler.VerifyToken)
+		api.POST("/users/refresh", authHandler.Refresh)
+		api.POST("/users/login/mfa", authHandler.LoginMFA)
+		api.POST("/users/login/mfa/enroll", authHandler.LoginMFAEnroll)
+		api.POST("/users/password/forgot", authHandler.ForgotPassword)
+		api.POST("/users/password/reset", authHandler.ResetPassword)
+		api.POST("/users/email/verify", authHandler.VerifyEmail)
+		api.POST("/users/email/resend", authHandler.ResendVerification)
 
 		// Protected routes
 		log.Println("Setting up protected routes...")
 		protected := api.Group("/users")
-		protected.Use(middleware.AuthMiddleware())
+		protected.Use(audit.Middleware(auditLog, "user"), auth.AuthMiddleware(verifier), middleware.RequireSession(sessionManager), middleware.AuditSelf())
 		{
 			protected.GET("/profile", authHandler.GetProfile)
 			protected.PUT("/profile", authHandler.UpdateProfile)
+			protected.PUT("/change-password", authHandler.ChangePassword)
 			protected.POST("/logout", authHandler.Logout)
+			protected.POST("/logout-all", authHandler.LogoutAll)
+			protected.GET("/sessions", authHandler.GetSessions)
+			protected.DELETE("/sessions/:id", authHandler.RevokeSession)
 			protected.POST("/bio", authHandler.UpdateBioInformation)
 			protected.GET("/activities", authHandler.GetUserActivities)
+			protected.GET("/mfa", authHandler.GetMFA)
+			protected.POST("/mfa/enroll", authHandler.EnrollMFA)
+			protected.POST("/mfa/confirm", authHandler.ConfirmMFA)
+			protected.POST("/mfa/recovery-codes", authHandler.RegenerateRecoveryCodes)
+			protected.DELETE("/mfa", authHandler.DisableMFA)
+		}
+
+		// Account administration
+		admin := api.Group("/admin")
+		admin.Use(audit.Middleware(auditLog, "user"), auth.AuthMiddleware(verifier), middleware.RequireSession(sessionManager), auth.RoleMiddleware(auth.RoleAdmin))
+		{
+			admin.GET("/users", authHandler.ListUsers)
+			admin.PUT("/users/:id/role", authHandler.SetUserRole)
+			admin.GET("/lockouts", authHandler.GetLockouts)
+			admin.POST("/users/:id/unlock", authHandler.UnlockUser)
+		}
+
+		// Patient lookup by insurance policy, for billing staff
+		insurance := api.Group("/insurance")
+		insurance.Use(audit.Middleware(auditLog, "bio_information"), auth.AuthMiddleware(verifier), middleware.RequireSession(sessionManager), auth.RoleMiddleware(auth.RoleBilling, auth.RoleAdmin))
+		{
+			insurance.GET("/patients", authHandler.FindByPolicyNumber)
+		}
+
+		// Audit log, for compliance officers only. Reads are audited too.
+		auditRoutes := api.Group("/audit")
+		auditRoutes.Use(audit.Middleware(auditLog, "audit_log"), auth.AuthMiddleware(verifier), middleware.RequireSession(sessionManager), auth.RoleMiddleware(auth.RoleCompliance))
+		{
+			auditRoutes.GET("", auditHandler.List)
+			auditRoutes.GET("/verify", auditHandler.Verify)
 		}
 	}
 
+	// Internal API for the other services, which read users through here
+	// instead of the users table
+	internal := r.Group("/internal/users")
+	internal.Use(audit.Middleware(auditLog, "user"), auth.InternalMiddleware(auth.InternalToken()))
+	{
+		internal.GET("", authHandler.InternalListUsers)
+		internal.GET("/:id", authHandler.InternalGetUser)
+		internal.PATCH("/:id/profile", authHandler.InternalUpdateProfile)
+	}
+
+	// Session checks behind every other service's tokens; too frequent, and
+	// too empty of patient data, to audit each one
+	internalSessions := r.Group("/internal/sessions")
+	internalSessions.Use(auth.InternalMiddleware(auth.InternalToken()))
+	{
+		internalSessions.GET("/:id", authHandler.InternalSessionStatus)
+	}
+
 	// Debug: Print all registered routes
 	routes := r.Routes()
 	log.Println("Registered routes:")
@@ -117,3 +252,16 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// rotateKeys rotates the signing key whenever it is older than the
+// configured rotation period.
+func rotateKeys(keySet *auth.KeySet) {
+	for {
+		if rotated, err := keySet.RotateIfDue(); err != nil {
+			log.Printf("Failed to rotate signing key: %v", err)
+		} else if rotated {
+			log.Printf("Rotated signing key, new kid %s", keySet.Current().ID)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,326 @@
+// Package mfa implements TOTP second factors, one-time recovery codes and
+// the short-lived challenge that sits between a correct password and the
+// token pair.
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"healthcare/auth-service/models"
+	"healthcare/shared/auth"
+)
+
+const (
+	DefaultIssuer       = "Healthcare"
+	DefaultChallengeTTL = 5 * time.Minute
+
+	maxChallengeAttempts = 5
+	recoveryCodeCount    = 10
+)
+
+// DefaultRequiredRoles must use MFA unless MFA_REQUIRED_ROLES says
+// otherwise.
+var DefaultRequiredRoles = []string{auth.RoleAdmin, auth.RoleDoctor}
+
+var (
+	ErrInvalidCode      = errors.New("mfa: invalid code")
+	ErrNotEnrolled      = errors.New("mfa: not enrolled")
+	ErrAlreadyEnrolled  = errors.New("mfa: already enrolled")
+	ErrInvalidChallenge = errors.New("mfa: invalid or expired challenge")
+)
+
+type Config struct {
+	Issuer        string
+	RequiredRoles []string
+	ChallengeTTL  time.Duration
+}
+
+// LoadConfig reads MFA_ISSUER, MFA_REQUIRED_ROLES (comma separated, "none"
+// to require it of nobody) and MFA_CHALLENGE_TTL.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		Issuer:        DefaultIssuer,
+		RequiredRoles: DefaultRequiredRoles,
+		ChallengeTTL:  DefaultChallengeTTL,
+	}
+	if v := os.Getenv("MFA_ISSUER"); v != "" {
+		cfg.Issuer = v
+	}
+	if v := os.Getenv("MFA_REQUIRED_ROLES"); v != "" {
+		cfg.RequiredRoles = nil
+		for _, role := range strings.Split(v, ",") {
+			if role = strings.TrimSpace(role); role != "" && role != "none" {
+				cfg.RequiredRoles = append(cfg.RequiredRoles, role)
+			}
+		}
+	}
+	if v := os.Getenv("MFA_CHALLENGE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, errors.New("invalid MFA_CHALLENGE_TTL: " + err.Error())
+		}
+		cfg.ChallengeTTL = d
+	}
+	return cfg, nil
+}
+
+type Service struct {
+	db  *gorm.DB
+	cfg Config
+}
+
+func NewService(db *gorm.DB, cfg Config) *Service {
+	return &Service{db: db, cfg: cfg}
+}
+
+// ChallengeTTL is how long a login challenge stays valid.
+func (s *Service) ChallengeTTL() time.Duration {
+	return s.cfg.ChallengeTTL
+}
+
+// Required reports whether users with role must use MFA.
+func (s *Service) Required(role string) bool {
+	for _, r := range s.cfg.RequiredRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether userID has a confirmed authenticator.
+func (s *Service) Enabled(userID uint) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.MFAFactor{}).
+		Where("user_id = ? AND confirmed_at IS NOT NULL", userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// Enroll starts enrollment for user, replacing any unconfirmed factor, and
+// returns the secret and its provisioning URI. The factor takes effect once
+// Confirm sees a valid code.
+func (s *Service) Enroll(user *models.User) (secret, uri string, err error) {
+	var existing models.MFAFactor
+	err = s.db.Where("user_id = ?", user.ID).First(&existing).Error
+	if err == nil && existing.ConfirmedAt != nil {
+		return "", "", ErrAlreadyEnrolled
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", "", err
+	}
+
+	secret, err = GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	factor := models.MFAFactor{UserID: user.ID, Secret: secret, CreatedAt: time.Now()}
+	if existing.ID != 0 {
+		factor.ID = existing.ID
+	}
+	if err := s.db.Save(&factor).Error; err != nil {
+		return "", "", err
+	}
+	return secret, ProvisioningURI(s.cfg.Issuer, user.Email, secret), nil
+}
+
+// Confirm activates userID's pending factor if code is valid and returns a
+// fresh set of recovery codes.
+func (s *Service) Confirm(userID uint, code string) ([]string, error) {
+	var factor models.MFAFactor
+	if err := s.db.Where("user_id = ? AND confirmed_at IS NULL", userID).First(&factor).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotEnrolled
+		}
+		return nil, err
+	}
+
+	step, ok := validate(factor.Secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&factor).Updates(map[string]interface{}{"confirmed_at": now, "last_used_step": step}).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// Verify checks a TOTP code against userID's confirmed factor. Each code is
+// accepted at most once.
+func (s *Service) Verify(userID uint, code string) error {
+	var factor models.MFAFactor
+	if err := s.db.Where("user_id = ? AND confirmed_at IS NOT NULL", userID).First(&factor).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotEnrolled
+		}
+		return err
+	}
+
+	step, ok := validate(factor.Secret, code, time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	// Only advance the step, so a code cannot be replayed inside its window.
+	result := s.db.Model(&models.MFAFactor{}).
+		Where("id = ? AND last_used_step < ?", factor.ID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// UseRecoveryCode consumes one of userID's recovery codes.
+func (s *Service) UseRecoveryCode(userID uint, code string) error {
+	result := s.db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all of userID's recovery codes.
+func (s *Service) RegenerateRecoveryCodes(userID uint) ([]string, error) {
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// RemainingRecoveryCodes counts userID's unused recovery codes.
+func (s *Service) RemainingRecoveryCodes(userID uint) (int64, error) {
+	var count int64
+	err := s.db.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// Disable removes userID's factor and recovery codes.
+func (s *Service) Disable(userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.MFAFactor{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// NewChallenge issues the token a client exchanges, together with a second
+// factor, for a token pair.
+func (s *Service) NewChallenge(userID uint, ipAddress string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	challenge := models.MFAChallenge{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		IPAddress: ipAddress,
+		ExpiresAt: now.Add(s.cfg.ChallengeTTL),
+		CreatedAt: now,
+	}
+	if err := s.db.Create(&challenge).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Challenge looks up a usable challenge by token.
+func (s *Service) Challenge(token string) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	if err := s.db.Where("token_hash = ?", hashToken(token)).First(&challenge).Error; err != nil {
+		return nil, ErrInvalidChallenge
+	}
+	if challenge.UsedAt != nil || challenge.Attempts >= maxChallengeAttempts || time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrInvalidChallenge
+	}
+	return &challenge, nil
+}
+
+// Fail counts a wrong code against the challenge; after a few the client has
+// to start over with the password.
+func (s *Service) Fail(challenge *models.MFAChallenge) error {
+	return s.db.Model(challenge).Update("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+// Complete marks the challenge used. Only one concurrent caller succeeds.
+func (s *Service) Complete(challenge *models.MFAChallenge) error {
+	result := s.db.Model(&models.MFAChallenge{}).
+		Where("id = ? AND used_at IS NULL", challenge.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidChallenge
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]models.RecoveryCode, recoveryCodeCount)
+	now := time.Now()
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(codes[i]), CreatedAt: now}
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, which users tend to
+// get wrong when typing codes back in.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
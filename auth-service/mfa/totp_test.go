@@ -0,0 +1,129 @@
+package mfa
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from RFC 6238 appendix B, "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := code(rfcSecret, tt.unix/period)
+		if err != nil {
+			t.Fatalf("code at %d: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / period
+	at := func(s int64) string {
+		c, err := code(rfcSecret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		input    string
+		wantOK   bool
+		wantStep int64
+	}{
+		{"current step", rfcSecret, at(step), true, step},
+		{"previous step", rfcSecret, at(step - 1), true, step - 1},
+		{"next step", rfcSecret, at(step + 1), true, step + 1},
+		{"two steps old", rfcSecret, at(step - 2), false, 0},
+		{"two steps ahead", rfcSecret, at(step + 2), false, 0},
+		{"spaces are ignored", rfcSecret, at(step)[:3] + " " + at(step)[3:], true, step},
+		{"lowercase secret", strings.ToLower(rfcSecret), at(step), true, step},
+		{"too short", rfcSecret, at(step)[:5], false, 0},
+		{"too long", rfcSecret, at(step) + "0", false, 0},
+		{"empty", rfcSecret, "", false, 0},
+		{"not digits", rfcSecret, "abcdef", false, 0},
+		{"wrong code", rfcSecret, "000000", false, 0},
+		{"invalid secret", "not base32!", at(step), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := validate(tt.secret, tt.input, now)
+			if ok != tt.wantOK {
+				t.Fatalf("validate(%q) ok = %v, want %v", tt.input, ok, tt.wantOK)
+			}
+			if got != tt.wantStep {
+				t.Errorf("validate(%q) step = %d, want %d", tt.input, got, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("two secrets are equal")
+	}
+	key, err := secretEncoding.DecodeString(a)
+	if err != nil {
+		t.Fatalf("secret %q is not base32: %v", a, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("secret is %d bytes, want 20", len(key))
+	}
+	if _, err := code(a, 1); err != nil {
+		t.Errorf("code with generated secret: %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI("Healthcare", "dr who@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("got %s://%s, want otpauth://totp", u.Scheme, u.Host)
+	}
+	if want := "/Healthcare:dr who@example.com"; u.Path != want {
+		t.Errorf("label = %q, want %q", u.Path, want)
+	}
+	q := u.Query()
+	for key, want := range map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Healthcare",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	} {
+		if got := q.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+)
+
+// AuditSelf marks the request as concerning the caller's own data, which is
+// true of every /api/users route. It must run after auth.AuthMiddleware.
+func AuditSelf() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		audit.SetPatient(c, auth.UserID(c))
+		c.Next()
+	}
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"healthcare/auth-service/sessions"
+	"healthcare/shared/auth"
+)
+
+// RequireSession rejects access tokens whose session has been revoked, so
+// logout takes effect before the token expires. It must run after
+// auth.AuthMiddleware.
+func RequireSession(m *sessions.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := auth.ClaimsFrom(c)
+		if !ok || claims.SessionID == "" || !m.IsActive(claims.SessionID, claims.UserID) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			return
+		}
+
+		c.Next()
+	}
+}
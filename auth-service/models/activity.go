@@ -7,13 +7,24 @@ import (
 type ActivityType string
 
 const (
-	ActivityProfileUpdate ActivityType = "profile_update"
-	ActivityLogin         ActivityType = "login"
-	ActivityLogout        ActivityType = "logout"
-	ActivityAppointment   ActivityType = "appointment"
-	ActivityRecordView    ActivityType = "record_view"
-	ActivityRecordUpdate  ActivityType = "record_update"
-	ActivityMessage       ActivityType = "message"
+	ActivityProfileUpdate  ActivityType = "profile_update"
+	ActivityLogin          ActivityType = "login"
+	ActivityLogout         ActivityType = "logout"
+	ActivityTokenReuse     ActivityType = "refresh_token_reuse"
+	ActivityMFAEnabled     ActivityType = "mfa_enabled"
+	ActivityMFADisabled    ActivityType = "mfa_disabled"
+	ActivityMFAFailed      ActivityType = "mfa_failed"
+	ActivityRecoveryCode   ActivityType = "mfa_recovery_code_used"
+	ActivityPasswordReset  ActivityType = "password_reset"
+	ActivityEmailVerified  ActivityType = "email_verified"
+	ActivityAccountLocked  ActivityType = "account_locked"
+	ActivityAccountUnlock  ActivityType = "account_unlocked"
+	ActivityPasswordChange ActivityType = "password_change"
+	ActivityRoleChange     ActivityType = "role_change"
+	ActivityAppointment    ActivityType = "appointment"
+	ActivityRecordView     ActivityType = "record_view"
+	ActivityRecordUpdate   ActivityType = "record_update"
+	ActivityMessage        ActivityType = "message"
 )
 
 type Activity struct {
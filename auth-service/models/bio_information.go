@@ -1,7 +1,11 @@
 package models
 
 import (
+	"strings"
 	"time"
+
+	"healthcare/shared/envelope"
+
 	"gorm.io/gorm"
 )
 
@@ -25,13 +29,39 @@ type BioInformation struct {
 	Address           string            `json:"address"`
 	Phone             string            `json:"phone"`
 	BloodType         string            `json:"bloodType"`
-	Allergies         string            `gorm:"type:text" json:"allergies"`
-	Medications       string            `gorm:"type:text" json:"medications"`
+	Allergies         string            `gorm:"type:text;serializer:encrypted" json:"allergies"`
+	Medications       string            `gorm:"type:text;serializer:encrypted" json:"medications"`
 	ChronicConditions string            `gorm:"type:text" json:"chronic"`
 	InsuranceProvider string            `json:"insuranceProvider"`
-	PolicyNumber      string            `json:"policyNumber"`
+	PolicyNumber      string            `gorm:"serializer:encrypted" json:"policyNumber"`
+	PolicyNumberIndex string            `gorm:"size:32;index" json:"-"` // blind index of PolicyNumber
 	ProfilePhoto      string            `gorm:"type:text" json:"profilePhoto"`
-	InsuranceCard     string            `gorm:"type:text" json:"insuranceCard"`
+	InsuranceCard     string            `gorm:"type:text;serializer:encrypted" json:"insuranceCard"`
 	EmergencyContacts []EmergencyContact `gorm:"foreignKey:BioInfoID" json:"emergencyContacts"`
 	User              User              `gorm:"foreignKey:UserID" json:"-"`
-}
\ No newline at end of file
+}
+
+// PolicyNumberColumn is the sealed policy number and its blind index, which
+// is what policy numbers are searched by.
+var PolicyNumberColumn = envelope.Column{
+	Table:     "bio_informations",
+	Name:      "policy_number",
+	Index:     "policy_number_index",
+	Normalize: NormalizePolicyNumber,
+}
+
+// PolicyNumberIndex is the blind index of a policy number.
+func PolicyNumberIndex(keys *envelope.Keyring, policyNumber string) (string, error) {
+	return keys.BlindIndex(envelope.Context(PolicyNumberColumn.Table, PolicyNumberColumn.Name), NormalizePolicyNumber(policyNumber))
+}
+
+// NormalizePolicyNumber is the form policy numbers are indexed and searched
+// in: upper case, without spaces or dashes.
+func NormalizePolicyNumber(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(s)))
+}
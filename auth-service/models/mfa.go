@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+)
+
+// MFAFactor is a user's TOTP authenticator. It only counts once ConfirmedAt
+// is set, i.e. after the user has proved they can generate codes with it.
+type MFAFactor struct {
+	ID           uint       `gorm:"primaryKey" json:"-"`
+	UserID       uint       `gorm:"uniqueIndex;not null" json:"-"`
+	Secret       string     `gorm:"not null" json:"-"`
+	ConfirmedAt  *time.Time `json:"confirmedAt,omitempty"`
+	LastUsedStep int64      `json:"-"` // last accepted TOTP step, to stop replays
+	CreatedAt    time.Time  `gorm:"not null" json:"createdAt"`
+	UpdatedAt    time.Time  `json:"-"`
+}
+
+// RecoveryCode is a single-use fallback for a lost authenticator. Only a
+// SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"uniqueIndex;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// MFAChallenge is issued after a correct password when the user must still
+// present a second factor. Only a SHA-256 hash of the token is stored.
+type MFAChallenge struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	Attempts  int    `gorm:"not null;default:0"`
+	IPAddress string
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time `gorm:"not null"`
+}
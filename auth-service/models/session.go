@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is one login of a user. Access tokens carry the session ID, so
+// revoking the session cuts off every token issued under it.
+type Session struct {
+	ID         string    `gorm:"primaryKey;size:32" json:"id"`
+	UserID     uint      `gorm:"not null;index" json:"userId"`
+	UserAgent  string    `json:"userAgent"`
+	IPAddress  string    `json:"ipAddress"`
+	LastUsedAt time.Time `gorm:"not null" json:"lastUsedAt"`
+	// ExpiresAt is the session's absolute end, set at login; refresh tokens
+	// never outlive it. Sessions from before it was stored have none.
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt    *time.Time `json:"revokedAt,omitempty"`
+	RevokeReason string     `json:"revokeReason,omitempty"`
+	CreatedAt    time.Time  `gorm:"not null" json:"createdAt"`
+	User         User       `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// IsActive reports whether the session may still be used.
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && (s.ExpiresAt == nil || time.Now().Before(*s.ExpiresAt))
+}
+
+// RefreshToken is a single-use refresh token belonging to a session. Only a
+// SHA-256 hash of the token is stored. Each refresh marks the presented
+// token used and issues the next one in the same session; presenting a used
+// token again revokes the whole session.
+type RefreshToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	SessionID string    `gorm:"not null;index;size:32"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time `gorm:"not null"`
+	Session   Session   `gorm:"foreignKey:SessionID"`
+}
@@ -4,16 +4,48 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+
+	"healthcare/shared/auth"
 )
 
+// User is the one identity record for the whole system. auth-service owns
+// the users table; other services read profiles through the internal API.
 type User struct {
 	gorm.Model
-	Email        string    `gorm:"uniqueIndex;not null" json:"email"`
-	Password     string    `gorm:"not null" json:"-"`
-	FirstName    string    `json:"firstName"`
-	LastName     string    `json:"lastName"`
-	Role         string    `gorm:"default:'user'" json:"role"`
-	LastLogin    time.Time `json:"lastLogin"`
-	IsActive     bool      `gorm:"default:true" json:"isActive"`
-	RefreshToken string    `json:"-"`
+	Email     string    `gorm:"uniqueIndex;not null" json:"email"`
+	Password  string    `gorm:"not null" json:"-"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Role      string    `gorm:"default:'patient'" json:"role"`
+	LastLogin time.Time `json:"lastLogin"`
+	IsActive  bool      `gorm:"default:true" json:"isActive"`
+	// EmailVerifiedAt is nil until the user opens the verification link.
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	Phone           string     `json:"phone"`
+	Address         string     `json:"address"`
+}
+
+// MigrateUsers brings rows written by the old user-service schema in line
+// with this one. It runs after AutoMigrate and is safe to repeat.
+func MigrateUsers(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// auth-service used to register everyone as "user", which no
+		// access rule recognises; user-service used "patient"
+		if err := tx.Model(&User{}).Where("role IS NULL OR role IN ?", []string{"", "user"}).
+			Update("role", auth.RolePatient).Error; err != nil {
+			return err
+		}
+		// Rows inserted by user-service never set is_active
+		if err := tx.Model(&User{}).Where("is_active IS NULL").Update("is_active", true).Error; err != nil {
+			return err
+		}
+		// user-service declared email unique as a constraint rather than
+		// an index; the index AutoMigrate keeps is enough
+		for _, name := range []string{"uni_users_email", "users_email_key"} {
+			if err := tx.Exec("ALTER TABLE users DROP CONSTRAINT IF EXISTS " + name).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
@@ -0,0 +1,273 @@
+// Package sessions issues access/refresh token pairs backed by revocable
+// sessions, and rotates refresh tokens with reuse detection.
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"healthcare/auth-service/models"
+	"healthcare/shared/auth"
+)
+
+const (
+	ReasonLogout         = "logout"
+	ReasonLogoutAll      = "logout_all"
+	ReasonReuse          = "refresh_token_reuse"
+	ReasonRevoked        = "revoked"
+	ReasonPasswordReset  = "password_reset"
+	ReasonPasswordChange = "password_change"
+	ReasonRoleChange     = "role_change"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("sessions: invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("sessions: refresh token reused")
+	ErrSessionNotFound     = errors.New("sessions: session not found")
+)
+
+// TokenPair is what a client receives after login, registration or refresh.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int // access token lifetime in seconds
+	SessionID    string
+}
+
+type Manager struct {
+	db         *gorm.DB
+	signer     *auth.Signer
+	refreshTTL time.Duration
+	maxAge     time.Duration // a session's absolute lifetime
+}
+
+func NewManager(db *gorm.DB, signer *auth.Signer, refreshTTL, maxAge time.Duration) *Manager {
+	return &Manager{db: db, signer: signer, refreshTTL: refreshTTL, maxAge: maxAge}
+}
+
+// Start opens a new session for user and returns its first token pair.
+func (m *Manager) Start(user *models.User, userAgent, ipAddress string) (*TokenPair, error) {
+	sessionID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(m.maxAge)
+	session := models.Session{
+		ID:         sessionID,
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		LastUsedAt: now,
+		ExpiresAt:  &expiresAt,
+		CreatedAt:  now,
+	}
+
+	var refreshToken string
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		refreshToken, err = m.createRefreshToken(tx, &session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.pair(user, sessionID, refreshToken)
+}
+
+// Rotate exchanges a refresh token for a new token pair in the same session.
+// A token can be exchanged once; presenting it a second time is treated as
+// theft and revokes the session, logging out both the attacker and the
+// legitimate client.
+func (m *Manager) Rotate(refreshToken string) (*TokenPair, *models.User, error) {
+	var stored models.RefreshToken
+	if err := m.db.Preload("Session").Where("token_hash = ?", hashToken(refreshToken)).First(&stored).Error; err != nil {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if !stored.Session.IsActive() {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if stored.UsedAt != nil {
+		m.revokeForReuse(&stored.Session)
+		return nil, nil, ErrRefreshTokenReused
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	var user models.User
+	if err := m.db.First(&user, stored.Session.UserID).Error; err != nil || !user.IsActive {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	var next string
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		// Only one concurrent caller can mark the token used.
+		result := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", stored.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+
+		if err := tx.Model(&models.Session{}).Where("id = ?", stored.SessionID).Update("last_used_at", now).Error; err != nil {
+			return err
+		}
+
+		var err error
+		next, err = m.createRefreshToken(tx, &stored.Session)
+		return err
+	})
+	if errors.Is(err, ErrRefreshTokenReused) {
+		m.revokeForReuse(&stored.Session)
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pair, err := m.pair(&user, stored.SessionID, next)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pair, &user, nil
+}
+
+// IsActive reports whether sessionID belongs to userID and has not been
+// revoked.
+func (m *Manager) IsActive(sessionID string, userID uint) bool {
+	var session models.Session
+	if err := m.db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		return false
+	}
+	return session.IsActive()
+}
+
+// Revoke ends a single session of userID.
+func (m *Manager) Revoke(sessionID string, userID uint, reason string) error {
+	result := m.db.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoke_reason": reason})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every active session of userID and returns how many were
+// revoked.
+func (m *Manager) RevokeAll(userID uint, reason string) (int64, error) {
+	result := m.db.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoke_reason": reason})
+	return result.RowsAffected, result.Error
+}
+
+// RevokeOthers ends every active session of userID except keepID.
+func (m *Manager) RevokeOthers(userID uint, keepID, reason string) (int64, error) {
+	result := m.db.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoke_reason": reason})
+	return result.RowsAffected, result.Error
+}
+
+// Active lists the sessions of userID that have not been revoked.
+func (m *Manager) Active(userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := m.db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("last_used_at desc").Find(&sessions).Error
+	return sessions, err
+}
+
+func (m *Manager) revokeForReuse(session *models.Session) {
+	m.Revoke(session.ID, session.UserID, ReasonReuse)
+
+	details, _ := json.Marshal(map[string]string{
+		"sessionId": session.ID,
+		"ipAddress": session.IPAddress,
+	})
+	m.db.Create(&models.Activity{
+		UserID:    session.UserID,
+		Type:      string(models.ActivityTokenReuse),
+		Details:   string(details),
+		CreatedAt: time.Now(),
+	})
+}
+
+// end is when session runs out. Sessions from before ExpiresAt was stored
+// run out maxAge after they started.
+func (m *Manager) end(session *models.Session) time.Time {
+	if session.ExpiresAt != nil {
+		return *session.ExpiresAt
+	}
+	return session.CreatedAt.Add(m.maxAge)
+}
+
+// createRefreshToken issues the next refresh token of session, expiring
+// after refreshTTL or when the session ends, whichever is sooner.
+func (m *Manager) createRefreshToken(tx *gorm.DB, session *models.Session) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	expiresAt := now.Add(m.refreshTTL)
+	if end := m.end(session); end.Before(expiresAt) {
+		expiresAt = end
+	}
+	stored := models.RefreshToken{
+		SessionID: session.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+	if err := tx.Create(&stored).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (m *Manager) pair(user *models.User, sessionID, refreshToken string) (*TokenPair, error) {
+	accessToken, err := m.signer.SignSession(sessionID, user.ID, user.Email, user.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(m.signer.TTL().Seconds()),
+		SessionID:    sessionID,
+	}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
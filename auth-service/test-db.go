@@ -1,3 +1,6 @@
+//go:build ignore
+
+// Run with: go run test-db.go
 package main
 
 import (
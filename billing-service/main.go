@@ -1,10 +1,18 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/clinic"
+	"healthcare/shared/identity"
+	"healthcare/shared/policy"
+
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -22,6 +30,17 @@ type Bill struct {
 	Items         []BillItem `gorm:"foreignKey:BillID"`
 }
 
+// BillItemNoShowFee is the item type of a missed-appointment fee.
+const BillItemNoShowFee = "no_show_fee"
+
+const (
+	// noShowFeeDue is how long a patient has to pay a no-show fee.
+	noShowFeeDue = 30 * 24 * time.Hour
+	// noShowLock is the first key of the advisory lock that serializes
+	// no-show fees for one appointment.
+	noShowLock = 4242
+)
+
 type BillItem struct {
 	gorm.Model
 	BillID      uint   `gorm:"not null"`
@@ -49,6 +68,30 @@ func main() {
 
 	// Auto migrate the schema
 	db.AutoMigrate(&Bill{}, &BillItem{})
+	if err := audit.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate audit log:", err)
+	}
+
+	verifier, err := auth.NewServiceVerifier(identity.NewClientFromEnv())
+	if err != nil {
+		log.Fatal("Failed to load auth configuration:", err)
+	}
+	policies := policy.New(db)
+	auditLog := audit.NewLogger(db, "billing-service")
+
+	clinicTZ, err := clinic.Location()
+	if err != nil {
+		log.Fatal("Invalid CLINIC_TIMEZONE:", err)
+	}
+
+	// No-show fees are only billed when NO_SHOW_FEE is set
+	var noShowFee float64
+	if v := os.Getenv("NO_SHOW_FEE"); v != "" {
+		noShowFee, err = strconv.ParseFloat(v, 64)
+		if err != nil || noShowFee < 0 {
+			log.Fatal("Invalid NO_SHOW_FEE:", v)
+		}
+	}
 
 	// Initialize Gin router
 	r := gin.Default()
@@ -67,6 +110,7 @@ func main() {
 
 	// Billing routes
 	billRoutes := r.Group("/api/bills")
+	billRoutes.Use(audit.Middleware(auditLog, "bill"), auth.AuthMiddleware(verifier))
 	{
 		// Create bill
 		billRoutes.POST("/", func(c *gin.Context) {
@@ -76,6 +120,10 @@ func main() {
 				return
 			}
 
+			if !policies.Authorize(c, policy.ResourceBills, policy.ActionWrite, bill.PatientID) {
+				return
+			}
+
 			if err := db.Create(&bill).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to create bill"})
 				return
@@ -85,7 +133,7 @@ func main() {
 		})
 
 		// Get patient's bills
-		billRoutes.GET("/patient/:patientId", func(c *gin.Context) {
+		billRoutes.GET("/patient/:patientId", policies.PatientParam(policy.ResourceBills, policy.ActionRead, "patientId"), func(c *gin.Context) {
 			var bills []Bill
 			if err := db.Preload("Items").Where("patient_id = ?", c.Param("patientId")).Find(&bills).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to fetch bills"})
@@ -96,12 +144,15 @@ func main() {
 		})
 
 		// Get doctor's bills
-		billRoutes.GET("/doctor/:doctorId", func(c *gin.Context) {
+		billRoutes.GET("/doctor/:doctorId", policies.DoctorParam(policy.ResourceBills, policy.ActionRead, "doctorId"), func(c *gin.Context) {
 			var bills []Bill
 			if err := db.Preload("Items").Where("doctor_id = ?", c.Param("doctorId")).Find(&bills).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to fetch bills"})
 				return
 			}
+			for _, b := range bills {
+				audit.SetPatients(c, b.PatientID)
+			}
 
 			c.JSON(200, bills)
 		})
@@ -114,6 +165,10 @@ func main() {
 				return
 			}
 
+			if !policies.Authorize(c, policy.ResourceBills, policy.ActionRead, bill.PatientID) {
+				return
+			}
+
 			c.JSON(200, bill)
 		})
 
@@ -125,6 +180,10 @@ func main() {
 				return
 			}
 
+			if !policies.Authorize(c, policy.ResourceBills, policy.ActionWrite, bill.PatientID) {
+				return
+			}
+
 			var status struct {
 				Status string `json:"status"`
 			}
@@ -144,13 +203,23 @@ func main() {
 
 		// Add item to bill
 		billRoutes.POST("/:id/items", func(c *gin.Context) {
+			var bill Bill
+			if err := db.First(&bill, c.Param("id")).Error; err != nil {
+				c.JSON(404, gin.H{"error": "Bill not found"})
+				return
+			}
+
+			if !policies.Authorize(c, policy.ResourceBills, policy.ActionWrite, bill.PatientID) {
+				return
+			}
+
 			var item BillItem
 			if err := c.ShouldBindJSON(&item); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
 
-			item.BillID = uint(c.GetUint("id"))
+			item.BillID = bill.ID
 			if err := db.Create(&item).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to add bill item"})
 				return
@@ -160,6 +229,70 @@ func main() {
 		})
 	}
 
+	// Internal API for appointment-service
+	internal := r.Group("/internal/bills")
+	internal.Use(auth.InternalMiddleware(auth.InternalToken()))
+	{
+		// Bill the fee for a missed appointment. Repeated calls for the
+		// same appointment return the existing bill.
+		internal.POST("/no-show", func(c *gin.Context) {
+			var input struct {
+				AppointmentID uint `binding:"required"`
+				PatientID     uint `binding:"required"`
+				DoctorID      uint `binding:"required"`
+				DateTime      time.Time
+			}
+			if err := c.ShouldBindJSON(&input); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if noShowFee == 0 {
+				c.Status(204)
+				return
+			}
+
+			var bill Bill
+			created := false
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", noShowLock, input.AppointmentID).Error; err != nil {
+					return err
+				}
+				err := tx.Preload("Items").
+					Joins("JOIN bill_items ON bill_items.bill_id = bills.id AND bill_items.type = ? AND bill_items.deleted_at IS NULL", BillItemNoShowFee).
+					Where("bills.appointment_id = ?", input.AppointmentID).
+					First(&bill).Error
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+
+				bill = Bill{
+					PatientID:     input.PatientID,
+					DoctorID:      input.DoctorID,
+					AppointmentID: input.AppointmentID,
+					Amount:        noShowFee,
+					Status:        "pending",
+					DueDate:       time.Now().Add(noShowFeeDue),
+					Items: []BillItem{{
+						Type:        BillItemNoShowFee,
+						Description: "Missed appointment on " + input.DateTime.In(clinicTZ).Format("2 Jan 2006 15:04"),
+						Amount:      noShowFee,
+					}},
+				}
+				created = true
+				return tx.Create(&bill).Error
+			})
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Failed to bill no-show fee"})
+				return
+			}
+			if created {
+				c.JSON(201, bill)
+				return
+			}
+			c.JSON(200, bill)
+		})
+	}
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -1,14 +1,19 @@
 #!/bin/bash
 
-# List of services to build
+# Services built from their own directory
 services=(
   "user-service"
+)
+
+# Go services build from the repository root so they can see ./shared
+root_services=(
   "auth-service"
   "appointment-service"
   "billing-service"
   "doctor-service"
   "medical-record-service"
   "notification-service"
+  "fhir-service"
 )
 
 # Loop through each service and build the Docker image
@@ -20,4 +25,10 @@ for service in "${services[@]}"; do
   echo "$service built successfully."
 done
 
-echo "All services built successfully." 
\ No newline at end of file
+for service in "${root_services[@]}"; do
+  echo "Building $service..."
+  docker build -t "$service:latest" -f "$service/Dockerfile" . || exit
+  echo "$service built successfully."
+done
+
+echo "All services built successfully." 
@@ -9,6 +9,7 @@ services=(
     "billing-service"
     "notification-service"
     "doctor-service"
+    "fhir-service"
 )
 
 # Copy health.go to each service
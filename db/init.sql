@@ -4,6 +4,10 @@ CREATE DATABASE healthcare;
 -- Connect to the database
 \c healthcare;
 
+-- appointment-service's overlap constraint needs btree_gist, which only a
+-- superuser or the database owner can create
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
 -- Create users table
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
@@ -57,7 +61,7 @@ CREATE TABLE appointments (
     patient_id INTEGER REFERENCES users(id),
     doctor_id INTEGER REFERENCES doctors(id),
     date_time TIMESTAMP NOT NULL,
-    status VARCHAR(50) DEFAULT 'scheduled',
+    status VARCHAR(50) DEFAULT 'requested',
     type VARCHAR(50),
     notes TEXT,
     duration INTEGER DEFAULT 30,
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"healthcare/shared/appointments"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSlotMinutes = 30
+	minSlotMinutes     = 5
+	maxSlotMinutes     = 8 * 60
+	defaultSlotDays    = 7
+	maxSlotDays        = 31
+	dateLayout         = "2006-01-02"
+)
+
+// Holiday closes the clinic for a whole day. Date is in the clinic time
+// zone.
+type Holiday struct {
+	gorm.Model
+	Date string `gorm:"uniqueIndex;size:10;not null"` // YYYY-MM-DD
+	Name string
+}
+
+// AvailabilityException changes one doctor's availability once. With
+// Available false the window is taken out (leave, training); with true it
+// adds hours the weekly rules do not cover.
+type AvailabilityException struct {
+	gorm.Model
+	DoctorID  uint      `gorm:"not null;index"`
+	StartsAt  time.Time `gorm:"not null"`
+	EndsAt    time.Time `gorm:"not null"`
+	Available bool
+	Reason    string
+}
+
+// Slot is a bookable window.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// slotEngine turns weekly Availability rules, holidays, exceptions and
+// existing appointments into free slots.
+type slotEngine struct {
+	db   *gorm.DB
+	busy *appointments.Client
+	loc  *time.Location
+}
+
+func newSlotEngine(db *gorm.DB, busy *appointments.Client, loc *time.Location) *slotEngine {
+	return &slotEngine{db: db, busy: busy, loc: loc}
+}
+
+// slots lists the free windows of length in [from, to) for a doctor.
+func (e *slotEngine) slots(doctorID uint, from, to time.Time, length time.Duration) ([]Slot, error) {
+	from, to = from.In(e.loc), to.In(e.loc)
+
+	var rules []Availability
+	if err := e.db.Where("doctor_id = ? AND is_available = ?", doctorID, true).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	var holidays []Holiday
+	if err := e.db.Where("date BETWEEN ? AND ?", from.Format(dateLayout), to.Format(dateLayout)).Find(&holidays).Error; err != nil {
+		return nil, err
+	}
+	closed := make(map[string]bool, len(holidays))
+	for _, h := range holidays {
+		closed[h.Date] = true
+	}
+
+	var exceptions []AvailabilityException
+	if err := e.db.Where("doctor_id = ? AND ends_at > ? AND starts_at < ?", doctorID, from, to).Find(&exceptions).Error; err != nil {
+		return nil, err
+	}
+
+	// Expand the weekly rules day by day. time.Date normalises wall times
+	// across DST changes.
+	var open []Slot
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, e.loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if closed[day.Format(dateLayout)] {
+			continue
+		}
+		for _, r := range rules {
+			if r.DayOfWeek != int(day.Weekday()) {
+				continue
+			}
+			start, end := wallClock(day, r.StartTime), wallClock(day, r.EndTime)
+			if end.After(start) {
+				open = append(open, Slot{Start: start, End: end})
+			}
+		}
+	}
+	for _, x := range exceptions {
+		if x.Available {
+			open = append(open, Slot{Start: x.StartsAt, End: x.EndsAt})
+		}
+	}
+	open = merge(open)
+
+	for _, x := range exceptions {
+		if !x.Available {
+			open = subtract(open, Slot{Start: x.StartsAt, End: x.EndsAt})
+		}
+	}
+	booked, err := e.busy.Busy(doctorID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range booked {
+		open = subtract(open, Slot{Start: b.Start, End: b.End})
+	}
+
+	// Cut each window into back-to-back slots from its start, dropping
+	// the ones outside [from, to)
+	slots := []Slot{}
+	for _, w := range open {
+		for start := w.Start; !start.Add(length).After(w.End) && start.Before(to); start = start.Add(length) {
+			if !start.Before(from) {
+				slots = append(slots, Slot{Start: start.In(e.loc), End: start.Add(length).In(e.loc)})
+			}
+		}
+	}
+	return slots, nil
+}
+
+// wallClock places the hour and minute of a rule time on day. Rule times
+// carry only a time of day; their UTC hour and minute are read as clinic
+// local time.
+func wallClock(day, t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location())
+}
+
+// merge sorts windows and joins the ones that overlap or touch.
+func merge(windows []Slot) []Slot {
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	var merged []Slot
+	for _, w := range windows {
+		if n := len(merged); n > 0 && !w.Start.After(merged[n-1].End) {
+			if w.End.After(merged[n-1].End) {
+				merged[n-1].End = w.End
+			}
+			continue
+		}
+		merged = append(merged, w)
+	}
+	return merged
+}
+
+// subtract removes cut from every window.
+func subtract(windows []Slot, cut Slot) []Slot {
+	var out []Slot
+	for _, w := range windows {
+		if !cut.Start.Before(w.End) || !cut.End.After(w.Start) {
+			out = append(out, w)
+			continue
+		}
+		if cut.Start.After(w.Start) {
+			out = append(out, Slot{Start: w.Start, End: cut.Start})
+		}
+		if cut.End.Before(w.End) {
+			out = append(out, Slot{Start: cut.End, End: w.End})
+		}
+	}
+	return out
+}
+
+// list answers GET /api/doctors/:id/slots?from=&to=&duration=. from and to
+// are dates in the clinic time zone (to inclusive) or RFC 3339 times;
+// duration is in minutes.
+func (e *slotEngine) list(c *gin.Context) {
+	doctorID, ok := doctorIDParam(c)
+	if !ok {
+		return
+	}
+	var doctor Doctor
+	if err := e.db.First(&doctor, doctorID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Doctor not found"})
+		return
+	}
+
+	minutes := defaultSlotMinutes
+	if v := c.Query("duration"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minSlotMinutes || n > maxSlotMinutes {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("duration must be between %d and %d minutes", minSlotMinutes, maxSlotMinutes)})
+			return
+		}
+		minutes = n
+	}
+
+	now := time.Now()
+	from, to := now, now.AddDate(0, 0, defaultSlotDays)
+	var err error
+	if v := c.Query("from"); v != "" {
+		if from, err = e.parseBound(v, false); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid from: " + err.Error()})
+			return
+		}
+		to = from.AddDate(0, 0, defaultSlotDays)
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = e.parseBound(v, true); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid to: " + err.Error()})
+			return
+		}
+	}
+	if !to.After(from) {
+		c.JSON(400, gin.H{"error": "to must be after from"})
+		return
+	}
+	if to.Sub(from) > maxSlotDays*24*time.Hour {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Range may not exceed %d days", maxSlotDays)})
+		return
+	}
+	// Only future time can be booked
+	if from.Before(now) {
+		from = now
+	}
+
+	slots, err := e.slots(doctor.ID, from, to, time.Duration(minutes)*time.Minute)
+	if err != nil {
+		log.Printf("Failed to compute slots for doctor %d: %v", doctor.ID, err)
+		c.JSON(502, gin.H{"error": "Failed to compute slots"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"doctorId": doctor.ID,
+		"timezone": e.loc.String(),
+		"duration": minutes,
+		"slots":    slots,
+	})
+}
+
+// parseBound reads a date in the clinic time zone or an RFC 3339 time. A
+// date used as an upper bound means the end of that day.
+func (e *slotEngine) parseBound(v string, upper bool) (time.Time, error) {
+	if t, err := time.ParseInLocation(dateLayout, v, e.loc); err == nil {
+		if upper {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.New("use YYYY-MM-DD or RFC 3339")
+	}
+	return t, nil
+}
+
+// doctorIDParam parses the :id path parameter.
+func doctorIDParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid doctor ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
@@ -5,6 +5,12 @@ import (
 	"os"
 	"time"
 
+	"healthcare/shared/appointments"
+	"healthcare/shared/auth"
+	"healthcare/shared/clinic"
+	"healthcare/shared/identity"
+	"healthcare/shared/policy"
+
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -13,7 +19,7 @@ import (
 
 type Doctor struct {
 	gorm.Model
-	UserID         uint `gorm:"not null"`
+	UserID         uint `gorm:"not null;uniqueIndex:idx_doctors_user_id,where:deleted_at IS NULL"` // one profile per user
 	Specialization string
 	LicenseNumber  string         `gorm:"unique"`
 	Experience     int            // years of experience
@@ -39,6 +45,23 @@ type Availability struct {
 	IsAvailable bool `gorm:"default:true"`
 }
 
+// NewDoctor is the body of a new profile. A doctor's profile is always
+// their own; UserID is read only from admins.
+type NewDoctor struct {
+	UserID         uint
+	Specialization string
+	LicenseNumber  string
+	Experience     int
+}
+
+// DoctorUpdate is the body of a profile change. Omitted fields are left as
+// they are; the owner, education and availability have their own routes.
+type DoctorUpdate struct {
+	Specialization *string
+	LicenseNumber  *string
+	Experience     *int
+}
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
@@ -57,7 +80,19 @@ func main() {
 	}
 
 	// Auto migrate the schema
-	db.AutoMigrate(&Doctor{}, &Education{}, &Availability{})
+	db.AutoMigrate(&Doctor{}, &Education{}, &Availability{}, &Holiday{}, &AvailabilityException{})
+
+	verifier, err := auth.NewServiceVerifier(identity.NewClientFromEnv())
+	if err != nil {
+		log.Fatal("Failed to load auth configuration:", err)
+	}
+
+	clinicTZ, err := clinic.Location()
+	if err != nil {
+		log.Fatal("Invalid CLINIC_TIMEZONE:", err)
+	}
+	policies := policy.New(db)
+	slotEngine := newSlotEngine(db, appointments.NewClientFromEnv(), clinicTZ)
 
 	// Initialize Gin router
 	r := gin.Default()
@@ -77,14 +112,43 @@ func main() {
 	// Doctor routes
 	doctorRoutes := r.Group("/api/doctors")
 	{
+		// Profile changes require a doctor or admin token; listings stay public
+		protected := doctorRoutes.Group("", auth.AuthMiddleware(verifier), auth.RoleMiddleware(auth.RoleAdmin, auth.RoleDoctor))
+		// A doctor changes only their own profile and calendar, which decide
+		// the slots patients can book; admins change anyone's
+		owner := policies.DoctorParam(policy.ResourceAppointments, policy.ActionWrite, "id")
+
 		// Create doctor profile
-		doctorRoutes.POST("/", func(c *gin.Context) {
-			var doctor Doctor
-			if err := c.ShouldBindJSON(&doctor); err != nil {
+		protected.POST("/", func(c *gin.Context) {
+			var input NewDoctor
+			if err := c.ShouldBindJSON(&input); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
+			if auth.Role(c) == auth.RoleDoctor {
+				input.UserID = auth.UserID(c)
+			}
+			if input.UserID == 0 {
+				c.JSON(400, gin.H{"error": "UserID is required"})
+				return
+			}
 
+			var existing int64
+			if err := db.Model(&Doctor{}).Where("user_id = ?", input.UserID).Count(&existing).Error; err != nil {
+				c.JSON(400, gin.H{"error": "Failed to create doctor profile"})
+				return
+			}
+			if existing > 0 {
+				c.JSON(409, gin.H{"error": "User already has a doctor profile"})
+				return
+			}
+
+			doctor := Doctor{
+				UserID:         input.UserID,
+				Specialization: input.Specialization,
+				LicenseNumber:  input.LicenseNumber,
+				Experience:     input.Experience,
+			}
 			if err := db.Create(&doctor).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to create doctor profile"})
 				return
@@ -116,19 +180,30 @@ func main() {
 		})
 
 		// Update doctor profile
-		doctorRoutes.PUT("/:id", func(c *gin.Context) {
+		protected.PUT("/:id", owner, func(c *gin.Context) {
 			var doctor Doctor
 			if err := db.First(&doctor, c.Param("id")).Error; err != nil {
 				c.JSON(404, gin.H{"error": "Doctor not found"})
 				return
 			}
 
-			if err := c.ShouldBindJSON(&doctor); err != nil {
+			var input DoctorUpdate
+			if err := c.ShouldBindJSON(&input); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
 
-			if err := db.Save(&doctor).Error; err != nil {
+			updates := map[string]interface{}{}
+			if input.Specialization != nil {
+				updates["specialization"] = *input.Specialization
+			}
+			if input.LicenseNumber != nil {
+				updates["license_number"] = *input.LicenseNumber
+			}
+			if input.Experience != nil {
+				updates["experience"] = *input.Experience
+			}
+			if err := db.Model(&doctor).Updates(updates).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to update doctor profile"})
 				return
 			}
@@ -137,14 +212,19 @@ func main() {
 		})
 
 		// Add education
-		doctorRoutes.POST("/:id/education", func(c *gin.Context) {
+		protected.POST("/:id/education", owner, func(c *gin.Context) {
 			var education Education
 			if err := c.ShouldBindJSON(&education); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
 
-			education.DoctorID = uint(c.GetUint("id"))
+			doctorID, ok := doctorIDParam(c)
+			if !ok {
+				return
+			}
+			education.ID = 0
+			education.DoctorID = doctorID
 			if err := db.Create(&education).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to add education"})
 				return
@@ -154,14 +234,19 @@ func main() {
 		})
 
 		// Update availability
-		doctorRoutes.POST("/:id/availability", func(c *gin.Context) {
+		protected.POST("/:id/availability", owner, func(c *gin.Context) {
 			var availability Availability
 			if err := c.ShouldBindJSON(&availability); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
 
-			availability.DoctorID = uint(c.GetUint("id"))
+			doctorID, ok := doctorIDParam(c)
+			if !ok {
+				return
+			}
+			availability.ID = 0
+			availability.DoctorID = doctorID
 			if err := db.Create(&availability).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to add availability"})
 				return
@@ -170,6 +255,65 @@ func main() {
 			c.JSON(201, availability)
 		})
 
+		// Free slots from the weekly rules, minus holidays, exceptions and
+		// booked appointments
+		doctorRoutes.GET("/:id/slots", slotEngine.list)
+
+		// One-off changes to a doctor's availability
+		protected.GET("/:id/exceptions", func(c *gin.Context) {
+			doctorID, ok := doctorIDParam(c)
+			if !ok {
+				return
+			}
+
+			var exceptions []AvailabilityException
+			if err := db.Where("doctor_id = ? AND ends_at > ?", doctorID, time.Now()).Order("starts_at").Find(&exceptions).Error; err != nil {
+				c.JSON(400, gin.H{"error": "Failed to fetch exceptions"})
+				return
+			}
+
+			c.JSON(200, exceptions)
+		})
+
+		protected.POST("/:id/exceptions", owner, func(c *gin.Context) {
+			var exception AvailabilityException
+			if err := c.ShouldBindJSON(&exception); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if !exception.EndsAt.After(exception.StartsAt) {
+				c.JSON(400, gin.H{"error": "EndsAt must be after StartsAt"})
+				return
+			}
+
+			doctorID, ok := doctorIDParam(c)
+			if !ok {
+				return
+			}
+			exception.ID = 0
+			exception.DoctorID = doctorID
+			if err := db.Create(&exception).Error; err != nil {
+				c.JSON(400, gin.H{"error": "Failed to add exception"})
+				return
+			}
+
+			c.JSON(201, exception)
+		})
+
+		protected.DELETE("/:id/exceptions/:exceptionId", owner, func(c *gin.Context) {
+			result := db.Where("id = ? AND doctor_id = ?", c.Param("exceptionId"), c.Param("id")).Delete(&AvailabilityException{})
+			if result.Error != nil {
+				c.JSON(400, gin.H{"error": "Failed to delete exception"})
+				return
+			}
+			if result.RowsAffected == 0 {
+				c.JSON(404, gin.H{"error": "Exception not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"message": "Exception deleted"})
+		})
+
 		// Get doctors by specialization
 		doctorRoutes.GET("/specialization/:specialization", func(c *gin.Context) {
 			var doctors []Doctor
@@ -182,6 +326,57 @@ func main() {
 		})
 	}
 
+	// Clinic holidays; anyone may list them, admins manage them
+	holidayRoutes := r.Group("/api/holidays")
+	{
+		holidayRoutes.GET("/", func(c *gin.Context) {
+			var holidays []Holiday
+			if err := db.Where("date >= ?", time.Now().In(clinicTZ).Format(dateLayout)).Order("date").Find(&holidays).Error; err != nil {
+				c.JSON(400, gin.H{"error": "Failed to fetch holidays"})
+				return
+			}
+
+			c.JSON(200, holidays)
+		})
+
+		admin := holidayRoutes.Group("", auth.AuthMiddleware(verifier), auth.RoleMiddleware(auth.RoleAdmin))
+
+		admin.POST("/", func(c *gin.Context) {
+			var holiday Holiday
+			if err := c.ShouldBindJSON(&holiday); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if _, err := time.Parse(dateLayout, holiday.Date); err != nil {
+				c.JSON(400, gin.H{"error": "Date must be YYYY-MM-DD"})
+				return
+			}
+
+			holiday.ID = 0
+			if err := db.Create(&holiday).Error; err != nil {
+				c.JSON(400, gin.H{"error": "Failed to add holiday"})
+				return
+			}
+
+			c.JSON(201, holiday)
+		})
+
+		admin.DELETE("/:id", func(c *gin.Context) {
+			// Hard delete, so the date can be added again
+			result := db.Unscoped().Where("id = ?", c.Param("id")).Delete(&Holiday{})
+			if result.Error != nil {
+				c.JSON(400, gin.H{"error": "Failed to delete holiday"})
+				return
+			}
+			if result.RowsAffected == 0 {
+				c.JSON(404, gin.H{"error": "Holiday not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"message": "Holiday deleted"})
+		})
+	}
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// appointmentStatuses maps appointment-service's statuses to FHIR's. A
+// rescheduled appointment was replaced by a new one, so it reads as
+// cancelled.
+var appointmentStatuses = map[string]string{
+	"requested":   "pending",
+	"confirmed":   "booked",
+	"checked_in":  "checked-in",
+	"in_progress": "arrived",
+	"completed":   "fulfilled",
+	"no_show":     "noshow",
+	"cancelled":   "cancelled",
+	"rescheduled": "cancelled",
+}
+
+var appointmentType = &resourceType{
+	Name:     "Appointment",
+	IDColumn: "appointments.id",
+	Params: []searchParam{
+		refParam("patient", "appointments.patient_id", "Patient"),
+		refParam("practitioner", "appointments.doctor_id", "Practitioner"),
+		dateParam("date", "appointments.date_time"),
+		{Name: "status", Type: "token", cond: func(s *server, v string) (string, []interface{}, error) {
+			var statuses []string
+			for ours, theirs := range appointmentStatuses {
+				if theirs == v {
+					statuses = append(statuses, ours)
+				}
+			}
+			if len(statuses) == 0 {
+				return "1 = 0", nil, nil
+			}
+			return "appointments.status IN ?", []interface{}{statuses}, nil
+		}},
+	},
+	query: func(s *server, c *gin.Context) (*gorm.DB, error) {
+		scope, err := s.scope(c, policy.ResourceAppointments, "appointments.patient_id")
+		if err != nil {
+			return nil, err
+		}
+		return s.db.Model(&StoredAppointment{}).Scopes(scope), nil
+	},
+	fetch: func(s *server, db *gorm.DB) ([]match, error) {
+		var appointments []StoredAppointment
+		if err := db.Find(&appointments).Error; err != nil {
+			return nil, err
+		}
+		matches := make([]match, len(appointments))
+		for i := range appointments {
+			a := &appointments[i]
+			matches[i] = match{ID: a.ID, PatientID: a.PatientID, Resource: toAppointment(a)}
+		}
+		return matches, nil
+	},
+}
+
+func toAppointment(a *StoredAppointment) Appointment {
+	status, ok := appointmentStatuses[a.Status]
+	if !ok {
+		status = "booked"
+	}
+	end := a.EndTime
+	if end.IsZero() {
+		end = a.DateTime.Add(time.Duration(a.Duration) * time.Minute)
+	}
+	// The doctor has yet to accept a requested appointment
+	doctorStatus := "accepted"
+	if a.Status == "requested" {
+		doctorStatus = "needs-action"
+	}
+	appointment := Appointment{
+		ResourceType:    "Appointment",
+		ID:              idString(a.ID),
+		Meta:            meta(a.UpdatedAt),
+		Status:          status,
+		Start:           instant(a.DateTime),
+		End:             instant(end),
+		MinutesDuration: a.Duration,
+		Created:         instant(a.CreatedAt),
+		Comment:         a.Notes,
+		Participant: []AppointmentParticipant{
+			{Actor: ref("Patient", a.PatientID), Required: "required", Status: "accepted"},
+			{Actor: ref("Practitioner", a.DoctorID), Required: "required", Status: doctorStatus},
+		},
+	}
+	if a.Type != "" {
+		appointment.AppointmentType = &CodeableConcept{Text: a.Type}
+	}
+	return appointment
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CapabilityStatement struct {
+	ResourceType string              `json:"resourceType"`
+	Status       string              `json:"status"`
+	Date         string              `json:"date"`
+	Kind         string              `json:"kind"`
+	Software     *CapabilitySoftware `json:"software,omitempty"`
+	FHIRVersion  string              `json:"fhirVersion"`
+	Format       []string            `json:"format"`
+	Rest         []CapabilityRest    `json:"rest"`
+}
+
+type CapabilitySoftware struct {
+	Name string `json:"name"`
+}
+
+type CapabilityRest struct {
+	Mode     string               `json:"mode"`
+	Security *CapabilitySecurity  `json:"security,omitempty"`
+	Resource []CapabilityResource `json:"resource"`
+}
+
+type CapabilitySecurity struct {
+	Description string `json:"description"`
+}
+
+type CapabilityResource struct {
+	Type        string                  `json:"type"`
+	Interaction []CapabilityInteraction `json:"interaction"`
+	SearchParam []CapabilitySearchParam `json:"searchParam,omitempty"`
+}
+
+type CapabilityInteraction struct {
+	Code string `json:"code"`
+}
+
+type CapabilitySearchParam struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// capability answers GET /fhir/metadata. It is built from the served
+// resource types, so it lists exactly what search accepts.
+func (s *server) capability(c *gin.Context) {
+	rest := CapabilityRest{
+		Mode:     "server",
+		Security: &CapabilitySecurity{Description: "Bearer access tokens issued by auth-service, checked against its JWKS. Results are limited to the patients the caller may access."},
+	}
+	for _, t := range s.types {
+		res := CapabilityResource{
+			Type:        t.Name,
+			Interaction: []CapabilityInteraction{{Code: "read"}, {Code: "search-type"}},
+			SearchParam: []CapabilitySearchParam{{Name: "_id", Type: "token"}},
+		}
+		for _, p := range t.Params {
+			res.SearchParam = append(res.SearchParam, CapabilitySearchParam{Name: p.Name, Type: p.Type})
+		}
+		rest.Resource = append(rest.Resource, res)
+	}
+	respond(c, 200, CapabilityStatement{
+		ResourceType: "CapabilityStatement",
+		Status:       "active",
+		Date:         instant(time.Now()),
+		Kind:         "instance",
+		Software:     &CapabilitySoftware{Name: "healthcare fhir-service"},
+		FHIRVersion:  fhirVersion,
+		Format:       []string{"json"},
+		Rest:         []CapabilityRest{rest},
+	})
+}
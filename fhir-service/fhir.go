@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FHIR R4 types, trimmed to the elements this service fills in.
+
+const (
+	fhirVersion = "4.0.1"
+	contentType = "application/fhir+json; charset=utf-8"
+	// licenseSystem identifies doctors' license numbers in Practitioner
+	// identifiers.
+	licenseSystem = "urn:healthcare:doctor-license"
+)
+
+type Meta struct {
+	LastUpdated string `json:"lastUpdated,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type HumanName struct {
+	Use    string   `json:"use,omitempty"`
+	Text   string   `json:"text,omitempty"`
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+type ContactPoint struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Use    string `json:"use,omitempty"`
+}
+
+type Address struct {
+	Text string `json:"text,omitempty"`
+}
+
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type Period struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+type Attachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Creation    string `json:"creation,omitempty"`
+}
+
+type Annotation struct {
+	Text string `json:"text"`
+}
+
+type Patient struct {
+	ResourceType string           `json:"resourceType"`
+	ID           string           `json:"id"`
+	Meta         *Meta            `json:"meta,omitempty"`
+	Active       bool             `json:"active"`
+	Name         []HumanName      `json:"name,omitempty"`
+	Telecom      []ContactPoint   `json:"telecom,omitempty"`
+	Gender       string           `json:"gender,omitempty"`
+	BirthDate    string           `json:"birthDate,omitempty"`
+	Address      []Address        `json:"address,omitempty"`
+	Contact      []PatientContact `json:"contact,omitempty"`
+}
+
+type PatientContact struct {
+	Name    *HumanName     `json:"name,omitempty"`
+	Telecom []ContactPoint `json:"telecom,omitempty"`
+}
+
+type Practitioner struct {
+	ResourceType  string          `json:"resourceType"`
+	ID            string          `json:"id"`
+	Meta          *Meta           `json:"meta,omitempty"`
+	Identifier    []Identifier    `json:"identifier,omitempty"`
+	Active        bool            `json:"active"`
+	Name          []HumanName     `json:"name,omitempty"`
+	Telecom       []ContactPoint  `json:"telecom,omitempty"`
+	Qualification []Qualification `json:"qualification,omitempty"`
+}
+
+type Qualification struct {
+	Code   CodeableConcept `json:"code"`
+	Period *Period         `json:"period,omitempty"`
+	Issuer *Reference      `json:"issuer,omitempty"`
+}
+
+type Appointment struct {
+	ResourceType    string                   `json:"resourceType"`
+	ID              string                   `json:"id"`
+	Meta            *Meta                    `json:"meta,omitempty"`
+	Status          string                   `json:"status"`
+	AppointmentType *CodeableConcept         `json:"appointmentType,omitempty"`
+	Start           string                   `json:"start,omitempty"`
+	End             string                   `json:"end,omitempty"`
+	MinutesDuration int                      `json:"minutesDuration,omitempty"`
+	Created         string                   `json:"created,omitempty"`
+	Comment         string                   `json:"comment,omitempty"`
+	Participant     []AppointmentParticipant `json:"participant"`
+}
+
+type AppointmentParticipant struct {
+	Actor    Reference `json:"actor"`
+	Required string    `json:"required,omitempty"`
+	Status   string    `json:"status"`
+}
+
+type Encounter struct {
+	ResourceType string                 `json:"resourceType"`
+	ID           string                 `json:"id"`
+	Meta         *Meta                  `json:"meta,omitempty"`
+	Status       string                 `json:"status"`
+	Class        Coding                 `json:"class"`
+	Subject      Reference              `json:"subject"`
+	Participant  []EncounterParticipant `json:"participant,omitempty"`
+	Period       *Period                `json:"period,omitempty"`
+}
+
+type EncounterParticipant struct {
+	Individual Reference `json:"individual"`
+}
+
+type Condition struct {
+	ResourceType       string            `json:"resourceType"`
+	ID                 string            `json:"id"`
+	Meta               *Meta             `json:"meta,omitempty"`
+	VerificationStatus CodeableConcept   `json:"verificationStatus"`
+	Category           []CodeableConcept `json:"category,omitempty"`
+	Code               CodeableConcept   `json:"code"`
+	Subject            Reference         `json:"subject"`
+	Encounter          *Reference        `json:"encounter,omitempty"`
+	RecordedDate       string            `json:"recordedDate,omitempty"`
+	Recorder           *Reference        `json:"recorder,omitempty"`
+	Note               []Annotation      `json:"note,omitempty"`
+}
+
+type MedicationRequest struct {
+	ResourceType              string          `json:"resourceType"`
+	ID                        string          `json:"id"`
+	Meta                      *Meta           `json:"meta,omitempty"`
+	Status                    string          `json:"status"`
+	Intent                    string          `json:"intent"`
+	MedicationCodeableConcept CodeableConcept `json:"medicationCodeableConcept"`
+	Subject                   Reference       `json:"subject"`
+	Encounter                 *Reference      `json:"encounter,omitempty"`
+	AuthoredOn                string          `json:"authoredOn,omitempty"`
+	Requester                 *Reference      `json:"requester,omitempty"`
+}
+
+type DocumentReference struct {
+	ResourceType string                     `json:"resourceType"`
+	ID           string                     `json:"id"`
+	Meta         *Meta                      `json:"meta,omitempty"`
+	Status       string                     `json:"status"`
+	Subject      Reference                  `json:"subject"`
+	Date         string                     `json:"date,omitempty"`
+	Description  string                     `json:"description,omitempty"`
+	Content      []DocumentReferenceContent `json:"content"`
+	Context      *DocumentReferenceContext  `json:"context,omitempty"`
+}
+
+type DocumentReferenceContent struct {
+	Attachment Attachment `json:"attachment"`
+}
+
+type DocumentReferenceContext struct {
+	Encounter []Reference `json:"encounter,omitempty"`
+}
+
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Meta         *Meta         `json:"meta,omitempty"`
+	Type         string        `json:"type"`
+	Total        int64         `json:"total"`
+	Link         []BundleLink  `json:"link,omitempty"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+type BundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+type BundleEntry struct {
+	FullURL  string       `json:"fullUrl"`
+	Resource interface{}  `json:"resource"`
+	Search   *EntrySearch `json:"search,omitempty"`
+}
+
+type EntrySearch struct {
+	Mode string `json:"mode"`
+}
+
+type OperationOutcome struct {
+	ResourceType string         `json:"resourceType"`
+	Issue        []OutcomeIssue `json:"issue"`
+}
+
+type OutcomeIssue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+// respond writes v as FHIR JSON.
+func respond(c *gin.Context, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status, data = 500, []byte(`{"resourceType":"OperationOutcome","issue":[{"severity":"fatal","code":"exception"}]}`)
+	}
+	c.Data(status, contentType, data)
+}
+
+// fail answers with an OperationOutcome. code is a FHIR issue type, such
+// as not-found or invalid.
+func fail(c *gin.Context, status int, code, diagnostics string) {
+	respond(c, status, OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue:        []OutcomeIssue{{Severity: "error", Code: code, Diagnostics: diagnostics}},
+	})
+}
+
+func ref(resourceType string, id uint) Reference {
+	return Reference{Reference: resourceType + "/" + strconv.FormatUint(uint64(id), 10)}
+}
+
+func refPtr(resourceType string, id uint) *Reference {
+	if id == 0 {
+		return nil
+	}
+	r := ref(resourceType, id)
+	return &r
+}
+
+func meta(updated time.Time) *Meta {
+	return &Meta{LastUpdated: instant(updated)}
+}
+
+// instant formats a FHIR instant or dateTime.
+func instant(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func idString(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/clinic"
+	"healthcare/shared/envelope"
+	"healthcare/shared/identity"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func main() {
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	// Database connection
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		dsn = "host=localhost user=postgres password=postgres dbname=healthcare port=5432 sslmode=disable"
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	// Clinical fields are sealed by the services that write them; the
+	// serializer has to be in place before gorm parses the models
+	keys, err := envelope.NewKeyringFromEnv(db)
+	if err != nil {
+		log.Fatal("Failed to set up encryption keys:", err)
+	}
+	envelope.Register(keys)
+
+	// The tables belong to the other services; only the audit log is ours
+	if err := audit.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate audit log:", err)
+	}
+
+	verifier, err := auth.NewServiceVerifier(identity.NewClientFromEnv())
+	if err != nil {
+		log.Fatal("Failed to load auth configuration:", err)
+	}
+	auditLog := audit.NewLogger(db, "fhir-service")
+	clinicTZ, err := clinic.Location()
+	if err != nil {
+		log.Fatal("Invalid CLINIC_TIMEZONE:", err)
+	}
+	fhir := newServer(db, policy.New(db), clinicTZ)
+
+	// Initialize Gin router
+	r := gin.Default()
+
+	// CORS middleware
+	r.Use(func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Accept")
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+		c.Next()
+	})
+
+	// FHIR R4 API; the CapabilityStatement is public, as the spec expects
+	r.GET("/fhir/metadata", fhir.capability)
+	fhirRoutes := r.Group("/fhir")
+	fhirRoutes.Use(audit.Middleware(auditLog, "fhir"), auth.AuthMiddleware(verifier))
+	{
+		fhirRoutes.GET("/:type", fhir.search)
+		fhirRoutes.GET("/:type/:id", fhir.read)
+	}
+
+	// Start server
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8088"
+	}
+	r.Run(":" + port)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Read-only views of tables the other services own. Only the columns this
+// service maps are declared, and it never migrates them.
+
+// User and BioInformation read auth-service's tables directly, against the
+// rule that user data goes through shared/identity. FHIR searches filter
+// patients and practitioners on name, email, phone, gender and birth date,
+// limit them to the caller's policy scope, and page the result, all in one
+// query; the internal API fetches users by ID or role and cannot do that.
+// This service never writes either table, and a change to their columns in
+// auth-service has to be made here too.
+type User struct {
+	gorm.Model
+	Email     string
+	FirstName string
+	LastName  string
+	Role      string
+	IsActive  bool
+	Phone     string
+	Address   string
+}
+
+type BioInformation struct {
+	gorm.Model
+	UserID            uint
+	FullName          string
+	DateOfBirth       string
+	Gender            string
+	Address           string
+	Phone             string
+	EmergencyContacts []EmergencyContact `gorm:"foreignKey:BioInfoID"`
+}
+
+type EmergencyContact struct {
+	ID        uint
+	BioInfoID uint
+	Name      string
+	Phone     string
+}
+
+type Doctor struct {
+	gorm.Model
+	UserID        uint
+	LicenseNumber string
+	User          User        `gorm:"foreignKey:UserID"`
+	Education     []Education `gorm:"foreignKey:DoctorID"`
+}
+
+type Education struct {
+	gorm.Model
+	DoctorID    uint
+	Degree      string
+	Institution string
+	Year        int
+	Field       string
+}
+
+// StoredAppointment and StoredAttachment are named apart from the FHIR
+// resources they map to.
+type StoredAppointment struct {
+	gorm.Model
+	PatientID uint
+	DoctorID  uint
+	DateTime  time.Time
+	Status    string
+	Type      string
+	Notes     string
+	Duration  int
+	EndTime   time.Time
+}
+
+func (StoredAppointment) TableName() string {
+	return "appointments"
+}
+
+type MedicalRecord struct {
+	gorm.Model
+	PatientID    uint
+	DoctorID     uint
+	Date         time.Time
+	Diagnosis    string `gorm:"serializer:encrypted"`
+	Prescription string `gorm:"serializer:encrypted"`
+	Notes        string `gorm:"serializer:encrypted"`
+	Status       string
+}
+
+type StoredAttachment struct {
+	gorm.Model
+	RecordID    uint
+	URL         string
+	Name        string
+	ContentType string
+	Size        int64
+	StorageKey  string
+}
+
+func (StoredAttachment) TableName() string {
+	return "attachments"
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"healthcare/shared/auth"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// bioSubquery selects the users whose bio information matches cond.
+const bioSubquery = "users.id IN (SELECT user_id FROM bio_informations WHERE deleted_at IS NULL AND "
+
+// Patients are users with the patient role and their bio information.
+// Their demographics are shown to whoever may see their appointments.
+var patientType = &resourceType{
+	Name:     "Patient",
+	IDColumn: "users.id",
+	Params: []searchParam{
+		{Name: "name", Type: "string", cond: func(s *server, v string) (string, []interface{}, error) {
+			sql, args, err := stringParam("name", "users.first_name", "users.last_name").cond(s, v)
+			if err != nil {
+				return "", nil, err
+			}
+			bioSQL, bioArgs, _ := stringParam("name", "full_name").cond(s, v)
+			return sql + " OR " + bioSubquery + "(" + bioSQL + "))", append(args, bioArgs...), nil
+		}},
+		stringParam("family", "users.last_name"),
+		stringParam("given", "users.first_name"),
+		{Name: "email", Type: "token", cond: func(s *server, v string) (string, []interface{}, error) {
+			return "LOWER(users.email) = LOWER(?)", []interface{}{v}, nil
+		}},
+		{Name: "phone", Type: "token", cond: func(s *server, v string) (string, []interface{}, error) {
+			return "users.phone = ? OR " + bioSubquery + "phone = ?)", []interface{}{v, v}, nil
+		}},
+		{Name: "gender", Type: "token", cond: func(s *server, v string) (string, []interface{}, error) {
+			switch v {
+			case "male", "female", "unknown":
+				return bioSubquery + "LOWER(gender) IN ?)", []interface{}{genderAliases[v]}, nil
+			case "other":
+				known := []string{""}
+				for _, aliases := range genderAliases {
+					known = append(known, aliases...)
+				}
+				return bioSubquery + "LOWER(gender) NOT IN ?)", []interface{}{known}, nil
+			}
+			return "", nil, paramError("gender must be male, female, other or unknown")
+		}},
+		{Name: "birthdate", Type: "date", cond: func(s *server, v string) (string, []interface{}, error) {
+			// Birth dates are stored as text, so only whole years, months or
+			// days are matched
+			if _, _, err := s.parseDate(v); err != nil || strings.Contains(v, "T") {
+				return "", nil, paramError("birthdate must be a year, a month or a day without a prefix")
+			}
+			return bioSubquery + "date_of_birth LIKE ?)", []interface{}{v + "%"}, nil
+		}},
+	},
+	query: func(s *server, c *gin.Context) (*gorm.DB, error) {
+		scope, err := s.scope(c, policy.ResourceAppointments, "users.id")
+		if err != nil {
+			return nil, err
+		}
+		return s.db.Model(&User{}).Where("users.role = ?", auth.RolePatient).Scopes(scope), nil
+	},
+	fetch: func(s *server, db *gorm.DB) ([]match, error) {
+		var users []User
+		if err := db.Find(&users).Error; err != nil {
+			return nil, err
+		}
+		ids := make([]uint, len(users))
+		for i, u := range users {
+			ids[i] = u.ID
+		}
+		var bios []BioInformation
+		if err := s.db.Preload("EmergencyContacts").Where("user_id IN ?", ids).Find(&bios).Error; err != nil {
+			return nil, err
+		}
+		bioOf := map[uint]*BioInformation{}
+		for i := range bios {
+			bioOf[bios[i].UserID] = &bios[i]
+		}
+
+		matches := make([]match, len(users))
+		for i := range users {
+			matches[i] = match{ID: users[i].ID, PatientID: users[i].ID, Resource: toPatient(&users[i], bioOf[users[i].ID])}
+		}
+		return matches, nil
+	},
+}
+
+// genderAliases are the stored genders each FHIR gender stands for.
+var genderAliases = map[string][]string{
+	"male":    {"male", "m"},
+	"female":  {"female", "f"},
+	"unknown": {"unknown"},
+}
+
+func fhirGender(gender string) string {
+	gender = strings.ToLower(strings.TrimSpace(gender))
+	if gender == "" {
+		return ""
+	}
+	for code, aliases := range genderAliases {
+		for _, alias := range aliases {
+			if gender == alias {
+				return code
+			}
+		}
+	}
+	return "other"
+}
+
+func toPatient(u *User, bio *BioInformation) Patient {
+	p := Patient{
+		ResourceType: "Patient",
+		ID:           idString(u.ID),
+		Meta:         meta(u.UpdatedAt),
+		Active:       u.IsActive,
+		Name:         names(u),
+		Telecom:      telecom(u.Email, u.Phone),
+	}
+	address := u.Address
+	if bio != nil {
+		if bio.FullName != "" && len(p.Name) > 0 {
+			p.Name[0].Text = bio.FullName
+		}
+		if bio.Phone != "" && bio.Phone != u.Phone {
+			p.Telecom = append(p.Telecom, ContactPoint{System: "phone", Value: bio.Phone})
+		}
+		p.Gender = fhirGender(bio.Gender)
+		if _, err := time.Parse("2006-01-02", bio.DateOfBirth); err == nil {
+			p.BirthDate = bio.DateOfBirth
+		}
+		if bio.Address != "" {
+			address = bio.Address
+		}
+		for _, contact := range bio.EmergencyContacts {
+			p.Contact = append(p.Contact, PatientContact{
+				Name:    &HumanName{Text: contact.Name},
+				Telecom: telecom("", contact.Phone),
+			})
+		}
+	}
+	if address != "" {
+		p.Address = []Address{{Text: address}}
+	}
+	return p
+}
+
+func names(u *User) []HumanName {
+	if u.FirstName == "" && u.LastName == "" {
+		return nil
+	}
+	name := HumanName{Use: "official", Family: u.LastName, Text: strings.TrimSpace(u.FirstName + " " + u.LastName)}
+	if u.FirstName != "" {
+		name.Given = strings.Fields(u.FirstName)
+	}
+	return []HumanName{name}
+}
+
+func telecom(email, phone string) []ContactPoint {
+	var points []ContactPoint
+	if email != "" {
+		points = append(points, ContactPoint{System: "email", Value: email})
+	}
+	if phone != "" {
+		points = append(points, ContactPoint{System: "phone", Value: phone})
+	}
+	return points
+}
+
+// doctorUsers selects the doctors whose user matches cond.
+const doctorUsers = "doctors.user_id IN (SELECT id FROM users WHERE deleted_at IS NULL AND ("
+
+// Practitioners are doctor profiles, which any signed-in user may look up.
+var practitionerType = &resourceType{
+	Name:     "Practitioner",
+	IDColumn: "doctors.id",
+	Params: []searchParam{
+		{Name: "name", Type: "string", cond: usersCond("name", "first_name", "last_name")},
+		{Name: "family", Type: "string", cond: usersCond("family", "last_name")},
+		{Name: "given", Type: "string", cond: usersCond("given", "first_name")},
+		{Name: "email", Type: "token", cond: func(s *server, v string) (string, []interface{}, error) {
+			return doctorUsers + "LOWER(email) = LOWER(?)))", []interface{}{v}, nil
+		}},
+		{Name: "identifier", Type: "token", cond: func(s *server, v string) (string, []interface{}, error) {
+			if i := strings.Index(v, "|"); i >= 0 {
+				if system := v[:i]; system != "" && system != licenseSystem {
+					return "1 = 0", nil, nil
+				}
+				v = v[i+1:]
+			}
+			return "doctors.license_number = ?", []interface{}{v}, nil
+		}},
+	},
+	query: func(s *server, c *gin.Context) (*gorm.DB, error) {
+		return s.db.Model(&Doctor{}), nil
+	},
+	fetch: func(s *server, db *gorm.DB) ([]match, error) {
+		var doctors []Doctor
+		if err := db.Preload("User").Preload("Education").Find(&doctors).Error; err != nil {
+			return nil, err
+		}
+		matches := make([]match, len(doctors))
+		for i := range doctors {
+			matches[i] = match{ID: doctors[i].ID, Resource: toPractitioner(&doctors[i])}
+		}
+		return matches, nil
+	},
+}
+
+// usersCond is a string parameter on the doctor's user.
+func usersCond(name string, columns ...string) func(*server, string) (string, []interface{}, error) {
+	return func(s *server, v string) (string, []interface{}, error) {
+		sql, args, err := stringParam(name, columns...).cond(s, v)
+		if err != nil {
+			return "", nil, err
+		}
+		return doctorUsers + sql + "))", args, nil
+	}
+}
+
+func toPractitioner(d *Doctor) Practitioner {
+	updated := d.UpdatedAt
+	if d.User.UpdatedAt.After(updated) {
+		updated = d.User.UpdatedAt
+	}
+	p := Practitioner{
+		ResourceType: "Practitioner",
+		ID:           idString(d.ID),
+		Meta:         meta(updated),
+		Active:       d.User.IsActive,
+		Name:         names(&d.User),
+		Telecom:      telecom(d.User.Email, d.User.Phone),
+	}
+	if d.LicenseNumber != "" {
+		p.Identifier = []Identifier{{System: licenseSystem, Value: d.LicenseNumber}}
+	}
+	for _, e := range d.Education {
+		q := Qualification{Code: CodeableConcept{Text: e.Degree}}
+		if e.Field != "" {
+			q.Code.Text += " in " + e.Field
+		}
+		if e.Year != 0 {
+			q.Period = &Period{End: strconv.Itoa(e.Year)}
+		}
+		if e.Institution != "" {
+			q.Issuer = &Reference{Display: e.Institution}
+		}
+		p.Qualification = append(p.Qualification, q)
+	}
+	return p
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// A medical record is one visit: it reads as an Encounter, its diagnosis
+// as a Condition and its prescription as a MedicationRequest, all with the
+// record's ID. Attachments read as DocumentReferences.
+
+// Record statuses, as medical-record-service sets them.
+const (
+	recordDraft         = "draft"
+	recordPendingCosign = "pending_cosign"
+)
+
+// records selects the medical records the caller may read.
+func records(s *server, c *gin.Context) (*gorm.DB, error) {
+	scope, err := s.scope(c, policy.ResourceRecords, "medical_records.patient_id")
+	if err != nil {
+		return nil, err
+	}
+	return s.db.Model(&MedicalRecord{}).Scopes(scope), nil
+}
+
+// fetchRecords loads a page of records as resources.
+func fetchRecords(db *gorm.DB, resource func(*MedicalRecord) interface{}) ([]match, error) {
+	var rows []MedicalRecord
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	matches := make([]match, len(rows))
+	for i := range rows {
+		matches[i] = match{ID: rows[i].ID, PatientID: rows[i].PatientID, Resource: resource(&rows[i])}
+	}
+	return matches, nil
+}
+
+// signed reports whether a record's content is final.
+func signed(r *MedicalRecord) bool {
+	return r.Status != recordDraft && r.Status != recordPendingCosign
+}
+
+var encounterType = &resourceType{
+	Name:     "Encounter",
+	IDColumn: "medical_records.id",
+	Params: []searchParam{
+		refParam("patient", "medical_records.patient_id", "Patient"),
+		refParam("practitioner", "medical_records.doctor_id", "Practitioner"),
+		dateParam("date", "medical_records.date"),
+	},
+	query: records,
+	fetch: func(s *server, db *gorm.DB) ([]match, error) {
+		return fetchRecords(db, func(r *MedicalRecord) interface{} {
+			return Encounter{
+				ResourceType: "Encounter",
+				ID:           idString(r.ID),
+				Meta:         meta(r.UpdatedAt),
+				Status:       "finished",
+				Class:        Coding{System: "http://terminology.hl7.org/CodeSystem/v3-ActCode", Code: "AMB", Display: "ambulatory"},
+				Subject:      ref("Patient", r.PatientID),
+				Participant:  []EncounterParticipant{{Individual: ref("Practitioner", r.DoctorID)}},
+				Period:       &Period{Start: instant(r.Date)},
+			}
+		})
+	},
+}
+
+var conditionType = &resourceType{
+	Name:     "Condition",
+	IDColumn: "medical_records.id",
+	Params: []searchParam{
+		refParam("patient", "medical_records.patient_id", "Patient"),
+		refParam("encounter", "medical_records.id", "Encounter"),
+		dateParam("recorded-date", "medical_records.date"),
+	},
+	query: func(s *server, c *gin.Context) (*gorm.DB, error) {
+		db, err := records(s, c)
+		if err != nil {
+			return nil, err
+		}
+		return db.Where("medical_records.diagnosis <> ''"), nil
+	},
+	fetch: func(s *server, db *gorm.DB) ([]match, error) {
+		return fetchRecords(db, func(r *MedicalRecord) interface{} {
+			verification := "confirmed"
+			if !signed(r) {
+				verification = "provisional"
+			}
+			condition := Condition{
+				ResourceType: "Condition",
+				ID:           idString(r.ID),
+				Meta:         meta(r.UpdatedAt),
+				VerificationStatus: CodeableConcept{Coding: []Coding{{
+					System: "http://terminology.hl7.org/CodeSystem/condition-ver-status",
+					Code:   verification,
+				}}},
+				Category: []CodeableConcept{{Coding: []Coding{{
+					System: "http://terminology.hl7.org/CodeSystem/condition-category",
+					Code:   "encounter-diagnosis",
+				}}}},
+				Code:         CodeableConcept{Text: r.Diagnosis},
+				Subject:      ref("Patient", r.PatientID),
+				Encounter:    refPtr("Encounter", r.ID),
+				RecordedDate: instant(r.Date),
+				Recorder:     refPtr("Practitioner", r.DoctorID),
+			}
+			if r.Notes != "" {
+				condition.Note = []Annotation{{Text: r.Notes}}
+			}
+			return condition
+		})
+	},
+}
+
+var medicationRequestType = &resourceType{
+	Name:     "MedicationRequest",
+	IDColumn: "medical_records.id",
+	Params: []searchParam{
+		refParam("patient", "medical_records.patient_id", "Patient"),
+		refParam("encounter", "medical_records.id", "Encounter"),
+		refParam("requester", "medical_records.doctor_id", "Practitioner"),
+		dateParam("authoredon", "medical_records.date"),
+	},
+	query: func(s *server, c *gin.Context) (*gorm.DB, error) {
+		db, err := records(s, c)
+		if err != nil {
+			return nil, err
+		}
+		return db.Where("medical_records.prescription <> ''"), nil
+	},
+	fetch: func(s *server, db *gorm.DB) ([]match, error) {
+		return fetchRecords(db, func(r *MedicalRecord) interface{} {
+			status := "active"
+			if !signed(r) {
+				status = "draft"
+			}
+			return MedicationRequest{
+				ResourceType:              "MedicationRequest",
+				ID:                        idString(r.ID),
+				Meta:                      meta(r.UpdatedAt),
+				Status:                    status,
+				Intent:                    "order",
+				MedicationCodeableConcept: CodeableConcept{Text: r.Prescription},
+				Subject:                   ref("Patient", r.PatientID),
+				Encounter:                 refPtr("Encounter", r.ID),
+				AuthoredOn:                instant(r.Date),
+				Requester:                 refPtr("Practitioner", r.DoctorID),
+			}
+		})
+	},
+}
+
+// Attachments are read through their record, so they take its access
+// rules.
+var documentReferenceType = &resourceType{
+	Name:     "DocumentReference",
+	IDColumn: "attachments.id",
+	Params: []searchParam{
+		refParam("patient", "medical_records.patient_id", "Patient"),
+		refParam("encounter", "attachments.record_id", "Encounter"),
+		dateParam("date", "attachments.created_at"),
+	},
+	query: func(s *server, c *gin.Context) (*gorm.DB, error) {
+		scope, err := s.scope(c, policy.ResourceRecords, "medical_records.patient_id")
+		if err != nil {
+			return nil, err
+		}
+		return s.db.Model(&StoredAttachment{}).
+			Joins("JOIN medical_records ON medical_records.id = attachments.record_id AND medical_records.deleted_at IS NULL").
+			Scopes(scope), nil
+	},
+	fetch: func(s *server, db *gorm.DB) ([]match, error) {
+		var attachments []StoredAttachment
+		if err := db.Select("attachments.*").Find(&attachments).Error; err != nil {
+			return nil, err
+		}
+		recordIDs := make([]uint, len(attachments))
+		for i, a := range attachments {
+			recordIDs[i] = a.RecordID
+		}
+		var rows []MedicalRecord
+		if err := s.db.Select("id", "patient_id").Where("id IN ?", recordIDs).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		patientOf := map[uint]uint{}
+		for _, r := range rows {
+			patientOf[r.ID] = r.PatientID
+		}
+
+		matches := make([]match, len(attachments))
+		for i := range attachments {
+			a := &attachments[i]
+			matches[i] = match{ID: a.ID, PatientID: patientOf[a.RecordID], Resource: s.toDocumentReference(a, patientOf[a.RecordID])}
+		}
+		return matches, nil
+	},
+}
+
+func (s *server) toDocumentReference(a *StoredAttachment, patientID uint) DocumentReference {
+	// Uploaded files are fetched through a short-lived link that
+	// medical-record-service hands out after checking access; older
+	// attachments are links already
+	url := a.URL
+	if a.StorageKey != "" {
+		url = fmt.Sprintf("%s/api/records/%d/attachments/%d/url", s.recordsURL, a.RecordID, a.ID)
+	}
+	return DocumentReference{
+		ResourceType: "DocumentReference",
+		ID:           idString(a.ID),
+		Meta:         meta(a.UpdatedAt),
+		Status:       "current",
+		Subject:      ref("Patient", patientID),
+		Date:         instant(a.CreatedAt),
+		Description:  a.Name,
+		Content: []DocumentReferenceContent{{Attachment: Attachment{
+			ContentType: a.ContentType,
+			URL:         url,
+			Size:        a.Size,
+			Title:       a.Name,
+			Creation:    instant(a.CreatedAt),
+		}}},
+		Context: &DocumentReferenceContext{Encounter: []Reference{ref("Encounter", a.RecordID)}},
+	}
+}
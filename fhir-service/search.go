@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultCount = 20
+	maxCount     = 100
+)
+
+// paramError is a search parameter the client got wrong; it answers 400.
+type paramError string
+
+func (e paramError) Error() string { return string(e) }
+
+// searchParam is a search parameter of a resource type. cond turns one
+// value into a condition.
+type searchParam struct {
+	Name string
+	Type string // FHIR search parameter type: token, string, reference, date
+	cond func(s *server, v string) (string, []interface{}, error)
+}
+
+// match is one resource found, with the patient it is about.
+type match struct {
+	ID        uint
+	PatientID uint
+	Resource  interface{}
+}
+
+// resourceType is a FHIR resource type served from our tables.
+type resourceType struct {
+	Name     string
+	IDColumn string
+	Params   []searchParam // besides _id, _count and _offset
+	// query selects the rows the caller may see; fetch loads a page of
+	// them.
+	query func(s *server, c *gin.Context) (*gorm.DB, error)
+	fetch func(s *server, db *gorm.DB) ([]match, error)
+}
+
+// server answers the FHIR API.
+type server struct {
+	db         *gorm.DB
+	policies   *policy.Policy
+	loc        *time.Location // date-only search values are days in the clinic's time zone
+	baseURL    string         // public base of the FHIR API; from the request when empty
+	recordsURL string         // public base of medical-record-service, for attachment links
+	types      []*resourceType
+}
+
+func newServer(db *gorm.DB, policies *policy.Policy, loc *time.Location) *server {
+	s := &server{
+		db:         db,
+		policies:   policies,
+		loc:        loc,
+		baseURL:    strings.TrimSuffix(os.Getenv("FHIR_BASE_URL"), "/"),
+		recordsURL: strings.TrimSuffix(os.Getenv("RECORDS_BASE_URL"), "/"),
+	}
+	if s.recordsURL == "" {
+		s.recordsURL = "http://localhost:8084"
+	}
+	s.types = []*resourceType{
+		patientType, practitionerType, appointmentType,
+		encounterType, conditionType, medicationRequestType, documentReferenceType,
+	}
+	return s
+}
+
+func (s *server) resourceType(name string) *resourceType {
+	for _, t := range s.types {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// base is the absolute URL resources are found under.
+func (s *server) base(c *gin.Context) string {
+	if s.baseURL != "" {
+		return s.baseURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host + "/fhir"
+}
+
+// scope limits a query to the patients the caller may read res of.
+func (s *server) scope(c *gin.Context, res policy.Resource, column string) (func(*gorm.DB) *gorm.DB, error) {
+	return s.policies.PatientScope(policy.SubjectFrom(c), res, policy.ActionRead, column)
+}
+
+// searchQuery is a parsed search.
+type searchQuery struct {
+	values url.Values
+	count  int
+	offset int
+}
+
+func parseQuery(values url.Values) (*searchQuery, error) {
+	q := &searchQuery{values: values, count: defaultCount}
+	if v := values.Get("_count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, paramError("_count must be a number of at least 0")
+		}
+		q.count = n
+		if q.count > maxCount {
+			q.count = maxCount
+		}
+	}
+	if v := values.Get("_offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, paramError("_offset must be a number of at least 0")
+		}
+		q.offset = n
+	}
+	return q, nil
+}
+
+// where applies the parameter p. As in FHIR, repeating a parameter ANDs
+// its occurrences and commas OR the values of one.
+func (q *searchQuery) where(s *server, db *gorm.DB, p searchParam) (*gorm.DB, error) {
+	for _, occurrence := range q.values[p.Name] {
+		var conds []string
+		var args []interface{}
+		for _, v := range strings.Split(occurrence, ",") {
+			sql, a, err := p.cond(s, strings.TrimSpace(v))
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, "("+sql+")")
+			args = append(args, a...)
+		}
+		db = db.Where(strings.Join(conds, " OR "), args...)
+	}
+	return db, nil
+}
+
+// refParam is a reference parameter matched against an ID column. Values
+// may be an ID, Type/ID or an absolute URL ending in Type/ID.
+func refParam(name, column, resourceType string) searchParam {
+	return searchParam{Name: name, Type: "reference", cond: func(s *server, v string) (string, []interface{}, error) {
+		if i := strings.LastIndex(v, "/"); i >= 0 {
+			head := v[:i]
+			if head != resourceType && !strings.HasSuffix(head, "/"+resourceType) {
+				return "", nil, paramError("expected a reference to " + resourceType + ": " + v)
+			}
+			v = v[i+1:]
+		}
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return "", nil, paramError("invalid id: " + v)
+		}
+		return column + " = ?", []interface{}{id}, nil
+	}}
+}
+
+// stringParam is a string parameter matched the FHIR way: case-insensitively,
+// against the start of any word of the columns.
+func stringParam(name string, columns ...string) searchParam {
+	return searchParam{Name: name, Type: "string", cond: func(s *server, v string) (string, []interface{}, error) {
+		if v == "" {
+			return "", nil, paramError(name + " is empty")
+		}
+		v = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(v)
+		var conds []string
+		var args []interface{}
+		for _, col := range columns {
+			conds = append(conds, col+" ILIKE ? OR "+col+" ILIKE ?")
+			args = append(args, v+"%", "% "+v+"%")
+		}
+		return strings.Join(conds, " OR "), args, nil
+	}}
+}
+
+// dateParam is a date parameter matched against a timestamp column. Values
+// take an eq, ne, gt, ge, lt or le prefix and may be a year, a month, a day
+// or a time; a value covers its whole period.
+func dateParam(name, column string) searchParam {
+	return searchParam{Name: name, Type: "date", cond: func(s *server, v string) (string, []interface{}, error) {
+		prefix := "eq"
+		if len(v) > 2 && v[0] >= 'a' && v[0] <= 'z' {
+			prefix, v = v[:2], v[2:]
+		}
+		start, end, err := s.parseDate(v)
+		if err != nil {
+			return "", nil, err
+		}
+		switch prefix {
+		case "eq":
+			return column + " >= ? AND " + column + " < ?", []interface{}{start, end}, nil
+		case "ne":
+			return column + " < ? OR " + column + " >= ?", []interface{}{start, end}, nil
+		case "gt":
+			return column + " >= ?", []interface{}{end}, nil
+		case "ge":
+			return column + " >= ?", []interface{}{start}, nil
+		case "lt":
+			return column + " < ?", []interface{}{start}, nil
+		case "le":
+			return column + " < ?", []interface{}{end}, nil
+		}
+		return "", nil, paramError("unsupported date prefix: " + prefix)
+	}}
+}
+
+// parseDate returns the period a FHIR date or dateTime covers.
+func (s *server) parseDate(v string) (time.Time, time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, t.Add(time.Second), nil
+	}
+	for _, layout := range []struct {
+		format string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		if t, err := time.ParseInLocation(layout.format, v, s.loc); err == nil {
+			return t, t.AddDate(layout.years, layout.months, layout.days), nil
+		}
+	}
+	return time.Time{}, time.Time{}, paramError("invalid date: " + v)
+}
+
+// run finds the page of rt's resources q asks for, and their total.
+func (s *server) run(c *gin.Context, rt *resourceType, q *searchQuery) ([]match, int64, error) {
+	db, err := rt.query(s, c)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, p := range append([]searchParam{refParam("_id", rt.IDColumn, rt.Name)}, rt.Params...) {
+		if db, err = q.where(s, db, p); err != nil {
+			return nil, 0, err
+		}
+	}
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	if q.count == 0 || int64(q.offset) >= total {
+		return nil, total, nil
+	}
+	matches, err := rt.fetch(s, db.Order(rt.IDColumn).Limit(q.count).Offset(q.offset))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A search is audited against every patient it returned
+	for _, m := range matches {
+		audit.SetPatients(c, m.PatientID)
+	}
+	return matches, total, nil
+}
+
+// search answers GET /fhir/:type with a searchset Bundle.
+func (s *server) search(c *gin.Context) {
+	rt := s.resourceType(c.Param("type"))
+	if rt == nil {
+		fail(c, 404, "not-supported", "Resource type not supported: "+c.Param("type"))
+		return
+	}
+	audit.SetDetail(c, "search "+rt.Name+"?"+c.Request.URL.RawQuery)
+	q, err := parseQuery(c.Request.URL.Query())
+	if err != nil {
+		fail(c, 400, "invalid", err.Error())
+		return
+	}
+	matches, total, err := s.run(c, rt, q)
+	var pe paramError
+	if errors.As(err, &pe) {
+		fail(c, 400, "invalid", pe.Error())
+		return
+	}
+	if err != nil {
+		fail(c, 500, "exception", "Search failed")
+		return
+	}
+
+	base := s.base(c)
+	bundle := Bundle{
+		ResourceType: "Bundle",
+		Meta:         meta(time.Now()),
+		Type:         "searchset",
+		Total:        total,
+		Link:         []BundleLink{{Relation: "self", URL: page(base, rt.Name, q.values, q.offset)}},
+	}
+	if int64(q.offset+q.count) < total && q.count > 0 {
+		bundle.Link = append(bundle.Link, BundleLink{Relation: "next", URL: page(base, rt.Name, q.values, q.offset+q.count)})
+	}
+	if q.offset > 0 {
+		prev := q.offset - q.count
+		if prev < 0 {
+			prev = 0
+		}
+		bundle.Link = append(bundle.Link, BundleLink{Relation: "previous", URL: page(base, rt.Name, q.values, prev)})
+	}
+	for _, m := range matches {
+		bundle.Entry = append(bundle.Entry, BundleEntry{
+			FullURL:  base + "/" + rt.Name + "/" + idString(m.ID),
+			Resource: m.Resource,
+			Search:   &EntrySearch{Mode: "match"},
+		})
+	}
+	respond(c, 200, bundle)
+}
+
+// page is the URL of the search values at offset.
+func page(base, resourceType string, values url.Values, offset int) string {
+	v := url.Values{}
+	for name, vs := range values {
+		v[name] = vs
+	}
+	v.Del("_offset")
+	if offset > 0 {
+		v.Set("_offset", strconv.Itoa(offset))
+	}
+	if len(v) == 0 {
+		return base + "/" + resourceType
+	}
+	return base + "/" + resourceType + "?" + v.Encode()
+}
+
+// read answers GET /fhir/:type/:id. Resources the caller may not see are
+// not found, like ones that do not exist.
+func (s *server) read(c *gin.Context) {
+	rt := s.resourceType(c.Param("type"))
+	if rt == nil {
+		fail(c, 404, "not-supported", "Resource type not supported: "+c.Param("type"))
+		return
+	}
+	audit.SetDetail(c, "read "+rt.Name)
+	if _, err := strconv.ParseUint(c.Param("id"), 10, 32); err != nil {
+		fail(c, 404, "not-found", rt.Name+"/"+c.Param("id")+" not found")
+		return
+	}
+	q := &searchQuery{values: url.Values{"_id": {c.Param("id")}}, count: 1}
+	matches, _, err := s.run(c, rt, q)
+	if err != nil {
+		fail(c, 500, "exception", "Read failed")
+		return
+	}
+	if len(matches) == 0 {
+		fail(c, 404, "not-found", rt.Name+"/"+c.Param("id")+" not found")
+		return
+	}
+	respond(c, 200, matches[0].Resource)
+}
@@ -44,6 +44,7 @@ check_service "medical-record-service" 8084
 check_service "billing-service" 8085
 check_service "notification-service" 8086
 check_service "doctor-service" 8087
+check_service "fhir-service" 8088
 
 echo "======================"
 echo "Health check completed!" 
\ No newline at end of file
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/blob"
+	"healthcare/shared/envelope"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAttachmentMaxMB  = 25
+	defaultAttachmentTypes  = "application/pdf,image/jpeg,image/png,image/gif,image/webp,application/dicom,text/plain"
+	defaultAttachmentURLTTL = 5 * time.Minute
+	// multipartOverhead is room for the multipart framing around the file.
+	multipartOverhead = 1 << 20
+	// maxUploadChunk caps the body of one resumable upload request.
+	maxUploadChunk = 8 << 20
+	// uploadTTL is how long an unfinished resumable upload is kept after
+	// its last chunk.
+	uploadTTL           = 24 * time.Hour
+	uploadSweepInterval = time.Hour
+	reencryptBatch      = 50
+	sniffLen            = 512
+)
+
+var (
+	errEmptyFile        = errors.New("file is empty")
+	errUnsupportedType  = errors.New("file type is not allowed")
+	errChecksumMismatch = errors.New("file does not match its SHA-256 checksum")
+	errStaleOffset      = errors.New("upload offset changed concurrently")
+	errNotDraft         = errors.New("attachments can only be added to drafts")
+)
+
+// AttachmentUpload is a resumable upload in progress. Chunks are stored as
+// separate blobs until the last one arrives; then they are joined into the
+// attachment. Only the user who started it can continue it.
+type AttachmentUpload struct {
+	ID        string `gorm:"primarykey;size:32"`
+	RecordID  uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null"`
+	Name      string
+	Size      int64     `gorm:"not null"`
+	Received  int64     `gorm:"not null;default:0"` // bytes so far, where to resume
+	SHA256    string    `gorm:"size:64"`            // expected checksum, if given
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// AttachmentUploadChunk is one received chunk of an AttachmentUpload.
+type AttachmentUploadChunk struct {
+	ID       uint   `gorm:"primarykey"`
+	UploadID string `gorm:"size:32;not null;index"`
+	Start    int64  `gorm:"not null"`
+	Size     int64  `gorm:"not null"`
+	Key      string `gorm:"not null"`
+}
+
+type attachments struct {
+	db         *gorm.DB
+	policies   *policy.Policy
+	breakGlass *breakGlass
+	store      *envelope.Store
+	maxSize    int64
+	types      map[string]bool
+	baseURL    string
+	secret     []byte
+	urlTTL     time.Duration
+}
+
+// newAttachments reads ATTACHMENT_MAX_MB (default 25), ATTACHMENT_TYPES (a
+// comma-separated list of allowed content types), ATTACHMENT_URL_TTL
+// (default 5m), FILES_BASE_URL, the public address download links are
+// built on, and FILES_URL_SECRET, which signs them and is required.
+func newAttachments(db *gorm.DB, policies *policy.Policy, breakGlass *breakGlass, store *envelope.Store) *attachments {
+	a := &attachments{
+		db:         db,
+		policies:   policies,
+		breakGlass: breakGlass,
+		store:      store,
+		maxSize:    defaultAttachmentMaxMB << 20,
+		types:      map[string]bool{},
+		baseURL:    strings.TrimSuffix(os.Getenv("FILES_BASE_URL"), "/"),
+		secret:     []byte(os.Getenv("FILES_URL_SECRET")),
+		urlTTL:     defaultAttachmentURLTTL,
+	}
+	if v := os.Getenv("ATTACHMENT_MAX_MB"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb <= 0 {
+			log.Fatal("Invalid ATTACHMENT_MAX_MB:", v)
+		}
+		a.maxSize = int64(mb) << 20
+	}
+	types := os.Getenv("ATTACHMENT_TYPES")
+	if types == "" {
+		types = defaultAttachmentTypes
+	}
+	for _, t := range strings.Split(types, ",") {
+		a.types[strings.TrimSpace(t)] = true
+	}
+	if v := os.Getenv("ATTACHMENT_URL_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid ATTACHMENT_URL_TTL:", v)
+		}
+		a.urlTTL = d
+	}
+	if a.baseURL == "" {
+		a.baseURL = "http://localhost:8083"
+	}
+	// Every replica has to check the links the others sign
+	if len(a.secret) == 0 {
+		log.Fatal("FILES_URL_SECRET is not set; it signs attachment download links")
+	}
+	return a
+}
+
+// loadRecord fetches the record named by :id for a change to its
+// attachments.
+func (a *attachments) loadRecord(c *gin.Context) (*MedicalRecord, bool) {
+	var record MedicalRecord
+	if err := a.db.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Medical record not found"})
+		return nil, false
+	}
+	if !a.policies.Authorize(c, policy.ResourceRecords, policy.ActionWrite, record.PatientID) {
+		return nil, false
+	}
+	return &record, true
+}
+
+// loadDraft is loadRecord for adding an attachment. Signing covers the
+// attachments, so a record takes new ones only while it is a draft, and
+// only from its author, as only the author edits a draft.
+func (a *attachments) loadDraft(c *gin.Context) (*MedicalRecord, bool) {
+	record, ok := a.loadRecord(c)
+	if !ok {
+		return nil, false
+	}
+	if record.Status != StatusDraft {
+		respondIngestError(c, errNotDraft)
+		return nil, false
+	}
+	doctorID, err := a.policies.DoctorIDFor(auth.UserID(c))
+	if err != nil || doctorID != record.DoctorID {
+		c.JSON(403, gin.H{"error": "Only the authoring doctor can add attachments to this draft"})
+		return nil, false
+	}
+	return record, true
+}
+
+// upload answers POST /api/records/:id/attachments, a multipart/form-data
+// request with the file in the part named "file". An X-Checksum-Sha256
+// header is checked against the file.
+func (a *attachments) upload(c *gin.Context) {
+	record, ok := a.loadDraft(c)
+	if !ok {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, a.maxSize+multipartOverhead)
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(415, gin.H{"error": "Upload the file as multipart/form-data in a part named file"})
+		return
+	}
+
+	// The file is spooled to disk first: its size has to be known before
+	// it goes to the store
+	var spool *os.File
+	var size int64
+	var name string
+	for spool == nil {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			c.JSON(400, gin.H{"error": "No part named file"})
+			return
+		}
+		if err != nil {
+			a.respondReadError(c, err)
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		name = part.FileName()
+		if spool, err = os.CreateTemp("", "attachment-*"); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to receive file"})
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if size, err = io.Copy(spool, io.LimitReader(part, a.maxSize+1)); err != nil {
+			a.respondReadError(c, err)
+			return
+		}
+	}
+	if size > a.maxSize {
+		a.respondTooLarge(c)
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to receive file"})
+		return
+	}
+
+	attachment, err := a.ingest(record, name, spool, size, c.GetHeader("X-Checksum-Sha256"), auth.UserID(c))
+	if err != nil {
+		respondIngestError(c, err)
+		return
+	}
+	c.JSON(201, attachment)
+}
+
+// ingest checks a file's type, stores it while hashing it, and files it
+// as an attachment of record.
+func (a *attachments) ingest(record *MedicalRecord, name string, r io.Reader, size int64, wantSHA256 string, userID uint) (*Attachment, error) {
+	if size == 0 {
+		return nil, errEmptyFile
+	}
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	contentType := sniff(head)
+	if !a.types[contentType] {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedType, contentType)
+	}
+
+	key := fmt.Sprintf("records/%d/%s", record.ID, randomHex(16))
+	hash := sha256.New()
+	keyID, err := a.store.Write(key, io.TeeReader(br, hash), size)
+	if err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if wantSHA256 != "" && !strings.EqualFold(wantSHA256, sum) {
+		a.deleteBlob(key)
+		return nil, errChecksumMismatch
+	}
+
+	attachment := Attachment{
+		RecordID:    record.ID,
+		Type:        kindOf(contentType),
+		Name:        cleanFileName(name),
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      sum,
+		StorageKey:  key,
+		UploadedBy:  userID,
+		KeyID:       keyID,
+	}
+	// The record may have been signed while the file was stored. Touching
+	// the row while it is still a draft serializes this with signing.
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&MedicalRecord{}).Where("id = ? AND status = ?", record.ID, StatusDraft).
+			Update("updated_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errNotDraft
+		}
+		return tx.Create(&attachment).Error
+	})
+	if err != nil {
+		a.deleteBlob(key)
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// UploadInput is the body of POST /api/records/:id/uploads.
+type UploadInput struct {
+	Name   string `binding:"required"`
+	Size   int64  `binding:"required,gt=0"`
+	SHA256 string `binding:"omitempty,len=64,hexadecimal"`
+}
+
+// createUpload answers POST /api/records/:id/uploads by starting a
+// resumable upload.
+func (a *attachments) createUpload(c *gin.Context) {
+	record, ok := a.loadDraft(c)
+	if !ok {
+		return
+	}
+	var input UploadInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Size > a.maxSize {
+		a.respondTooLarge(c)
+		return
+	}
+
+	upload := AttachmentUpload{
+		ID:        randomHex(16),
+		RecordID:  record.ID,
+		UserID:    auth.UserID(c),
+		Name:      input.Name,
+		Size:      input.Size,
+		SHA256:    strings.ToLower(input.SHA256),
+		ExpiresAt: time.Now().Add(uploadTTL),
+	}
+	if err := a.db.Create(&upload).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to start upload"})
+		return
+	}
+	c.JSON(201, gin.H{"upload": upload, "maxChunkSize": maxUploadChunk})
+}
+
+// loadUpload fetches the caller's upload named by :uploadId.
+func (a *attachments) loadUpload(c *gin.Context) (*MedicalRecord, *AttachmentUpload, bool) {
+	record, ok := a.loadRecord(c)
+	if !ok {
+		return nil, nil, false
+	}
+	var upload AttachmentUpload
+	if err := a.db.Where("id = ? AND record_id = ? AND user_id = ? AND expires_at > ?",
+		c.Param("uploadId"), record.ID, auth.UserID(c), time.Now()).First(&upload).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Upload not found"})
+		return nil, nil, false
+	}
+	return record, &upload, true
+}
+
+// getUpload answers GET /api/records/:id/uploads/:uploadId; Received is
+// where to resume.
+func (a *attachments) getUpload(c *gin.Context) {
+	_, upload, ok := a.loadUpload(c)
+	if !ok {
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+	c.JSON(200, upload)
+}
+
+// uploadChunk answers PATCH /api/records/:id/uploads/:uploadId. The body
+// is the next chunk and the Upload-Offset header says where it starts.
+// The last chunk completes the upload and answers with the attachment.
+func (a *attachments) uploadChunk(c *gin.Context) {
+	record, upload, ok := a.loadUpload(c)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Upload-Offset header is required"})
+		return
+	}
+	if offset != upload.Received {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+		c.JSON(409, gin.H{"error": "Upload-Offset does not match the bytes received", "offset": upload.Received})
+		return
+	}
+	length := c.Request.ContentLength
+	switch {
+	case length <= 0:
+		c.JSON(411, gin.H{"error": "Content-Length is required"})
+		return
+	case length > maxUploadChunk:
+		c.JSON(413, gin.H{"error": fmt.Sprintf("Chunks are at most %d bytes", maxUploadChunk)})
+		return
+	case offset+length > upload.Size:
+		c.JSON(400, gin.H{"error": "Chunk runs past the size of the upload"})
+		return
+	}
+
+	// Each attempt gets its own key, so a losing concurrent attempt only
+	// deletes its own blob
+	chunk := AttachmentUploadChunk{
+		UploadID: upload.ID,
+		Start:    offset,
+		Size:     length,
+		Key:      fmt.Sprintf("uploads/%s/%d-%s", upload.ID, offset, randomHex(4)),
+	}
+	if err := a.store.Put(chunk.Key, c.Request.Body, length, "application/octet-stream"); err != nil {
+		log.Printf("Failed to store chunk of upload %s: %v", upload.ID, err)
+		c.JSON(502, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chunk).Error; err != nil {
+			return err
+		}
+		res := tx.Model(upload).Where("received = ?", offset).
+			Updates(map[string]interface{}{"received": offset + length, "expires_at": time.Now().Add(uploadTTL)})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errStaleOffset
+		}
+		return nil
+	})
+	if err != nil {
+		a.deleteBlob(chunk.Key)
+		if errors.Is(err, errStaleOffset) {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(400, gin.H{"error": "Failed to record chunk"})
+		return
+	}
+	upload.Received = offset + length
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+	if upload.Received < upload.Size {
+		c.JSON(200, upload)
+		return
+	}
+	attachment, err := a.finish(record, upload)
+	if err != nil {
+		respondIngestError(c, err)
+		return
+	}
+	c.JSON(201, attachment)
+}
+
+// finish joins the chunks of a complete upload into an attachment. The
+// upload is discarded whether that succeeds or not.
+func (a *attachments) finish(record *MedicalRecord, upload *AttachmentUpload) (*Attachment, error) {
+	defer a.discard(upload)
+	var chunks []AttachmentUploadChunk
+	if err := a.db.Where("upload_id = ?", upload.ID).Order("start").Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+	joined := &chunkReader{store: a.store}
+	for _, ch := range chunks {
+		joined.keys = append(joined.keys, ch.Key)
+	}
+	defer joined.Close()
+	return a.ingest(record, upload.Name, joined, upload.Size, upload.SHA256, upload.UserID)
+}
+
+// abortUpload answers DELETE /api/records/:id/uploads/:uploadId.
+func (a *attachments) abortUpload(c *gin.Context) {
+	_, upload, ok := a.loadUpload(c)
+	if !ok {
+		return
+	}
+	a.discard(upload)
+	c.JSON(200, gin.H{"message": "Upload cancelled"})
+}
+
+// discard deletes an upload and its chunks.
+func (a *attachments) discard(upload *AttachmentUpload) {
+	var chunks []AttachmentUploadChunk
+	if err := a.db.Where("upload_id = ?", upload.ID).Find(&chunks).Error; err != nil {
+		log.Printf("Failed to load chunks of upload %s: %v", upload.ID, err)
+		return
+	}
+	for _, ch := range chunks {
+		a.deleteBlob(ch.Key)
+	}
+	if err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", upload.ID).Delete(&AttachmentUploadChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(upload).Error
+	}); err != nil {
+		log.Printf("Failed to delete upload %s: %v", upload.ID, err)
+	}
+}
+
+// run discards abandoned uploads and re-encrypts files every
+// uploadSweepInterval.
+func (a *attachments) run() {
+	for range time.Tick(uploadSweepInterval) {
+		var expired []AttachmentUpload
+		if err := a.db.Where("expires_at <= ?", time.Now()).Limit(100).Find(&expired).Error; err != nil {
+			log.Printf("Failed to find expired uploads: %v", err)
+		}
+		for i := range expired {
+			a.discard(&expired[i])
+		}
+		if err := a.reencrypt(); err != nil {
+			log.Printf("Failed to re-encrypt attachments: %v", err)
+		}
+	}
+}
+
+// reencrypt moves stored files to the active data key: files sealed under
+// an older key, and files stored before encryption was turned on.
+func (a *attachments) reencrypt() error {
+	activeID, err := a.store.ActiveKeyID()
+	if err != nil {
+		return err
+	}
+	var lastID uint
+	for {
+		var stale []Attachment
+		if err := a.db.Unscoped().Where("id > ? AND storage_key <> '' AND key_id IS DISTINCT FROM ?", lastID, activeID).
+			Order("id").Limit(reencryptBatch).Find(&stale).Error; err != nil {
+			return err
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		for i := range stale {
+			lastID = stale[i].ID
+			if err := a.reseal(&stale[i]); err != nil {
+				log.Printf("Failed to re-encrypt attachment %d: %v", stale[i].ID, err)
+			}
+		}
+	}
+}
+
+// reseal copies an attachment's file to a new blob under the active key,
+// checking it against its checksum on the way, and drops the old blob.
+func (a *attachments) reseal(attachment *Attachment) error {
+	body, err := a.store.Get(attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	key := fmt.Sprintf("records/%d/%s", attachment.RecordID, randomHex(16))
+	hash := sha256.New()
+	keyID, err := a.store.Write(key, io.TeeReader(body, hash), attachment.Size)
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); attachment.SHA256 != "" && sum != attachment.SHA256 {
+		a.deleteBlob(key)
+		return errChecksumMismatch
+	}
+	res := a.db.Unscoped().Model(&Attachment{}).Where("id = ? AND storage_key = ?", attachment.ID, attachment.StorageKey).
+		UpdateColumns(map[string]interface{}{"storage_key": key, "key_id": keyID})
+	if res.Error != nil || res.RowsAffected == 0 {
+		a.deleteBlob(key)
+		return res.Error
+	}
+	a.deleteBlob(attachment.StorageKey)
+	return nil
+}
+
+// downloadURL answers GET /api/records/:id/attachments/:attachmentId/url
+// with a link to the file that works for urlTTL.
+func (a *attachments) downloadURL(c *gin.Context) {
+	var record MedicalRecord
+	if err := a.db.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Medical record not found"})
+		return
+	}
+	if !a.breakGlass.authorize(c, policy.ActionRead, record.PatientID, record.ID, "download_attachment") {
+		return
+	}
+	var attachment Attachment
+	if err := a.db.Where("id = ? AND record_id = ?", c.Param("attachmentId"), record.ID).First(&attachment).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if attachment.StorageKey == "" {
+		// Attachments from before uploads are only links
+		c.JSON(200, gin.H{"url": attachment.URL})
+		return
+	}
+
+	expires := time.Now().Add(a.urlTTL).Unix()
+	userID := auth.UserID(c)
+	c.JSON(200, gin.H{
+		"url": fmt.Sprintf("%s/files/%d?expires=%d&user=%d&sig=%s",
+			a.baseURL, attachment.ID, expires, userID, a.sign(attachment.ID, userID, expires)),
+		"expiresAt": time.Unix(expires, 0).UTC(),
+	})
+}
+
+// sign is the signature of a download link: the attachment, the user it
+// was issued to, and its expiry.
+func (a *attachments) sign(attachmentID, userID uint, expires int64) string {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%d:%d:%d", attachmentID, userID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serve answers GET /files/:attachmentId, the signed download link. The
+// link is the credential, so it is short-lived and the download is
+// audited as the user it was issued to.
+func (a *attachments) serve(c *gin.Context) {
+	attachmentID, errID := strconv.ParseUint(c.Param("attachmentId"), 10, 32)
+	userID, errUser := strconv.ParseUint(c.Query("user"), 10, 32)
+	expires, errExp := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if errID != nil || errUser != nil || errExp != nil ||
+		!hmac.Equal([]byte(c.Query("sig")), []byte(a.sign(uint(attachmentID), uint(userID), expires))) {
+		c.JSON(403, gin.H{"error": "Invalid download link"})
+		return
+	}
+	if time.Now().Unix() > expires {
+		c.JSON(403, gin.H{"error": "Download link has expired"})
+		return
+	}
+	c.Set(auth.ContextUserID, uint(userID))
+
+	var attachment Attachment
+	if err := a.db.First(&attachment, attachmentID).Error; err != nil || attachment.StorageKey == "" {
+		c.JSON(404, gin.H{"error": "Attachment not found"})
+		return
+	}
+	var record MedicalRecord
+	if err := a.db.Select("id", "patient_id").First(&record, attachment.RecordID).Error; err == nil {
+		audit.SetPatient(c, record.PatientID)
+	}
+	audit.SetResourceID(c, strconv.FormatUint(attachmentID, 10))
+
+	body, err := a.store.Get(attachment.StorageKey)
+	if errors.Is(err, blob.ErrNotFound) {
+		c.JSON(404, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read attachment %d: %v", attachment.ID, err)
+		c.JSON(502, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	defer body.Close()
+	c.DataFromReader(200, attachment.Size, attachment.ContentType, body, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, no-store",
+	})
+}
+
+func (a *attachments) deleteBlob(key string) {
+	if err := a.store.Delete(key); err != nil {
+		log.Printf("Failed to delete blob %s: %v", key, err)
+	}
+}
+
+func (a *attachments) respondTooLarge(c *gin.Context) {
+	c.JSON(413, gin.H{"error": fmt.Sprintf("Files are at most %d MB", a.maxSize>>20)})
+}
+
+func (a *attachments) respondReadError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		a.respondTooLarge(c)
+		return
+	}
+	c.JSON(400, gin.H{"error": "Failed to read upload"})
+}
+
+// respondIngestError maps a failed ingest to a response.
+func respondIngestError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errEmptyFile):
+		c.JSON(400, gin.H{"error": err.Error()})
+	case errors.Is(err, errUnsupportedType):
+		c.JSON(415, gin.H{"error": err.Error()})
+	case errors.Is(err, errChecksumMismatch):
+		c.JSON(422, gin.H{"error": err.Error()})
+	case errors.Is(err, errNotDraft):
+		c.JSON(409, gin.H{"error": "Attachments can only be added to drafts"})
+	default:
+		log.Printf("Failed to store attachment: %v", err)
+		c.JSON(502, gin.H{"error": "Failed to store attachment"})
+	}
+}
+
+// sniff detects a file's content type from its first bytes, ignoring
+// whatever the client claimed.
+func sniff(head []byte) string {
+	// DICOM files have a 128-byte preamble followed by "DICM"
+	if len(head) >= 132 && string(head[128:132]) == "DICM" {
+		return "application/dicom"
+	}
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// kindOf is the attachment Type for a content type.
+func kindOf(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image"
+	case contentType == "application/dicom":
+		return "dicom"
+	default:
+		return "document"
+	}
+}
+
+// cleanFileName keeps the base name of a client-supplied file name,
+// without control characters.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// chunkReader reads the blobs under keys one after another, opening each
+// only when it is reached.
+type chunkReader struct {
+	store *envelope.Store
+	keys  []string
+	cur   io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			body, err := r.store.Get(r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.keys = body, r.keys[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
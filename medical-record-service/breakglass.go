@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/identity"
+	"healthcare/shared/notify"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const minBreakGlassReason = 20
+
+// EmergencyAccess is a time-limited break-glass grant letting a doctor read
+// the records of a patient they have no relationship with. Grants are never
+// changed or removed; like the log, the table is append-only.
+type EmergencyAccess struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"` // the doctor's user ID
+	DoctorID  uint   `gorm:"not null"`
+	PatientID uint   `gorm:"not null;index"`
+	Reason    string `gorm:"type:text;not null"`
+	IPAddress string
+	ExpiresAt time.Time `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// EmergencyAccessLog records every use of a break-glass grant. The table is
+// append-only; a trigger rejects updates and deletes.
+type EmergencyAccessLog struct {
+	ID        uint   `gorm:"primaryKey"`
+	GrantID   uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null"`
+	PatientID uint   `gorm:"not null;index"`
+	RecordID  uint   // 0 for list and grant entries
+	Action    string `gorm:"not null"` // granted, list_records, view_record
+	IPAddress string
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+const breakGlassAppendOnly = `
+CREATE OR REPLACE FUNCTION break_glass_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS emergency_access_logs_append_only ON emergency_access_logs;
+DROP FUNCTION IF EXISTS emergency_access_logs_append_only();
+
+DROP TRIGGER IF EXISTS break_glass_append_only ON emergency_access_logs;
+CREATE TRIGGER break_glass_append_only
+	BEFORE UPDATE OR DELETE ON emergency_access_logs
+	FOR EACH ROW EXECUTE FUNCTION break_glass_append_only();
+
+DROP TRIGGER IF EXISTS break_glass_append_only ON emergency_accesses;
+CREATE TRIGGER break_glass_append_only
+	BEFORE UPDATE OR DELETE ON emergency_accesses
+	FOR EACH ROW EXECUTE FUNCTION break_glass_append_only();
+`
+
+// breakGlass grants emergency access and lets it stand in for the normal
+// relationship check on record reads.
+type breakGlass struct {
+	db       *gorm.DB
+	policies *policy.Policy
+	notifier *notify.Client
+	users    *identity.Client // finds the admins to notify
+	ttl      time.Duration
+}
+
+func newBreakGlass(db *gorm.DB, policies *policy.Policy, notifier *notify.Client, users *identity.Client) *breakGlass {
+	ttl := time.Hour
+	if v := os.Getenv("BREAK_GLASS_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatal("Invalid BREAK_GLASS_TTL:", err)
+		}
+		ttl = d
+	}
+	return &breakGlass{db: db, policies: policies, notifier: notifier, users: users, ttl: ttl}
+}
+
+func migrateBreakGlass(db *gorm.DB) error {
+	if err := db.AutoMigrate(&EmergencyAccess{}, &EmergencyAccessLog{}); err != nil {
+		return err
+	}
+	return db.Exec(breakGlassAppendOnly).Error
+}
+
+// authorize checks access to patientID's records. A doctor without a
+// relationship is let through on an active grant, and that read is logged.
+func (b *breakGlass) authorize(c *gin.Context, act policy.Action, patientID, recordID uint, action string) bool {
+	audit.SetPatient(c, patientID)
+	ok, err := b.policies.CanAccessPatient(policy.SubjectFrom(c), policy.ResourceRecords, act, patientID)
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"error": "Failed to check permissions"})
+		return false
+	}
+	if ok {
+		return true
+	}
+
+	if act == policy.ActionRead && auth.Role(c) == auth.RoleDoctor {
+		grant, err := b.activeGrant(auth.UserID(c), patientID)
+		if err == nil && grant != nil && b.logAccess(c, grant, recordID, action) == nil {
+			audit.SetDetail(c, fmt.Sprintf("break-glass grant %d", grant.ID))
+			return true
+		}
+	}
+
+	c.AbortWithStatusJSON(403, gin.H{"error": "Access denied"})
+	return false
+}
+
+// patientParam is policy.PatientParam for record reads, with break-glass.
+func (b *breakGlass) patientParam(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param(param), 10, 32)
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "Invalid " + param})
+			return
+		}
+		if b.authorize(c, policy.ActionRead, uint(id), 0, "list_records") {
+			c.Next()
+		}
+	}
+}
+
+func (b *breakGlass) activeGrant(userID, patientID uint) (*EmergencyAccess, error) {
+	var grant EmergencyAccess
+	err := b.db.Where("user_id = ? AND patient_id = ? AND expires_at > ?", userID, patientID, time.Now()).
+		Order("expires_at desc").
+		First(&grant).Error
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func (b *breakGlass) logAccess(c *gin.Context, grant *EmergencyAccess, recordID uint, action string) error {
+	return b.db.Create(&EmergencyAccessLog{
+		GrantID:   grant.ID,
+		UserID:    grant.UserID,
+		PatientID: grant.PatientID,
+		RecordID:  recordID,
+		Action:    action,
+		IPAddress: c.ClientIP(),
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+// request handles POST /api/records/emergency-access.
+func (b *breakGlass) request(c *gin.Context) {
+	var input struct {
+		PatientID uint   `json:"patientId" binding:"required"`
+		Reason    string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(input.Reason) < minBreakGlassReason {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Reason must be at least %d characters", minBreakGlassReason)})
+		return
+	}
+
+	doctorID, err := b.policies.DoctorIDFor(auth.UserID(c))
+	if err != nil || doctorID == 0 {
+		c.JSON(403, gin.H{"error": "Doctor profile not found"})
+		return
+	}
+
+	now := time.Now()
+	grant := EmergencyAccess{
+		UserID:    auth.UserID(c),
+		DoctorID:  doctorID,
+		PatientID: input.PatientID,
+		Reason:    input.Reason,
+		IPAddress: c.ClientIP(),
+		ExpiresAt: now.Add(b.ttl),
+		CreatedAt: now,
+	}
+
+	err = b.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&grant).Error; err != nil {
+			return err
+		}
+		return tx.Create(&EmergencyAccessLog{
+			GrantID:   grant.ID,
+			UserID:    grant.UserID,
+			PatientID: grant.PatientID,
+			Action:    "granted",
+			IPAddress: grant.IPAddress,
+			CreatedAt: now,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to grant emergency access"})
+		return
+	}
+	audit.SetPatient(c, grant.PatientID)
+	audit.SetResourceID(c, strconv.FormatUint(uint64(grant.ID), 10))
+	audit.SetDetail(c, "break-glass reason: "+grant.Reason)
+
+	// Access is granted even if notification-service is down; the audit
+	// trail above is the record of truth.
+	if err := b.notifyGrant(&grant); err != nil {
+		log.Printf("Failed to send break-glass notifications for grant %d: %v", grant.ID, err)
+	}
+
+	c.JSON(201, grant)
+}
+
+// list handles GET /api/records/emergency-access. Admins see every grant,
+// optionally filtered by ?patientId=; doctors see their own.
+func (b *breakGlass) list(c *gin.Context) {
+	query := b.db.Order("created_at desc")
+	if auth.Role(c) != auth.RoleAdmin {
+		query = query.Where("user_id = ?", auth.UserID(c))
+	}
+	if patientID := c.Query("patientId"); patientID != "" {
+		query = query.Where("patient_id = ?", patientID)
+	}
+
+	var grants []EmergencyAccess
+	if err := query.Find(&grants).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch emergency access grants"})
+		return
+	}
+
+	c.JSON(200, grants)
+}
+
+// logs handles GET /api/records/emergency-access/:id/logs for admins.
+func (b *breakGlass) logs(c *gin.Context) {
+	var entries []EmergencyAccessLog
+	if err := b.db.Where("grant_id = ?", c.Param("id")).Order("created_at").Find(&entries).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch emergency access log"})
+		return
+	}
+
+	c.JSON(200, entries)
+}
+
+// notifyGrant tells the patient and every admin that emergency access was
+// used. The patient is told first, so a failed admin lookup cannot stop
+// their notice; both errors are returned.
+func (b *breakGlass) notifyGrant(grant *EmergencyAccess) error {
+	data, _ := json.Marshal(gin.H{
+		"grantId":   grant.ID,
+		"doctorId":  grant.DoctorID,
+		"patientId": grant.PatientID,
+		"reason":    grant.Reason,
+		"expiresAt": grant.ExpiresAt,
+	})
+
+	patientErr := b.notifier.Send(notify.Notification{
+		UserID:   grant.PatientID,
+		Type:     "record",
+		Title:    "Emergency access to your medical records",
+		Message:  "A doctor used emergency access to view your medical records. Reason: " + grant.Reason,
+		Data:     string(data),
+		Priority: notify.PriorityHigh,
+	})
+	return errors.Join(patientErr, b.notifyAdmins(grant, string(data)))
+}
+
+// notifyAdmins tells every admin that emergency access was granted.
+func (b *breakGlass) notifyAdmins(grant *EmergencyAccess, data string) error {
+	admins, err := b.users.UsersWithRole(auth.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	adminIDs := make([]uint, len(admins))
+	for i, admin := range admins {
+		adminIDs[i] = admin.ID
+	}
+
+	return b.notifier.SendAll(adminIDs, notify.Notification{
+		Type:     "record",
+		Title:    "Break-glass access granted",
+		Message:  fmt.Sprintf("Doctor %d was granted emergency access to patient %d. Reason: %s", grant.DoctorID, grant.PatientID, grant.Reason),
+		Data:     data,
+		Priority: notify.PriorityHigh,
+	})
+}
@@ -5,6 +5,14 @@ import (
 	"os"
 	"time"
 
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/blob"
+	"healthcare/shared/envelope"
+	"healthcare/shared/identity"
+	"healthcare/shared/notify"
+	"healthcare/shared/policy"
+
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -13,21 +21,32 @@ import (
 
 type MedicalRecord struct {
 	gorm.Model
-	PatientID    uint      `gorm:"not null"`
-	DoctorID     uint      `gorm:"not null"`
-	Date         time.Time `gorm:"not null"`
-	Diagnosis    string
-	Prescription string
-	Notes        string
-	Attachments  []Attachment `gorm:"foreignKey:RecordID"`
+	PatientID    uint                     `gorm:"not null"`
+	DoctorID     uint                     `gorm:"not null"`
+	Date         time.Time                `gorm:"not null"`
+	Diagnosis    string                   `gorm:"serializer:encrypted"`
+	Prescription string                   `gorm:"serializer:encrypted"`
+	Notes        string                   `gorm:"serializer:encrypted"`
+	Version      int                      `gorm:"not null;default:1"` // latest in medical_record_versions
+	Status       string                   `gorm:"not null;default:draft;index"`
+	CosignerID   *uint                    // supervising doctor who has to co-sign
+	Attachments  []Attachment             `gorm:"foreignKey:RecordID"`
+	Addenda      []MedicalRecordAddendum  `gorm:"foreignKey:RecordID"`
+	Signatures   []MedicalRecordSignature `gorm:"foreignKey:RecordID"`
 }
 
 type Attachment struct {
 	gorm.Model
-	RecordID uint   `gorm:"not null"`
-	Type     string // image, document, etc.
-	URL      string
-	Name     string
+	RecordID    uint   `gorm:"not null"`
+	Type        string // image, document, etc.
+	URL         string // external link; only attachments from before uploads
+	Name        string
+	ContentType string
+	Size        int64
+	SHA256      string `gorm:"size:64"`
+	StorageKey  string `json:"-"`
+	UploadedBy  uint
+	KeyID       uint `json:"-"` // data key the file is sealed with, 0 if it is not
 }
 
 func main() {
@@ -47,8 +66,62 @@ func main() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	// Clinical fields and files are sealed with the tenant's data key; the
+	// serializer has to be in place before gorm parses the models
+	keys, err := envelope.NewKeyringFromEnv(db)
+	if err != nil {
+		log.Fatal("Failed to set up encryption keys:", err)
+	}
+	envelope.Register(keys)
+
 	// Auto migrate the schema
-	db.AutoMigrate(&MedicalRecord{}, &Attachment{})
+	if err := migrateLegacyRecords(db); err != nil {
+		log.Fatal("Failed to lock legacy records:", err)
+	}
+	db.AutoMigrate(&MedicalRecord{}, &Attachment{}, &AttachmentUpload{}, &AttachmentUploadChunk{})
+	if err := audit.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate audit log:", err)
+	}
+	if err := migrateBreakGlass(db); err != nil {
+		log.Fatal("Failed to migrate emergency access tables:", err)
+	}
+	if err := migrateHistory(db); err != nil {
+		log.Fatal("Failed to migrate record history:", err)
+	}
+	if err := migrateSigning(db); err != nil {
+		log.Fatal("Failed to migrate record signatures:", err)
+	}
+	if err := envelope.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate data keys:", err)
+	}
+	go envelope.NewReencryptor(db, keys,
+		envelope.Column{Table: "medical_records", Name: "diagnosis"},
+		envelope.Column{Table: "medical_records", Name: "prescription"},
+		envelope.Column{Table: "medical_records", Name: "notes"},
+		envelope.Column{Table: "medical_record_versions", Name: "diagnosis"},
+		envelope.Column{Table: "medical_record_versions", Name: "prescription"},
+		envelope.Column{Table: "medical_record_versions", Name: "notes"},
+		envelope.Column{Table: "medical_record_versions", Name: "diff"},
+		envelope.Column{Table: "medical_record_addenda", Name: "text"},
+	).Run(envelope.DefaultSweepInterval)
+
+	users := identity.NewClientFromEnv()
+	verifier, err := auth.NewServiceVerifier(users)
+	if err != nil {
+		log.Fatal("Failed to load auth configuration:", err)
+	}
+	policies := policy.New(db)
+	auditLog := audit.NewLogger(db, "medical-record-service")
+	notifier := notify.NewClientFromEnv()
+	breakGlass := newBreakGlass(db, policies, notifier, users)
+	blobs, err := blob.NewStoreFromEnv()
+	if err != nil {
+		log.Fatal("Failed to open file store:", err)
+	}
+	files := newAttachments(db, policies, breakGlass, envelope.NewStore(blobs, keys))
+	go files.run()
+	records := newHistory(db, policies, breakGlass)
+	signatures := newSigning(db, policies, breakGlass, notifier)
 
 	// Initialize Gin router
 	r := gin.Default()
@@ -56,8 +129,9 @@ func main() {
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Upload-Offset, X-Checksum-Sha256")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Upload-Offset")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -67,16 +141,32 @@ func main() {
 
 	// Medical record routes
 	recordRoutes := r.Group("/api/records")
+	recordRoutes.Use(audit.Middleware(auditLog, "medical_record"), auth.AuthMiddleware(verifier))
 	{
 		// Create medical record
 		recordRoutes.POST("/", func(c *gin.Context) {
-			var record MedicalRecord
-			if err := c.ShouldBindJSON(&record); err != nil {
+			var input NewRecord
+			if err := c.ShouldBindJSON(&input); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
+			record := input.record()
+
+			// Doctors always file records under their own profile
+			if auth.Role(c) == auth.RoleDoctor {
+				doctorID, err := policies.DoctorIDFor(auth.UserID(c))
+				if err != nil || doctorID == 0 {
+					c.JSON(403, gin.H{"error": "Doctor profile not found"})
+					return
+				}
+				record.DoctorID = doctorID
+			}
+
+			if !policies.Authorize(c, policy.ResourceRecords, policy.ActionWrite, record.PatientID) {
+				return
+			}
 
-			if err := db.Create(&record).Error; err != nil {
+			if err := records.create(c, &record); err != nil {
 				c.JSON(400, gin.H{"error": "Failed to create medical record"})
 				return
 			}
@@ -84,10 +174,15 @@ func main() {
 			c.JSON(201, record)
 		})
 
+		// Break-glass emergency access
+		recordRoutes.POST("/emergency-access", auth.RoleMiddleware(auth.RoleDoctor), breakGlass.request)
+		recordRoutes.GET("/emergency-access", auth.RoleMiddleware(auth.RoleAdmin, auth.RoleDoctor), breakGlass.list)
+		recordRoutes.GET("/emergency-access/:id/logs", auth.RoleMiddleware(auth.RoleAdmin), breakGlass.logs)
+
 		// Get patient's medical records
-		recordRoutes.GET("/patient/:patientId", func(c *gin.Context) {
+		recordRoutes.GET("/patient/:patientId", breakGlass.patientParam("patientId"), func(c *gin.Context) {
 			var records []MedicalRecord
-			if err := db.Preload("Attachments").Where("patient_id = ?", c.Param("patientId")).Find(&records).Error; err != nil {
+			if err := db.Preload("Attachments").Preload("Addenda").Preload("Signatures").Where("patient_id = ?", c.Param("patientId")).Find(&records).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to fetch medical records"})
 				return
 			}
@@ -96,12 +191,15 @@ func main() {
 		})
 
 		// Get doctor's medical records
-		recordRoutes.GET("/doctor/:doctorId", func(c *gin.Context) {
+		recordRoutes.GET("/doctor/:doctorId", policies.DoctorParam(policy.ResourceRecords, policy.ActionRead, "doctorId"), func(c *gin.Context) {
 			var records []MedicalRecord
-			if err := db.Preload("Attachments").Where("doctor_id = ?", c.Param("doctorId")).Find(&records).Error; err != nil {
+			if err := db.Preload("Attachments").Preload("Addenda").Preload("Signatures").Where("doctor_id = ?", c.Param("doctorId")).Find(&records).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to fetch medical records"})
 				return
 			}
+			for _, r := range records {
+				audit.SetPatients(c, r.PatientID)
+			}
 
 			c.JSON(200, records)
 		})
@@ -109,53 +207,45 @@ func main() {
 		// Get specific medical record
 		recordRoutes.GET("/:id", func(c *gin.Context) {
 			var record MedicalRecord
-			if err := db.Preload("Attachments").First(&record, c.Param("id")).Error; err != nil {
+			if err := db.Preload("Attachments").Preload("Addenda").Preload("Signatures").First(&record, c.Param("id")).Error; err != nil {
 				c.JSON(404, gin.H{"error": "Medical record not found"})
 				return
 			}
 
-			c.JSON(200, record)
-		})
-
-		// Update medical record
-		recordRoutes.PUT("/:id", func(c *gin.Context) {
-			var record MedicalRecord
-			if err := db.First(&record, c.Param("id")).Error; err != nil {
-				c.JSON(404, gin.H{"error": "Medical record not found"})
-				return
-			}
-
-			if err := c.ShouldBindJSON(&record); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
-				return
-			}
-
-			if err := db.Save(&record).Error; err != nil {
-				c.JSON(400, gin.H{"error": "Failed to update medical record"})
+			if !breakGlass.authorize(c, policy.ActionRead, record.PatientID, record.ID, "view_record") {
 				return
 			}
 
 			c.JSON(200, record)
 		})
 
-		// Add attachment to medical record
-		recordRoutes.POST("/:id/attachments", func(c *gin.Context) {
-			var attachment Attachment
-			if err := c.ShouldBindJSON(&attachment); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
-				return
-			}
-
-			attachment.RecordID = uint(c.GetUint("id"))
-			if err := db.Create(&attachment).Error; err != nil {
-				c.JSON(400, gin.H{"error": "Failed to add attachment"})
-				return
-			}
-
-			c.JSON(201, attachment)
-		})
+		// Every change is kept as a new version: edits, formal amendments
+		// and addenda, which add to a record without changing it
+		recordRoutes.PUT("/:id", records.edit)
+		recordRoutes.POST("/:id/amendments", records.amend)
+		recordRoutes.POST("/:id/addenda", records.addendum)
+		recordRoutes.GET("/:id/versions", records.versions)
+		recordRoutes.GET("/:id/versions/:version", records.version)
+
+		// Signing locks a draft; a supervising doctor may have to co-sign
+		recordRoutes.GET("/queue", auth.RoleMiddleware(auth.RoleDoctor), signatures.queue)
+		recordRoutes.POST("/:id/sign", auth.RoleMiddleware(auth.RoleDoctor), signatures.sign)
+		recordRoutes.POST("/:id/cosign", auth.RoleMiddleware(auth.RoleDoctor), signatures.cosign)
+		recordRoutes.GET("/:id/signatures", signatures.signatures)
+
+		// Attachments: a whole file in one request, or a resumable upload
+		// in chunks
+		recordRoutes.POST("/:id/attachments", files.upload)
+		recordRoutes.GET("/:id/attachments/:attachmentId/url", files.downloadURL)
+		recordRoutes.POST("/:id/uploads", files.createUpload)
+		recordRoutes.GET("/:id/uploads/:uploadId", files.getUpload)
+		recordRoutes.PATCH("/:id/uploads/:uploadId", files.uploadChunk)
+		recordRoutes.DELETE("/:id/uploads/:uploadId", files.abortUpload)
 	}
 
+	// Signed download links; the signature stands in for the token
+	r.GET("/files/:attachmentId", audit.Middleware(auditLog, "attachment"), files.serve)
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/notify"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Record statuses. A draft is edited by its author; signing locks it, after
+// which it only changes by amendment.
+const (
+	StatusDraft          = "draft"
+	StatusPendingCosign  = "pending_cosign" // signed by its author, awaiting the supervisor
+	StatusSigned         = "signed"
+	StatusAmended        = "amended"
+	StatusLegacy         = "legacy" // written before signing existed; locked, but unsigned
+	defaultDraftStaleAge = 72 * time.Hour
+)
+
+// Signer roles.
+const (
+	SignerAuthor   = "author"
+	SignerCosigner = "cosigner"
+)
+
+var errRecordChanged = errors.New("record was changed while signing, reload it and try again")
+
+// MedicalRecordSignature is one doctor's signature on a record version.
+// Hash covers the version's content, the record's attachments and the
+// signer, so a later change to either shows up as an invalid signature.
+type MedicalRecordSignature struct {
+	ID       uint      `gorm:"primaryKey"`
+	RecordID uint      `gorm:"not null;index"`
+	Version  int       `gorm:"not null"`
+	Role     string    `gorm:"not null"`
+	DoctorID uint      `gorm:"not null"`
+	UserID   uint      `gorm:"not null"`
+	Hash     string    `gorm:"size:64;not null"`
+	SignedAt time.Time `gorm:"not null"`
+	Valid    *bool     `gorm:"-" json:",omitempty"` // set when the signature is checked
+}
+
+const signaturesAppendOnly = `
+DROP TRIGGER IF EXISTS record_history_append_only ON medical_record_signatures;
+CREATE TRIGGER record_history_append_only
+	BEFORE UPDATE OR DELETE ON medical_record_signatures
+	FOR EACH ROW EXECUTE FUNCTION record_history_append_only();
+`
+
+// migrateLegacyRecords locks the records written before signing existed.
+// It runs before AutoMigrate adds the status column, whose default would
+// otherwise turn them all into editable drafts; once the column exists it
+// does nothing.
+func migrateLegacyRecords(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&MedicalRecord{}) || m.HasColumn(&MedicalRecord{}, "Status") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("ALTER TABLE medical_records ADD COLUMN status text NOT NULL DEFAULT '" + StatusDraft + "'").Error; err != nil {
+			return err
+		}
+		return tx.Exec("UPDATE medical_records SET status = ?", StatusLegacy).Error
+	})
+}
+
+// migrateSigning runs after migrateHistory, which creates the trigger
+// function.
+func migrateSigning(db *gorm.DB) error {
+	if err := db.AutoMigrate(&MedicalRecordSignature{}); err != nil {
+		return err
+	}
+	return db.Exec(signaturesAppendOnly).Error
+}
+
+// signatureHash hashes what a signature vouches for. Times are truncated to
+// what Postgres stores, so the hash can be recomputed from the database.
+// Attachments are only added to drafts, so those of a signed record are
+// the ones it was signed with; a record without any hashes as it did before
+// attachments were covered.
+func signatureHash(v *MedicalRecordVersion, attachments []Attachment, s *MedicalRecordSignature) string {
+	fields := []interface{}{
+		v.RecordID, v.Version, v.PatientID, v.DoctorID,
+		v.Date.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+		v.Diagnosis, v.Prescription, v.Notes,
+		s.Role, s.DoctorID, s.UserID,
+		s.SignedAt.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+	}
+	if len(attachments) > 0 {
+		files := make([][]interface{}, len(attachments))
+		for i, a := range attachments {
+			files[i] = []interface{}{a.ID, a.Name, a.ContentType, a.Size, a.SHA256, a.URL}
+		}
+		fields = append(fields, files)
+	}
+	data, _ := json.Marshal(fields)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signing moves records from draft to signed and lists what doctors have
+// left to sign.
+type signing struct {
+	db         *gorm.DB
+	policies   *policy.Policy
+	breakGlass *breakGlass
+	notifier   *notify.Client
+	staleAfter time.Duration
+}
+
+func newSigning(db *gorm.DB, policies *policy.Policy, breakGlass *breakGlass, notifier *notify.Client) *signing {
+	staleAfter := defaultDraftStaleAge
+	if v := os.Getenv("DRAFT_STALE_AFTER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid DRAFT_STALE_AFTER:", v)
+		}
+		staleAfter = d
+	}
+	return &signing{db: db, policies: policies, breakGlass: breakGlass, notifier: notifier, staleAfter: staleAfter}
+}
+
+// doctor returns the caller's doctor profile ID, or answers 403.
+func (s *signing) doctor(c *gin.Context) (uint, bool) {
+	doctorID, err := s.policies.DoctorIDFor(auth.UserID(c))
+	if err != nil || doctorID == 0 {
+		c.JSON(403, gin.H{"error": "Doctor profile not found"})
+		return 0, false
+	}
+	return doctorID, true
+}
+
+func (s *signing) load(c *gin.Context) (*MedicalRecord, bool) {
+	var record MedicalRecord
+	if err := s.db.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Medical record not found"})
+		return nil, false
+	}
+	audit.SetPatient(c, record.PatientID)
+	return &record, true
+}
+
+// SignInput is the body of POST /api/records/:id/sign. CosignerID names the
+// supervising doctor who has to co-sign, if any. Version, when given, is the
+// version the author reviewed.
+type SignInput struct {
+	CosignerID *uint
+	Version    int
+}
+
+// sign answers POST /api/records/:id/sign. Only the authoring doctor signs,
+// and only a draft.
+func (s *signing) sign(c *gin.Context) {
+	doctorID, ok := s.doctor(c)
+	if !ok {
+		return
+	}
+	record, ok := s.load(c)
+	if !ok {
+		return
+	}
+	var input SignInput
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if record.DoctorID != doctorID {
+		c.JSON(403, gin.H{"error": "Only the authoring doctor can sign this record"})
+		return
+	}
+	if record.Status != StatusDraft {
+		c.JSON(409, gin.H{"error": "Only drafts can be signed"})
+		return
+	}
+	if input.Version != 0 && input.Version != record.Version {
+		c.JSON(409, gin.H{"error": errStaleVersion.Error(), "version": record.Version})
+		return
+	}
+
+	status := StatusSigned
+	var cosignerUserID uint
+	if input.CosignerID != nil {
+		if *input.CosignerID == doctorID {
+			c.JSON(400, gin.H{"error": "A record cannot be co-signed by its author"})
+			return
+		}
+		var userIDs []uint
+		if err := s.db.Table("doctors").Where("id = ? AND deleted_at IS NULL", *input.CosignerID).Pluck("user_id", &userIDs).Error; err != nil || len(userIDs) == 0 {
+			c.JSON(400, gin.H{"error": "Co-signing doctor not found"})
+			return
+		}
+		cosignerUserID = userIDs[0]
+		status = StatusPendingCosign
+	}
+
+	signature, err := s.record(c, record, doctorID, SignerAuthor, StatusDraft, map[string]interface{}{
+		"status":      status,
+		"cosigner_id": input.CosignerID,
+	})
+	if errors.Is(err, errRecordChanged) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to sign medical record"})
+		return
+	}
+
+	if cosignerUserID != 0 {
+		err := s.notifier.Send(notify.Notification{
+			UserID:  cosignerUserID,
+			Type:    "record",
+			Title:   "Medical record awaiting your co-signature",
+			Message: fmt.Sprintf("Doctor %d signed medical record %d and named you to co-sign it.", doctorID, record.ID),
+		})
+		if err != nil {
+			log.Printf("Failed to notify co-signer of record %d: %v", record.ID, err)
+		}
+	}
+	c.JSON(201, signature)
+}
+
+// cosign answers POST /api/records/:id/cosign, by the supervising doctor
+// named when the record was signed.
+func (s *signing) cosign(c *gin.Context) {
+	doctorID, ok := s.doctor(c)
+	if !ok {
+		return
+	}
+	record, ok := s.load(c)
+	if !ok {
+		return
+	}
+	if record.Status != StatusPendingCosign {
+		c.JSON(409, gin.H{"error": "Record is not awaiting co-signature"})
+		return
+	}
+	if record.CosignerID == nil || *record.CosignerID != doctorID {
+		c.JSON(403, gin.H{"error": "Only the named supervising doctor can co-sign this record"})
+		return
+	}
+
+	signature, err := s.record(c, record, doctorID, SignerCosigner, StatusPendingCosign, map[string]interface{}{
+		"status": StatusSigned,
+	})
+	if errors.Is(err, errRecordChanged) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to co-sign medical record"})
+		return
+	}
+	c.JSON(201, signature)
+}
+
+// record signs record's current version and moves it out of status.
+func (s *signing) record(c *gin.Context, record *MedicalRecord, doctorID uint, role, status string, updates map[string]interface{}) (*MedicalRecordSignature, error) {
+	signature := &MedicalRecordSignature{
+		RecordID: record.ID,
+		Version:  record.Version,
+		Role:     role,
+		DoctorID: doctorID,
+		UserID:   auth.UserID(c),
+		SignedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&MedicalRecord{}).
+			Where("id = ? AND version = ? AND status = ?", record.ID, record.Version, status).
+			Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errRecordChanged
+		}
+
+		if err := baseline(tx, record); err != nil {
+			return err
+		}
+		var version MedicalRecordVersion
+		if err := tx.Where("record_id = ? AND version = ?", record.ID, record.Version).First(&version).Error; err != nil {
+			return err
+		}
+		var attachments []Attachment
+		if err := tx.Where("record_id = ?", record.ID).Order("id").Find(&attachments).Error; err != nil {
+			return err
+		}
+		signature.Hash = signatureHash(&version, attachments, signature)
+		return tx.Create(signature).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	audit.SetDetail(c, role+" signature on version "+strconv.Itoa(record.Version))
+	return signature, nil
+}
+
+// signatures answers GET /api/records/:id/signatures, each checked against
+// the version it signs.
+func (s *signing) signatures(c *gin.Context) {
+	var record MedicalRecord
+	if err := s.db.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Medical record not found"})
+		return
+	}
+	if !s.breakGlass.authorize(c, policy.ActionRead, record.PatientID, record.ID, "view_signatures") {
+		return
+	}
+
+	var signatures []MedicalRecordSignature
+	if err := s.db.Where("record_id = ?", record.ID).Order("signed_at").Find(&signatures).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch signatures"})
+		return
+	}
+	var attachments []Attachment
+	if err := s.db.Where("record_id = ?", record.ID).Order("id").Find(&attachments).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch signatures"})
+		return
+	}
+	versions := map[int]*MedicalRecordVersion{}
+	for i := range signatures {
+		sig := &signatures[i]
+		v, ok := versions[sig.Version]
+		if !ok {
+			v = &MedicalRecordVersion{}
+			if err := s.db.Where("record_id = ? AND version = ?", record.ID, sig.Version).First(v).Error; err != nil {
+				v = nil
+			}
+			versions[sig.Version] = v
+		}
+		valid := v != nil && signatureHash(v, attachments, sig) == sig.Hash
+		sig.Valid = &valid
+	}
+	c.JSON(200, signatures)
+}
+
+// queue answers GET /api/records/queue: the caller's drafts left unsigned
+// for longer than DRAFT_STALE_AFTER, and the records waiting on their
+// co-signature.
+func (s *signing) queue(c *gin.Context) {
+	doctorID, ok := s.doctor(c)
+	if !ok {
+		return
+	}
+	var drafts, cosign []MedicalRecord
+	if err := s.db.Where("doctor_id = ? AND status = ? AND created_at < ?", doctorID, StatusDraft, time.Now().Add(-s.staleAfter)).
+		Order("created_at").Find(&drafts).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch work queue"})
+		return
+	}
+	if err := s.db.Where("cosigner_id = ? AND status = ?", doctorID, StatusPendingCosign).
+		Order("updated_at").Find(&cosign).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch work queue"})
+		return
+	}
+	for _, r := range drafts {
+		audit.SetPatients(c, r.PatientID)
+	}
+	for _, r := range cosign {
+		audit.SetPatients(c, r.PatientID)
+	}
+	c.JSON(200, gin.H{"drafts": drafts, "cosign": cosign})
+}
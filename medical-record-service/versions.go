@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"healthcare/shared/auth"
+	"healthcare/shared/policy"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of record version.
+const (
+	VersionCreated   = "created"
+	VersionImported  = "imported" // the record as it was before versioning
+	VersionEdit      = "edit"
+	VersionAmendment = "amendment"
+	VersionAddendum  = "addendum"
+)
+
+var errStaleVersion = errors.New("record was changed by someone else, reload it and try again")
+
+// MedicalRecordVersion is a record as it stood after one change, with who
+// made the change, why, and what it changed. Versions are never changed or
+// deleted; a trigger allows nothing but re-encrypting their sealed columns.
+type MedicalRecordVersion struct {
+	ID           uint   `gorm:"primaryKey" json:"-"`
+	RecordID     uint   `gorm:"not null;uniqueIndex:idx_record_versions_version"`
+	Version      int    `gorm:"not null;uniqueIndex:idx_record_versions_version"`
+	Kind         string `gorm:"not null"`
+	AuthorID     uint   // 0 for imported versions
+	AuthorRole   string
+	Reason       string        `gorm:"type:text"`
+	PatientID    uint          `gorm:"not null"`
+	DoctorID     uint          `gorm:"not null"`
+	Date         time.Time     `gorm:"not null"`
+	Diagnosis    string        `gorm:"serializer:encrypted"`
+	Prescription string        `gorm:"serializer:encrypted"`
+	Notes        string        `gorm:"serializer:encrypted"`
+	Diff         string        `gorm:"type:text;serializer:encrypted" json:"-"`
+	Changes      []FieldChange `gorm:"-"`
+	CreatedAt    time.Time     `gorm:"not null"`
+}
+
+// FieldChange is one field changed by a version.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (v *MedicalRecordVersion) BeforeCreate(tx *gorm.DB) error {
+	diff, err := json.Marshal(v.Changes)
+	v.Diff = string(diff)
+	return err
+}
+
+func (v *MedicalRecordVersion) AfterFind(tx *gorm.DB) error {
+	if v.Diff == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(v.Diff), &v.Changes)
+}
+
+// MedicalRecordAddendum adds to a record without changing what it says.
+type MedicalRecordAddendum struct {
+	ID         uint      `gorm:"primaryKey"`
+	RecordID   uint      `gorm:"not null;index"`
+	Version    int       `gorm:"not null"` // the record version it created
+	AuthorID   uint      `gorm:"not null"`
+	AuthorRole string    `gorm:"not null"`
+	Text       string    `gorm:"type:text;not null;serializer:encrypted"`
+	CreatedAt  time.Time `gorm:"not null"`
+}
+
+func (MedicalRecordAddendum) TableName() string {
+	return "medical_record_addenda"
+}
+
+// recordHistoryAppendOnly rejects deletes, and updates other than to the
+// sealed columns named as trigger arguments, which the re-encryption sweep
+// rewrites.
+const recordHistoryAppendOnly = `
+CREATE OR REPLACE FUNCTION record_history_append_only() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' AND to_jsonb(NEW) - TG_ARGV = to_jsonb(OLD) - TG_ARGV THEN
+		RETURN NEW;
+	END IF;
+	RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS record_history_append_only ON medical_record_versions;
+CREATE TRIGGER record_history_append_only
+	BEFORE UPDATE OR DELETE ON medical_record_versions
+	FOR EACH ROW EXECUTE FUNCTION record_history_append_only('diagnosis', 'prescription', 'notes', 'diff');
+
+DROP TRIGGER IF EXISTS record_history_append_only ON medical_record_addenda;
+CREATE TRIGGER record_history_append_only
+	BEFORE UPDATE OR DELETE ON medical_record_addenda
+	FOR EACH ROW EXECUTE FUNCTION record_history_append_only('text');
+`
+
+func migrateHistory(db *gorm.DB) error {
+	if err := db.AutoMigrate(&MedicalRecordVersion{}, &MedicalRecordAddendum{}); err != nil {
+		return err
+	}
+	return db.Exec(recordHistoryAppendOnly).Error
+}
+
+// history keeps every change to a record as a new version.
+type history struct {
+	db         *gorm.DB
+	policies   *policy.Policy
+	breakGlass *breakGlass
+}
+
+func newHistory(db *gorm.DB, policies *policy.Policy, breakGlass *breakGlass) *history {
+	return &history{db: db, policies: policies, breakGlass: breakGlass}
+}
+
+// create stores a new record as its first version.
+func (h *history) create(c *gin.Context, record *MedicalRecord) error {
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		record.Model = gorm.Model{}
+		record.Version = 1
+		record.Status = StatusDraft
+		record.CosignerID = nil
+		record.Attachments = nil
+		record.Addenda = nil
+		record.Signatures = nil
+		if err := tx.Create(record).Error; err != nil {
+			return err
+		}
+		return appendVersion(tx, c, record, nil, VersionCreated, "")
+	})
+}
+
+// save writes the changes made to record since prev as its next version.
+// It fails with errStaleVersion if another change got there first.
+func save(tx *gorm.DB, c *gin.Context, record, prev *MedicalRecord, kind, reason string) error {
+	record.Version = prev.Version + 1
+	res := tx.Model(record).Where("version = ?", prev.Version).
+		Select("patient_id", "doctor_id", "date", "diagnosis", "prescription", "notes", "status", "version", "updated_at").
+		Updates(record)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errStaleVersion
+	}
+	return appendVersion(tx, c, record, prev, kind, reason)
+}
+
+// appendVersion stores record as a version. prev is the record before the
+// change, nil for a new one.
+func appendVersion(tx *gorm.DB, c *gin.Context, record, prev *MedicalRecord, kind, reason string) error {
+	if prev != nil {
+		if err := baseline(tx, prev); err != nil {
+			return err
+		}
+	}
+
+	version := snapshot(record, kind, reason)
+	version.AuthorID = auth.UserID(c)
+	version.AuthorRole = auth.Role(c)
+	version.Changes = diff(prev, record)
+	return tx.Create(&version).Error
+}
+
+// baseline stores a record from before versioning as it stands, so its
+// history starts where it was.
+func baseline(tx *gorm.DB, record *MedicalRecord) error {
+	var count int64
+	if err := tx.Model(&MedicalRecordVersion{}).Where("record_id = ?", record.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	imported := snapshot(record, VersionImported, "")
+	return tx.Create(&imported).Error
+}
+
+func snapshot(record *MedicalRecord, kind, reason string) MedicalRecordVersion {
+	return MedicalRecordVersion{
+		RecordID:     record.ID,
+		Version:      record.Version,
+		Kind:         kind,
+		Reason:       reason,
+		PatientID:    record.PatientID,
+		DoctorID:     record.DoctorID,
+		Date:         record.Date,
+		Diagnosis:    record.Diagnosis,
+		Prescription: record.Prescription,
+		Notes:        record.Notes,
+	}
+}
+
+// diff lists the fields that differ between two states of a record; prev
+// is nil for a new one.
+func diff(prev, record *MedicalRecord) []FieldChange {
+	if prev == nil {
+		prev = &MedicalRecord{}
+	}
+	var changes []FieldChange
+	add := func(field, old, new string) {
+		if old != new {
+			changes = append(changes, FieldChange{Field: field, Old: old, New: new})
+		}
+	}
+	id := func(v uint) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	add("PatientID", id(prev.PatientID), id(record.PatientID))
+	add("DoctorID", id(prev.DoctorID), id(record.DoctorID))
+	add("Date", date(prev.Date), date(record.Date))
+	add("Diagnosis", prev.Diagnosis, record.Diagnosis)
+	add("Prescription", prev.Prescription, record.Prescription)
+	add("Notes", prev.Notes, record.Notes)
+	return changes
+}
+
+// NewRecord is the body of a new record. It has no ID and no
+// associations; attachments, addenda and signatures only come in through
+// their own endpoints.
+type NewRecord struct {
+	PatientID    uint
+	DoctorID     uint
+	Date         time.Time
+	Diagnosis    string
+	Prescription string
+	Notes        string
+}
+
+// record returns the record to create from the input.
+func (in NewRecord) record() MedicalRecord {
+	return MedicalRecord{
+		PatientID:    in.PatientID,
+		DoctorID:     in.DoctorID,
+		Date:         in.Date,
+		Diagnosis:    in.Diagnosis,
+		Prescription: in.Prescription,
+		Notes:        in.Notes,
+	}
+}
+
+// RecordChange is the body of an edit or an amendment. Omitted fields are
+// left as they are. Version, when given, is the version the change was
+// made to; a record changed since is refused with 409.
+type RecordChange struct {
+	PatientID    *uint
+	DoctorID     *uint
+	Date         *time.Time
+	Diagnosis    *string
+	Prescription *string
+	Notes        *string
+	Reason       string `binding:"required"`
+	Version      int
+}
+
+// load fetches the record named by :id for a change.
+func (h *history) load(c *gin.Context) (*MedicalRecord, bool) {
+	var record MedicalRecord
+	if err := h.db.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Medical record not found"})
+		return nil, false
+	}
+	if !h.policies.Authorize(c, policy.ResourceRecords, policy.ActionWrite, record.PatientID) {
+		return nil, false
+	}
+	return &record, true
+}
+
+// edit answers PUT /api/records/:id.
+func (h *history) edit(c *gin.Context) {
+	h.change(c, VersionEdit)
+}
+
+// amend answers POST /api/records/:id/amendments, a formal correction.
+func (h *history) amend(c *gin.Context) {
+	h.change(c, VersionAmendment)
+}
+
+func (h *history) change(c *gin.Context, kind string) {
+	prev, ok := h.load(c)
+	if !ok {
+		return
+	}
+	var input RecordChange
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Version != 0 && input.Version != prev.Version {
+		c.JSON(409, gin.H{"error": errStaleVersion.Error(), "version": prev.Version})
+		return
+	}
+	// Drafts are edited until signed, and signed records only amended
+	switch {
+	case kind == VersionEdit && prev.Status != StatusDraft:
+		c.JSON(409, gin.H{"error": "Only drafts can be edited, file an amendment or addendum instead"})
+		return
+	case kind == VersionAmendment && prev.Status == StatusDraft:
+		c.JSON(409, gin.H{"error": "Drafts are edited, not amended, until they are signed"})
+		return
+	case kind == VersionAmendment && prev.Status == StatusPendingCosign:
+		c.JSON(409, gin.H{"error": "Record is awaiting co-signature"})
+		return
+	}
+	// Only the author edits a draft, as only the author signs it
+	if kind == VersionEdit {
+		doctorID, err := h.policies.DoctorIDFor(auth.UserID(c))
+		if err != nil || doctorID != prev.DoctorID {
+			c.JSON(403, gin.H{"error": "Only the authoring doctor can edit this draft"})
+			return
+		}
+	}
+
+	record := *prev
+	if kind == VersionAmendment {
+		record.Status = StatusAmended
+	}
+	if input.PatientID != nil {
+		record.PatientID = *input.PatientID
+	}
+	// Doctors file records under their own profile, as on create
+	if input.DoctorID != nil && auth.Role(c) != auth.RoleDoctor {
+		record.DoctorID = *input.DoctorID
+	}
+	if input.Date != nil {
+		record.Date = *input.Date
+	}
+	if input.Diagnosis != nil {
+		record.Diagnosis = *input.Diagnosis
+	}
+	if input.Prescription != nil {
+		record.Prescription = *input.Prescription
+	}
+	if input.Notes != nil {
+		record.Notes = *input.Notes
+	}
+
+	// The change may move the record to another patient
+	if record.PatientID != prev.PatientID && !h.policies.Authorize(c, policy.ResourceRecords, policy.ActionWrite, record.PatientID) {
+		return
+	}
+	if len(diff(prev, &record)) == 0 {
+		c.JSON(400, gin.H{"error": "Nothing to change"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		return save(tx, c, &record, prev, kind, input.Reason)
+	})
+	if errors.Is(err, errStaleVersion) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to update medical record"})
+		return
+	}
+	c.JSON(200, record)
+}
+
+// AddendumInput is the body of POST /api/records/:id/addenda.
+type AddendumInput struct {
+	Text   string `binding:"required"`
+	Reason string
+}
+
+// addendum answers POST /api/records/:id/addenda. An addendum adds to the
+// record without changing it, as a version of its own.
+func (h *history) addendum(c *gin.Context) {
+	prev, ok := h.load(c)
+	if !ok {
+		return
+	}
+	var input AddendumInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	// The co-signer signs the version the author signed
+	if prev.Status == StatusPendingCosign {
+		c.JSON(409, gin.H{"error": "Record is awaiting co-signature"})
+		return
+	}
+
+	record := *prev
+	addendum := MedicalRecordAddendum{
+		RecordID:   record.ID,
+		AuthorID:   auth.UserID(c),
+		AuthorRole: auth.Role(c),
+		Text:       input.Text,
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := save(tx, c, &record, prev, VersionAddendum, input.Reason); err != nil {
+			return err
+		}
+		addendum.Version = record.Version
+		return tx.Create(&addendum).Error
+	})
+	if errors.Is(err, errStaleVersion) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to add addendum"})
+		return
+	}
+	c.JSON(201, addendum)
+}
+
+// VersionSummary is a version without the record it stores.
+type VersionSummary struct {
+	Version    int
+	Kind       string
+	AuthorID   uint
+	AuthorRole string
+	Reason     string
+	Changes    []FieldChange
+	CreatedAt  time.Time
+}
+
+// readable fetches the record named by :id for reading its history.
+func (h *history) readable(c *gin.Context, action string) (*MedicalRecord, bool) {
+	var record MedicalRecord
+	if err := h.db.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Medical record not found"})
+		return nil, false
+	}
+	if !h.breakGlass.authorize(c, policy.ActionRead, record.PatientID, record.ID, action) {
+		return nil, false
+	}
+	return &record, true
+}
+
+// versions answers GET /api/records/:id/versions, oldest first.
+func (h *history) versions(c *gin.Context) {
+	record, ok := h.readable(c, "view_versions")
+	if !ok {
+		return
+	}
+	var versions []MedicalRecordVersion
+	if err := h.db.Where("record_id = ?", record.ID).Order("version").Find(&versions).Error; err != nil {
+		c.JSON(400, gin.H{"error": "Failed to fetch versions"})
+		return
+	}
+	summaries := make([]VersionSummary, len(versions))
+	for i, v := range versions {
+		summaries[i] = VersionSummary{
+			Version:    v.Version,
+			Kind:       v.Kind,
+			AuthorID:   v.AuthorID,
+			AuthorRole: v.AuthorRole,
+			Reason:     v.Reason,
+			Changes:    v.Changes,
+			CreatedAt:  v.CreatedAt,
+		}
+	}
+	c.JSON(200, summaries)
+}
+
+// version answers GET /api/records/:id/versions/:version with the record
+// as it stood at that version.
+func (h *history) version(c *gin.Context) {
+	record, ok := h.readable(c, "view_version")
+	if !ok {
+		return
+	}
+	var version MedicalRecordVersion
+	if err := h.db.Where("record_id = ? AND version = ?", record.ID, c.Param("version")).First(&version).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Version not found"})
+		return
+	}
+	c.JSON(200, version)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewRecordIgnoresIDAndAssociations(t *testing.T) {
+	body := `{
+		"ID": 41,
+		"PatientID": 7,
+		"DoctorID": 3,
+		"Diagnosis": "flu",
+		"Status": "signed",
+		"Attachments": [{"ID": 12, "RecordID": 99, "URL": "https://example.com/x.pdf", "SHA256": "00", "Size": 1}],
+		"Addenda": [{"ID": 5, "Text": "late"}],
+		"Signatures": [{"ID": 6}]
+	}`
+	var input NewRecord
+	if err := json.Unmarshal([]byte(body), &input); err != nil {
+		t.Fatal(err)
+	}
+	record := input.record()
+
+	if record.ID != 0 {
+		t.Errorf("ID = %d, want 0", record.ID)
+	}
+	if record.Status != "" {
+		t.Errorf("Status = %q, want it left to create", record.Status)
+	}
+	if record.Attachments != nil || record.Addenda != nil || record.Signatures != nil {
+		t.Errorf("associations kept: %d attachments, %d addenda, %d signatures",
+			len(record.Attachments), len(record.Addenda), len(record.Signatures))
+	}
+	if record.PatientID != 7 || record.DoctorID != 3 || record.Diagnosis != "flu" {
+		t.Errorf("fields not copied: %+v", record)
+	}
+}
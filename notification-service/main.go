@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"os"
 	"time"
 
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+	"healthcare/shared/identity"
+	"healthcare/shared/policy"
+
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -23,6 +29,19 @@ type Notification struct {
 	Priority string `gorm:"default:'normal'"` // high, normal, low
 }
 
+// breakGlassNotice reports whether n tells someone about a break-glass
+// grant, which medical-record-service sends as a record notice carrying
+// the grant's ID.
+func breakGlassNotice(n *Notification) bool {
+	if n.Type != "record" || n.Data == "" {
+		return false
+	}
+	var data struct {
+		GrantID uint `json:"grantId"`
+	}
+	return json.Unmarshal([]byte(n.Data), &data) == nil && data.GrantID != 0
+}
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
@@ -42,6 +61,16 @@ func main() {
 
 	// Auto migrate the schema
 	db.AutoMigrate(&Notification{})
+	if err := audit.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate audit log:", err)
+	}
+
+	verifier, err := auth.NewServiceVerifier(identity.NewClientFromEnv())
+	if err != nil {
+		log.Fatal("Failed to load auth configuration:", err)
+	}
+	policies := policy.New(db)
+	auditLog := audit.NewLogger(db, "notification-service")
 
 	// Initialize Gin router
 	r := gin.Default()
@@ -60,6 +89,7 @@ func main() {
 
 	// Notification routes
 	notificationRoutes := r.Group("/api/notifications")
+	notificationRoutes.Use(audit.Middleware(auditLog, "notification"), auth.AuthMiddleware(verifier))
 	{
 		// Create notification
 		notificationRoutes.POST("/", func(c *gin.Context) {
@@ -69,6 +99,10 @@ func main() {
 				return
 			}
 
+			if !policies.Authorize(c, policy.ResourceNotifications, policy.ActionWrite, notification.UserID) {
+				return
+			}
+
 			if err := db.Create(&notification).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to create notification"})
 				return
@@ -78,7 +112,7 @@ func main() {
 		})
 
 		// Get user's notifications
-		notificationRoutes.GET("/user/:userId", func(c *gin.Context) {
+		notificationRoutes.GET("/user/:userId", policies.PatientParam(policy.ResourceNotifications, policy.ActionRead, "userId"), func(c *gin.Context) {
 			var notifications []Notification
 			if err := db.Where("user_id = ?", c.Param("userId")).Order("created_at desc").Find(&notifications).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to fetch notifications"})
@@ -89,7 +123,7 @@ func main() {
 		})
 
 		// Get unread notifications count
-		notificationRoutes.GET("/user/:userId/unread/count", func(c *gin.Context) {
+		notificationRoutes.GET("/user/:userId/unread/count", policies.PatientParam(policy.ResourceNotifications, policy.ActionRead, "userId"), func(c *gin.Context) {
 			var count int64
 			if err := db.Model(&Notification{}).Where("user_id = ? AND read = ?", c.Param("userId"), false).Count(&count).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to get unread count"})
@@ -107,6 +141,10 @@ func main() {
 				return
 			}
 
+			if !policies.Authorize(c, policy.ResourceNotifications, policy.ActionWrite, notification.UserID) {
+				return
+			}
+
 			notification.Read = true
 			notification.ReadAt = time.Now()
 			if err := db.Save(&notification).Error; err != nil {
@@ -118,7 +156,7 @@ func main() {
 		})
 
 		// Mark all notifications as read
-		notificationRoutes.PUT("/user/:userId/read-all", func(c *gin.Context) {
+		notificationRoutes.PUT("/user/:userId/read-all", policies.PatientParam(policy.ResourceNotifications, policy.ActionWrite, "userId"), func(c *gin.Context) {
 			if err := db.Model(&Notification{}).Where("user_id = ? AND read = ?", c.Param("userId"), false).Updates(map[string]interface{}{
 				"read":    true,
 				"read_at": time.Now(),
@@ -132,7 +170,23 @@ func main() {
 
 		// Delete notification
 		notificationRoutes.DELETE("/:id", func(c *gin.Context) {
-			if err := db.Delete(&Notification{}, c.Param("id")).Error; err != nil {
+			var notification Notification
+			if err := db.First(&notification, c.Param("id")).Error; err != nil {
+				c.JSON(404, gin.H{"error": "Notification not found"})
+				return
+			}
+
+			if !policies.Authorize(c, policy.ResourceNotifications, policy.ActionWrite, notification.UserID) {
+				return
+			}
+			// Break-glass notices tell patients their records were opened;
+			// only the recipient may remove one
+			if breakGlassNotice(&notification) && notification.UserID != auth.UserID(c) {
+				c.JSON(403, gin.H{"error": "Break-glass notices can only be deleted by their recipient"})
+				return
+			}
+
+			if err := db.Delete(&notification).Error; err != nil {
 				c.JSON(400, gin.H{"error": "Failed to delete notification"})
 				return
 			}
@@ -141,6 +195,27 @@ func main() {
 		})
 	}
 
+	// Internal routes, called by other services with INTERNAL_API_TOKEN
+	internalRoutes := r.Group("/internal/notifications")
+	internalRoutes.Use(auth.InternalMiddleware(auth.InternalToken()))
+	{
+		// Create notification on behalf of a service
+		internalRoutes.POST("/", func(c *gin.Context) {
+			var notification Notification
+			if err := c.ShouldBindJSON(&notification); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			if err := db.Create(&notification).Error; err != nil {
+				c.JSON(400, gin.H{"error": "Failed to create notification"})
+				return
+			}
+
+			c.JSON(201, notification)
+		})
+	}
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
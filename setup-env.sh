@@ -2,7 +2,14 @@
 
 # Common environment variables
 DB_URL="host=localhost user=postgres password=postgres dbname=healthcare port=5432 sslmode=disable"
-JWT_SECRET="your-super-secret-jwt-key-change-in-production"
+JWKS_URL="http://localhost:8081/.well-known/jwks.json"
+# auth-service's internal API: user profiles and session checks
+AUTH_URL="http://localhost:8081"
+# Shared secret for service-to-service calls
+INTERNAL_API_TOKEN=$(openssl rand -hex 32)
+# Key-encryption keys for data at rest, shared by every service that
+# encrypts; keep them out of database backups
+KMS_DIR="$(pwd)/kms"
 
 # Function to create .env file for a service
 create_env_file() {
@@ -14,7 +21,9 @@ create_env_file() {
     cat > "$env_file" << EOF
 PORT=$port
 DATABASE_URL=$DB_URL
-JWT_SECRET=$JWT_SECRET
+JWT_JWKS_URL=$JWKS_URL
+AUTH_SERVICE_URL=$AUTH_URL
+INTERNAL_API_TOKEN=$INTERNAL_API_TOKEN
 EOF
     echo "Created $env_file"
 }
@@ -22,11 +31,33 @@ EOF
 # Create .env files for all services
 create_env_file "auth-service" 8081
 create_env_file "user-service" 8082
+
+# Account emails (password reset, verification) are written to ./mail
+printf 'MAIL_DRIVER=file\nAPP_URL=http://localhost:3000\n' >> "auth-service/.env"
+echo "KMS_DIR=$KMS_DIR" >> "auth-service/.env"
 create_env_file "appointment-service" 8083
+echo "NOTIFICATION_SERVICE_URL=http://localhost:8086" >> "appointment-service/.env"
+echo "CALENDAR_BASE_URL=http://localhost:8083" >> "appointment-service/.env"
+# Telehealth rooms use the local stub video provider
+echo "VIDEO_STUB_SECRET=$(openssl rand -hex 32)" >> "appointment-service/.env"
+echo "BILLING_SERVICE_URL=http://localhost:8085" >> "appointment-service/.env"
+# Slots suggested when a booking clashes come from doctor-service
+echo "DOCTOR_SERVICE_URL=http://localhost:8087" >> "appointment-service/.env"
 create_env_file "medical-record-service" 8084
+echo "NOTIFICATION_SERVICE_URL=http://localhost:8086" >> "medical-record-service/.env"
+# Attachments are stored under ./blobs; download links point back here
+echo "FILES_BASE_URL=http://localhost:8084" >> "medical-record-service/.env"
+echo "FILES_URL_SECRET=$(openssl rand -hex 32)" >> "medical-record-service/.env"
+echo "KMS_DIR=$KMS_DIR" >> "medical-record-service/.env"
 create_env_file "billing-service" 8085
 create_env_file "notification-service" 8086
 create_env_file "doctor-service" 8087
+echo "APPOINTMENT_SERVICE_URL=http://localhost:8083" >> "doctor-service/.env"
+create_env_file "fhir-service" 8088
+# FHIR clients fetch attachments through medical-record-service's links
+echo "FHIR_BASE_URL=http://localhost:8088/fhir" >> "fhir-service/.env"
+echo "RECORDS_BASE_URL=http://localhost:8084" >> "fhir-service/.env"
+echo "KMS_DIR=$KMS_DIR" >> "fhir-service/.env"
 
 # Create frontend .env file
 echo "Creating frontend .env file..."
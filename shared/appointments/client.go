@@ -0,0 +1,76 @@
+// Package appointments reads doctors' bookings through appointment-service's
+// internal API.
+package appointments
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"healthcare/shared/auth"
+)
+
+const DefaultURL = "http://localhost:8082"
+
+// Interval is a booked window, start inclusive and end exclusive.
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// NewClientFromEnv reads APPOINTMENT_SERVICE_URL and INTERNAL_API_TOKEN.
+func NewClientFromEnv() *Client {
+	baseURL := os.Getenv("APPOINTMENT_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return NewClient(baseURL, auth.InternalToken())
+}
+
+// Busy lists the doctor's active appointments that overlap [from, to),
+// ordered by start.
+func (c *Client) Busy(doctorID uint, from, to time.Time) ([]Interval, error) {
+	q := url.Values{}
+	q.Set("doctorId", strconv.FormatUint(uint64(doctorID), 10))
+	q.Set("from", from.Format(time.RFC3339))
+	q.Set("to", to.Format(time.RFC3339))
+
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/internal/appointments/busy?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(auth.InternalTokenHeader, c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("appointments: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("appointments: unexpected status %d", resp.StatusCode)
+	}
+
+	var busy []Interval
+	if err := json.NewDecoder(resp.Body).Decode(&busy); err != nil {
+		return nil, err
+	}
+	return busy, nil
+}
@@ -0,0 +1,342 @@
+// Package audit records who read or changed which patient's data. Every
+// service writes to one shared audit_entries table; each entry carries the
+// hash of the entry before it, so editing or deleting a row breaks the chain
+// and shows up in Verify.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Outcomes of an audited request.
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// Actions of an audited request.
+const (
+	ActionRead  = "read"
+	ActionWrite = "write"
+)
+
+// ErrChainBroken is returned by Verify when an entry no longer matches its
+// hash or its predecessor.
+var ErrChainBroken = errors.New("audit: hash chain broken")
+
+// chainLock is the Postgres advisory lock key that serializes appends, so
+// concurrent writers from different services cannot fork the chain.
+const chainLock = 0x61756469 // "audi"
+
+// Entry is one audited access.
+type Entry struct {
+	ID           uint      `gorm:"primaryKey"`
+	OccurredAt   time.Time `gorm:"not null;index"`
+	Service      string    `gorm:"not null;index"`
+	ActorID      uint      `gorm:"index"` // 0 when the caller was not authenticated
+	ActorRole    string
+	Action       string `gorm:"not null"`
+	ResourceType string `gorm:"not null"`
+	ResourceID   string
+	PatientID    uint   `gorm:"index"` // 0 when the request was not about one patient
+	Outcome      string `gorm:"not null"`
+	StatusCode   int
+	Method       string
+	Path         string
+	IPAddress    string
+	UserAgent    string
+	Detail       string `gorm:"type:text"`
+	PrevHash     string `gorm:"size:64;not null"`
+	Hash         string `gorm:"size:64;not null;uniqueIndex"`
+}
+
+func (Entry) TableName() string {
+	return "audit_entries"
+}
+
+// computeHash hashes the entry's fields together with PrevHash.
+func (e *Entry) computeHash() string {
+	fields := []string{
+		e.PrevHash,
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		e.Service,
+		strconv.FormatUint(uint64(e.ActorID), 10),
+		e.ActorRole,
+		e.Action,
+		e.ResourceType,
+		e.ResourceID,
+		strconv.FormatUint(uint64(e.PatientID), 10),
+		e.Outcome,
+		strconv.Itoa(e.StatusCode),
+		e.Method,
+		e.Path,
+		e.IPAddress,
+		e.UserAgent,
+		e.Detail,
+	}
+	for i, f := range fields {
+		fields[i] = strconv.Quote(f)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+const appendOnly = `
+CREATE OR REPLACE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_entries is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_entries_append_only ON audit_entries;
+CREATE TRIGGER audit_entries_append_only
+	BEFORE UPDATE OR DELETE ON audit_entries
+	FOR EACH ROW EXECUTE FUNCTION audit_entries_append_only();
+
+CREATE OR REPLACE FUNCTION audit_pending_immutable() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_pending rows cannot be changed';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_pending_immutable ON audit_pending;
+CREATE TRIGGER audit_pending_immutable
+	BEFORE UPDATE ON audit_pending
+	FOR EACH ROW EXECUTE FUNCTION audit_pending_immutable();
+`
+
+// pendingEntry is an entry recorded but not yet chained. Requests only
+// insert into audit_pending, which takes no lock; a Logger's sealer moves
+// the rows onto the chain. The entry is kept as JSON so it is hashed
+// exactly as recorded.
+type pendingEntry struct {
+	ID    uint   `gorm:"primaryKey"`
+	Entry string `gorm:"type:text;not null"`
+}
+
+func (pendingEntry) TableName() string {
+	return "audit_pending"
+}
+
+// Migrate creates the audit tables, makes the chain append-only and
+// pending entries unchangeable.
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Entry{}, &pendingEntry{}); err != nil {
+		return err
+	}
+	return db.Exec(appendOnly).Error
+}
+
+// batchSize is how many pending entries are chained at once.
+const batchSize = 200
+
+// sealInterval is how often a Logger looks for pending entries left by
+// itself or by a service that stopped before chaining them.
+const sealInterval = 5 * time.Second
+
+// maxRecordBackoff caps the wait between attempts to record an entry.
+const maxRecordBackoff = 10 * time.Second
+
+// Logger records entries on behalf of one service. Record stores an entry
+// durably in audit_pending; a background sealer chains pending entries in
+// batches, so requests never wait on chainLock and an entry is never lost
+// to a restart.
+type Logger struct {
+	db      *gorm.DB
+	service string
+	wake    chan struct{}
+}
+
+// NewLogger returns a Logger and starts its sealer.
+func NewLogger(db *gorm.DB, service string) *Logger {
+	l := &Logger{db: db, service: service, wake: make(chan struct{}, 1)}
+	go l.run()
+	return l
+}
+
+// Record stores e for the chain, filling in Service and OccurredAt; the
+// sealer fills in the hashes. Should the database be unreachable, Record
+// keeps trying rather than drop the entry.
+func (l *Logger) Record(e *Entry) {
+	if e.Service == "" {
+		e.Service = l.service
+	}
+	// Postgres keeps microseconds; hash what will be read back
+	e.OccurredAt = time.Now().UTC().Truncate(time.Microsecond)
+	data, err := json.Marshal(e)
+	if err != nil {
+		// An Entry holds only strings, numbers and a time
+		panic(err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := l.db.Create(&pendingEntry{Entry: string(data)}).Error
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to record audit entry for %s %s (attempt %d), retrying: %v", e.Method, e.Path, attempt, err)
+		backoff := time.Duration(attempt) * time.Second
+		if backoff > maxRecordBackoff {
+			backoff = maxRecordBackoff
+		}
+		time.Sleep(backoff)
+	}
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run chains pending entries whenever Record adds one and every
+// sealInterval. A batch that fails stays pending for the next round.
+func (l *Logger) run() {
+	tick := time.NewTicker(sealInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-l.wake:
+		case <-tick.C:
+		}
+		for {
+			n, err := l.sealPending()
+			if err != nil {
+				log.Printf("Failed to chain pending audit entries: %v", err)
+				break
+			}
+			if n < batchSize {
+				break
+			}
+		}
+	}
+}
+
+// sealPending moves up to batchSize pending entries, oldest first, onto
+// the chain and returns how many it moved.
+func (l *Logger) sealPending() (int, error) {
+	var n int
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", chainLock).Error; err != nil {
+			return err
+		}
+
+		var pending []pendingEntry
+		if err := tx.Order("id").Limit(batchSize).Find(&pending).Error; err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		entries, ids := decodePending(pending)
+		if err := l.append(tx, entries); err != nil {
+			return err
+		}
+		n = len(entries)
+		return tx.Delete(&pendingEntry{}, ids).Error
+	})
+	return n, err
+}
+
+// decodePending returns the entries stored in pending and the rows' IDs.
+// A row that no longer decodes is chained as a failure entry carrying its
+// text, so it is neither lost nor left to block the rows behind it.
+func decodePending(pending []pendingEntry) ([]*Entry, []uint) {
+	entries := make([]*Entry, len(pending))
+	ids := make([]uint, len(pending))
+	for i, p := range pending {
+		var e Entry
+		if err := json.Unmarshal([]byte(p.Entry), &e); err != nil {
+			e = Entry{
+				OccurredAt:   time.Now().UTC().Truncate(time.Microsecond),
+				Service:      "audit",
+				Action:       ActionWrite,
+				ResourceType: "audit_pending",
+				ResourceID:   strconv.FormatUint(uint64(p.ID), 10),
+				Outcome:      OutcomeFailure,
+				Detail:       "undecodable pending entry: " + p.Entry,
+			}
+		}
+		entries[i] = &e
+		ids[i] = p.ID
+	}
+	return entries, ids
+}
+
+// append adds entries to the end of the chain. The caller holds chainLock
+// in tx.
+func (l *Logger) append(tx *gorm.DB, entries []*Entry) error {
+	var prev []string
+	if err := tx.Model(&Entry{}).Order("id desc").Limit(1).Pluck("hash", &prev).Error; err != nil {
+		return err
+	}
+	last := ""
+	if len(prev) > 0 {
+		last = prev[0]
+	}
+	seal(last, entries)
+	return tx.Create(entries).Error
+}
+
+// seal chains entries onto the entry with hash prev.
+func seal(prev string, entries []*Entry) {
+	for _, e := range entries {
+		e.ID = 0 // assigned by the insert
+		e.PrevHash = prev
+		e.Hash = e.computeHash()
+		prev = e.Hash
+	}
+}
+
+// Verify walks the whole chain in order and returns the number of entries
+// checked. A broken link is reported as ErrChainBroken with the ID of the
+// first bad entry. Verify cannot tell if entries were cut from the end of the
+// chain; compare the count and last hash with an earlier export for that.
+func Verify(db *gorm.DB) (int64, error) {
+	var (
+		chain  chain
+		broken error
+	)
+	var batch []Entry
+	result := db.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if broken = chain.next(&batch[i]); broken != nil {
+				return broken
+			}
+		}
+		return nil
+	})
+	if broken != nil {
+		return chain.checked, broken
+	}
+	return chain.checked, result.Error
+}
+
+// chain checks entries one at a time, in ID order.
+type chain struct {
+	prev    string
+	checked int64
+}
+
+// next checks e against the entry before it.
+func (c *chain) next(e *Entry) error {
+	switch {
+	case e.PrevHash != c.prev:
+		return fmt.Errorf("%w at entry %d: previous hash does not match", ErrChainBroken, e.ID)
+	case e.computeHash() != e.Hash:
+		return fmt.Errorf("%w at entry %d: contents do not match hash", ErrChainBroken, e.ID)
+	}
+	c.prev = e.Hash
+	c.checked++
+	return nil
+}
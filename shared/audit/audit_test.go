@@ -0,0 +1,249 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sealed returns n correctly chained entries.
+func sealed(n int) []Entry {
+	entries := make([]Entry, n)
+	prev := ""
+	for i := range entries {
+		e := &entries[i]
+		e.ID = uint(i + 1)
+		e.OccurredAt = time.Date(2024, 1, 1, 9, i, 0, 0, time.UTC)
+		e.Service = "medical-record-service"
+		e.ActorID = 7
+		e.ActorRole = "doctor"
+		e.Action = ActionRead
+		e.ResourceType = "medical_record"
+		e.ResourceID = "42"
+		e.PatientID = 3
+		e.Outcome = OutcomeSuccess
+		e.StatusCode = 200
+		e.PrevHash = prev
+		e.Hash = e.computeHash()
+		prev = e.Hash
+	}
+	return entries
+}
+
+func TestChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func([]Entry) []Entry
+		checked int64
+		badID   uint // 0 when the chain should verify
+		reason  string
+	}{
+		{
+			name:    "intact",
+			tamper:  func(e []Entry) []Entry { return e },
+			checked: 4,
+		},
+		{
+			name:    "empty",
+			tamper:  func(e []Entry) []Entry { return nil },
+			checked: 0,
+		},
+		{
+			name: "edited field",
+			tamper: func(e []Entry) []Entry {
+				e[1].Outcome = OutcomeDenied
+				return e
+			},
+			checked: 1,
+			badID:   2,
+			reason:  "contents do not match hash",
+		},
+		{
+			name: "edited field with hash recomputed",
+			tamper: func(e []Entry) []Entry {
+				e[1].PatientID = 9
+				e[1].Hash = e[1].computeHash()
+				return e
+			},
+			checked: 2,
+			badID:   3,
+			reason:  "previous hash does not match",
+		},
+		{
+			name: "edited hash",
+			tamper: func(e []Entry) []Entry {
+				e[3].Hash = strings.Repeat("0", 64)
+				return e
+			},
+			checked: 3,
+			badID:   4,
+			reason:  "contents do not match hash",
+		},
+		{
+			name: "entry deleted",
+			tamper: func(e []Entry) []Entry {
+				return append(e[:1], e[2:]...)
+			},
+			checked: 1,
+			badID:   3,
+			reason:  "previous hash does not match",
+		},
+		{
+			name: "first entry deleted",
+			tamper: func(e []Entry) []Entry {
+				return e[1:]
+			},
+			checked: 0,
+			badID:   2,
+			reason:  "previous hash does not match",
+		},
+		{
+			name: "entries swapped",
+			tamper: func(e []Entry) []Entry {
+				e[1], e[2] = e[2], e[1]
+				return e
+			},
+			checked: 1,
+			badID:   3,
+			reason:  "previous hash does not match",
+		},
+		{
+			// Verify cannot see entries cut from the end
+			name: "last entry deleted",
+			tamper: func(e []Entry) []Entry {
+				return e[:3]
+			},
+			checked: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				c   chain
+				err error
+			)
+			for _, e := range tt.tamper(sealed(4)) {
+				if err = c.next(&e); err != nil {
+					break
+				}
+			}
+
+			if c.checked != tt.checked {
+				t.Errorf("checked %d entries, want %d", c.checked, tt.checked)
+			}
+			if tt.badID == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrChainBroken) {
+				t.Fatalf("got error %v, want ErrChainBroken", err)
+			}
+			if want := fmt.Sprintf("at entry %d: %s", tt.badID, tt.reason); !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %q, want one containing %q", err, want)
+			}
+		})
+	}
+}
+
+func TestComputeHashCoversEveryField(t *testing.T) {
+	base := sealed(1)[0]
+	edits := map[string]func(*Entry){
+		"PrevHash":     func(e *Entry) { e.PrevHash = "x" },
+		"OccurredAt":   func(e *Entry) { e.OccurredAt = e.OccurredAt.Add(time.Microsecond) },
+		"Service":      func(e *Entry) { e.Service = "x" },
+		"ActorID":      func(e *Entry) { e.ActorID++ },
+		"ActorRole":    func(e *Entry) { e.ActorRole = "admin" },
+		"Action":       func(e *Entry) { e.Action = ActionWrite },
+		"ResourceType": func(e *Entry) { e.ResourceType = "x" },
+		"ResourceID":   func(e *Entry) { e.ResourceID = "43" },
+		"PatientID":    func(e *Entry) { e.PatientID++ },
+		"Outcome":      func(e *Entry) { e.Outcome = OutcomeFailure },
+		"StatusCode":   func(e *Entry) { e.StatusCode = 500 },
+		"Method":       func(e *Entry) { e.Method = "DELETE" },
+		"Path":         func(e *Entry) { e.Path = "/x" },
+		"IPAddress":    func(e *Entry) { e.IPAddress = "10.0.0.1" },
+		"UserAgent":    func(e *Entry) { e.UserAgent = "x" },
+		"Detail":       func(e *Entry) { e.Detail = "x" },
+	}
+	for field, edit := range edits {
+		t.Run(field, func(t *testing.T) {
+			e := base
+			edit(&e)
+			if e.computeHash() == base.Hash {
+				t.Errorf("changing %s does not change the hash", field)
+			}
+		})
+	}
+}
+
+func TestComputeHashSeparatesFields(t *testing.T) {
+	// Moving text from one field to the next must not produce the same hash
+	a := sealed(1)[0]
+	b := a
+	a.Method, a.Path = "GET", "/api"
+	b.Method, b.Path = "GET\n/", "api"
+	if a.computeHash() == b.computeHash() {
+		t.Error("fields that concatenate to the same text hash the same")
+	}
+}
+
+func TestSealContinuesChain(t *testing.T) {
+	// A batch sealed onto the last stored entry verifies with it
+	stored := sealed(2)
+	batch := []*Entry{{Service: "a"}, {Service: "b"}, {Service: "c"}}
+	batch[0].ID = 9 // left over from a rolled back attempt
+	seal(stored[1].Hash, batch)
+
+	var c chain
+	for i := range stored {
+		if err := c.next(&stored[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range batch {
+		if e.ID != 0 {
+			t.Errorf("ID %d not cleared", e.ID)
+		}
+		if err := c.next(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPendingEntryKeepsHash(t *testing.T) {
+	// An entry chained from audit_pending hashes as it was recorded
+	e := sealed(1)[0]
+	e.ID = 0
+	e.OccurredAt = time.Date(2024, 1, 1, 9, 0, 0, 123456000, time.UTC)
+	e.Detail = "search Patient?name=\"O'Brien\"\n"
+	want := e.computeHash()
+
+	data, err := json.Marshal(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, ids := decodePending([]pendingEntry{{ID: 4, Entry: string(data)}})
+	if len(ids) != 1 || ids[0] != 4 {
+		t.Errorf("ids = %v, want [4]", ids)
+	}
+	if got := entries[0].computeHash(); got != want {
+		t.Errorf("hash changed through audit_pending: %s, want %s", got, want)
+	}
+}
+
+func TestDecodePendingKeepsGarbage(t *testing.T) {
+	entries, ids := decodePending([]pendingEntry{{ID: 1, Entry: "{"}})
+	if len(entries) != 1 || ids[0] != 1 {
+		t.Fatalf("got %d entries for ids %v, want the row kept", len(entries), ids)
+	}
+	e := entries[0]
+	if e.Outcome != OutcomeFailure || e.ResourceID != "1" || !strings.HasSuffix(e.Detail, "{") {
+		t.Errorf("undecodable row not recorded as such: %+v", e)
+	}
+}
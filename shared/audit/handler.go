@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Handler serves the audit query API for compliance officers.
+type Handler struct {
+	db *gorm.DB
+}
+
+func NewHandler(db *gorm.DB) *Handler {
+	return &Handler{db: db}
+}
+
+// List returns entries newest first. Query parameters: patientId, actorId,
+// service, resourceType, resourceId, action, outcome, from and to (RFC 3339),
+// limit and offset.
+func (h *Handler) List(c *gin.Context) {
+	f, err := FilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if limit <= 0 || limit > maxLimit {
+		limit = defaultLimit
+	}
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	var total int64
+	if err := f.Apply(h.db).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count audit entries"})
+		return
+	}
+
+	var entries []Entry
+	if err := f.Apply(h.db).Order("id desc").Limit(limit).Offset(offset).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit entries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "total": total})
+}
+
+// Verify checks the whole hash chain.
+func (h *Handler) Verify(c *gin.Context) {
+	checked, err := Verify(h.db)
+	if errors.Is(err, ErrChainBroken) {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "checked": checked, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "checked": checked})
+}
+
+// FilterFromQuery builds a Filter from request query parameters.
+func FilterFromQuery(c *gin.Context) (Filter, error) {
+	f := Filter{
+		Service:      c.Query("service"),
+		ResourceType: c.Query("resourceType"),
+		ResourceID:   c.Query("resourceId"),
+		Action:       c.Query("action"),
+		Outcome:      c.Query("outcome"),
+	}
+
+	var err error
+	if f.PatientID, err = parseID(c.Query("patientId")); err != nil {
+		return f, errors.New("Invalid patientId")
+	}
+	if f.ActorID, err = parseID(c.Query("actorId")); err != nil {
+		return f, errors.New("Invalid actorId")
+	}
+	if f.From, err = parseTime(c.Query("from")); err != nil {
+		return f, errors.New("Invalid from, expected RFC 3339")
+	}
+	if f.To, err = parseTime(c.Query("to")); err != nil {
+		return f, errors.New("Invalid to, expected RFC 3339")
+	}
+	return f, nil
+}
+
+func parseID(s string) (uint, error) {
+	if s == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint(id), err
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"healthcare/shared/auth"
+)
+
+// Context keys read by Middleware.
+const (
+	contextPatientID  = "audit_patient_id"
+	contextPatientIDs = "audit_patient_ids"
+	contextResourceID = "audit_resource_id"
+	contextDetail     = "audit_detail"
+)
+
+// SetPatient records which patient the current request is about.
+// policy.Authorize calls it, so handlers rarely need to.
+func SetPatient(c *gin.Context, patientID uint) {
+	c.Set(contextPatientID, patientID)
+}
+
+// SetPatients records the patients whose data a bulk read returned. The
+// request is logged once for each of them, so a patient's access history
+// includes lists and searches as well as single reads.
+func SetPatients(c *gin.Context, patientIDs ...uint) {
+	ids, _ := c.Get(contextPatientIDs)
+	list, _ := ids.([]uint)
+	c.Set(contextPatientIDs, append(list, patientIDs...))
+}
+
+// SetResourceID overrides the resource ID, which defaults to the :id path
+// parameter.
+func SetResourceID(c *gin.Context, id string) {
+	c.Set(contextResourceID, id)
+}
+
+// SetDetail attaches a free-text note to the request's entry.
+func SetDetail(c *gin.Context, detail string) {
+	c.Set(contextDetail, detail)
+}
+
+// Middleware writes an entry for every request once the handler has run,
+// one per patient when SetPatients was called.
+// Register it before auth.AuthMiddleware so rejected tokens are audited too.
+func Middleware(l *Logger, resourceType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		for _, e := range entries(c, resourceType) {
+			l.Record(e)
+		}
+	}
+}
+
+// entries builds the entries for the request in c.
+func entries(c *gin.Context, resourceType string) []*Entry {
+	e := Entry{
+		ActorID:      auth.UserID(c),
+		ActorRole:    auth.Role(c),
+		Action:       ActionWrite,
+		ResourceType: resourceType,
+		ResourceID:   c.Param("id"),
+		PatientID:    c.GetUint(contextPatientID),
+		Outcome:      outcome(c.Writer.Status()),
+		StatusCode:   c.Writer.Status(),
+		Method:       c.Request.Method,
+		Path:         c.Request.URL.Path,
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.Request.UserAgent(),
+		Detail:       c.GetString(contextDetail),
+	}
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		e.Action = ActionRead
+	}
+	if id, ok := c.Get(contextResourceID); ok {
+		e.ResourceID, _ = id.(string)
+	}
+	if e.PatientID == 0 {
+		if id, err := strconv.ParseUint(c.Param("patientId"), 10, 32); err == nil {
+			e.PatientID = uint(id)
+		}
+	}
+
+	ids, _ := c.Get(contextPatientIDs)
+	patients, _ := ids.([]uint)
+	if e.PatientID != 0 {
+		patients = append([]uint{e.PatientID}, patients...)
+	}
+	if len(patients) == 0 {
+		return []*Entry{&e}
+	}
+	seen := make(map[uint]bool, len(patients))
+	list := make([]*Entry, 0, len(patients))
+	for _, id := range patients {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		entry := e
+		entry.PatientID = id
+		list = append(list, &entry)
+	}
+	if len(list) == 0 {
+		return []*Entry{&e}
+	}
+	return list
+}
+
+func outcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return OutcomeDenied
+	case status >= 400:
+		return OutcomeFailure
+	default:
+		return OutcomeSuccess
+	}
+}
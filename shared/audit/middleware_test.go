@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEntriesPerPatient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name  string
+		set   func(*gin.Context)
+		param string
+		want  []uint
+	}{
+		{
+			name: "no patient",
+			set:  func(*gin.Context) {},
+			want: []uint{0},
+		},
+		{
+			name:  "patient path parameter",
+			set:   func(*gin.Context) {},
+			param: "5",
+			want:  []uint{5},
+		},
+		{
+			name: "single patient",
+			set:  func(c *gin.Context) { SetPatient(c, 3) },
+			want: []uint{3},
+		},
+		{
+			name: "bulk read",
+			set: func(c *gin.Context) {
+				SetPatients(c, 4, 2, 4)
+				SetPatients(c, 0, 9)
+			},
+			want: []uint{4, 2, 9},
+		},
+		{
+			name: "single and bulk",
+			set: func(c *gin.Context) {
+				SetPatient(c, 2)
+				SetPatients(c, 2, 7)
+			},
+			want: []uint{2, 7},
+		},
+		{
+			name: "bulk read that returned nothing",
+			set:  func(c *gin.Context) { SetPatients(c) },
+			want: []uint{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/api/records/doctor/1", nil)
+			if tt.param != "" {
+				c.Params = gin.Params{{Key: "patientId", Value: tt.param}}
+			}
+			tt.set(c)
+
+			var got []uint
+			for _, e := range entries(c, "medical_record") {
+				if e.Action != ActionRead || e.Path != "/api/records/doctor/1" {
+					t.Errorf("entry not copied from the request: %+v", e)
+				}
+				got = append(got, e.PatientID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patients %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Filter selects entries for the query API and the export command. Zero
+// fields match everything.
+type Filter struct {
+	PatientID    uint
+	ActorID      uint
+	Service      string
+	ResourceType string
+	ResourceID   string
+	Action       string
+	Outcome      string
+	From         time.Time
+	To           time.Time
+}
+
+// Apply adds the filter's conditions to db.
+func (f Filter) Apply(db *gorm.DB) *gorm.DB {
+	q := db.Model(&Entry{})
+	if f.PatientID != 0 {
+		q = q.Where("patient_id = ?", f.PatientID)
+	}
+	if f.ActorID != 0 {
+		q = q.Where("actor_id = ?", f.ActorID)
+	}
+	if f.Service != "" {
+		q = q.Where("service = ?", f.Service)
+	}
+	if f.ResourceType != "" {
+		q = q.Where("resource_type = ?", f.ResourceType)
+	}
+	if f.ResourceID != "" {
+		q = q.Where("resource_id = ?", f.ResourceID)
+	}
+	if f.Action != "" {
+		q = q.Where("action = ?", f.Action)
+	}
+	if f.Outcome != "" {
+		q = q.Where("outcome = ?", f.Outcome)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("occurred_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Where("occurred_at < ?", f.To)
+	}
+	return q
+}
+
+// Each calls fn for every entry matching f, oldest first.
+func Each(db *gorm.DB, f Filter, fn func(*Entry) error) error {
+	var batch []Entry
+	return f.Apply(db).FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if err := fn(&batch[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
@@ -0,0 +1,139 @@
+// Package auth holds the JWT claims model, key loading and gin middleware
+// shared by every healthcare service, so a token issued by auth-service
+// means the same thing wherever it is presented.
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultIssuer      = "healthcare-auth-service"
+	DefaultAudience    = "healthcare"
+	DefaultTTL         = 15 * time.Minute
+	DefaultRefreshTTL  = 7 * 24 * time.Hour
+	DefaultSessionAge  = 30 * 24 * time.Hour
+	DefaultAlgorithm   = AlgRS256
+	DefaultKeysDir     = "keys"
+	DefaultKeyRotation = 30 * 24 * time.Hour
+	DefaultJWKSURL     = "http://localhost:8081/.well-known/jwks.json"
+
+	DefaultSessionCheckTTL = 30 * time.Second
+
+	DefaultPasswordResetTTL = time.Hour
+	DefaultVerificationTTL  = 48 * time.Hour
+)
+
+// Config describes how tokens are signed and which issuer and audience they
+// must carry to be accepted. Algorithm, KeysDir and KeyRotation only matter
+// to services that sign tokens; JWKSURL only to those that verify them
+// against auth-service's published keys.
+type Config struct {
+	Issuer     string
+	Audience   string
+	TTL        time.Duration
+	RefreshTTL time.Duration
+	// SessionAge is how long a session lasts from login; refreshing does
+	// not extend it.
+	SessionAge  time.Duration
+	Algorithm   string
+	KeysDir     string
+	KeyRotation time.Duration
+	JWKSURL     string
+
+	// Lifetimes of the one-time tokens mailed out for password resets and
+	// email verification.
+	PasswordResetTTL time.Duration
+	VerificationTTL  time.Duration
+
+	// SessionCheckTTL is how long services other than auth-service trust
+	// an answer about whether a session has been revoked.
+	SessionCheckTTL time.Duration
+
+	// RequireEmailVerification blocks login until the user has verified
+	// their email address.
+	RequireEmailVerification bool
+}
+
+// LoadConfig reads the token configuration from the environment. Every
+// setting is optional: JWT_ISSUER, JWT_AUDIENCE, JWT_TTL, JWT_REFRESH_TTL,
+// SESSION_MAX_AGE, JWT_ALG, JWT_KEYS_DIR, JWT_KEY_ROTATION, JWT_JWKS_URL, PASSWORD_RESET_TTL,
+// EMAIL_VERIFICATION_TTL, SESSION_CHECK_TTL and REQUIRE_EMAIL_VERIFICATION
+// fall back to the package defaults.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		Issuer:    getEnv("JWT_ISSUER", DefaultIssuer),
+		Audience:  getEnv("JWT_AUDIENCE", DefaultAudience),
+		Algorithm: getEnv("JWT_ALG", DefaultAlgorithm),
+		KeysDir:   getEnv("JWT_KEYS_DIR", DefaultKeysDir),
+		JWKSURL:   getEnv("JWT_JWKS_URL", DefaultJWKSURL),
+	}
+
+	if cfg.Algorithm != AlgRS256 && cfg.Algorithm != AlgEdDSA {
+		return Config{}, fmt.Errorf("auth: unsupported JWT_ALG %q", cfg.Algorithm)
+	}
+
+	var err error
+	if cfg.TTL, err = getDuration("JWT_TTL", DefaultTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.RefreshTTL, err = getDuration("JWT_REFRESH_TTL", DefaultRefreshTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.SessionAge, err = getDuration("SESSION_MAX_AGE", DefaultSessionAge); err != nil {
+		return Config{}, err
+	}
+	if cfg.KeyRotation, err = getDuration("JWT_KEY_ROTATION", DefaultKeyRotation); err != nil {
+		return Config{}, err
+	}
+	if cfg.PasswordResetTTL, err = getDuration("PASSWORD_RESET_TTL", DefaultPasswordResetTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.VerificationTTL, err = getDuration("EMAIL_VERIFICATION_TTL", DefaultVerificationTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.SessionCheckTTL, err = getDuration("SESSION_CHECK_TTL", DefaultSessionCheckTTL); err != nil {
+		return Config{}, err
+	}
+	if v := os.Getenv("REQUIRE_EMAIL_VERIFICATION"); v != "" {
+		if cfg.RequireEmailVerification, err = strconv.ParseBool(v); err != nil {
+			return Config{}, fmt.Errorf("auth: invalid REQUIRE_EMAIL_VERIFICATION %q: %w", v, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// maxTokenTTL is the longest lifetime of any token signed under cfg, which
+// is how long a retired signing key must stay published.
+func (cfg Config) maxTokenTTL() time.Duration {
+	ttl := cfg.TTL
+	for _, d := range []time.Duration{cfg.PasswordResetTTL, cfg.VerificationTTL} {
+		if d > ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+func getDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("auth: invalid %s %q: %w", key, v, err)
+	}
+	return d, nil
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
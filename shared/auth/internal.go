@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InternalTokenHeader carries the service-to-service token.
+const InternalTokenHeader = "X-Internal-Token"
+
+// InternalToken returns the token services use to call each other's
+// internal routes.
+func InternalToken() string {
+	return os.Getenv("INTERNAL_API_TOKEN")
+}
+
+// InternalMiddleware guards routes that only other services may call. With
+// an empty token the routes are closed entirely.
+func InternalMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		presented := c.GetHeader(InternalTokenHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid internal token"})
+			return
+		}
+
+		c.Next()
+	}
+}
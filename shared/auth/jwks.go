@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	jwksCacheTTL     = 10 * time.Minute
+	jwksMinRefresh   = 30 * time.Second
+	jwksFetchTimeout = 5 * time.Second
+)
+
+// JWK is a single public key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK encodes an RSA or Ed25519 public key.
+func NewJWK(kid, alg string, public crypto.PublicKey) (JWK, error) {
+	jwk := JWK{Kid: kid, Use: "sig", Alg: alg}
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	default:
+		return JWK{}, fmt.Errorf("auth: unsupported public key type %T", public)
+	}
+	return jwk, nil
+}
+
+// PublicKey decodes the key.
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("auth: unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("auth: invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("auth: unsupported key type %q", j.Kty)
+	}
+}
+
+// errEmptyJWKS is returned when auth-service serves a key set with no
+// usable keys; the keys fetched before are kept.
+var errEmptyJWKS = errors.New("auth: JWKS has no usable keys")
+
+// RemoteKeySet fetches auth-service's JWKS and caches it. An unknown kid
+// triggers a refetch, rate limited so a flood of forged tokens cannot turn
+// into a flood of requests to auth-service. Cached keys are served while a
+// fetch is in flight, and concurrent lookups share one fetch.
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	inflight    *jwksFetch
+}
+
+// jwksFetch is a fetch in progress; done is closed once err is set.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		url:    url,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		keys:   map[string]crypto.PublicKey{},
+	}
+}
+
+// PublicKey implements KeyProvider. A known key is returned at once, and
+// refreshed in the background once the cache is stale; only an unknown kid
+// waits for auth-service.
+func (r *RemoteKeySet) PublicKey(kid string) (crypto.PublicKey, error) {
+	r.mu.RLock()
+	key, ok := r.keys[kid]
+	fresh := time.Since(r.fetchedAt) < jwksCacheTTL
+	r.mu.RUnlock()
+	if ok {
+		if !fresh {
+			go r.refresh()
+		}
+		return key, nil
+	}
+
+	if err := r.refresh(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if key, ok := r.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// refresh refetches the key set, or waits for the fetch already in
+// flight. The lock is only held to start the fetch and to store its result.
+func (r *RemoteKeySet) refresh() error {
+	r.mu.Lock()
+	if f := r.inflight; f != nil {
+		r.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	if time.Since(r.lastAttempt) < jwksMinRefresh {
+		r.mu.Unlock()
+		return nil
+	}
+	r.lastAttempt = time.Now()
+	f := &jwksFetch{done: make(chan struct{})}
+	r.inflight = f
+	r.mu.Unlock()
+
+	keys, err := r.fetch()
+	if err == nil && len(keys) == 0 {
+		err = errEmptyJWKS
+	}
+
+	r.mu.Lock()
+	if err == nil {
+		r.keys = keys
+		r.fetchedAt = time.Now()
+	}
+	r.inflight = nil
+	f.err = err
+	r.mu.Unlock()
+	close(f.done)
+	return err
+}
+
+// fetch downloads and decodes the key set, skipping keys it cannot parse.
+func (r *RemoteKeySet) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := r.client.Get(r.url)
+	if err != nil {
+		return nil, fmt.Errorf("auth: fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: fetching JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var set JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("auth: decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves the key set returned by keys, counting requests.
+func jwksServer(t *testing.T, keys func() JWKS) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		json.NewEncoder(w).Encode(keys())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func testJWK(t *testing.T, kid string) JWK {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := NewJWK(kid, AlgEdDSA, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwk
+}
+
+func TestRemoteKeySetSharesFetch(t *testing.T) {
+	set := JWKS{Keys: []JWK{testJWK(t, "a")}}
+	release := make(chan struct{})
+	srv, calls := jwksServer(t, func() JWKS {
+		<-release
+		return set
+	})
+	r := NewRemoteKeySet(srv.URL)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.PublicKey("a")
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("PublicKey: %v", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
+
+func TestRemoteKeySetServesCachedKeyDuringFetch(t *testing.T) {
+	set := JWKS{Keys: []JWK{testJWK(t, "a")}}
+	block := make(chan struct{})
+	defer close(block)
+	var slow atomic.Bool
+	srv, _ := jwksServer(t, func() JWKS {
+		if slow.Load() {
+			<-block
+		}
+		return set
+	})
+	r := NewRemoteKeySet(srv.URL)
+	if _, err := r.PublicKey("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unknown kid starts a fetch that hangs
+	slow.Store(true)
+	r.mu.Lock()
+	r.lastAttempt = time.Time{}
+	r.mu.Unlock()
+	go r.PublicKey("b")
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.PublicKey("a")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup of a cached key waited for the fetch")
+	}
+}
+
+func TestRemoteKeySetKeepsKeysOnEmptySet(t *testing.T) {
+	var empty atomic.Bool
+	set := JWKS{Keys: []JWK{testJWK(t, "a")}}
+	srv, _ := jwksServer(t, func() JWKS {
+		if empty.Load() {
+			return JWKS{Keys: []JWK{{Kid: "x", Kty: "bogus"}}}
+		}
+		return set
+	})
+	r := NewRemoteKeySet(srv.URL)
+	if _, err := r.PublicKey("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	empty.Store(true)
+	r.mu.Lock()
+	r.lastAttempt = time.Time{}
+	r.mu.Unlock()
+	if _, err := r.PublicKey("b"); !errors.Is(err, errEmptyJWKS) {
+		t.Errorf("unknown kid against an empty set: got %v, want %v", err, errEmptyJWKS)
+	}
+	if _, err := r.PublicKey("a"); err != nil {
+		t.Errorf("key from before the empty set was dropped: %v", err)
+	}
+}
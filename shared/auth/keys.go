@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing algorithms supported for new keys.
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var ErrUnknownKey = errors.New("auth: unknown signing key")
+
+// SigningKey is a private key and the ID it is published under.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+// KeyProvider resolves the public key for a token's kid header.
+type KeyProvider interface {
+	PublicKey(kid string) (crypto.PublicKey, error)
+}
+
+// KeySet holds the signing keys of the token issuer, one PKCS#8 PEM file per
+// key in a directory. The newest key signs new tokens. Older keys stay
+// published until every token they signed has expired, so rotation never
+// invalidates a live token.
+type KeySet struct {
+	mu       sync.RWMutex
+	dir      string
+	alg      string
+	rotation time.Duration
+	ttl      time.Duration
+	keys     []*SigningKey // oldest first
+}
+
+// LoadKeySet reads the keys in cfg.KeysDir, creating the directory and a
+// first key if there are none.
+func LoadKeySet(cfg Config) (*KeySet, error) {
+	ks := &KeySet{
+		dir:      cfg.KeysDir,
+		alg:      cfg.Algorithm,
+		rotation: cfg.KeyRotation,
+		ttl:      cfg.maxTokenTTL(),
+	}
+
+	if err := os.MkdirAll(ks.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("auth: creating key directory: %w", err)
+	}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	if len(ks.keys) == 0 {
+		if _, err := ks.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+// Current returns the key new tokens are signed with.
+func (ks *KeySet) Current() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[len(ks.keys)-1]
+}
+
+// PublicKey implements KeyProvider.
+func (ks *KeySet) PublicKey(kid string) (crypto.PublicKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for _, k := range ks.keys {
+		if k.ID == kid {
+			return k.Private.Public(), nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWKS returns the public half of every published key.
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	set := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, k := range ks.keys {
+		jwk, err := NewJWK(k.ID, k.Algorithm, k.Private.Public())
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// Rotate generates a new current key and prunes keys that no longer sign
+// any unexpired token.
+func (ks *KeySet) Rotate() (*SigningKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, err := generateKey(ks.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return nil, err
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(ks.dir, key.ID+".pem"), block, 0o600); err != nil {
+		return nil, fmt.Errorf("auth: writing key: %w", err)
+	}
+
+	ks.keys = append(ks.keys, key)
+	ks.prune()
+	return key, nil
+}
+
+// RotateIfDue picks up keys written by other replicas and rotates when the
+// current key is older than the rotation period.
+func (ks *KeySet) RotateIfDue() (bool, error) {
+	ks.mu.Lock()
+	err := ks.reload()
+	due := len(ks.keys) == 0 || time.Since(ks.keys[len(ks.keys)-1].CreatedAt) >= ks.rotation
+	ks.mu.Unlock()
+	if err != nil || !due {
+		return false, err
+	}
+
+	_, err = ks.Rotate()
+	return err == nil, err
+}
+
+// reload replaces the in-memory keys with the contents of the directory.
+// The caller must hold the write lock or own ks exclusively.
+func (ks *KeySet) reload() error {
+	entries, err := os.ReadDir(ks.dir)
+	if err != nil {
+		return fmt.Errorf("auth: reading key directory: %w", err)
+	}
+
+	var keys []*SigningKey
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		key, err := readKey(filepath.Join(ks.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	ks.keys = keys
+	return nil
+}
+
+// prune drops keys whose successor was created more than one token lifetime
+// ago. The caller must hold the write lock.
+func (ks *KeySet) prune() {
+	keep := ks.keys[:0]
+	for i, k := range ks.keys {
+		if i < len(ks.keys)-1 && time.Since(ks.keys[i+1].CreatedAt) > ks.ttl {
+			os.Remove(filepath.Join(ks.dir, k.ID+".pem"))
+			continue
+		}
+		keep = append(keep, k)
+	}
+	ks.keys = keep
+}
+
+func generateKey(alg string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("auth: unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: generating key: %w", err)
+	}
+
+	id, err := keyID(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: id, Algorithm: alg, Private: private, CreatedAt: time.Now()}, nil
+}
+
+func readKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: reading key: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: reading key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("auth: %s is not a PEM file", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("auth: parsing %s: %w", path, err)
+	}
+
+	key := &SigningKey{CreatedAt: info.ModTime()}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm, key.Private = AlgRS256, k
+	case ed25519.PrivateKey:
+		key.Algorithm, key.Private = AlgEdDSA, k
+	default:
+		return nil, fmt.Errorf("auth: %s holds an unsupported key type", path)
+	}
+
+	if key.ID, err = keyID(key.Private.Public()); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyID derives a stable kid from the public key.
+func keyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
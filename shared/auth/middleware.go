@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by AuthMiddleware.
+const (
+	ContextUserID = "user_id"
+	ContextEmail  = "email"
+	ContextRole   = "role"
+	ContextClaims = "claims"
+)
+
+// AuthMiddleware rejects requests without a valid bearer token, or whose
+// session has been revoked when the verifier checks sessions, and stores
+// the token claims in the gin context.
+func AuthMiddleware(v *Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
+			return
+		}
+
+		// Format: "Bearer <token>"
+		parts := strings.SplitN(authHeader, " ", 2)
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
+			return
+		}
+
+		claims, err := v.Verify(parts[1])
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		if err := v.checkSession(claims); errors.Is(err, ErrSessionRevoked) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			return
+		} else if err != nil {
+			log.Printf("Failed to check session %s: %v", claims.SessionID, err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Could not check session"})
+			return
+		}
+
+		c.Set(ContextUserID, claims.UserID)
+		c.Set(ContextEmail, claims.Email)
+		c.Set(ContextRole, claims.Role)
+		c.Set(ContextClaims, claims)
+
+		c.Next()
+	}
+}
+
+// RoleMiddleware allows the request through only if the authenticated user
+// has one of the given roles. It must run after AuthMiddleware.
+func RoleMiddleware(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userRole := Role(c)
+		if userRole == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Role not found in token"})
+			return
+		}
+
+		for _, role := range roles {
+			if role == userRole {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	}
+}
+
+// UserID returns the authenticated user's ID, or 0 if there is none.
+func UserID(c *gin.Context) uint {
+	return c.GetUint(ContextUserID)
+}
+
+// Role returns the authenticated user's role, or "" if there is none.
+func Role(c *gin.Context) string {
+	return c.GetString(ContextRole)
+}
+
+// ClaimsFrom returns the claims stored by AuthMiddleware.
+func ClaimsFrom(c *gin.Context) (*Claims, bool) {
+	v, ok := c.Get(ContextClaims)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(*Claims)
+	return claims, ok
+}
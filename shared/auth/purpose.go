@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purposes of the one-time tokens mailed to users.
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+)
+
+var ErrTokenUsed = errors.New("auth: token already used")
+
+// PurposeClaims is the payload of a one-time token. Its audience is the
+// access-token audience suffixed with the purpose, so a reset token is never
+// accepted as an access token or as a verification token, and vice versa.
+type PurposeClaims struct {
+	UserID  uint   `json:"user_id"`
+	Email   string `json:"email"`
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+func purposeAudience(cfg Config, purpose string) string {
+	return cfg.Audience + ":" + purpose
+}
+
+// SignPurpose returns a signed one-time token for purpose. Each token gets
+// a unique ID for ConsumeToken to record.
+func (s *Signer) SignPurpose(purpose string, userID uint, email string) (string, error) {
+	ttl := s.cfg.VerificationTTL
+	if purpose == PurposePasswordReset {
+		ttl = s.cfg.PasswordResetTTL
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &PurposeClaims{
+		UserID:  userID,
+		Email:   email,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			Issuer:    s.cfg.Issuer,
+			Audience:  jwt.ClaimStrings{purposeAudience(s.cfg, purpose)},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	key := s.keys.Current()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// VerifyPurpose checks the signature, expiry and purpose of a one-time
+// token. It does not check whether the token was already used.
+func (v *Verifier) VerifyPurpose(purpose, tokenString string) (*PurposeClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{AlgRS256, AlgEdDSA}),
+		jwt.WithIssuer(v.cfg.Issuer),
+		jwt.WithAudience(purposeAudience(v.cfg, purpose)),
+		jwt.WithExpirationRequired(),
+	)
+
+	claims := &PurposeClaims{}
+	token, err := parser.ParseWithClaims(tokenString, claims, v.keyFunc)
+	if err != nil || !token.Valid || claims.UserID == 0 || claims.Purpose != purpose || claims.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// UsedToken records a consumed one-time token.
+type UsedToken struct {
+	ID        string    `gorm:"primaryKey;size:32"`
+	Purpose   string    `gorm:"not null"`
+	UserID    uint      `gorm:"not null;index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    time.Time `gorm:"not null"`
+}
+
+// ConsumeToken marks a verified one-time token used, returning ErrTokenUsed
+// if it already was. Run it in the same transaction as the change the token
+// authorizes.
+func ConsumeToken(tx *gorm.DB, claims *PurposeClaims) error {
+	used := UsedToken{
+		ID:        claims.ID,
+		Purpose:   claims.Purpose,
+		UserID:    claims.UserID,
+		ExpiresAt: claims.ExpiresAt.Time,
+		UsedAt:    time.Now(),
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&used)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTokenUsed
+	}
+	return nil
+}
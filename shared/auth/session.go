@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrSessionRevoked is returned for a token whose session has ended.
+var ErrSessionRevoked = errors.New("auth: session has been revoked")
+
+// SessionChecker reports whether a session of userID is still live. Services
+// other than auth-service ask its internal API through shared/identity.
+type SessionChecker interface {
+	SessionActive(sessionID string, userID uint) (bool, error)
+}
+
+// maxCachedSessions bounds the cache; expired answers are swept once it
+// grows past this.
+const maxCachedSessions = 10000
+
+// sessionCache remembers a SessionChecker's answers for ttl. Once an answer
+// has expired, a checker that cannot be reached is an error rather than a
+// stale yes.
+type sessionCache struct {
+	checker SessionChecker
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	answers map[string]sessionAnswer
+}
+
+type sessionAnswer struct {
+	active  bool
+	checked time.Time
+}
+
+// CheckSessions makes AuthMiddleware reject tokens whose session has been
+// revoked, or that carry none, asking checker and trusting its answers for
+// ttl. Logout and revocation therefore take effect within ttl rather
+// than when the token expires.
+func (v *Verifier) CheckSessions(checker SessionChecker, ttl time.Duration) {
+	v.sessions = &sessionCache{
+		checker: checker,
+		ttl:     ttl,
+		now:     time.Now,
+		answers: map[string]sessionAnswer{},
+	}
+}
+
+// checkSession returns ErrSessionRevoked when claims' session has ended,
+// or the checker's error when it could not be asked.
+func (v *Verifier) checkSession(claims *Claims) error {
+	if v.sessions == nil {
+		return nil
+	}
+	if claims.SessionID == "" {
+		return ErrSessionRevoked
+	}
+	active, err := v.sessions.active(claims.SessionID, claims.UserID)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+func (s *sessionCache) active(sessionID string, userID uint) (bool, error) {
+	key := sessionID + "/" + strconv.FormatUint(uint64(userID), 10)
+	now := s.now()
+
+	s.mu.Lock()
+	answer, ok := s.answers[key]
+	s.mu.Unlock()
+	if ok && now.Sub(answer.checked) < s.ttl {
+		return answer.active, nil
+	}
+
+	active, err := s.checker.SessionActive(sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.answers) >= maxCachedSessions {
+		for k, a := range s.answers {
+			if now.Sub(a.checked) >= s.ttl {
+				delete(s.answers, k)
+			}
+		}
+	}
+	s.answers[key] = sessionAnswer{active: active, checked: now}
+	return active, nil
+}
@@ -0,0 +1,76 @@
+// Package billing lets services raise charges through billing-service's
+// internal API.
+package billing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"healthcare/shared/auth"
+)
+
+const DefaultURL = "http://localhost:8084"
+
+// NoShow is a missed appointment that may be charged a fee.
+type NoShow struct {
+	AppointmentID uint      `json:"AppointmentID"`
+	PatientID     uint      `json:"PatientID"`
+	DoctorID      uint      `json:"DoctorID"`
+	DateTime      time.Time `json:"DateTime"`
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// NewClientFromEnv reads BILLING_SERVICE_URL and INTERNAL_API_TOKEN.
+func NewClientFromEnv() *Client {
+	baseURL := os.Getenv("BILLING_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return NewClient(baseURL, auth.InternalToken())
+}
+
+// NoShowFee bills the fee for a missed appointment. It is safe to call
+// more than once for the same appointment, and succeeds without a bill when
+// billing-service charges no fee.
+func (c *Client) NoShowFee(n NoShow) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/internal/bills/no-show", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(auth.InternalTokenHeader, c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("billing: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	default:
+		return fmt.Errorf("billing: unexpected status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,63 @@
+// Package blob stores files behind a pluggable Store: the local filesystem
+// for development, or any S3-compatible object store (AWS S3, MinIO).
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const DefaultDir = "blobs"
+
+var ErrNotFound = errors.New("blob: not found")
+
+// Store keeps blobs by key. Keys are slash-separated paths chosen by the
+// caller, never by end users.
+type Store interface {
+	// Put stores exactly size bytes from r under key.
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob under key, or returns ErrNotFound.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the blob under key. Deleting a missing blob is not
+	// an error.
+	Delete(key string) error
+}
+
+// NewStoreFromEnv picks a Store by BLOB_DRIVER: "local" (the default,
+// files under BLOB_DIR) or "s3" (S3_ENDPOINT, S3_REGION, S3_BUCKET,
+// S3_ACCESS_KEY, S3_SECRET_KEY; S3_PATH_STYLE for MinIO and similar).
+func NewStoreFromEnv() (Store, error) {
+	switch driver := getEnv("BLOB_DRIVER", "local"); driver {
+	case "local":
+		return NewLocalStore(getEnv("BLOB_DIR", DefaultDir))
+	case "s3":
+		bucket := os.Getenv("S3_BUCKET")
+		if bucket == "" {
+			return nil, fmt.Errorf("blob: S3_BUCKET is required for BLOB_DRIVER=s3")
+		}
+		pathStyle, err := strconv.ParseBool(getEnv("S3_PATH_STYLE", "false"))
+		if err != nil {
+			return nil, fmt.Errorf("blob: invalid S3_PATH_STYLE: %w", err)
+		}
+		return &S3Store{
+			Endpoint:  getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			Bucket:    bucket,
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: pathStyle,
+		}, nil
+	default:
+		return nil, fmt.Errorf("blob: unknown BLOB_DRIVER %q", driver)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,177 @@
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Store keeps blobs in an S3 bucket, signing requests with AWS
+// Signature Version 4. PathStyle addresses the bucket as
+// Endpoint/Bucket/key, as MinIO and most other S3-compatible stores
+// expect, instead of Bucket.host/key.
+type S3Store struct {
+	Endpoint  string // e.g. https://s3.amazonaws.com or http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Client    *http.Client // http.DefaultClient if nil
+}
+
+func (s *S3Store) Put(key string, r io.Reader, size int64, contentType string) error {
+	body := io.NopCloser(r)
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := s.request(http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return s.do(req, nil)
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	req, err := s.request(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadCloser
+	if err := s.do(req, &body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	req, err := s.request(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, nil)
+}
+
+// request builds a signed request for key.
+func (s *S3Store) request(method, key string, body io.ReadCloser) (*http.Request, error) {
+	base, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("blob: invalid S3 endpoint: %w", err)
+	}
+	path := "/" + escapePath(key)
+	if s.PathStyle {
+		path = "/" + escapePath(s.Bucket) + path
+	} else {
+		base.Host = s.Bucket + "." + base.Host
+	}
+	u, err := url.Parse(base.Scheme + "://" + base.Host + path)
+	if err != nil {
+		return nil, fmt.Errorf("blob: %w", err)
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+	headers := [][2]string{
+		{"host", u.Host},
+		{"x-amz-content-sha256", unsignedPayload},
+		{"x-amz-date", amzDate},
+	}
+	req.Header.Set("Authorization", s.authorization(method, path, "", headers, unsignedPayload, amzDate))
+	return req, nil
+}
+
+// do sends req. On success the body is handed to *body if body is not nil,
+// and closed otherwise.
+func (s *S3Store) do(req *http.Request, body *io.ReadCloser) error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("blob: %w", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		if body != nil {
+			*body = resp.Body
+			return nil
+		}
+		resp.Body.Close()
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("blob: S3 %s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, msg)
+}
+
+// authorization computes the SigV4 Authorization header. headers are the
+// signed headers, lower-case and sorted by name.
+func (s *S3Store) authorization(method, path, query string, headers [][2]string, payloadHash, amzDate string) string {
+	var canonicalHeaders strings.Builder
+	names := make([]string, len(headers))
+	for i, h := range headers {
+		canonicalHeaders.WriteString(h[0] + ":" + strings.TrimSpace(h[1]) + "\n")
+		names[i] = h[0]
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{method, path, query, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := amzDate[:8] + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex(canonical)
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature)
+}
+
+// escapePath percent-encodes everything but the unreserved characters of
+// RFC 3986 and the slash, as SigV4 expects of S3 object paths.
+func escapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,18 @@
+// Package clinic holds settings every scheduling service reads the same way.
+package clinic
+
+import (
+	"os"
+	"time"
+	_ "time/tzdata" // CLINIC_TIMEZONE must resolve in minimal images
+)
+
+// Location is the clinic's time zone, from CLINIC_TIMEZONE (default UTC).
+// Opening hours, holidays and recurring appointments are laid out in it.
+func Location() (*time.Location, error) {
+	name := os.Getenv("CLINIC_TIMEZONE")
+	if name == "" {
+		name = "UTC"
+	}
+	return time.LoadLocation(name)
+}
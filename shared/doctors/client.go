@@ -0,0 +1,69 @@
+// Package doctors reads doctors' bookable slots from doctor-service, which
+// knows their working hours, exceptions and the clinic's holidays.
+package doctors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const DefaultURL = "http://localhost:8087"
+
+// Slot is a bookable window, start inclusive and end exclusive.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// NewClientFromEnv reads DOCTOR_SERVICE_URL.
+func NewClientFromEnv() *Client {
+	baseURL := os.Getenv("DOCTOR_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return NewClient(baseURL)
+}
+
+// Slots lists the doctor's free slots of minutes length in [from, to),
+// ordered by start.
+func (c *Client) Slots(doctorID uint, from, to time.Time, minutes int) ([]Slot, error) {
+	q := url.Values{}
+	q.Set("from", from.Format(time.RFC3339))
+	q.Set("to", to.Format(time.RFC3339))
+	q.Set("duration", strconv.Itoa(minutes))
+
+	u := c.baseURL + "/api/doctors/" + strconv.FormatUint(uint64(doctorID), 10) + "/slots?" + q.Encode()
+	resp, err := c.http.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("doctors: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doctors: unexpected status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Slots []Slot `json:"slots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Slots, nil
+}
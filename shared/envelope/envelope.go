@@ -0,0 +1,351 @@
+// Package envelope encrypts sensitive columns and files at rest. Values are
+// sealed with AES-256-GCM under a per-tenant data key; data keys are kept
+// in the data_keys table, wrapped by a key-encryption key held in a KMS.
+//
+// Data keys rotate on a schedule. The newest key of a tenant seals new
+// values, older keys open what has not been re-encrypted yet, and a
+// Reencryptor moves old values to the newest key in the background.
+package envelope
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultTenant   = "default"
+	DefaultRotation = 90 * 24 * time.Hour
+
+	// Data keys seal values; index keys compute blind indexes and never
+	// rotate, since every index would have to be recomputed.
+	PurposeData  = "data"
+	PurposeIndex = "index"
+
+	// prefix starts every sealed value: enc:v1:<data key ID>:<base64>.
+	prefix = "enc:v1:"
+	// activeTTL is how long the active key is cached, so keys rotated by
+	// another service are picked up.
+	activeTTL = time.Minute
+)
+
+var (
+	ErrUnknownKey = errors.New("envelope: unknown data key")
+	ErrCorrupt    = errors.New("envelope: ciphertext is corrupt or was tampered with")
+)
+
+// DataKey is a tenant's data key, wrapped by the KEK KEKID.
+type DataKey struct {
+	ID        uint      `gorm:"primaryKey"`
+	Tenant    string    `gorm:"not null;index"`
+	Purpose   string    `gorm:"not null"`
+	KEKID     string    `gorm:"column:kek_id;not null"`
+	Wrapped   []byte    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&DataKey{})
+}
+
+type dataKey struct {
+	id     uint
+	tenant string
+	secret []byte
+}
+
+type activeKey struct {
+	key      *dataKey
+	loadedAt time.Time
+}
+
+// cache is shared by a Keyring and its ForTenant views.
+type cache struct {
+	mu     sync.Mutex
+	keys   map[uint]*dataKey
+	active map[string]activeKey // by tenant and purpose
+}
+
+// Keyring seals and opens values for one tenant.
+type Keyring struct {
+	db       *gorm.DB
+	kms      KMS
+	tenant   string
+	rotation time.Duration
+	cache    *cache
+}
+
+// NewKeyring returns a Keyring for tenant whose data keys rotate every
+// rotation; 0 never rotates them on its own.
+func NewKeyring(db *gorm.DB, kms KMS, tenant string, rotation time.Duration) *Keyring {
+	return &Keyring{
+		db:       db,
+		kms:      kms,
+		tenant:   tenant,
+		rotation: rotation,
+		cache:    &cache{keys: map[uint]*dataKey{}, active: map[string]activeKey{}},
+	}
+}
+
+// NewKeyringFromEnv opens the KMS chosen by KMS_PROVIDER and reads
+// ENCRYPTION_TENANT (default "default") and DATA_KEY_ROTATION (default
+// 2160h, 90 days).
+func NewKeyringFromEnv(db *gorm.DB) (*Keyring, error) {
+	kms, err := NewKMSFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	rotation := DefaultRotation
+	if v := getEnv("DATA_KEY_ROTATION", ""); v != "" {
+		if rotation, err = time.ParseDuration(v); err != nil || rotation < 0 {
+			return nil, fmt.Errorf("envelope: invalid DATA_KEY_ROTATION %q", v)
+		}
+	}
+	return NewKeyring(db, kms, getEnv("ENCRYPTION_TENANT", DefaultTenant), rotation), nil
+}
+
+func (k *Keyring) Tenant() string { return k.tenant }
+
+func (k *Keyring) KMS() KMS { return k.kms }
+
+// ForTenant returns a Keyring for another tenant, sharing k's key cache.
+func (k *Keyring) ForTenant(tenant string) *Keyring {
+	view := *k
+	view.tenant = tenant
+	return &view
+}
+
+// Seal encrypts plaintext under the tenant's active data key. context names
+// where the value lives, such as "medical_records.notes"; the value only
+// opens under the same context, so it cannot be moved to another column.
+func (k *Keyring) Seal(context, plaintext string) (string, error) {
+	key, err := k.active(PurposeData)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key.secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+	return prefix + strconv.FormatUint(uint64(key.id), 10) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed by Seal. A value that was never sealed,
+// written before encryption was turned on, is returned as it is.
+func (k *Keyring) Open(context, value string) (string, error) {
+	id, ok := KeyID(value)
+	if !ok {
+		return value, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(value[strings.LastIndexByte(value, ':')+1:])
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	key, err := k.key(id)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key.secret)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", ErrCorrupt
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(context))
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	return string(plaintext), nil
+}
+
+// KeyID returns the data key a sealed value was sealed with, and false for
+// a value that is not sealed.
+func KeyID(value string) (uint, bool) {
+	if !strings.HasPrefix(value, prefix) {
+		return 0, false
+	}
+	rest := value[len(prefix):]
+	i := strings.IndexByte(rest, ':')
+	if i < 0 {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(rest[:i], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// BlindIndex returns a keyed hash of value for exact-match lookups on a
+// sealed column: store it next to the column and search by the index of
+// the search term. Normalize values first, so "ab-12" finds "AB 12".
+func (k *Keyring) BlindIndex(context, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	key, err := k.active(PurposeIndex)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(context))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// ActiveKeyID returns the data key new values are sealed with.
+func (k *Keyring) ActiveKeyID() (uint, error) {
+	key, err := k.active(PurposeData)
+	if err != nil {
+		return 0, err
+	}
+	return key.id, nil
+}
+
+// RotateDataKey makes a new data key active for the tenant now, whatever
+// the age of the current one.
+func (k *Keyring) RotateDataKey() (uint, error) {
+	key, err := k.create(PurposeData, true)
+	if err != nil {
+		return 0, err
+	}
+	return key.id, nil
+}
+
+// RewrapDataKeys wraps every data key, of every tenant, under the KMS's
+// current KEK. Run it after rotating the KEK, so the old KEK can be
+// retired; the data keys themselves and everything they sealed stay as
+// they are.
+func (k *Keyring) RewrapDataKeys() (int, error) {
+	current, err := k.kms.Current()
+	if err != nil {
+		return 0, err
+	}
+	var stale []DataKey
+	if err := k.db.Where("kek_id <> ?", current).Find(&stale).Error; err != nil {
+		return 0, err
+	}
+	for i, row := range stale {
+		secret, err := k.kms.Unwrap(row.KEKID, row.Wrapped)
+		if err != nil {
+			return i, fmt.Errorf("envelope: unwrapping data key %d: %w", row.ID, err)
+		}
+		kekID, wrapped, err := k.kms.Wrap(secret)
+		if err != nil {
+			return i, err
+		}
+		if err := k.db.Model(&DataKey{}).Where("id = ? AND kek_id = ?", row.ID, row.KEKID).
+			UpdateColumns(map[string]interface{}{"kek_id": kekID, "wrapped": wrapped}).Error; err != nil {
+			return i, err
+		}
+	}
+	return len(stale), nil
+}
+
+// active returns the tenant's newest key for purpose, creating one when
+// there is none or the data key is due for rotation.
+func (k *Keyring) active(purpose string) (*dataKey, error) {
+	name := k.tenant + "/" + purpose
+	k.cache.mu.Lock()
+	cached, ok := k.cache.active[name]
+	k.cache.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < activeTTL {
+		return cached.key, nil
+	}
+
+	key, err := k.create(purpose, false)
+	if err != nil {
+		return nil, err
+	}
+	k.cache.mu.Lock()
+	k.cache.active[name] = activeKey{key: key, loadedAt: time.Now()}
+	k.cache.mu.Unlock()
+	return key, nil
+}
+
+// create returns the tenant's newest key for purpose, first adding a new
+// one if force is set, there is none, or a data key is due. The advisory
+// lock keeps services starting together from each adding one.
+func (k *Keyring) create(purpose string, force bool) (*dataKey, error) {
+	var row DataKey
+	err := k.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "data_keys/"+k.tenant+"/"+purpose).Error; err != nil {
+			return err
+		}
+		err := tx.Where("tenant = ? AND purpose = ?", k.tenant, purpose).Order("id DESC").First(&row).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		due := purpose == PurposeData && k.rotation > 0 && time.Since(row.CreatedAt) >= k.rotation
+		if err == nil && !force && !due {
+			return nil
+		}
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		kekID, wrapped, err := k.kms.Wrap(secret)
+		if err != nil {
+			return err
+		}
+		row = DataKey{Tenant: k.tenant, Purpose: purpose, KEKID: kekID, Wrapped: wrapped}
+		return tx.Create(&row).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("envelope: loading %s key: %w", purpose, err)
+	}
+	return k.unwrap(row)
+}
+
+// key returns the data key id. Keys of other tenants are unknown here.
+func (k *Keyring) key(id uint) (*dataKey, error) {
+	k.cache.mu.Lock()
+	key, ok := k.cache.keys[id]
+	k.cache.mu.Unlock()
+	if !ok {
+		var row DataKey
+		if err := k.db.First(&row, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+		} else if err != nil {
+			return nil, fmt.Errorf("envelope: loading data key: %w", err)
+		}
+		var err error
+		if key, err = k.unwrap(row); err != nil {
+			return nil, err
+		}
+	}
+	if key.tenant != k.tenant {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+func (k *Keyring) unwrap(row DataKey) (*dataKey, error) {
+	secret, err := k.kms.Unwrap(row.KEKID, row.Wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: unwrapping data key %d: %w", row.ID, err)
+	}
+	key := &dataKey{id: row.ID, tenant: row.Tenant, secret: secret}
+	k.cache.mu.Lock()
+	k.cache.keys[row.ID] = key
+	k.cache.mu.Unlock()
+	return key, nil
+}
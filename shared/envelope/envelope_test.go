@@ -0,0 +1,393 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"healthcare/shared/blob"
+)
+
+const testTenant = "clinic-a"
+
+// testKeyring is a Keyring without a database: data keys are wrapped by a
+// FileKMS and placed straight in the cache.
+type testKeyring struct {
+	*Keyring
+	kms  *FileKMS
+	rows map[uint]DataKey
+}
+
+func newTestKeyring(t *testing.T) *testKeyring {
+	t.Helper()
+	kms, err := NewFileKMS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeyring{Keyring: NewKeyring(nil, kms, testTenant, 0), kms: kms, rows: map[uint]DataKey{}}
+}
+
+// addKey wraps a new data key under the current KEK and, for the
+// keyring's own tenant, makes it active, as RotateDataKey would.
+func (k *testKeyring) addKey(t *testing.T, id uint, tenant string) {
+	t.Helper()
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	kekID, wrapped, err := k.kms.Wrap(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := DataKey{ID: id, Tenant: tenant, Purpose: PurposeData, KEKID: kekID, Wrapped: wrapped}
+	k.rows[id] = row
+	key, err := k.unwrap(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant == k.tenant {
+		k.cache.active[tenant+"/"+PurposeData] = activeKey{key: key, loadedAt: time.Now()}
+	}
+}
+
+// reload drops every cached key and unwraps the stored rows again, as a
+// restarted service would.
+func (k *testKeyring) reload(t *testing.T) {
+	t.Helper()
+	k.cache.keys = map[uint]*dataKey{}
+	for _, row := range k.rows {
+		if _, err := k.unwrap(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func seal(t *testing.T, k *testKeyring, context, plaintext string) string {
+	t.Helper()
+	v, err := k.Seal(context, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestSealOpenAcrossRotation(t *testing.T) {
+	const ctx = "medical_records.notes"
+	k := newTestKeyring(t)
+
+	k.addKey(t, 1, testTenant)
+	v1 := seal(t, k, ctx, "first visit")
+
+	// A new data key, wrapped under a new KEK
+	oldKEK, _ := k.kms.Current()
+	if _, err := k.kms.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	k.addKey(t, 2, testTenant)
+	v2 := seal(t, k, ctx, "second visit")
+	if k.rows[1].KEKID != oldKEK || k.rows[2].KEKID == oldKEK {
+		t.Fatalf("data keys wrapped under %s and %s, want %s and a new KEK", k.rows[1].KEKID, k.rows[2].KEKID, oldKEK)
+	}
+	k.reload(t)
+
+	tests := []struct {
+		value  string
+		wantID uint
+		want   string
+	}{
+		{v1, 1, "first visit"},
+		{v2, 2, "second visit"},
+	}
+	for _, tt := range tests {
+		if id, ok := KeyID(tt.value); !ok || id != tt.wantID {
+			t.Errorf("KeyID(%q) = %d, %v, want %d", tt.value, id, ok, tt.wantID)
+		}
+		got, err := k.Open(ctx, tt.value)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", tt.value, err)
+		}
+		if got != tt.want {
+			t.Errorf("Open(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	if id, err := k.ActiveKeyID(); err != nil || id != 2 {
+		t.Errorf("ActiveKeyID = %d, %v, want 2", id, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	const ctx = "medical_records.notes"
+	k := newTestKeyring(t)
+	k.addKey(t, 1, testTenant)
+	k.addKey(t, 7, "clinic-b")
+	sealed := seal(t, k, ctx, "allergic to penicillin")
+	k.cache.active["clinic-b/"+PurposeData] = activeKey{key: k.cache.keys[7], loadedAt: time.Now()}
+	other, err := k.ForTenant("clinic-b").Seal(ctx, "clinic b's note")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := sealed[strings.LastIndexByte(sealed, ':')+1:]
+	raw, err := base64.RawStdEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	flipped := base64.RawStdEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name    string
+		keys    *Keyring
+		context string
+		value   string
+		want    string
+		wantErr error
+	}{
+		{"sealed", k.Keyring, ctx, sealed, "allergic to penicillin", nil},
+		{"never sealed", k.Keyring, ctx, "plain old note", "plain old note", nil},
+		{"empty", k.Keyring, ctx, "", "", nil},
+		{"other context", k.Keyring, "patients.address", sealed, "", ErrCorrupt},
+		{"tampered", k.Keyring, ctx, "enc:v1:1:" + flipped, "", ErrCorrupt},
+		{"truncated", k.Keyring, ctx, "enc:v1:1:" + body[:8], "", ErrCorrupt},
+		{"not base64", k.Keyring, ctx, "enc:v1:1:***", "", ErrCorrupt},
+		{"moved to another key", k.Keyring, ctx, "enc:v1:7:" + body, "", ErrUnknownKey},
+		{"other tenant's value", k.Keyring, ctx, other, "", ErrUnknownKey},
+		{"other tenant's own keyring", k.ForTenant("clinic-b"), ctx, other, "clinic b's note", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.Open(tt.context, tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Open: got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Open = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSealUsesFreshNonce(t *testing.T) {
+	k := newTestKeyring(t)
+	k.addKey(t, 1, testTenant)
+	a := seal(t, k, "c", "same")
+	b := seal(t, k, "c", "same")
+	if a == b {
+		t.Error("sealing the same value twice gave the same ciphertext")
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   uint
+		wantOK bool
+	}{
+		{"enc:v1:12:AAAA", 12, true},
+		{"enc:v1:0:", 0, true},
+		{"enc:v1:12", 0, false},
+		{"enc:v1:x:AAAA", 0, false},
+		{"enc:v1:-1:AAAA", 0, false},
+		{"enc:v1:99999999999:AAAA", 0, false},
+		{"enc:v2:12:AAAA", 0, false},
+		{"plain", 0, false},
+	}
+	for _, tt := range tests {
+		id, ok := KeyID(tt.value)
+		if id != tt.want || ok != tt.wantOK {
+			t.Errorf("KeyID(%q) = %d, %v, want %d, %v", tt.value, id, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFileKMS(t *testing.T) {
+	kms, err := NewFileKMS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	kekID, wrapped, err := kms.Wrap(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kms.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := kms.Current(); current == kekID {
+		t.Fatal("Rotate did not change the current KEK")
+	}
+
+	tampered := append([]byte(nil), wrapped...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		kekID   string
+		wrapped []byte
+		wantErr error
+	}{
+		{"old KEK still unwraps", kekID, wrapped, nil},
+		{"unknown KEK", "0000000000000000", wrapped, ErrUnknownKEK},
+		{"path in KEK ID", "../" + kekID, wrapped, ErrUnknownKEK},
+		{"empty KEK ID", "", wrapped, ErrUnknownKEK},
+		{"tampered", kekID, tampered, ErrCorrupt},
+		{"truncated", kekID, wrapped[:4], ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := kms.Unwrap(tt.kekID, tt.wrapped)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Unwrap: got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, secret) {
+				t.Error("Unwrap returned a different key")
+			}
+		})
+	}
+}
+
+func TestStoreAcrossRotation(t *testing.T) {
+	local, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newTestKeyring(t)
+	store := NewStore(local, k.Keyring)
+
+	put := func(key string, data []byte) uint {
+		t.Helper()
+		id, err := store.Write(key, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("Write %s: %v", key, err)
+		}
+		return id
+	}
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+
+	k.addKey(t, 1, testTenant)
+	old := random(2*segmentSize + 10)
+	if id := put("a/old", old); id != 1 {
+		t.Errorf("old blob sealed with key %d, want 1", id)
+	}
+	empty := []byte{}
+	put("a/empty", empty)
+
+	if _, err := k.kms.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	k.addKey(t, 2, testTenant)
+	newer := random(segmentSize)
+	if id := put("a/new", newer); id != 2 {
+		t.Errorf("new blob sealed with key %d, want 2", id)
+	}
+	plain := []byte("stored before encryption")
+	if err := local.Put("a/plain", bytes.NewReader(plain), int64(len(plain)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	k.reload(t)
+
+	tests := []struct {
+		key  string
+		want []byte
+	}{
+		{"a/old", old},
+		{"a/empty", empty},
+		{"a/new", newer},
+		{"a/plain", plain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if tt.key != "a/plain" {
+				info, err := os.Stat(filepath.Join(local.Dir, tt.key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := SealedSize(int64(len(tt.want))); info.Size() != want {
+					t.Errorf("stored %d bytes, want %d", info.Size(), want)
+				}
+			}
+			got := readBlob(t, store, tt.key)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("read %d bytes back, want the %d written", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestStoreDetectsTampering(t *testing.T) {
+	k := newTestKeyring(t)
+	k.addKey(t, 1, testTenant)
+	data := make([]byte, 2*segmentSize+10)
+	rand.Read(data)
+
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"flipped byte", func(b []byte) []byte { b[headerSize+5] ^= 1; return b }},
+		{"last segment dropped", func(b []byte) []byte { return b[:headerSize+2*(segmentSize+tagSize)] }},
+		{"cut mid segment", func(b []byte) []byte { return b[:len(b)-3] }},
+		{"segments swapped", func(b []byte) []byte {
+			seg := segmentSize + tagSize
+			first := append([]byte(nil), b[headerSize:headerSize+seg]...)
+			copy(b[headerSize:], b[headerSize+seg:headerSize+2*seg])
+			copy(b[headerSize+seg:], first)
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, err := blob.NewLocalStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := NewStore(local, k.Keyring)
+			if _, err := store.Write("x", bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(local.Dir, "x")
+			stored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.tamper(stored), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := store.Get("x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("reading a tampered blob: got error %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+func readBlob(t *testing.T, s *Store, key string) []byte {
+	t.Helper()
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	return b
+}
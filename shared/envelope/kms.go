@@ -0,0 +1,172 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultKMSDir = "kms"
+
+var ErrUnknownKEK = errors.New("envelope: unknown key-encryption key")
+
+// KMS holds the key-encryption keys (KEKs) that wrap data keys. KEKs never
+// leave it; only wrapped data keys are stored in the database.
+type KMS interface {
+	// Current returns the ID of the KEK new data keys are wrapped with.
+	Current() (string, error)
+	// Wrap encrypts a data key under the current KEK.
+	Wrap(dataKey []byte) (kekID string, wrapped []byte, err error)
+	// Unwrap decrypts a data key wrapped under kekID.
+	Unwrap(kekID string, wrapped []byte) ([]byte, error)
+	// Rotate makes a new KEK current. Older KEKs still unwrap.
+	Rotate() (string, error)
+}
+
+// NewKMSFromEnv picks a KMS by KMS_PROVIDER. The only provider so far is
+// "file" (the default), a stand-in for a real KMS keeping KEKs under
+// KMS_DIR.
+func NewKMSFromEnv() (KMS, error) {
+	switch provider := getEnv("KMS_PROVIDER", "file"); provider {
+	case "file":
+		return NewFileKMS(getEnv("KMS_DIR", DefaultKMSDir))
+	default:
+		return nil, fmt.Errorf("envelope: unknown KMS_PROVIDER %q", provider)
+	}
+}
+
+// FileKMS keeps each KEK as a hex file <id>.kek in Dir, and the ID of the
+// current one in the file "current". Every service sharing the database
+// must share the directory too.
+type FileKMS struct {
+	Dir string
+}
+
+// NewFileKMS opens dir, creating it and a first KEK if there is none.
+func NewFileKMS(dir string) (*FileKMS, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("envelope: creating KMS directory: %w", err)
+	}
+	k := &FileKMS{Dir: dir}
+	if _, err := k.Current(); errors.Is(err, os.ErrNotExist) {
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *FileKMS) Current() (string, error) {
+	id, err := os.ReadFile(filepath.Join(k.Dir, "current"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(id)), nil
+}
+
+func (k *FileKMS) Wrap(dataKey []byte) (string, []byte, error) {
+	id, err := k.Current()
+	if err != nil {
+		return "", nil, fmt.Errorf("envelope: reading current KEK: %w", err)
+	}
+	aead, err := k.aead(id)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return id, aead.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+func (k *FileKMS) Unwrap(kekID string, wrapped []byte) ([]byte, error) {
+	aead, err := k.aead(kekID)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(kekID))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+// Rotate writes a new KEK and then points "current" at it, so a reader
+// never sees a current KEK that is not there yet.
+func (k *FileKMS) Rotate() (string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	kekID := hex.EncodeToString(id)
+	if err := os.WriteFile(filepath.Join(k.Dir, kekID+".kek"), []byte(hex.EncodeToString(secret)), 0o600); err != nil {
+		return "", fmt.Errorf("envelope: writing KEK: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(k.Dir, ".current-*")
+	if err != nil {
+		return "", fmt.Errorf("envelope: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(kekID)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(k.Dir, "current"))
+	}
+	if err != nil {
+		return "", fmt.Errorf("envelope: switching KEK: %w", err)
+	}
+	return kekID, nil
+}
+
+func (k *FileKMS) aead(kekID string) (cipher.AEAD, error) {
+	if kekID == "" || strings.ContainsAny(kekID, `/\.`) {
+		return nil, ErrUnknownKEK
+	}
+	data, err := os.ReadFile(filepath.Join(k.Dir, kekID+".kek"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKEK, kekID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("envelope: reading KEK: %w", err)
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("envelope: KEK %s is not hex", kekID)
+	}
+	return newAEAD(secret)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
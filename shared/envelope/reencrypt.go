@@ -0,0 +1,126 @@
+package envelope
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultSweepInterval = 10 * time.Minute
+	reencryptBatch       = 100
+)
+
+// Column is a sealed column of a table with an id primary key.
+type Column struct {
+	Table string
+	Name  string
+	// Index is the column holding the blind index of the value, if it has
+	// one, and Normalize prepares values for it.
+	Index     string
+	Normalize func(string) string
+}
+
+// Reencryptor moves sealed columns to the active data key: values sealed
+// under an older key, and plaintext written before encryption was turned
+// on. Missing blind indexes are filled in on the way.
+type Reencryptor struct {
+	db      *gorm.DB
+	keys    *Keyring
+	columns []Column
+}
+
+func NewReencryptor(db *gorm.DB, keys *Keyring, columns ...Column) *Reencryptor {
+	return &Reencryptor{db: db, keys: keys, columns: columns}
+}
+
+// Run sweeps every interval.
+func (r *Reencryptor) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := r.Sweep()
+		if err != nil {
+			log.Printf("Failed to re-encrypt: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Re-encrypted %d values", n)
+		}
+	}
+}
+
+// Sweep re-encrypts every value not yet under the active data key and
+// returns how many it rewrote.
+func (r *Reencryptor) Sweep() (int, error) {
+	activeID, err := r.keys.ActiveKeyID()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, col := range r.columns {
+		n, err := r.sweepColumn(col, activeID)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s.%s: %w", col.Table, col.Name, err)
+		}
+	}
+	return total, nil
+}
+
+func (r *Reencryptor) sweepColumn(col Column, activeID uint) (int, error) {
+	current := prefix + strconv.FormatUint(uint64(activeID), 10) + ":%"
+	stale := col.Name + " NOT LIKE ?"
+	if col.Index != "" {
+		stale = "(" + stale + " OR COALESCE(" + col.Index + ", '') = '')"
+	}
+	context := Context(col.Table, col.Name)
+
+	done := 0
+	var lastID uint
+	for {
+		// Tables are read raw: no model, so no serializer, and soft-deleted
+		// rows are included
+		var rows []struct {
+			ID    uint
+			Value string
+		}
+		if err := r.db.Table(col.Table).Select("id", col.Name+" AS value").
+			Where("id > ? AND "+col.Name+" <> '' AND "+stale, lastID, current).
+			Order("id").Limit(reencryptBatch).Scan(&rows).Error; err != nil {
+			return done, err
+		}
+		if len(rows) == 0 {
+			return done, nil
+		}
+
+		for _, row := range rows {
+			lastID = row.ID
+			plaintext, err := r.keys.Open(context, row.Value)
+			if err != nil {
+				log.Printf("Failed to open %s of row %d: %v", context, row.ID, err)
+				continue
+			}
+			sealed, err := r.keys.Seal(context, plaintext)
+			if err != nil {
+				return done, err
+			}
+			updates := map[string]interface{}{col.Name: sealed}
+			if col.Index != "" {
+				if col.Normalize != nil {
+					plaintext = col.Normalize(plaintext)
+				}
+				if updates[col.Index], err = r.keys.BlindIndex(context, plaintext); err != nil {
+					return done, err
+				}
+			}
+			// A row changed since it was read is skipped; the new value is
+			// sealed under the active key already
+			res := r.db.Table(col.Table).Where("id = ? AND "+col.Name+" = ?", row.ID, row.Value).UpdateColumns(updates)
+			if res.Error != nil {
+				return done, res.Error
+			}
+			done += int(res.RowsAffected)
+		}
+	}
+}
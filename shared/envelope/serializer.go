@@ -0,0 +1,60 @@
+package envelope
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm/schema"
+)
+
+// SerializerName is the gorm serializer sealing string fields. Tag a field
+// `gorm:"serializer:encrypted"` to keep it sealed in the database and
+// plaintext in Go. Updates through a map bypass serializers, so sealed
+// columns must be written from the struct.
+const SerializerName = "encrypted"
+
+// Register installs the serializer for keys. Call it before the first
+// query or migration, while gorm has not parsed any model yet.
+func Register(keys *Keyring) {
+	schema.RegisterSerializer(SerializerName, serializer{keys: keys})
+}
+
+// Context is the context a column's values are sealed under.
+func Context(table, column string) string {
+	return table + "." + column
+}
+
+type serializer struct {
+	keys *Keyring
+}
+
+func (s serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("envelope: cannot open %T in %s", dbValue, field.Name)
+	}
+	plaintext, err := s.keys.Open(Context(field.Schema.Table, field.DBName), value)
+	if err != nil {
+		return fmt.Errorf("envelope: opening %s: %w", field.Name, err)
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+func (s serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("envelope: %s is not a string", field.Name)
+	}
+	if plaintext == "" {
+		return "", nil
+	}
+	return s.keys.Seal(Context(field.Schema.Table, field.DBName), plaintext)
+}
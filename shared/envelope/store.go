@@ -0,0 +1,225 @@
+package envelope
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"healthcare/shared/blob"
+)
+
+const (
+	// blobMagic starts every sealed blob, followed by the data key ID and
+	// a random nonce prefix.
+	blobMagic  = "HCE1"
+	headerSize = 16
+	// Blobs are sealed in segments, so they stream in both directions.
+	// Each segment has its own nonce (the prefix and its number) and is
+	// flagged in its associated data when it is the last, so segments can
+	// be neither reordered nor dropped.
+	segmentSize = 64 << 10
+	tagSize     = 16
+)
+
+// Store seals blobs on their way into a blob.Store and opens them on the
+// way out. Blobs stored before encryption was turned on read as they are.
+type Store struct {
+	blobs blob.Store
+	keys  *Keyring
+}
+
+func NewStore(blobs blob.Store, keys *Keyring) *Store {
+	return &Store{blobs: blobs, keys: keys}
+}
+
+// SealedSize is the stored size of a blob of size bytes.
+func SealedSize(size int64) int64 {
+	segments := (size + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return headerSize + segments*tagSize + size
+}
+
+// Put implements blob.Store.
+func (s *Store) Put(key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.Write(key, r, size)
+	return err
+}
+
+// Write seals exactly size bytes from r under key and returns the data key
+// it used. The stored content type is always application/octet-stream.
+func (s *Store) Write(key string, r io.Reader, size int64) (uint, error) {
+	dk, err := s.keys.active(PurposeData)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := newAEAD(dk.secret)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, headerSize)
+	copy(header, blobMagic)
+	binary.BigEndian.PutUint32(header[4:8], uint32(dk.id))
+	if _, err := rand.Read(header[8:]); err != nil {
+		return 0, err
+	}
+
+	sr := &sealReader{segments: segments{aead: aead, header: header, key: key}, src: r, remaining: size, out: header}
+	if err := s.blobs.Put(key, sr, SealedSize(size), "application/octet-stream"); err != nil {
+		return 0, err
+	}
+	return dk.id, nil
+}
+
+// Get implements blob.Store.
+func (s *Store) Get(key string) (io.ReadCloser, error) {
+	body, err := s.blobs.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(body, segmentSize+tagSize)
+	header, err := br.Peek(headerSize)
+	if err != nil || string(header[:4]) != blobMagic {
+		// Not sealed
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, body}, nil
+	}
+	header = append([]byte(nil), header...)
+	br.Discard(headerSize)
+
+	dk, err := s.keys.key(uint(binary.BigEndian.Uint32(header[4:8])))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	aead, err := newAEAD(dk.secret)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &openReader{segments: segments{aead: aead, header: header, key: key}, src: br, body: body}, nil
+}
+
+// ActiveKeyID returns the data key new blobs are sealed with.
+func (s *Store) ActiveKeyID() (uint, error) {
+	return s.keys.ActiveKeyID()
+}
+
+// Delete implements blob.Store.
+func (s *Store) Delete(key string) error {
+	return s.blobs.Delete(key)
+}
+
+// segments seals and opens the segments of one blob.
+type segments struct {
+	aead   cipher.AEAD
+	header []byte
+	key    string
+	n      uint32
+}
+
+func (s *segments) nonce() []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, s.header[8:16])
+	binary.BigEndian.PutUint32(nonce[8:], s.n)
+	return nonce
+}
+
+// data binds a segment to its blob, its key and whether it is the last.
+func (s *segments) data(last bool) []byte {
+	ad := append(append([]byte(nil), s.header...), s.key...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+type sealReader struct {
+	segments
+	src       io.Reader
+	remaining int64
+	plain     []byte
+	out       []byte // sealed bytes not read yet
+	done      bool
+}
+
+func (r *sealReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n := int64(segmentSize)
+		if r.remaining < n {
+			n = r.remaining
+		}
+		if r.plain == nil {
+			r.plain = make([]byte, segmentSize)
+		}
+		if _, err := io.ReadFull(r.src, r.plain[:n]); err != nil {
+			return 0, fmt.Errorf("envelope: reading blob: %w", err)
+		}
+		r.remaining -= n
+		r.done = r.remaining == 0
+		r.out = r.aead.Seal(nil, r.nonce(), r.plain[:n], r.data(r.done))
+		r.n++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+type openReader struct {
+	segments
+	src  *bufio.Reader
+	body io.Closer
+	buf  []byte
+	out  []byte // opened bytes not read yet
+	done bool
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, segmentSize+tagSize)
+		}
+		n, err := io.ReadFull(r.src, r.buf)
+		switch {
+		case err == io.EOF:
+			// The last segment is flagged, so running out before it means
+			// the blob was cut short
+			return 0, ErrCorrupt
+		case err == io.ErrUnexpectedEOF:
+			r.done = true
+		case err != nil:
+			return 0, err
+		default:
+			if _, err := r.src.Peek(1); err == io.EOF {
+				r.done = true
+			}
+		}
+		opened, err := r.aead.Open(r.buf[:0], r.nonce(), r.buf[:n], r.data(r.done))
+		if err != nil {
+			return 0, ErrCorrupt
+		}
+		r.out = opened
+		r.n++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *openReader) Close() error {
+	return r.body.Close()
+}
+
+var _ blob.Store = (*Store)(nil)
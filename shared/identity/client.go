@@ -0,0 +1,145 @@
+// Package identity reads and updates user profiles through auth-service's
+// internal API. auth-service owns the users table; other services go
+// through this client instead of querying it.
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"healthcare/shared/auth"
+)
+
+const DefaultURL = "http://localhost:8081"
+
+var ErrNotFound = errors.New("identity: user not found")
+
+// User is a user's profile as auth-service returns it.
+type User struct {
+	ID              uint       `json:"id"`
+	Email           string     `json:"email"`
+	FirstName       string     `json:"firstName"`
+	LastName        string     `json:"lastName"`
+	Role            string     `json:"role"`
+	Phone           string     `json:"phone"`
+	Address         string     `json:"address"`
+	IsActive        bool       `json:"isActive"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+}
+
+// ProfileUpdate changes the fields that are set and leaves the rest alone.
+type ProfileUpdate struct {
+	FirstName *string `json:"firstName,omitempty"`
+	LastName  *string `json:"lastName,omitempty"`
+	Phone     *string `json:"phone,omitempty"`
+	Address   *string `json:"address,omitempty"`
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// NewClientFromEnv reads AUTH_SERVICE_URL and INTERNAL_API_TOKEN.
+func NewClientFromEnv() *Client {
+	baseURL := os.Getenv("AUTH_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return NewClient(baseURL, auth.InternalToken())
+}
+
+// User fetches the profile of user id.
+func (c *Client) User(id uint) (*User, error) {
+	var user User
+	if err := c.do(http.MethodGet, c.userURL(id), nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UsersWithRole lists the active users with role.
+func (c *Client) UsersWithRole(role string) ([]User, error) {
+	var users []User
+	if err := c.do(http.MethodGet, c.baseURL+"/internal/users?role="+url.QueryEscape(role), nil, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// UpdateProfile applies u to user id and returns the updated profile.
+func (c *Client) UpdateProfile(id uint, u ProfileUpdate) (*User, error) {
+	var user User
+	if err := c.do(http.MethodPatch, c.userURL(id)+"/profile", u, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SessionActive reports whether session sessionID of user userID is still
+// live. It makes the client an auth.SessionChecker.
+func (c *Client) SessionActive(sessionID string, userID uint) (bool, error) {
+	var status struct {
+		Active bool `json:"active"`
+	}
+	u := c.baseURL + "/internal/sessions/" + url.PathEscape(sessionID) + "?userId=" + strconv.FormatUint(uint64(userID), 10)
+	if err := c.do(http.MethodGet, u, nil, &status); err != nil {
+		return false, err
+	}
+	return status.Active, nil
+}
+
+func (c *Client) userURL(id uint) string {
+	return c.baseURL + "/internal/users/" + strconv.FormatUint(uint64(id), 10)
+}
+
+func (c *Client) do(method, url string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(auth.InternalTokenHeader, c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("identity: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("identity: unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,258 @@
+// Package lockout slows down and then blocks password guessing. Failed
+// logins are counted per account and per client IP; each failure pushes the
+// next allowed attempt further out, and too many failures within a window
+// lock the key for a while.
+package lockout
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultMaxAccountFailures = 5
+	DefaultMaxIPFailures      = 20
+	DefaultWindow             = 15 * time.Minute
+	DefaultLockoutDuration    = 15 * time.Minute
+	DefaultBaseDelay          = 500 * time.Millisecond
+	DefaultMaxDelay           = 10 * time.Second
+)
+
+// Record is the failure state of one key.
+type Record struct {
+	Key           string `gorm:"primaryKey;size:320"`
+	Failures      int    `gorm:"not null"`
+	WindowStart   time.Time
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+func (Record) TableName() string {
+	return "login_attempts"
+}
+
+// Store keeps failure counters. Fail must be atomic, since several
+// instances may count against the same key.
+type Store interface {
+	Get(key string) (Record, error)
+	// Fail counts a failure at now, starting a new window if the current one
+	// started more than window ago, and returns the updated record.
+	Fail(key string, now time.Time, window time.Duration) (Record, error)
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+	// Locked lists keys locked at now.
+	Locked(now time.Time) ([]Record, error)
+	// Prune drops records that no longer throttle or lock anything.
+	Prune(now time.Time, window time.Duration) error
+}
+
+type Config struct {
+	MaxAccountFailures int
+	MaxIPFailures      int
+	Window             time.Duration
+	LockoutDuration    time.Duration
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+}
+
+// LoadConfig reads LOGIN_MAX_ACCOUNT_FAILURES, LOGIN_MAX_IP_FAILURES,
+// LOGIN_FAILURE_WINDOW, LOGIN_LOCKOUT_DURATION, LOGIN_BASE_DELAY and
+// LOGIN_MAX_DELAY, all optional.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		MaxAccountFailures: DefaultMaxAccountFailures,
+		MaxIPFailures:      DefaultMaxIPFailures,
+		Window:             DefaultWindow,
+		LockoutDuration:    DefaultLockoutDuration,
+		BaseDelay:          DefaultBaseDelay,
+		MaxDelay:           DefaultMaxDelay,
+	}
+
+	ints := map[string]*int{
+		"LOGIN_MAX_ACCOUNT_FAILURES": &cfg.MaxAccountFailures,
+		"LOGIN_MAX_IP_FAILURES":      &cfg.MaxIPFailures,
+	}
+	for key, dst := range ints {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return cfg, fmt.Errorf("lockout: invalid %s %q", key, v)
+			}
+			*dst = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"LOGIN_FAILURE_WINDOW":   &cfg.Window,
+		"LOGIN_LOCKOUT_DURATION": &cfg.LockoutDuration,
+		"LOGIN_BASE_DELAY":       &cfg.BaseDelay,
+		"LOGIN_MAX_DELAY":        &cfg.MaxDelay,
+	}
+	for key, dst := range durations {
+		if v := os.Getenv(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return cfg, fmt.Errorf("lockout: invalid %s %q: %w", key, v, err)
+			}
+			*dst = d
+		}
+	}
+
+	return cfg, nil
+}
+
+// NewStoreFromEnv returns the store named by LOCKOUT_STORE: "postgres" (the
+// default, shared by every instance) or "memory" (per process).
+func NewStoreFromEnv(db *gorm.DB) (Store, error) {
+	switch v := os.Getenv("LOCKOUT_STORE"); v {
+	case "", "postgres":
+		return NewPostgresStore(db)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("lockout: unknown LOCKOUT_STORE %q", v)
+	}
+}
+
+// Decision says whether a login attempt may go ahead.
+type Decision struct {
+	Allowed    bool
+	Locked     bool          // a key is locked, not just throttled
+	RetryAfter time.Duration // when not allowed
+}
+
+// RetryAfterSeconds is RetryAfter rounded up, for the Retry-After header.
+func (d Decision) RetryAfterSeconds() int {
+	return int(math.Ceil(d.RetryAfter.Seconds()))
+}
+
+// Guard applies the lockout policy to login attempts.
+type Guard struct {
+	store Store
+	cfg   Config
+	now   func() time.Time
+}
+
+func NewGuard(store Store, cfg Config) *Guard {
+	return &Guard{store: store, cfg: cfg, now: time.Now}
+}
+
+// AccountKey and IPKey name the counters for an email address and a client
+// IP.
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check decides whether a login for email from ip may be attempted now.
+func (g *Guard) Check(email, ip string) (Decision, error) {
+	now := g.now()
+	decision := Decision{Allowed: true}
+
+	for _, key := range []string{AccountKey(email), IPKey(ip)} {
+		rec, err := g.store.Get(key)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		var wait time.Duration
+		locked := rec.LockedUntil != nil && now.Before(*rec.LockedUntil)
+		if locked {
+			wait = rec.LockedUntil.Sub(now)
+		} else if rec.Failures > 0 && now.Sub(rec.WindowStart) < g.cfg.Window {
+			wait = rec.LastFailureAt.Add(g.delay(rec.Failures)).Sub(now)
+		}
+
+		if wait > 0 {
+			decision.Allowed = false
+			decision.Locked = decision.Locked || locked
+			if wait > decision.RetryAfter {
+				decision.RetryAfter = wait
+			}
+		}
+	}
+	return decision, nil
+}
+
+// Failure counts a failed login. It reports whether this failure locked the
+// account, so the caller can record the event.
+func (g *Guard) Failure(email, ip string) (accountLocked bool, err error) {
+	now := g.now()
+
+	limits := []struct {
+		key string
+		max int
+	}{
+		{AccountKey(email), g.cfg.MaxAccountFailures},
+		{IPKey(ip), g.cfg.MaxIPFailures},
+	}
+	for i, l := range limits {
+		rec, err := g.store.Fail(l.key, now, g.cfg.Window)
+		if err != nil {
+			return false, err
+		}
+		if rec.Failures >= l.max && (rec.LockedUntil == nil || !now.Before(*rec.LockedUntil)) {
+			if err := g.store.Lock(l.key, now.Add(g.cfg.LockoutDuration)); err != nil {
+				return false, err
+			}
+			if i == 0 {
+				accountLocked = true
+			}
+		}
+	}
+	return accountLocked, nil
+}
+
+// Success clears the account's counter. The IP counter is left alone so one
+// valid login cannot launder a spray across many accounts.
+func (g *Guard) Success(email string) error {
+	return g.store.Reset(AccountKey(email))
+}
+
+// Unlock clears the account's counter and lock.
+func (g *Guard) Unlock(email string) error {
+	return g.store.Reset(AccountKey(email))
+}
+
+// Locked lists the keys that are currently locked.
+func (g *Guard) Locked() ([]Record, error) {
+	return g.store.Locked(g.now())
+}
+
+// Prune drops stale records.
+func (g *Guard) Prune() error {
+	return g.store.Prune(g.now(), g.cfg.Window)
+}
+
+// PruneEvery calls Prune every interval. Run it in its own goroutine.
+func (g *Guard) PruneEvery(interval time.Duration) {
+	for {
+		if err := g.Prune(); err != nil {
+			log.Printf("Failed to prune login attempts: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// delay is how long after the n-th failure the next attempt is allowed:
+// BaseDelay doubling per failure, capped at MaxDelay.
+func (g *Guard) delay(failures int) time.Duration {
+	d := g.cfg.BaseDelay
+	for i := 1; i < failures && d < g.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > g.cfg.MaxDelay {
+		d = g.cfg.MaxDelay
+	}
+	return d
+}
@@ -0,0 +1,283 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	MaxAccountFailures: 3,
+	MaxIPFailures:      5,
+	Window:             15 * time.Minute,
+	LockoutDuration:    10 * time.Minute,
+	BaseDelay:          time.Second,
+	MaxDelay:           4 * time.Second,
+}
+
+const (
+	alice = "alice@example.com"
+	bob   = "bob@example.com"
+	ip1   = "10.0.0.1"
+	ip2   = "10.0.0.2"
+)
+
+// step advances the clock by after and then runs op: "fail", "success",
+// "unlock" or "check".
+type step struct {
+	after     time.Duration
+	op        string
+	email, ip string
+	locks     bool     // fail: whether it locked the account
+	want      Decision // check
+}
+
+func allowed() Decision { return Decision{Allowed: true} }
+
+func throttled(d time.Duration) Decision { return Decision{RetryAfter: d} }
+
+func locked(d time.Duration) Decision { return Decision{Locked: true, RetryAfter: d} }
+
+func TestGuard(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "first attempt is allowed",
+			steps: []step{
+				{op: "check", email: alice, ip: ip1, want: allowed()},
+			},
+		},
+		{
+			name: "a failure delays the next attempt",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{op: "check", email: alice, ip: ip1, want: throttled(time.Second)},
+				{after: 400 * time.Millisecond, op: "check", email: alice, ip: ip1, want: throttled(600 * time.Millisecond)},
+				{after: 600 * time.Millisecond, op: "check", email: alice, ip: ip1, want: allowed()},
+			},
+		},
+		{
+			name: "delay doubles per failure",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{after: time.Second, op: "fail", email: alice, ip: ip1},
+				{op: "check", email: alice, ip: ip1, want: throttled(2 * time.Second)},
+			},
+		},
+		{
+			name: "too many account failures lock the account",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{after: time.Second, op: "fail", email: alice, ip: ip1},
+				{after: 2 * time.Second, op: "fail", email: alice, ip: ip1, locks: true},
+				{op: "check", email: alice, ip: ip2, want: locked(10 * time.Minute)},
+				{after: 9 * time.Minute, op: "check", email: alice, ip: ip2, want: locked(time.Minute)},
+				{after: time.Minute, op: "check", email: alice, ip: ip2, want: allowed()},
+			},
+		},
+		{
+			name: "lock does not reach other accounts",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1, locks: true},
+				{op: "check", email: bob, ip: ip2, want: allowed()},
+			},
+		},
+		{
+			name: "a failure while locked does not extend the lock",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1, locks: true},
+				{after: 5 * time.Minute, op: "fail", email: alice, ip: ip2},
+				{op: "check", email: alice, ip: ip2, want: locked(5 * time.Minute)},
+			},
+		},
+		{
+			name: "failures in a new window start counting again",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1},
+				{after: 15 * time.Minute, op: "check", email: alice, ip: ip1, want: allowed()},
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1},
+				{op: "check", email: alice, ip: ip2, want: throttled(2 * time.Second)},
+			},
+		},
+		{
+			name: "success clears the account but not the IP",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1},
+				{op: "success", email: alice},
+				{op: "check", email: alice, ip: ip2, want: allowed()},
+				{op: "check", email: bob, ip: ip1, want: throttled(2 * time.Second)},
+				{op: "fail", email: alice, ip: ip2},
+				{op: "fail", email: alice, ip: ip2},
+				{op: "check", email: alice, ip: ip2, want: throttled(2 * time.Second)},
+			},
+		},
+		{
+			name: "too many IP failures lock the IP for every account",
+			steps: []step{
+				{op: "fail", email: "a@example.com", ip: ip1},
+				{op: "fail", email: "b@example.com", ip: ip1},
+				{op: "fail", email: "c@example.com", ip: ip1},
+				{op: "fail", email: "d@example.com", ip: ip1},
+				{op: "fail", email: "e@example.com", ip: ip1},
+				{op: "check", email: alice, ip: ip1, want: locked(10 * time.Minute)},
+				{op: "check", email: alice, ip: ip2, want: allowed()},
+			},
+		},
+		{
+			name: "account key ignores case and spaces",
+			steps: []step{
+				{op: "fail", email: " Alice@Example.COM ", ip: ip1},
+				{op: "fail", email: "ALICE@example.com", ip: ip1},
+				{op: "fail", email: alice, ip: ip1, locks: true},
+				{op: "check", email: "Alice@example.com", ip: ip2, want: locked(10 * time.Minute)},
+			},
+		},
+		{
+			name: "unlock clears a locked account",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1, locks: true},
+				{op: "unlock", email: alice},
+				{op: "check", email: alice, ip: ip2, want: allowed()},
+			},
+		},
+		{
+			name: "longest wait wins",
+			steps: []step{
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: alice, ip: ip1},
+				{op: "fail", email: bob, ip: ip1},
+				// account: 2 failures, 2s; IP: 3 failures, 4s
+				{op: "check", email: alice, ip: ip1, want: throttled(4 * time.Second)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+			g := NewGuard(NewMemoryStore(), testConfig)
+			g.now = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				switch s.op {
+				case "fail":
+					got, err := g.Failure(s.email, s.ip)
+					if err != nil {
+						t.Fatalf("step %d: Failure: %v", i, err)
+					}
+					if got != s.locks {
+						t.Errorf("step %d: Failure locked account = %v, want %v", i, got, s.locks)
+					}
+				case "success":
+					if err := g.Success(s.email); err != nil {
+						t.Fatalf("step %d: Success: %v", i, err)
+					}
+				case "unlock":
+					if err := g.Unlock(s.email); err != nil {
+						t.Fatalf("step %d: Unlock: %v", i, err)
+					}
+				case "check":
+					got, err := g.Check(s.email, s.ip)
+					if err != nil {
+						t.Fatalf("step %d: Check: %v", i, err)
+					}
+					if got != s.want {
+						t.Errorf("step %d: Check = %+v, want %+v", i, got, s.want)
+					}
+				default:
+					t.Fatalf("step %d: unknown op %q", i, s.op)
+				}
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	g := NewGuard(NewMemoryStore(), testConfig)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 4 * time.Second},
+		{50, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := g.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLockedAndPrune(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	cfg := testConfig
+	cfg.LockoutDuration = 2 * cfg.Window
+	store := NewMemoryStore()
+	g := NewGuard(store, cfg)
+	g.now = func() time.Time { return now }
+
+	for i := 0; i < cfg.MaxAccountFailures; i++ {
+		if _, err := g.Failure(alice, ip1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := g.Failure(bob, ip2); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := g.Locked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Key != AccountKey(alice) {
+		t.Fatalf("Locked = %+v, want only %s", recs, AccountKey(alice))
+	}
+
+	// The window has passed but alice is still locked
+	now = now.Add(cfg.Window)
+	if err := g.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.records) != 1 {
+		t.Errorf("after the window, %d records kept, want 1", len(store.records))
+	}
+
+	now = now.Add(cfg.LockoutDuration - cfg.Window)
+	if err := g.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.records) != 0 {
+		t.Errorf("after the lock, %d records kept, want 0", len(store.records))
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+	}
+	for _, tt := range tests {
+		if got := (Decision{RetryAfter: tt.d}).RetryAfterSeconds(); got != tt.want {
+			t.Errorf("RetryAfterSeconds(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
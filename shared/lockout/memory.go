@@ -0,0 +1,83 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps counters in process memory. Counters are lost on restart
+// and not shared between instances, so it suits development and single
+// instance deployments.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Get(key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[key], nil
+}
+
+func (s *MemoryStore) Fail(key string, now time.Time, window time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[key]
+	if !ok || now.Sub(rec.WindowStart) >= window {
+		rec = Record{Key: key, WindowStart: now, LockedUntil: rec.LockedUntil}
+	}
+	rec.Failures++
+	rec.LastFailureAt = now
+	s.records[key] = rec
+	return rec, nil
+}
+
+func (s *MemoryStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := s.records[key]
+	rec.Key = key
+	rec.LockedUntil = &until
+	s.records[key] = rec
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryStore) Locked(now time.Time) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var locked []Record
+	for _, rec := range s.records {
+		if rec.LockedUntil != nil && now.Before(*rec.LockedUntil) {
+			locked = append(locked, rec)
+		}
+	}
+	return locked, nil
+}
+
+func (s *MemoryStore) Prune(now time.Time, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, rec := range s.records {
+		expired := now.Sub(rec.WindowStart) >= window
+		unlocked := rec.LockedUntil == nil || !now.Before(*rec.LockedUntil)
+		if expired && unlocked {
+			delete(s.records, key)
+		}
+	}
+	return nil
+}
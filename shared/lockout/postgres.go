@@ -0,0 +1,71 @@
+package lockout
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PostgresStore keeps counters in the login_attempts table, so every
+// instance of every login service sees the same counts.
+type PostgresStore struct {
+	db *gorm.DB
+}
+
+// NewPostgresStore creates the login_attempts table if needed.
+func NewPostgresStore(db *gorm.DB) (*PostgresStore, error) {
+	if err := db.AutoMigrate(&Record{}); err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func (s *PostgresStore) Get(key string) (Record, error) {
+	var recs []Record
+	if err := s.db.Where("key = ?", key).Limit(1).Find(&recs).Error; err != nil {
+		return Record{}, err
+	}
+	if len(recs) == 0 {
+		return Record{Key: key}, nil
+	}
+	return recs[0], nil
+}
+
+// failSQL increments in one statement so concurrent failures are never lost.
+const failSQL = `
+INSERT INTO login_attempts (key, failures, window_start, last_failure_at)
+VALUES (@key, 1, @now, @now)
+ON CONFLICT (key) DO UPDATE SET
+	failures = CASE WHEN login_attempts.window_start <= @cutoff THEN 1 ELSE login_attempts.failures + 1 END,
+	window_start = CASE WHEN login_attempts.window_start <= @cutoff THEN @now ELSE login_attempts.window_start END,
+	last_failure_at = @now
+RETURNING key, failures, window_start, last_failure_at, locked_until`
+
+func (s *PostgresStore) Fail(key string, now time.Time, window time.Duration) (Record, error) {
+	var rec Record
+	err := s.db.Raw(failSQL, map[string]interface{}{
+		"key":    key,
+		"now":    now,
+		"cutoff": now.Add(-window),
+	}).Scan(&rec).Error
+	return rec, err
+}
+
+func (s *PostgresStore) Lock(key string, until time.Time) error {
+	return s.db.Model(&Record{}).Where("key = ?", key).Update("locked_until", until).Error
+}
+
+func (s *PostgresStore) Reset(key string) error {
+	return s.db.Where("key = ?", key).Delete(&Record{}).Error
+}
+
+func (s *PostgresStore) Locked(now time.Time) ([]Record, error) {
+	var recs []Record
+	err := s.db.Where("locked_until > ?", now).Order("locked_until desc").Find(&recs).Error
+	return recs, err
+}
+
+func (s *PostgresStore) Prune(now time.Time, window time.Duration) error {
+	return s.db.Where("window_start <= ? AND (locked_until IS NULL OR locked_until <= ?)", now.Add(-window), now).
+		Delete(&Record{}).Error
+}
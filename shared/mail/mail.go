@@ -0,0 +1,136 @@
+// Package mail sends transactional email through a pluggable Sender: SMTP
+// in production, files or the log for local development.
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultFrom   = "Healthcare <no-reply@healthcare.local>"
+	DefaultAppURL = "http://localhost:3000"
+	DefaultDir    = "mail"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Sender delivers a Message.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// NewSenderFromEnv picks a Sender by MAIL_DRIVER: "smtp" (SMTP_HOST,
+// SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD), "file" (writes .eml files to
+// MAIL_DIR) or "log" (the default). MAIL_FROM sets the sender address.
+func NewSenderFromEnv() (Sender, error) {
+	from := getEnv("MAIL_FROM", DefaultFrom)
+
+	switch driver := getEnv("MAIL_DRIVER", "log"); driver {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("mail: SMTP_HOST is required for MAIL_DRIVER=smtp")
+		}
+		return &SMTPSender{
+			Addr:     net.JoinHostPort(host, getEnv("SMTP_PORT", "587")),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "file":
+		return NewFileSender(getEnv("MAIL_DIR", DefaultDir), from)
+	case "log":
+		return &LogSender{From: from}, nil
+	default:
+		return nil, fmt.Errorf("mail: unknown MAIL_DRIVER %q", driver)
+	}
+}
+
+// SMTPSender sends through an SMTP server, upgrading to TLS when the server
+// offers STARTTLS.
+type SMTPSender struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(msg Message) error {
+	var a smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		a = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, a, address(s.From), []string{msg.To}, format(s.From, msg))
+}
+
+// FileSender writes each message as an .eml file, for inspecting mail in
+// local development.
+type FileSender struct {
+	Dir  string
+	From string
+	seq  atomic.Int64
+}
+
+func NewFileSender(dir, from string) (*FileSender, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mail: creating %s: %w", dir, err)
+	}
+	return &FileSender{Dir: dir, From: from}, nil
+}
+
+func (s *FileSender) Send(msg Message) error {
+	name := fmt.Sprintf("%s-%d.eml", time.Now().UTC().Format("20060102T150405.000000000"), s.seq.Add(1))
+	return os.WriteFile(filepath.Join(s.Dir, name), format(s.From, msg), 0o600)
+}
+
+// LogSender prints messages to the standard logger. Links in them are live
+// tokens, so it must not be used in production.
+type LogSender struct {
+	From string
+}
+
+func (s *LogSender) Send(msg Message) error {
+	log.Printf("mail: to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// address strips a display name: "Name <a@b>" becomes "a@b".
+func address(from string) string {
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return from
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,55 @@
+package mail
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AppURL is the frontend base URL that links in emails point to, from
+// APP_URL.
+func AppURL() string {
+	return strings.TrimSuffix(getEnv("APP_URL", DefaultAppURL), "/")
+}
+
+// PasswordReset is the email carrying a password reset link.
+func PasswordReset(to, name, token string, ttl time.Duration) Message {
+	link := AppURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(`Hello %s,
+
+We received a request to reset your password. Open this link to choose a new one:
+
+%s
+
+The link works once and expires in %s. If you did not ask for a reset, you can ignore this email.
+`, greetingName(name), link, ttl),
+	}
+}
+
+// EmailVerification is the email asking a user to confirm their address.
+func EmailVerification(to, name, token string, ttl time.Duration) Message {
+	link := AppURL() + "/verify-email?token=" + url.QueryEscape(token)
+	return Message{
+		To:      to,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(`Hello %s,
+
+Please confirm your email address by opening this link:
+
+%s
+
+The link expires in %s.
+`, greetingName(name), link, ttl),
+	}
+}
+
+func greetingName(name string) string {
+	if name = strings.TrimSpace(name); name == "" {
+		return "there"
+	}
+	return name
+}
@@ -0,0 +1,93 @@
+// Package notify lets services raise notifications through
+// notification-service's internal API.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"healthcare/shared/auth"
+)
+
+const DefaultURL = "http://localhost:8085"
+
+// Priorities understood by notification-service.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Notification mirrors the fields notification-service accepts.
+type Notification struct {
+	UserID   uint   `json:"UserID"`
+	Type     string `json:"Type"`
+	Title    string `json:"Title"`
+	Message  string `json:"Message"`
+	Data     string `json:"Data,omitempty"`
+	Priority string `json:"Priority,omitempty"`
+}
+
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// NewClientFromEnv reads NOTIFICATION_SERVICE_URL and INTERNAL_API_TOKEN.
+func NewClientFromEnv() *Client {
+	baseURL := os.Getenv("NOTIFICATION_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return NewClient(baseURL, auth.InternalToken())
+}
+
+// Send creates a notification.
+func (c *Client) Send(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/internal/notifications/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(auth.InternalTokenHeader, c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("notify: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SendAll sends n to every user in userIDs and returns the first error.
+func (c *Client) SendAll(userIDs []uint, n Notification) error {
+	var firstErr error
+	for _, id := range userIDs {
+		n.UserID = id
+		if err := c.Send(n); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
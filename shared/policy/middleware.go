@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"healthcare/shared/audit"
+	"healthcare/shared/auth"
+)
+
+// SubjectFrom builds the Subject for the authenticated caller. It must run
+// after auth.AuthMiddleware.
+func SubjectFrom(c *gin.Context) Subject {
+	return Subject{UserID: auth.UserID(c), Role: auth.Role(c)}
+}
+
+// Authorize checks access to patientID's data and, when denied, aborts the
+// request with 403 (or 500 if the check itself failed). Handlers call it
+// after loading a row so the check uses the row's real owner. The patient is
+// also recorded for the audit log.
+func (p *Policy) Authorize(c *gin.Context, res Resource, act Action, patientID uint) bool {
+	audit.SetPatient(c, patientID)
+	ok, err := p.CanAccessPatient(SubjectFrom(c), res, act, patientID)
+	return p.finish(c, ok, err)
+}
+
+// AuthorizeDoctor is Authorize for data filed under a doctor.
+func (p *Policy) AuthorizeDoctor(c *gin.Context, res Resource, act Action, doctorID uint) bool {
+	ok, err := p.CanAccessDoctor(SubjectFrom(c), res, act, doctorID)
+	return p.finish(c, ok, err)
+}
+
+// PatientParam guards routes keyed by a patient ID path parameter, such as
+// /patient/:patientId.
+func (p *Policy) PatientParam(res Resource, act Action, param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param(param), 10, 32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+			return
+		}
+		if p.Authorize(c, res, act, uint(id)) {
+			c.Next()
+		}
+	}
+}
+
+// DoctorParam guards routes keyed by a doctor ID path parameter, such as
+// /doctor/:doctorId.
+func (p *Policy) DoctorParam(res Resource, act Action, param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param(param), 10, 32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+			return
+		}
+		if p.AuthorizeDoctor(c, res, act, uint(id)) {
+			c.Next()
+		}
+	}
+}
+
+func (p *Policy) finish(c *gin.Context, ok bool, err error) bool {
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+		return false
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+// Package policy decides who may read or change a patient's data. It
+// combines role-based rules (admins and billing staff get fixed scopes) with
+// relationship-based rules (doctors see only patients they have an
+// appointment or a medical record with).
+package policy
+
+import (
+	"gorm.io/gorm"
+
+	"healthcare/shared/auth"
+)
+
+// Resource names a category of patient data.
+type Resource string
+
+const (
+	ResourceAppointments  Resource = "appointments"
+	ResourceRecords       Resource = "records"
+	ResourceBills         Resource = "bills"
+	ResourceNotifications Resource = "notifications"
+)
+
+type Action string
+
+const (
+	ActionRead  Action = "read"
+	ActionWrite Action = "write"
+)
+
+type scopes map[Resource][]Action
+
+var (
+	readWrite = []Action{ActionRead, ActionWrite}
+	readOnly  = []Action{ActionRead}
+)
+
+// ownerScopes is what every user may do with their own data.
+var ownerScopes = scopes{
+	ResourceAppointments:  readWrite,
+	ResourceRecords:       readOnly,
+	ResourceBills:         readOnly,
+	ResourceNotifications: readWrite,
+}
+
+// staffScopes is what staff roles may do for any patient.
+var staffScopes = map[string]scopes{
+	auth.RoleAdmin: {
+		ResourceAppointments:  readWrite,
+		ResourceBills:         readWrite,
+		ResourceNotifications: readWrite,
+	},
+	auth.RoleBilling: {
+		ResourceAppointments: readOnly,
+		ResourceBills:        readWrite,
+	},
+}
+
+// doctorScopes is what a doctor may do for patients they have a
+// relationship with, and with data filed under their own doctor ID.
+var doctorScopes = scopes{
+	ResourceAppointments: readWrite,
+	ResourceRecords:      readWrite,
+	ResourceBills:        readOnly,
+}
+
+// doctorPatientScopes limits doctorScopes for patient-keyed lookups: a
+// doctor never sees a patient's bills.
+var doctorPatientScopes = scopes{
+	ResourceAppointments: readWrite,
+	ResourceRecords:      readWrite,
+}
+
+func (s scopes) allows(res Resource, act Action) bool {
+	for _, a := range s[res] {
+		if a == act {
+			return true
+		}
+	}
+	return false
+}
+
+// Subject is the authenticated caller.
+type Subject struct {
+	UserID uint
+	Role   string
+}
+
+// Policy evaluates access rules. All services share one database, so the
+// relationship checks read the appointments, medical_records and doctors
+// tables directly.
+type Policy struct {
+	db *gorm.DB
+}
+
+func New(db *gorm.DB) *Policy {
+	return &Policy{db: db}
+}
+
+// CanAccessPatient reports whether s may perform act on res belonging to
+// patientID.
+func (p *Policy) CanAccessPatient(s Subject, res Resource, act Action, patientID uint) (bool, error) {
+	if s.UserID == 0 {
+		return false, nil
+	}
+	if s.UserID == patientID && ownerScopes.allows(res, act) {
+		return true, nil
+	}
+	if staffScopes[s.Role].allows(res, act) {
+		return true, nil
+	}
+	if s.Role != auth.RoleDoctor || !doctorPatientScopes.allows(res, act) {
+		return false, nil
+	}
+
+	doctorID, err := p.DoctorIDFor(s.UserID)
+	if err != nil || doctorID == 0 {
+		return false, err
+	}
+	return p.HasRelationship(doctorID, patientID)
+}
+
+// PatientScope limits a query to rows s may perform act on, where column
+// holds the patient ID: every row for staff, their own rows, and for a
+// doctor the rows of patients they have a relationship with. It applies the
+// same rules as CanAccessPatient, for listings that cannot check row by row.
+func (p *Policy) PatientScope(s Subject, res Resource, act Action, column string) (func(*gorm.DB) *gorm.DB, error) {
+	if staffScopes[s.Role].allows(res, act) {
+		return func(db *gorm.DB) *gorm.DB { return db }, nil
+	}
+	own := s.UserID != 0 && ownerScopes.allows(res, act)
+	var doctorID uint
+	if s.UserID != 0 && s.Role == auth.RoleDoctor && doctorPatientScopes.allows(res, act) {
+		var err error
+		if doctorID, err = p.DoctorIDFor(s.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(db *gorm.DB) *gorm.DB {
+		switch {
+		case doctorID != 0 && own:
+			return db.Where(column+" = ? OR "+column+" IN (?) OR "+column+" IN (?)", s.UserID, p.patientsOf("appointments", doctorID), p.patientsOf("medical_records", doctorID))
+		case doctorID != 0:
+			return db.Where(column+" IN (?) OR "+column+" IN (?)", p.patientsOf("appointments", doctorID), p.patientsOf("medical_records", doctorID))
+		case own:
+			return db.Where(column+" = ?", s.UserID)
+		default:
+			return db.Where("1 = 0")
+		}
+	}, nil
+}
+
+// patientsOf selects the patients doctorID has rows with in table.
+func (p *Policy) patientsOf(table string, doctorID uint) *gorm.DB {
+	return p.related(table).Select("patient_id").Where("doctor_id = ?", doctorID)
+}
+
+// related selects the rows of table that make a relationship. Cancelled
+// and rescheduled appointments do not: anyone can book a slot with any
+// doctor and cancel it again.
+func (p *Policy) related(table string) *gorm.DB {
+	q := p.db.Table(table).Where("deleted_at IS NULL")
+	if table == "appointments" {
+		q = q.Where("status NOT IN ?", []string{"cancelled", "rescheduled"})
+	}
+	return q
+}
+
+// CanAccessDoctor reports whether s may perform act on res filed under
+// doctorID, e.g. a doctor's own schedule.
+func (p *Policy) CanAccessDoctor(s Subject, res Resource, act Action, doctorID uint) (bool, error) {
+	if s.UserID == 0 {
+		return false, nil
+	}
+	if staffScopes[s.Role].allows(res, act) {
+		return true, nil
+	}
+	if s.Role != auth.RoleDoctor || !doctorScopes.allows(res, act) {
+		return false, nil
+	}
+
+	own, err := p.DoctorIDFor(s.UserID)
+	if err != nil {
+		return false, err
+	}
+	return own != 0 && own == doctorID, nil
+}
+
+// DoctorIDFor returns the doctor profile ID of userID, or 0 if the user has
+// no doctor profile. Profiles from before user_id was unique may repeat a
+// user; the oldest counts.
+func (p *Policy) DoctorIDFor(userID uint) (uint, error) {
+	var ids []uint
+	err := p.db.Table("doctors").
+		Where("user_id = ? AND deleted_at IS NULL", userID).
+		Order("id").
+		Limit(1).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// HasRelationship reports whether doctorID has a live appointment or a
+// medical record with patientID.
+func (p *Policy) HasRelationship(doctorID, patientID uint) (bool, error) {
+	for _, table := range []string{"appointments", "medical_records"} {
+		var count int64
+		err := p.related(table).
+			Where("doctor_id = ? AND patient_id = ?", doctorID, patientID).
+			Limit(1).
+			Count(&count).Error
+		if err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
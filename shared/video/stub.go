@@ -0,0 +1,93 @@
+package video
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const stubAudience = "video-stub"
+
+var ErrRoomClosed = errors.New("video: room is closed")
+
+// StubProvider stands in for a video backend. Room URLs point at BaseURL
+// and join tokens are HS256 JWTs that Verify checks, so the web client can
+// be developed without a real backend.
+type StubProvider struct {
+	BaseURL string
+	secret  []byte
+
+	mu     sync.Mutex
+	closed map[string]bool
+}
+
+func NewStubProvider(baseURL string, secret []byte) *StubProvider {
+	return &StubProvider{BaseURL: strings.TrimSuffix(baseURL, "/"), secret: secret, closed: map[string]bool{}}
+}
+
+type stubClaims struct {
+	Room string `json:"room"`
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+func (p *StubProvider) Name() string { return "stub" }
+
+func (p *StubProvider) CreateRoom(roomID string) (string, error) {
+	log.Printf("video: stub room %s opened", roomID)
+	return p.BaseURL + "/" + roomID, nil
+}
+
+func (p *StubProvider) JoinToken(g Grant) (string, error) {
+	claims := stubClaims{
+		Room: g.RoomID,
+		Role: g.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   g.Identity,
+			Audience:  jwt.ClaimStrings{stubAudience},
+			NotBefore: jwt.NewNumericDate(g.NotBefore),
+			ExpiresAt: jwt.NewNumericDate(g.Expires),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(p.secret)
+}
+
+func (p *StubProvider) CloseRoom(roomID string) error {
+	p.mu.Lock()
+	p.closed[roomID] = true
+	p.mu.Unlock()
+	log.Printf("video: stub room %s closed", roomID)
+	return nil
+}
+
+// Verify checks a join token the way a backend would on connect, and
+// returns what it grants.
+func (p *StubProvider) Verify(token string) (*Grant, error) {
+	var claims stubClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return p.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(stubAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	closed := p.closed[claims.Room]
+	p.mu.Unlock()
+	if closed {
+		return nil, ErrRoomClosed
+	}
+	return &Grant{
+		RoomID:    claims.Room,
+		Identity:  claims.Subject,
+		Role:      claims.Role,
+		NotBefore: claims.NotBefore.Time,
+		Expires:   claims.ExpiresAt.Time,
+	}, nil
+}
@@ -0,0 +1,70 @@
+// Package video creates rooms and join tokens on a video backend through a
+// pluggable Provider. The stub provider, for local development, signs its
+// own tokens and serves no media.
+package video
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const DefaultStubURL = "http://localhost:3000/visit"
+
+// Roles a participant joins a room with. The host can admit and remove
+// others and ends the call.
+const (
+	RoleHost        = "host"
+	RoleParticipant = "participant"
+)
+
+// Grant is what a join token allows: one identity, in one room, with one
+// role, between NotBefore and Expires.
+type Grant struct {
+	RoomID    string
+	Identity  string
+	Role      string
+	NotBefore time.Time
+	Expires   time.Time
+}
+
+// Provider is a video backend.
+type Provider interface {
+	// Name identifies the provider in stored sessions.
+	Name() string
+	// CreateRoom opens a room with the given ID and returns its URL.
+	CreateRoom(roomID string) (url string, err error)
+	// JoinToken signs a token for g.
+	JoinToken(g Grant) (string, error)
+	// CloseRoom ends the call for everyone still in it.
+	CloseRoom(roomID string) error
+}
+
+// NewProviderFromEnv picks a Provider by VIDEO_PROVIDER. Only "stub" (the
+// default) is built in: rooms live under VIDEO_STUB_URL and tokens are
+// signed with VIDEO_STUB_SECRET.
+func NewProviderFromEnv() (Provider, error) {
+	switch provider := getEnv("VIDEO_PROVIDER", "stub"); provider {
+	case "stub":
+		secret := []byte(os.Getenv("VIDEO_STUB_SECRET"))
+		if len(secret) == 0 {
+			log.Println("video: VIDEO_STUB_SECRET not set, join tokens will not survive a restart")
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, err
+			}
+		}
+		return NewStubProvider(getEnv("VIDEO_STUB_URL", DefaultStubURL), secret), nil
+	default:
+		return nil, fmt.Errorf("video: unknown VIDEO_PROVIDER %q", provider)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
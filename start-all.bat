@@ -45,6 +45,11 @@ cd doctor-service
 start cmd /k "go mod download && go run main.go"
 cd ..
 
+REM FHIR Service
+cd fhir-service
+start cmd /k "go mod download && go run main.go"
+cd ..
+
 echo All services started!
 echo Frontend: http://localhost:3000
 echo Auth Service: http://localhost:8081
@@ -54,6 +59,7 @@ echo Medical Record Service: http://localhost:8084
 echo Billing Service: http://localhost:8085
 echo Notification Service: http://localhost:8086
 echo Doctor Service: http://localhost:8087
+echo FHIR Service: http://localhost:8088/fhir
 
 REM Wait for user input before closing
 pause 
\ No newline at end of file
@@ -28,6 +28,7 @@ Start-GoService -ServiceName "medical-record-service" -Port "8084"
 Start-GoService -ServiceName "billing-service" -Port "8085"
 Start-GoService -ServiceName "notification-service" -Port "8086"
 Start-GoService -ServiceName "doctor-service" -Port "8087"
+Start-GoService -ServiceName "fhir-service" -Port "8088"
 
 Write-Host "`nAll services started!" -ForegroundColor Green
 Write-Host "Frontend: http://localhost:3000" -ForegroundColor Cyan
@@ -38,6 +39,7 @@ Write-Host "Medical Record Service: http://localhost:8084" -ForegroundColor Cyan
 Write-Host "Billing Service: http://localhost:8085" -ForegroundColor Cyan
 Write-Host "Notification Service: http://localhost:8086" -ForegroundColor Cyan
 Write-Host "Doctor Service: http://localhost:8087" -ForegroundColor Cyan
+Write-Host "FHIR Service: http://localhost:8088/fhir" -ForegroundColor Cyan
 
 Write-Host "`nPress any key to stop all services..."
 $null = $Host.UI.RawUI.ReadKey("NoEcho,IncludeKeyDown") 
\ No newline at end of file
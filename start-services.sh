@@ -26,6 +26,7 @@ start_service "medical-record-service" 8084
 start_service "billing-service" 8085
 start_service "notification-service" 8086
 start_service "doctor-service" 8087
+start_service "fhir-service" 8088
 
 echo "All services started!"
 echo "Frontend: http://localhost:3000"
@@ -36,6 +37,7 @@ echo "Medical Record Service: http://localhost:8084"
 echo "Billing Service: http://localhost:8085"
 echo "Notification Service: http://localhost:8086"
 echo "Doctor Service: http://localhost:8087"
+echo "FHIR Service: http://localhost:8088/fhir"
 
 # Wait for all background processes
 wait 
\ No newline at end of file
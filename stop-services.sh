@@ -34,6 +34,7 @@ stop_service 8084  # medical-record-service
 stop_service 8085  # billing-service
 stop_service 8086  # notification-service
 stop_service 8087  # doctor-service
+stop_service 8088  # fhir-service
 
 echo "======================"
 echo "All services stopped!" 
\ No newline at end of file
@@ -1,49 +1,32 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
 
-	"user-service/middleware"
+	"healthcare/shared/auth"
+	"healthcare/shared/identity"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
 )
 
-type User struct {
-	gorm.Model
-	Email     string `gorm:"unique;not null"`
-	Password  string `gorm:"not null"`
-	FirstName string
-	LastName  string
-	Role      string `gorm:"default:'patient'"`
-	Phone     string
-	Address   string
-}
-
+// user-service is a profile facade. auth-service owns users, registration,
+// login and passwords; this service reads and updates profiles through
+// auth-service's internal API and keeps no user data of its own.
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found")
 	}
 
-	// Database connection
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		dsn = "host=localhost user=postgres password=postgres dbname=healthcare port=5432 sslmode=disable"
-	}
-
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	users := identity.NewClientFromEnv()
+	verifier, err := auth.NewServiceVerifier(users)
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		log.Fatal("Failed to load auth configuration:", err)
 	}
 
-	// Auto-migrate the schema
-	db.AutoMigrate(&User{})
-
 	// Initialize Gin router
 	r := gin.Default()
 
@@ -59,92 +42,27 @@ func main() {
 		c.Next()
 	})
 
-	// Public routes
-	r.POST("/api/users/register", func(c *gin.Context) {
-		var user User
-		if err := c.ShouldBindJSON(&user); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-
-		// Hash password before saving
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to hash password"})
-			return
-		}
-		user.Password = string(hashedPassword)
-
-		if err := db.Create(&user).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to create user"})
-			return
-		}
-
-		// Generate JWT token
-		token, err := middleware.GenerateToken(user.ID, user.Email, user.Role)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to generate token"})
-			return
-		}
-
-		c.JSON(201, gin.H{
-			"message": "User created successfully",
-			"token":   token,
-		})
-	})
-
-	r.POST("/api/users/login", func(c *gin.Context) {
-		var loginData struct {
-			Email    string `json:"email"`
-			Password string `json:"password"`
-		}
-
-		if err := c.ShouldBindJSON(&loginData); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-
-		var user User
-		if err := db.Where("email = ?", loginData.Email).First(&user).Error; err != nil {
-			c.JSON(401, gin.H{"error": "Invalid credentials"})
-			return
-		}
-
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginData.Password)); err != nil {
-			c.JSON(401, gin.H{"error": "Invalid credentials"})
-			return
-		}
-
-		token, err := middleware.GenerateToken(user.ID, user.Email, user.Role)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to generate token"})
-			return
-		}
-
-		c.JSON(200, gin.H{
-			"message": "Login successful",
-			"token":   token,
-		})
-	})
-
 	// Protected routes
 	authorized := r.Group("/api/users")
-	authorized.Use(middleware.AuthMiddleware())
+	authorized.Use(auth.AuthMiddleware(verifier))
 	{
 		// Get user profile
 		authorized.GET("/profile", func(c *gin.Context) {
-			userID, _ := c.Get("user_id")
-			var user User
-			if err := db.First(&user, userID).Error; err != nil {
+			user, err := users.User(auth.UserID(c))
+			if errors.Is(err, identity.ErrNotFound) {
 				c.JSON(404, gin.H{"error": "User not found"})
 				return
 			}
+			if err != nil {
+				log.Printf("Failed to fetch profile: %v", err)
+				c.JSON(502, gin.H{"error": "Failed to fetch profile"})
+				return
+			}
 			c.JSON(200, user)
 		})
 
-		// Update user profile
+		// Update user profile. Empty fields are left unchanged.
 		authorized.PUT("/profile", func(c *gin.Context) {
-			userID, _ := c.Get("user_id")
 			var updateData struct {
 				FirstName string `json:"first_name"`
 				LastName  string `json:"last_name"`
@@ -157,85 +75,34 @@ func main() {
 				return
 			}
 
-			if err := db.Model(&User{}).Where("id = ?", userID).Updates(updateData).Error; err != nil {
-				c.JSON(500, gin.H{"error": "Failed to update profile"})
-				return
-			}
-
-			c.JSON(200, gin.H{"message": "Profile updated successfully"})
-		})
-
-		// Change password
-		authorized.PUT("/change-password", func(c *gin.Context) {
-			userID, _ := c.Get("user_id")
-			var passwordData struct {
-				CurrentPassword string `json:"current_password"`
-				NewPassword     string `json:"new_password"`
-			}
-
-			if err := c.ShouldBindJSON(&passwordData); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
-				return
+			var update identity.ProfileUpdate
+			for _, f := range []struct {
+				value string
+				dst   **string
+			}{
+				{updateData.FirstName, &update.FirstName},
+				{updateData.LastName, &update.LastName},
+				{updateData.Phone, &update.Phone},
+				{updateData.Address, &update.Address},
+			} {
+				if f.value != "" {
+					value := f.value
+					*f.dst = &value
+				}
 			}
 
-			var user User
-			if err := db.First(&user, userID).Error; err != nil {
+			user, err := users.UpdateProfile(auth.UserID(c), update)
+			if errors.Is(err, identity.ErrNotFound) {
 				c.JSON(404, gin.H{"error": "User not found"})
 				return
 			}
-
-			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(passwordData.CurrentPassword)); err != nil {
-				c.JSON(401, gin.H{"error": "Current password is incorrect"})
-				return
-			}
-
-			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(passwordData.NewPassword), bcrypt.DefaultCost)
 			if err != nil {
-				c.JSON(500, gin.H{"error": "Failed to hash password"})
-				return
-			}
-
-			if err := db.Model(&user).Update("password", string(hashedPassword)).Error; err != nil {
-				c.JSON(500, gin.H{"error": "Failed to update password"})
-				return
-			}
-
-			c.JSON(200, gin.H{"message": "Password changed successfully"})
-		})
-	}
-
-	// Admin routes
-	admin := r.Group("/api/admin")
-	admin.Use(middleware.AuthMiddleware(), middleware.RoleMiddleware("admin"))
-	{
-		// Get all users
-		admin.GET("/users", func(c *gin.Context) {
-			var users []User
-			if err := db.Find(&users).Error; err != nil {
-				c.JSON(500, gin.H{"error": "Failed to fetch users"})
-				return
-			}
-			c.JSON(200, users)
-		})
-
-		// Update user role
-		admin.PUT("/users/:id/role", func(c *gin.Context) {
-			userID := c.Param("id")
-			var roleData struct {
-				Role string `json:"role"`
-			}
-
-			if err := c.ShouldBindJSON(&roleData); err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
-				return
-			}
-
-			if err := db.Model(&User{}).Where("id = ?", userID).Update("role", roleData.Role).Error; err != nil {
-				c.JSON(500, gin.H{"error": "Failed to update role"})
+				log.Printf("Failed to update profile: %v", err)
+				c.JSON(502, gin.H{"error": "Failed to update profile"})
 				return
 			}
 
-			c.JSON(200, gin.H{"message": "Role updated successfully"})
+			c.JSON(200, gin.H{"message": "Profile updated successfully", "user": user})
 		})
 	}
 